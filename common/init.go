@@ -99,6 +99,9 @@ func InitEnv() {
 	GlobalWebRateLimitNum = GetEnvOrDefault("GLOBAL_WEB_RATE_LIMIT", 60)
 	GlobalWebRateLimitDuration = int64(GetEnvOrDefault("GLOBAL_WEB_RATE_LIMIT_DURATION", 180))
 
+	CountTokensRateLimitNum = GetEnvOrDefault("COUNT_TOKENS_RATE_LIMIT", 60)
+	CountTokensRateLimitDuration = int64(GetEnvOrDefault("COUNT_TOKENS_RATE_LIMIT_DURATION", 60))
+
 	initConstantEnv()
 }
 
@@ -5,6 +5,7 @@ import (
 	_ "embed"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/QuantumNous/new-api/common"
 	"github.com/go-redis/redis/v8"
@@ -13,9 +14,13 @@ import (
 //go:embed lua/rate_limit.lua
 var rateLimitScript string
 
+//go:embed lua/counter_limit.lua
+var counterLimitScript string
+
 type RedisLimiter struct {
-	client         *redis.Client
-	limitScriptSHA string
+	client           *redis.Client
+	limitScriptSHA   string
+	counterScriptSHA string
 }
 
 var (
@@ -30,9 +35,14 @@ func New(ctx context.Context, r *redis.Client) *RedisLimiter {
 		if err != nil {
 			common.SysLog(fmt.Sprintf("Failed to load rate limit script: %v", err))
 		}
+		counterSHA, err := r.ScriptLoad(ctx, counterLimitScript).Result()
+		if err != nil {
+			common.SysLog(fmt.Sprintf("Failed to load counter limit script: %v", err))
+		}
 		instance = &RedisLimiter{
-			client:         r,
-			limitScriptSHA: limitSHA,
+			client:           r,
+			limitScriptSHA:   limitSHA,
+			counterScriptSHA: counterSHA,
 		}
 	})
 
@@ -68,6 +78,24 @@ func (rl *RedisLimiter) Allow(ctx context.Context, key string, opts ...Option) (
 	return result == 1, nil
 }
 
+// Reserve adds amount to the counter at key when the result stays within limit and reports
+// whether it did. A limit of 0 adds unconditionally, an amount of 0 only checks the counter.
+func (rl *RedisLimiter) Reserve(ctx context.Context, key string, amount int64, limit int64, expiration time.Duration) (bool, error) {
+	result, err := rl.client.EvalSha(
+		ctx,
+		rl.counterScriptSHA,
+		[]string{key},
+		amount,
+		limit,
+		int64(expiration.Seconds()),
+	).Int()
+
+	if err != nil {
+		return false, fmt.Errorf("counter limit failed: %w", err)
+	}
+	return result == 1, nil
+}
+
 
 type Config struct {
 	Capacity  int64
@@ -0,0 +1,27 @@
+-- Counter limiter for fixed windows and in-flight counts
+-- KEYS[1]: counter key
+-- ARGV[1]: amount to add, may be negative to release
+-- ARGV[2]: limit, 0 adds unconditionally
+-- ARGV[3]: expiration in seconds, refreshed on every change
+
+local key = KEYS[1]
+local amount = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local expiration = tonumber(ARGV[3])
+
+local current = tonumber(redis.call('GET', key) or '0')
+
+-- an amount of 0 only checks that the counter is below the limit
+if limit > 0 and current + math.max(amount, 1) > limit then
+    return 0
+end
+
+if amount ~= 0 then
+    current = redis.call('INCRBY', key, amount)
+    if current < 0 then
+        redis.call('SET', key, 0)
+    end
+    redis.call('EXPIRE', key, expiration)
+end
+
+return 1
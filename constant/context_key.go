@@ -17,6 +17,9 @@ const (
 	ContextKeyTokenSpecificChannelId ContextKey = "specific_channel_id"
 	ContextKeyTokenModelLimitEnabled ContextKey = "token_model_limit_enabled"
 	ContextKeyTokenModelLimit        ContextKey = "token_model_limit"
+	ContextKeyTokenHedgeEnabled      ContextKey = "token_hedge_enabled"
+	ContextKeyTokenMcpServers        ContextKey = "token_mcp_servers"
+	ContextKeyBatchId                ContextKey = "batch_id"
 
 	
 	ContextKeyChannelId                ContextKey = "channel_id"
@@ -35,6 +38,10 @@ const (
 	ContextKeyChannelIsMultiKey        ContextKey = "channel_is_multi_key"
 	ContextKeyChannelMultiKeyIndex     ContextKey = "channel_multi_key_index"
 	ContextKeyChannelKey               ContextKey = "channel_key"
+	ContextKeyChannelAffinityKey       ContextKey = "channel_affinity_key"
+	ContextKeyChannelAffinityTarget    ContextKey = "channel_affinity_target"
+	ContextKeyChannelCapacityLease     ContextKey = "channel_capacity_lease"
+	ContextKeyChannelNoReservation     ContextKey = "channel_no_reservation"
 
 	
 	ContextKeyUserId      ContextKey = "id"
@@ -0,0 +1,208 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/model"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const batchCompletionWindow = "24h"
+
+const maxBatchListLimit = 100
+
+func toOpenAIBatch(batch *model.Batch) dto.OpenAIBatch {
+	openAIBatch := dto.OpenAIBatch{
+		ID:               batch.Id,
+		Object:           "batch",
+		Endpoint:         batch.Endpoint,
+		InputFileID:      batch.InputFileId,
+		CompletionWindow: batch.CompletionWindow,
+		Status:           batch.Status,
+		OutputFileID:     batch.OutputFileId,
+		ErrorFileID:      batch.ErrorFileId,
+		CreatedAt:        batch.CreatedAt,
+		InProgressAt:     batch.InProgressAt,
+		ExpiresAt:        batch.ExpiresAt,
+		FinalizingAt:     batch.FinalizingAt,
+		CompletedAt:      batch.CompletedAt,
+		FailedAt:         batch.FailedAt,
+		ExpiredAt:        batch.ExpiredAt,
+		CancellingAt:     batch.CancellingAt,
+		CancelledAt:      batch.CancelledAt,
+		RequestCounts: dto.OpenAIBatchRequestCounts{
+			Total:     batch.TotalCount,
+			Completed: batch.CompletedCount,
+			Failed:    batch.FailedCount,
+		},
+	}
+	if batch.Errors != "" {
+		var batchErrors []dto.OpenAIBatchError
+		if err := common.UnmarshalJsonStr(batch.Errors, &batchErrors); err == nil {
+			openAIBatch.Errors = &dto.OpenAIBatchErrors{Object: "list", Data: batchErrors}
+		}
+	}
+	if batch.Metadata != "" {
+		_ = common.UnmarshalJsonStr(batch.Metadata, &openAIBatch.Metadata)
+	}
+	return openAIBatch
+}
+
+// getUserBatch loads the batch named in the path and writes the error response when the user cannot access it.
+func getUserBatch(c *gin.Context) (*model.Batch, bool) {
+	batchId := c.Param("id")
+	batch, err := model.GetUserBatchById(batchId, c.GetInt("id"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			openAiErrorMessage(c, http.StatusNotFound, fmt.Sprintf("No such Batch object: %s", batchId), "id", "batch_not_found")
+		} else {
+			openAiServerError(c, err)
+		}
+		return nil, false
+	}
+	return batch, true
+}
+
+func CreateBatch(c *gin.Context) {
+	var request dto.OpenAIBatchRequest
+	if err := common.UnmarshalBodyReusable(c, &request); err != nil {
+		openAiErrorMessage(c, http.StatusBadRequest, "invalid request body: "+err.Error(), "", "invalid_request")
+		return
+	}
+	if _, ok := batchEndpoints[request.Endpoint]; !ok {
+		openAiErrorMessage(c, http.StatusBadRequest, fmt.Sprintf("Unsupported endpoint: %s", request.Endpoint), "endpoint", "invalid_value")
+		return
+	}
+	if request.CompletionWindow != batchCompletionWindow {
+		openAiErrorMessage(c, http.StatusBadRequest, "completion_window must be 24h", "completion_window", "invalid_value")
+		return
+	}
+	userId := c.GetInt("id")
+	inputFile, err := model.GetUserFileById(request.InputFileId, userId)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			fileNotFound(c, request.InputFileId)
+		} else {
+			openAiServerError(c, err)
+		}
+		return
+	}
+	if inputFile.Purpose != "batch" {
+		openAiErrorMessage(c, http.StatusBadRequest, fmt.Sprintf("File %s was not uploaded with purpose batch", inputFile.Id), "input_file_id", "invalid_value")
+		return
+	}
+	var metadata string
+	if len(request.Metadata) > 0 {
+		metadataBytes, err := common.Marshal(request.Metadata)
+		if err != nil {
+			openAiErrorMessage(c, http.StatusBadRequest, "invalid metadata: "+err.Error(), "metadata", "invalid_value")
+			return
+		}
+		metadata = string(metadataBytes)
+	}
+	now := time.Now()
+	batch := &model.Batch{
+		Id:               model.NewBatchId(),
+		UserId:           userId,
+		TokenId:          c.GetInt("token_id"),
+		ClientIp:         c.ClientIP(),
+		Endpoint:         request.Endpoint,
+		InputFileId:      inputFile.Id,
+		CompletionWindow: request.CompletionWindow,
+		Status:           model.BatchStatusValidating,
+		Metadata:         metadata,
+		CreatedAt:        now.Unix(),
+		ExpiresAt:        now.Add(24 * time.Hour).Unix(),
+	}
+	if err = batch.Insert(); err != nil {
+		openAiServerError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, toOpenAIBatch(batch))
+}
+
+func RetrieveBatch(c *gin.Context) {
+	batch, ok := getUserBatch(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, toOpenAIBatch(batch))
+}
+
+func ListBatches(c *gin.Context) {
+	limit := 20
+	if limitStr := c.Query("limit"); limitStr != "" {
+		parsed, err := strconv.Atoi(limitStr)
+		if err != nil || parsed <= 0 {
+			openAiErrorMessage(c, http.StatusBadRequest, "limit must be a positive integer", "limit", "invalid_value")
+			return
+		}
+		limit = min(parsed, maxBatchListLimit)
+	}
+	batches, err := model.GetUserBatches(c.GetInt("id"), c.Query("after"), limit+1)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			openAiErrorMessage(c, http.StatusNotFound, fmt.Sprintf("No such Batch object: %s", c.Query("after")), "after", "batch_not_found")
+			return
+		}
+		openAiServerError(c, err)
+		return
+	}
+	list := dto.OpenAIBatchList{
+		Object:  "list",
+		Data:    make([]dto.OpenAIBatch, 0, len(batches)),
+		HasMore: len(batches) > limit,
+	}
+	if list.HasMore {
+		batches = batches[:limit]
+	}
+	for _, batch := range batches {
+		list.Data = append(list.Data, toOpenAIBatch(batch))
+	}
+	if len(list.Data) > 0 {
+		list.FirstID = list.Data[0].ID
+		list.LastID = list.Data[len(list.Data)-1].ID
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+// CancelBatch cancels a batch that has not started yet right away, a running batch stops sending
+// new requests and is finalized with the results it has so far.
+func CancelBatch(c *gin.Context) {
+	batch, ok := getUserBatch(c)
+	if !ok {
+		return
+	}
+	now := common.GetTimestamp()
+	cancelled, err := model.TransitionBatchStatus(batch.Id, []string{model.BatchStatusValidating}, model.BatchStatusCancelled, map[string]any{
+		"cancelling_at": now,
+		"cancelled_at":  now,
+	})
+	if err == nil && !cancelled {
+		_, err = model.TransitionBatchStatus(batch.Id, []string{model.BatchStatusInProgress}, model.BatchStatusCancelling, map[string]any{
+			"cancelling_at": now,
+		})
+	}
+	if err != nil {
+		openAiServerError(c, err)
+		return
+	}
+	batch, err = model.GetBatchById(batch.Id)
+	if err != nil {
+		openAiServerError(c, err)
+		return
+	}
+	if batch.Status != model.BatchStatusCancelling && batch.Status != model.BatchStatusCancelled {
+		openAiErrorMessage(c, http.StatusConflict, fmt.Sprintf("Cannot cancel a batch with status %s", batch.Status), "", "invalid_state")
+		return
+	}
+	c.JSON(http.StatusOK, toOpenAIBatch(batch))
+}
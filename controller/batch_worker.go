@@ -0,0 +1,442 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/bytedance/gopkg/util/gopool"
+	"github.com/gin-gonic/gin"
+)
+
+// batchEndpoints are the endpoints a batch can target, with the relay format of their requests.
+var batchEndpoints = map[string]types.RelayFormat{
+	"/v1/chat/completions": types.RelayFormatOpenAI,
+	"/v1/completions":      types.RelayFormatOpenAI,
+	"/v1/embeddings":       types.RelayFormatEmbedding,
+	"/v1/responses":        types.RelayFormatOpenAIResponses,
+}
+
+const maxBatchLineSize = 32 << 20
+
+const batchProgressInterval = 2 * time.Second
+
+type batchIdContextKey struct{}
+
+var (
+	batchEngine     *gin.Engine
+	batchEngineOnce sync.Once
+)
+
+// getBatchEngine returns the router batch requests are sent through.
+func getBatchEngine() *gin.Engine {
+	batchEngineOnce.Do(func() {
+		batchEngine = newInternalRelayEngine(batchEndpoints, func(c *gin.Context) {
+			if batchId, ok := c.Request.Context().Value(batchIdContextKey{}).(string); ok {
+				common.SetContextKey(c, constant.ContextKeyBatchId, batchId)
+			}
+			c.Next()
+		})
+	})
+	return batchEngine
+}
+
+// RunBatchWorker picks up new batches and runs them, it only runs on the master node.
+func RunBatchWorker() {
+	failInterruptedBatches()
+	for {
+		interval := operation_setting.GetBatchSetting().PollIntervalSeconds
+		if interval <= 0 {
+			interval = 5
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+		batches, err := model.GetBatchesByStatus([]string{model.BatchStatusValidating}, 10)
+		if err != nil {
+			common.SysError("failed to load batches: " + err.Error())
+			continue
+		}
+		for _, batch := range batches {
+			claimed, err := model.TransitionBatchStatus(batch.Id, []string{model.BatchStatusValidating}, model.BatchStatusInProgress, map[string]any{
+				"in_progress_at": common.GetTimestamp(),
+			})
+			if err != nil || !claimed {
+				continue
+			}
+			batch := batch
+			gopool.Go(func() {
+				runBatch(batch)
+			})
+		}
+	}
+}
+
+// failInterruptedBatches closes batches that were running when the server stopped. Their requests are not
+// replayed, the ones that already ran were billed.
+func failInterruptedBatches() {
+	batches, err := model.GetBatchesByStatus([]string{model.BatchStatusInProgress, model.BatchStatusFinalizing, model.BatchStatusCancelling}, 1000)
+	if err != nil {
+		common.SysError("failed to load interrupted batches: " + err.Error())
+		return
+	}
+	now := common.GetTimestamp()
+	for _, batch := range batches {
+		if batch.Status == model.BatchStatusCancelling {
+			_, _ = model.TransitionBatchStatus(batch.Id, []string{model.BatchStatusCancelling}, model.BatchStatusCancelled, map[string]any{"cancelled_at": now})
+			continue
+		}
+		failBatch(batch, []dto.OpenAIBatchError{{Code: "batch_interrupted", Message: "the batch was interrupted by a server restart"}})
+	}
+}
+
+func failBatch(batch *model.Batch, batchErrors []dto.OpenAIBatchError) {
+	errorsJson, _ := common.Marshal(batchErrors)
+	_, err := model.TransitionBatchStatus(batch.Id, []string{model.BatchStatusValidating, model.BatchStatusInProgress, model.BatchStatusFinalizing}, model.BatchStatusFailed, map[string]any{
+		"errors":    string(errorsJson),
+		"failed_at": common.GetTimestamp(),
+	})
+	if err != nil {
+		common.SysError(fmt.Sprintf("failed to fail batch %s: %s", batch.Id, err.Error()))
+	}
+}
+
+func openBatchInput(batch *model.Batch) (io.ReadCloser, error) {
+	inputFile, err := model.GetUserFileById(batch.InputFileId, batch.UserId)
+	if err != nil {
+		return nil, err
+	}
+	storage, err := service.GetFileStorage()
+	if err != nil {
+		return nil, err
+	}
+	return storage.Get(context.Background(), inputFile.StorageKey)
+}
+
+// readBatchLines calls fn with every non-empty line of the input file and its 1-based line number.
+func readBatchLines(batch *model.Batch, fn func(lineNumber int, line []byte) bool) error {
+	input, err := openBatchInput(batch)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), maxBatchLineSize)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if !fn(lineNumber, line) {
+			break
+		}
+	}
+	return scanner.Err()
+}
+
+// validateBatchInput checks every line of the input file before any request is sent and returns the number of requests.
+func validateBatchInput(batch *model.Batch) (int, []dto.OpenAIBatchError) {
+	var batchErrors []dto.OpenAIBatchError
+	maxRequests := operation_setting.GetBatchSetting().MaxRequests
+	customIds := make(map[string]struct{})
+	total := 0
+	err := readBatchLines(batch, func(lineNumber int, line []byte) bool {
+		total++
+		var input dto.OpenAIBatchInputLine
+		if err := common.Unmarshal(line, &input); err != nil {
+			batchErrors = append(batchErrors, dto.OpenAIBatchError{Code: "invalid_json_line", Message: "line is not valid JSON: " + err.Error(), Line: lineNumber})
+		} else if input.CustomId == "" {
+			batchErrors = append(batchErrors, dto.OpenAIBatchError{Code: "missing_required_parameter", Message: "custom_id is required", Param: "custom_id", Line: lineNumber})
+		} else if _, ok := customIds[input.CustomId]; ok {
+			batchErrors = append(batchErrors, dto.OpenAIBatchError{Code: "duplicate_custom_id", Message: fmt.Sprintf("custom_id %s is used more than once", input.CustomId), Param: "custom_id", Line: lineNumber})
+		} else if input.Method != http.MethodPost {
+			batchErrors = append(batchErrors, dto.OpenAIBatchError{Code: "invalid_method", Message: "method must be POST", Param: "method", Line: lineNumber})
+		} else if input.Url != batch.Endpoint {
+			batchErrors = append(batchErrors, dto.OpenAIBatchError{Code: "mismatched_endpoint", Message: fmt.Sprintf("url must be %s, the endpoint of the batch", batch.Endpoint), Param: "url", Line: lineNumber})
+		} else {
+			customIds[input.CustomId] = struct{}{}
+		}
+		if maxRequests > 0 && total > maxRequests {
+			batchErrors = append(batchErrors, dto.OpenAIBatchError{Code: "too_many_requests", Message: fmt.Sprintf("a batch can contain at most %d requests", maxRequests), Line: lineNumber})
+			return false
+		}
+		// the list is only there to explain the failure, a sample is enough
+		return len(batchErrors) < 100
+	})
+	if err != nil {
+		batchErrors = append(batchErrors, dto.OpenAIBatchError{Code: "invalid_input_file", Message: err.Error()})
+	}
+	if total == 0 && len(batchErrors) == 0 {
+		batchErrors = append(batchErrors, dto.OpenAIBatchError{Code: "empty_file", Message: "the input file contains no requests"})
+	}
+	return total, batchErrors
+}
+
+// batchResultFile collects the result lines of a batch in a temporary file until they are stored.
+type batchResultFile struct {
+	mu    sync.Mutex
+	file  *os.File
+	count int
+}
+
+func newBatchResultFile() (*batchResultFile, error) {
+	file, err := os.CreateTemp("", "batch-*.jsonl")
+	if err != nil {
+		return nil, err
+	}
+	return &batchResultFile{file: file}, nil
+}
+
+func (f *batchResultFile) write(line *dto.OpenAIBatchOutputLine) error {
+	data, err := common.Marshal(line)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.count++
+	_, err = f.file.Write(append(data, '\n'))
+	return err
+}
+
+func (f *batchResultFile) close() {
+	_ = f.file.Close()
+	_ = os.Remove(f.file.Name())
+}
+
+// store saves the results as a file of the batch's owner, it returns an empty id when there are no results.
+func (f *batchResultFile) store(batch *model.Batch, name string) (string, error) {
+	if f.count == 0 {
+		return "", nil
+	}
+	size, err := f.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+	if _, err = f.file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	file := &model.File{
+		UserId:   batch.UserId,
+		TokenId:  batch.TokenId,
+		Filename: fmt.Sprintf("%s_%s.jsonl", batch.Id, name),
+		Purpose:  "batch_output",
+		Bytes:    size,
+		MimeType: "application/jsonl",
+	}
+	if err = service.SaveUserFile(context.Background(), file, f.file); err != nil {
+		return "", err
+	}
+	return file.Id, nil
+}
+
+// runBatch sends every request of the batch through the relay with bounded concurrency
+// and stores the results as the batch's output and error files.
+func runBatch(batch *model.Batch) {
+	total, batchErrors := validateBatchInput(batch)
+	if len(batchErrors) > 0 {
+		failBatch(batch, batchErrors)
+		return
+	}
+	token, err := model.GetTokenById(batch.TokenId)
+	if err != nil {
+		failBatch(batch, []dto.OpenAIBatchError{{Code: "invalid_token", Message: "the token that created the batch no longer exists"}})
+		return
+	}
+	if err = model.DB.Model(&model.Batch{}).Where("id = ?", batch.Id).Update("total_count", total).Error; err != nil {
+		common.SysError(fmt.Sprintf("failed to update batch %s: %s", batch.Id, err.Error()))
+	}
+
+	outputFile, err := newBatchResultFile()
+	if err != nil {
+		failBatch(batch, []dto.OpenAIBatchError{{Code: "server_error", Message: err.Error()}})
+		return
+	}
+	defer outputFile.close()
+	errorFile, err := newBatchResultFile()
+	if err != nil {
+		failBatch(batch, []dto.OpenAIBatchError{{Code: "server_error", Message: err.Error()}})
+		return
+	}
+	defer errorFile.close()
+
+	var completed, failed atomic.Int64
+	var stopped atomic.Value
+	stopped.Store("")
+	done := make(chan struct{})
+	gopool.Go(func() {
+		ticker := time.NewTicker(batchProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				_ = model.UpdateBatchProgress(batch.Id, int(completed.Load()), int(failed.Load()))
+				if status, err := model.GetBatchStatus(batch.Id); err == nil && status == model.BatchStatusCancelling {
+					stopped.Store(model.BatchStatusCancelled)
+				} else if batch.ExpiresAt > 0 && common.GetTimestamp() > batch.ExpiresAt {
+					stopped.Store(model.BatchStatusExpired)
+				}
+			}
+		}
+	})
+
+	concurrency := operation_setting.GetBatchSetting().Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	lines := make(chan []byte)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		gopool.Go(func() {
+			defer wg.Done()
+			for line := range lines {
+				result := runBatchLine(batch, token, line)
+				var writeErr error
+				if result.Error == nil {
+					completed.Add(1)
+					writeErr = outputFile.write(result)
+				} else {
+					failed.Add(1)
+					writeErr = errorFile.write(result)
+				}
+				if writeErr != nil {
+					common.SysError(fmt.Sprintf("failed to write result of batch %s: %s", batch.Id, writeErr.Error()))
+				}
+			}
+		})
+	}
+	err = readBatchLines(batch, func(lineNumber int, line []byte) bool {
+		if stopped.Load().(string) != "" {
+			return false
+		}
+		lines <- bytes.Clone(line)
+		return true
+	})
+	close(lines)
+	wg.Wait()
+	close(done)
+	if err != nil {
+		common.SysError(fmt.Sprintf("failed to read input of batch %s: %s", batch.Id, err.Error()))
+	}
+	finishBatch(batch, stopped.Load().(string), int(completed.Load()), int(failed.Load()), outputFile, errorFile)
+}
+
+func finishBatch(batch *model.Batch, stoppedStatus string, completed int, failed int, outputFile *batchResultFile, errorFile *batchResultFile) {
+	_, _ = model.TransitionBatchStatus(batch.Id, []string{model.BatchStatusInProgress}, model.BatchStatusFinalizing, map[string]any{
+		"finalizing_at": common.GetTimestamp(),
+	})
+	fields := map[string]any{
+		"completed_count": completed,
+		"failed_count":    failed,
+	}
+	outputFileId, err := outputFile.store(batch, "output")
+	if err != nil {
+		failBatch(batch, []dto.OpenAIBatchError{{Code: "server_error", Message: "failed to store the output file: " + err.Error()}})
+		return
+	}
+	errorFileId, err := errorFile.store(batch, "error")
+	if err != nil {
+		failBatch(batch, []dto.OpenAIBatchError{{Code: "server_error", Message: "failed to store the error file: " + err.Error()}})
+		return
+	}
+	fields["output_file_id"] = outputFileId
+	fields["error_file_id"] = errorFileId
+
+	now := common.GetTimestamp()
+	status := model.BatchStatusCompleted
+	switch stoppedStatus {
+	case model.BatchStatusCancelled:
+		status = model.BatchStatusCancelled
+		fields["cancelled_at"] = now
+	case model.BatchStatusExpired:
+		status = model.BatchStatusExpired
+		fields["expired_at"] = now
+	default:
+		fields["completed_at"] = now
+	}
+	// a cancel request can still arrive while the batch is finalizing, the results are kept either way
+	finished, err := model.TransitionBatchStatus(batch.Id, []string{model.BatchStatusFinalizing}, status, fields)
+	if err == nil && !finished {
+		fields["cancelled_at"] = now
+		_, err = model.TransitionBatchStatus(batch.Id, []string{model.BatchStatusCancelling, model.BatchStatusInProgress}, model.BatchStatusCancelled, fields)
+	}
+	if err != nil {
+		common.SysError(fmt.Sprintf("failed to finish batch %s: %s", batch.Id, err.Error()))
+	}
+}
+
+// runBatchLine sends one request of the batch through the relay and returns its result line.
+func runBatchLine(batch *model.Batch, token *model.Token, line []byte) *dto.OpenAIBatchOutputLine {
+	var input dto.OpenAIBatchInputLine
+	_ = common.Unmarshal(line, &input)
+	result := &dto.OpenAIBatchOutputLine{
+		ID:       "batch_req_" + common.GetRandomString(24),
+		CustomId: input.CustomId,
+	}
+	var streamOption struct {
+		Stream bool `json:"stream"`
+	}
+	if err := common.Unmarshal(input.Body, &streamOption); err != nil || streamOption.Stream {
+		result.Error = &dto.OpenAIBatchError{Code: "invalid_request", Message: "body must be a JSON object without stream"}
+		return result
+	}
+
+	ctx := context.WithValue(context.Background(), batchIdContextKey{}, batch.Id)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, input.Url, bytes.NewReader(input.Body))
+	if err != nil {
+		result.Error = &dto.OpenAIBatchError{Code: "invalid_request", Message: err.Error()}
+		return result
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer sk-"+token.Key)
+	if batch.ClientIp != "" {
+		req.RemoteAddr = net.JoinHostPort(batch.ClientIp, "0")
+	}
+	recorder := httptest.NewRecorder()
+	getBatchEngine().ServeHTTP(recorder, req)
+
+	body := recorder.Body.Bytes()
+	if common.GetJsonType(body) != "object" {
+		body, _ = common.Marshal(string(body))
+	}
+	result.Response = &dto.OpenAIBatchLineResponse{
+		StatusCode: recorder.Code,
+		RequestId:  recorder.Header().Get(common.RequestIdKey),
+		Body:       body,
+	}
+	if recorder.Code != http.StatusOK {
+		var errorBody struct {
+			Error dto.OpenAIError `json:"error"`
+		}
+		message := http.StatusText(recorder.Code)
+		if err := common.Unmarshal(body, &errorBody); err == nil && errorBody.Error.Message != "" {
+			message = errorBody.Error.Message
+		}
+		code := fmt.Sprintf("%v", errorBody.Error.Code)
+		if errorBody.Error.Code == nil {
+			code = "request_failed"
+		}
+		result.Error = &dto.OpenAIBatchError{Code: code, Message: message}
+	}
+	return result
+}
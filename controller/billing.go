@@ -8,6 +8,26 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+// getBillingBudget returns the budget the billing endpoints report in place of the lifetime quota, the one with
+// the least quota left when less is left of it than of the lifetime quota.
+func getBillingBudget(c *gin.Context, remainQuota int, unlimited bool) *model.Budget {
+	var budgets []*model.Budget
+	var err error
+	if common.DisplayTokenStatEnabled {
+		budgets, err = model.GetBudgets(c.GetInt("id"), c.GetInt("token_id"))
+	} else {
+		budgets, err = model.GetSubjectBudgets(c.GetInt("id"), 0)
+	}
+	if err != nil {
+		return nil
+	}
+	budget := tightestBudget(budgets)
+	if budget == nil || (!unlimited && budget.Remaining() >= remainQuota) {
+		return nil
+	}
+	return budget
+}
+
 func GetSubscription(c *gin.Context) {
 	var remainQuota int
 	var usedQuota int
@@ -39,6 +59,10 @@ func GetSubscription(c *gin.Context) {
 		return
 	}
 	quota := remainQuota + usedQuota
+	budget := getBillingBudget(c, remainQuota, token != nil && token.UnlimitedQuota)
+	if budget != nil {
+		quota = budget.Quota
+	}
 	amount := float64(quota)
 	
 	
@@ -53,7 +77,7 @@ func GetSubscription(c *gin.Context) {
 	default:
 		amount = amount / common.QuotaPerUnit
 	}
-	if token != nil && token.UnlimitedQuota {
+	if budget == nil && token != nil && token.UnlimitedQuota {
 		amount = 100000000
 	}
 	subscription := OpenAISubscriptionResponse{
@@ -90,6 +114,15 @@ func GetUsage(c *gin.Context) {
 		})
 		return
 	}
+	var budget *model.Budget
+	if token != nil {
+		budget = getBillingBudget(c, token.RemainQuota, token.UnlimitedQuota)
+	} else if remainQuota, err := model.GetUserQuota(c.GetInt("id"), false); err == nil {
+		budget = getBillingBudget(c, remainQuota, false)
+	}
+	if budget != nil {
+		quota = budget.Used
+	}
 	amount := float64(quota)
 	switch operation_setting.GetQuotaDisplayType() {
 	case operation_setting.QuotaDisplayTypeCNY:
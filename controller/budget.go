@@ -0,0 +1,176 @@
+package controller
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BudgetRequest sets the quota of each budget period, 0 removes the budget.
+type BudgetRequest struct {
+	Day   int `json:"day"`
+	Week  int `json:"week"`
+	Month int `json:"month"`
+}
+
+func (req *BudgetRequest) quotas() map[string]int {
+	return map[string]int{
+		model.BudgetPeriodDay:   req.Day,
+		model.BudgetPeriodWeek:  req.Week,
+		model.BudgetPeriodMonth: req.Month,
+	}
+}
+
+type BudgetStatus struct {
+	Subject   string `json:"subject"`
+	Period    string `json:"period"`
+	Quota     int    `json:"quota"`
+	Used      int    `json:"used"`
+	Remaining int    `json:"remaining"`
+	ResetAt   int64  `json:"reset_at"`
+}
+
+func buildBudgetStatuses(budgets []*model.Budget) []BudgetStatus {
+	statuses := make([]BudgetStatus, 0, len(budgets))
+	for _, budget := range budgets {
+		statuses = append(statuses, BudgetStatus{
+			Subject:   budget.Subject(),
+			Period:    budget.Period,
+			Quota:     budget.Quota,
+			Used:      budget.Used,
+			Remaining: budget.Remaining(),
+			ResetAt:   budget.ResetAt(),
+		})
+	}
+	return statuses
+}
+
+// tightestBudget returns the budget with the least quota left, nil without budgets.
+func tightestBudget(budgets []*model.Budget) *model.Budget {
+	var tightest *model.Budget
+	for _, budget := range budgets {
+		if tightest == nil || budget.Remaining() < tightest.Remaining() {
+			tightest = budget
+		}
+	}
+	return tightest
+}
+
+func GetTokenBudgets(c *gin.Context) {
+	userId := c.GetInt("id")
+	tokenId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if _, err = model.GetTokenByIds(tokenId, userId); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	budgets, err := model.GetSubjectBudgets(userId, tokenId)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, buildBudgetStatuses(budgets))
+}
+
+func UpdateTokenBudgets(c *gin.Context) {
+	userId := c.GetInt("id")
+	tokenId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	var req BudgetRequest
+	if err = c.ShouldBindJSON(&req); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if _, err = model.GetTokenByIds(tokenId, userId); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if err = model.SetBudgets(userId, tokenId, req.quotas()); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	budgets, err := model.GetSubjectBudgets(userId, tokenId)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, buildBudgetStatuses(budgets))
+}
+
+// GetSelfBudgets returns the budgets set on all tokens of the user.
+func GetSelfBudgets(c *gin.Context) {
+	budgets, err := model.GetSubjectBudgets(c.GetInt("id"), 0)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, buildBudgetStatuses(budgets))
+}
+
+// getManagedUser loads the user an admin manages the budgets of.
+func getManagedUser(c *gin.Context) (*model.User, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		common.ApiError(c, err)
+		return nil, false
+	}
+	user, err := model.GetUserById(id, false)
+	if err != nil {
+		common.ApiError(c, err)
+		return nil, false
+	}
+	myRole := c.GetInt("role")
+	if myRole <= user.Role && myRole != common.RoleRootUser {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "No permission to access information of users at the same level or higher.",
+		})
+		return nil, false
+	}
+	return user, true
+}
+
+func GetUserBudgets(c *gin.Context) {
+	user, ok := getManagedUser(c)
+	if !ok {
+		return
+	}
+	budgets, err := model.GetSubjectBudgets(user.Id, 0)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, buildBudgetStatuses(budgets))
+}
+
+func UpdateUserBudgets(c *gin.Context) {
+	user, ok := getManagedUser(c)
+	if !ok {
+		return
+	}
+	var req BudgetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if err := model.SetBudgets(user.Id, 0, req.quotas()); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	budgets, err := model.GetSubjectBudgets(user.Id, 0)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, buildBudgetStatuses(budgets))
+}
@@ -987,6 +987,35 @@ func BatchSetChannelTag(c *gin.Context) {
 	return
 }
 
+func GetChannelStats(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    model.GetAllChannelStats(),
+	})
+}
+
+func GetChannelBreakers(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    model.GetChannelBreakers(),
+	})
+}
+
+func ResetChannelBreakers(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	model.ResetChannelBreakers(id)
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+	})
+}
+
 func GetTagModels(c *gin.Context) {
 	tag := c.Query("tag")
 	if tag == "" {
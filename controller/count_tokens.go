@@ -0,0 +1,67 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/relay"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/relay/helper"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CountTokens returns the input tokens of a Claude messages or Responses request without running it.
+// The upstream count API of the selected channel is used when it has one, otherwise the local estimate.
+// Counting is free, no quota is consumed and nothing is logged to the usage log.
+func CountTokens(c *gin.Context, relayFormat types.RelayFormat) {
+	request, err := helper.GetAndValidateRequest(c, relayFormat)
+	if err != nil {
+		countTokensError(c, relayFormat, types.NewError(err, types.ErrorCodeInvalidRequest))
+		return
+	}
+	relayInfo, err := relaycommon.GenRelayInfo(c, relayFormat, request, nil)
+	if err != nil {
+		countTokensError(c, relayFormat, types.NewError(err, types.ErrorCodeGenRelayInfoFailed))
+		return
+	}
+
+	tokens, err := relay.CountTokensHelper(c, relayInfo)
+	if err != nil {
+		if !errors.Is(err, relay.ErrTokenCountNotSupported) {
+			logger.LogWarn(c, "upstream token counting failed, using the local estimate: "+err.Error())
+		}
+		tokens, err = service.CountRequestToken(c, request.GetTokenCountMeta(), relayInfo)
+		if err != nil {
+			countTokensError(c, relayFormat, types.NewError(err, types.ErrorCodeCountTokenFailed))
+			return
+		}
+	}
+
+	if relayFormat == types.RelayFormatClaude {
+		c.JSON(http.StatusOK, gin.H{"input_tokens": tokens})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"object":       "response.input_tokens",
+		"input_tokens": tokens,
+	})
+}
+
+func countTokensError(c *gin.Context, relayFormat types.RelayFormat, newAPIError *types.NewAPIError) {
+	newAPIError.SetMessage(common.MessageWithRequestId(newAPIError.Error(), c.GetString(common.RequestIdKey)))
+	if relayFormat == types.RelayFormatClaude {
+		c.JSON(newAPIError.StatusCode, gin.H{
+			"type":  "error",
+			"error": newAPIError.ToClaudeError(),
+		})
+		return
+	}
+	c.JSON(newAPIError.StatusCode, gin.H{
+		"error": newAPIError.ToOpenAIError(),
+	})
+}
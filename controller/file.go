@@ -0,0 +1,203 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/system_setting"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var filePurposes = []string{"assistants", "batch", "fine-tune", "vision", "user_data", "evals"}
+
+const maxFileListLimit = 10000
+
+func fileNotFound(c *gin.Context, fileId string) {
+	openAiErrorMessage(c, http.StatusNotFound, fmt.Sprintf("No such File object: %s", fileId), "id", "file_not_found")
+}
+
+func toOpenAIFile(file *model.File) dto.OpenAIFile {
+	return dto.OpenAIFile{
+		ID:        file.Id,
+		Object:    "file",
+		Bytes:     file.Bytes,
+		CreatedAt: file.CreatedAt,
+		ExpiresAt: file.ExpiresAt,
+		Filename:  file.Filename,
+		Purpose:   file.Purpose,
+		Status:    file.Status,
+	}
+}
+
+// getUserFile loads the file named in the path and writes the error response when the user cannot access it.
+func getUserFile(c *gin.Context) (*model.File, bool) {
+	fileId := c.Param("id")
+	file, err := model.GetUserFileById(fileId, c.GetInt("id"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			fileNotFound(c, fileId)
+		} else {
+			openAiServerError(c, err)
+		}
+		return nil, false
+	}
+	return file, true
+}
+
+func ListFiles(c *gin.Context) {
+	limit := maxFileListLimit
+	if limitStr := c.Query("limit"); limitStr != "" {
+		parsed, err := strconv.Atoi(limitStr)
+		if err != nil || parsed <= 0 {
+			openAiErrorMessage(c, http.StatusBadRequest, "limit must be a positive integer", "limit", "invalid_value")
+			return
+		}
+		limit = min(parsed, maxFileListLimit)
+	}
+	order := c.DefaultQuery("order", "desc")
+	if order != "asc" && order != "desc" {
+		openAiErrorMessage(c, http.StatusBadRequest, "order must be asc or desc", "order", "invalid_value")
+		return
+	}
+	files, err := model.GetUserFiles(c.GetInt("id"), c.Query("purpose"), c.Query("after"), limit+1, order == "asc")
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			fileNotFound(c, c.Query("after"))
+			return
+		}
+		openAiServerError(c, err)
+		return
+	}
+	list := dto.OpenAIFileList{
+		Object:  "list",
+		Data:    make([]dto.OpenAIFile, 0, len(files)),
+		HasMore: len(files) > limit,
+	}
+	if list.HasMore {
+		files = files[:limit]
+	}
+	for _, file := range files {
+		list.Data = append(list.Data, toOpenAIFile(file))
+	}
+	if len(list.Data) > 0 {
+		list.FirstID = list.Data[0].ID
+		list.LastID = list.Data[len(list.Data)-1].ID
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+func UploadFile(c *gin.Context) {
+	settings := system_setting.GetFileStorageSettings()
+	maxBytes := int64(settings.MaxFileSizeMB) << 20
+	if maxBytes > 0 {
+		// leave room for the multipart envelope and the other form fields
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes+1<<20)
+	}
+	purpose := c.PostForm("purpose")
+	if !slices.Contains(filePurposes, purpose) {
+		openAiErrorMessage(c, http.StatusBadRequest, fmt.Sprintf("Invalid purpose: %s", purpose), "purpose", "invalid_value")
+		return
+	}
+	header, err := c.FormFile("file")
+	if err != nil {
+		openAiErrorMessage(c, http.StatusBadRequest, "a file is required: "+err.Error(), "file", "invalid_value")
+		return
+	}
+	if maxBytes > 0 && header.Size > maxBytes {
+		openAiErrorMessage(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("File is larger than %d MB", settings.MaxFileSizeMB), "file", "file_too_large")
+		return
+	}
+	content, err := header.Open()
+	if err != nil {
+		openAiServerError(c, err)
+		return
+	}
+	defer content.Close()
+
+	file := &model.File{
+		UserId:   c.GetInt("id"),
+		TokenId:  c.GetInt("token_id"),
+		Filename: filepath.Base(header.Filename),
+		Purpose:  purpose,
+		Bytes:    header.Size,
+		MimeType: header.Header.Get("Content-Type"),
+	}
+	if err = service.SaveUserFile(c.Request.Context(), file, content); err != nil {
+		logger.LogError(c, "failed to store uploaded file: "+err.Error())
+		openAiServerError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, toOpenAIFile(file))
+}
+
+func RetrieveFile(c *gin.Context) {
+	file, ok := getUserFile(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, toOpenAIFile(file))
+}
+
+func DeleteFile(c *gin.Context) {
+	file, ok := getUserFile(c)
+	if !ok {
+		return
+	}
+	if err := file.Delete(); err != nil {
+		openAiServerError(c, err)
+		return
+	}
+	if storage, err := service.GetFileStorage(); err == nil {
+		if err = storage.Delete(c.Request.Context(), file.StorageKey); err != nil {
+			logger.LogWarn(c, fmt.Sprintf("failed to delete stored content of file %s: %s", file.Id, err.Error()))
+		}
+	}
+	c.JSON(http.StatusOK, dto.OpenAIFileDeleted{
+		ID:      file.Id,
+		Object:  "file",
+		Deleted: true,
+	})
+}
+
+func RetrieveFileContent(c *gin.Context) {
+	file, ok := getUserFile(c)
+	if !ok {
+		return
+	}
+	storage, err := service.GetFileStorage()
+	if err != nil {
+		openAiServerError(c, err)
+		return
+	}
+	content, err := storage.Get(c.Request.Context(), file.StorageKey)
+	if err != nil {
+		if errors.Is(err, service.ErrStoredFileNotFound) {
+			fileNotFound(c, file.Id)
+			return
+		}
+		openAiServerError(c, err)
+		return
+	}
+	defer content.Close()
+	contentType := file.MimeType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": file.Filename}))
+	c.Header("Content-Length", strconv.FormatInt(file.Bytes, 10))
+	c.Status(http.StatusOK)
+	_, _ = io.Copy(c.Writer, content)
+}
@@ -0,0 +1,212 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/relay/helper"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	mcpErrorParse          = -32700
+	mcpErrorInvalidRequest = -32600
+	mcpErrorMethodNotFound = -32601
+	mcpErrorInvalidParams  = -32602
+	mcpErrorInternal       = -32603
+	// the range below -32000 is left to the server, the gateway uses it for quota errors
+	mcpErrorInsufficientQuota = -32001
+)
+
+var mcpSupportedProtocolVersions = []string{service.McpProtocolVersion, "2025-03-26", "2024-11-05"}
+
+func mcpResult(c *gin.Context, id json.RawMessage, result any) {
+	data, err := common.Marshal(result)
+	if err != nil {
+		mcpError(c, id, mcpErrorInternal, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, service.McpRpcMessage{JsonRpc: "2.0", Id: id, Result: data})
+}
+
+func mcpError(c *gin.Context, id json.RawMessage, code int, message string) {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	c.JSON(http.StatusOK, service.McpRpcMessage{
+		JsonRpc: "2.0",
+		Id:      id,
+		Error:   &service.McpRpcError{Code: code, Message: message},
+	})
+}
+
+// mcpRelayInfo carries the user and token of an /mcp request to the billing of the tool calls.
+func mcpRelayInfo(c *gin.Context) *relaycommon.RelayInfo {
+	return &relaycommon.RelayInfo{
+		UserId:         common.GetContextKeyInt(c, constant.ContextKeyUserId),
+		UsingGroup:     common.GetContextKeyString(c, constant.ContextKeyUsingGroup),
+		UserGroup:      common.GetContextKeyString(c, constant.ContextKeyUserGroup),
+		TokenId:        common.GetContextKeyInt(c, constant.ContextKeyTokenId),
+		TokenKey:       common.GetContextKeyString(c, constant.ContextKeyTokenKey),
+		TokenUnlimited: common.GetContextKeyBool(c, constant.ContextKeyTokenUnlimited),
+		StartTime:      time.Now(),
+	}
+}
+
+// Mcp serves the registered MCP servers over the streamable HTTP transport. The gateway is stateless, every
+// message is answered with JSON and no session id is handed out.
+func Mcp(c *gin.Context) {
+	if !operation_setting.GetMcpSetting().Enabled {
+		openAiErrorMessage(c, http.StatusNotFound, "MCP is not enabled", "", "mcp_disabled")
+		return
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		mcpError(c, nil, mcpErrorParse, err.Error())
+		return
+	}
+	if common.GetJsonType(body) == "array" {
+		mcpError(c, nil, mcpErrorInvalidRequest, "batched messages are not supported")
+		return
+	}
+	var message service.McpRpcMessage
+	if err := common.Unmarshal(body, &message); err != nil {
+		mcpError(c, nil, mcpErrorParse, "invalid JSON-RPC message: "+err.Error())
+		return
+	}
+	if len(message.Id) == 0 || message.Method == "" {
+		// notifications and responses need no answer
+		c.Status(http.StatusAccepted)
+		return
+	}
+
+	switch message.Method {
+	case "initialize":
+		var params struct {
+			ProtocolVersion string `json:"protocolVersion"`
+		}
+		_ = common.Unmarshal(message.Params, &params)
+		protocolVersion := service.McpProtocolVersion
+		if slices.Contains(mcpSupportedProtocolVersions, params.ProtocolVersion) {
+			protocolVersion = params.ProtocolVersion
+		}
+		mcpResult(c, message.Id, gin.H{
+			"protocolVersion": protocolVersion,
+			"capabilities": gin.H{
+				"tools": gin.H{"listChanged": false},
+			},
+			"serverInfo": gin.H{
+				"name":    "new-api",
+				"version": common.Version,
+			},
+		})
+	case "ping":
+		mcpResult(c, message.Id, gin.H{})
+	case "tools/list":
+		mcpListTools(c, message.Id)
+	case "tools/call":
+		mcpCallTool(c, message.Id, message.Params)
+	default:
+		mcpError(c, message.Id, mcpErrorMethodNotFound, "method not found: "+message.Method)
+	}
+}
+
+// McpMethodNotAllowed answers the GET and DELETE of the transport, the gateway opens no streams and keeps no sessions.
+func McpMethodNotAllowed(c *gin.Context) {
+	c.Header("Allow", http.MethodPost)
+	c.Status(http.StatusMethodNotAllowed)
+}
+
+func mcpListTools(c *gin.Context, id json.RawMessage) {
+	servers, err := service.GetAccessibleMcpServers(c)
+	if err != nil {
+		mcpError(c, id, mcpErrorInternal, err.Error())
+		return
+	}
+	tools := make([]service.McpTool, 0)
+	for _, server := range servers {
+		serverTools, err := service.ListMcpServerTools(c.Request.Context(), server)
+		if err != nil {
+			// one unreachable server does not hide the tools of the others
+			logger.LogWarn(c, fmt.Sprintf("failed to list tools of mcp server %s: %s", server.Name, err.Error()))
+			continue
+		}
+		for _, tool := range serverTools {
+			tool.Name = service.McpToolName(server.Name, tool.Name)
+			tools = append(tools, tool)
+		}
+	}
+	mcpResult(c, id, gin.H{"tools": tools})
+}
+
+func mcpCallTool(c *gin.Context, id json.RawMessage, rawParams json.RawMessage) {
+	var params struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	}
+	if err := common.Unmarshal(rawParams, &params); err != nil {
+		mcpError(c, id, mcpErrorInvalidParams, "invalid params: "+err.Error())
+		return
+	}
+	serverName, toolName, ok := service.SplitMcpToolName(params.Name)
+	if !ok {
+		mcpError(c, id, mcpErrorInvalidParams, "unknown tool: "+params.Name)
+		return
+	}
+	servers, err := service.GetAccessibleMcpServers(c)
+	if err != nil {
+		mcpError(c, id, mcpErrorInternal, err.Error())
+		return
+	}
+	index := slices.IndexFunc(servers, func(server *model.McpServer) bool {
+		return server.Name == serverName
+	})
+	if index < 0 {
+		mcpError(c, id, mcpErrorInvalidParams, "unknown tool: "+params.Name)
+		return
+	}
+	server := servers[index]
+
+	info := mcpRelayInfo(c)
+	groupRatio := helper.HandleGroupRatio(c, info).GroupRatio
+	if apiErr := service.CheckMcpCallQuota(c, info, service.McpCallQuota(server, groupRatio)); apiErr != nil {
+		if apiErr.GetErrorCode() == types.ErrorCodeQueryDataError {
+			mcpError(c, id, mcpErrorInternal, apiErr.Error())
+			return
+		}
+		mcpError(c, id, mcpErrorInsufficientQuota, apiErr.Error())
+		return
+	}
+
+	result, err := service.CallMcpServerTool(c.Request.Context(), server, toolName, params.Arguments)
+	service.RecordMcpToolCall(c, info, server, toolName, groupRatio, err, time.Since(info.StartTime))
+	if err != nil {
+		var rpcErr *service.McpRpcError
+		if errors.As(err, &rpcErr) {
+			mcpError(c, id, rpcErr.Code, rpcErr.Message)
+			return
+		}
+		// transport failures are tool errors the model can see
+		mcpResult(c, id, gin.H{
+			"content": []gin.H{{"type": "text", "text": "tool call failed: " + strings.TrimSpace(err.Error())}},
+			"isError": true,
+		})
+		return
+	}
+	c.JSON(http.StatusOK, service.McpRpcMessage{JsonRpc: "2.0", Id: id, Result: result})
+}
@@ -0,0 +1,142 @@
+package controller
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// server names become the prefix of the tool names, they have to be valid in function names of every upstream
+var mcpServerNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+func validateMcpServer(server *model.McpServer) error {
+	if !mcpServerNamePattern.MatchString(server.Name) || strings.Contains(server.Name, service.McpToolNameSeparator) {
+		return errors.New("The server name may only contain letters, digits, '-' and single '_', up to 32 characters.")
+	}
+	switch server.Transport {
+	case "":
+		server.Transport = model.McpTransportStreamableHttp
+	case model.McpTransportStreamableHttp, model.McpTransportSse:
+	default:
+		return errors.New("The transport must be streamable_http or sse.")
+	}
+	serverUrl, err := url.Parse(server.Url)
+	if err != nil || (serverUrl.Scheme != "http" && serverUrl.Scheme != "https") || serverUrl.Host == "" {
+		return errors.New("The server URL must be an http or https URL.")
+	}
+	if strings.TrimSpace(server.Headers) != "" {
+		var headers map[string]string
+		if err := common.UnmarshalJsonStr(server.Headers, &headers); err != nil {
+			return errors.New("The headers must be a JSON object of strings.")
+		}
+	}
+	if server.CallPrice < 0 {
+		return errors.New("The call price cannot be negative.")
+	}
+	if server.Status == 0 {
+		server.Status = model.McpServerStatusEnabled
+	}
+	dup, err := model.IsMcpServerNameDuplicated(server.Id, server.Name)
+	if err != nil {
+		return err
+	}
+	if dup {
+		return errors.New("The server name already exists.")
+	}
+	return nil
+}
+
+func GetMcpServers(c *gin.Context) {
+	servers, err := model.GetAllMcpServers()
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, servers)
+}
+
+func CreateMcpServer(c *gin.Context) {
+	var server model.McpServer
+	if err := c.ShouldBindJSON(&server); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	server.Id = 0
+	if err := validateMcpServer(&server); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if err := server.Insert(); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, &server)
+}
+
+func UpdateMcpServer(c *gin.Context) {
+	var server model.McpServer
+	if err := c.ShouldBindJSON(&server); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if server.Id == 0 {
+		common.ApiErrorMsg(c, "Missing server ID")
+		return
+	}
+	existing, err := model.GetMcpServerById(server.Id)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if err := validateMcpServer(&server); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	server.CreatedTime = existing.CreatedTime
+	if err := server.Update(); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, &server)
+}
+
+func DeleteMcpServer(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if err := model.DeleteMcpServerById(id); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, nil)
+}
+
+// GetMcpServerTools connects to the server and lists its tools, it lets the admin check a server.
+func GetMcpServerTools(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	server, err := model.GetMcpServerById(id)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	tools, err := service.ListMcpServerTools(c.Request.Context(), server)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, tools)
+}
@@ -177,7 +177,10 @@ func UpdateMidjourneyTaskBulk() {
 					logger.LogError(ctx, "UpdateMidjourneyTask task error: "+err.Error())
 				} else {
 					if shouldReturnQuota {
-						err = model.IncreaseUserQuota(task.UserId, task.Quota, false)
+						err = model.AdjustUserQuota(task.UserId, task.Quota, model.QuotaMovement{
+							Reason:    model.QuotaReasonTaskRefund,
+							Reference: task.MjId,
+						}, false)
 						if err != nil {
 							logger.LogError(ctx, "fail to increase user quota: "+err.Error())
 						}
@@ -204,6 +204,18 @@ func ListModels(c *gin.Context, modelType int) {
 			"models":        userGeminiModels,
 			"nextPageToken": nil,
 		})
+	case constant.ChannelTypeOllama:
+		userOllamaModels := make([]dto.OllamaModel, len(userOpenAiModels))
+		for i, model := range userOpenAiModels {
+			userOllamaModels[i] = dto.OllamaModel{
+				Name:       model.Id,
+				Model:      model.Id,
+				ModifiedAt: time.Unix(int64(model.Created), 0).UTC().Format(time.RFC3339),
+			}
+		}
+		c.JSON(200, gin.H{
+			"models": userOllamaModels,
+		})
 	default:
 		c.JSON(200, gin.H{
 			"success": true,
@@ -0,0 +1,31 @@
+package controller
+
+import (
+	"net/http"
+
+	"github.com/QuantumNous/new-api/dto"
+
+	"github.com/gin-gonic/gin"
+)
+
+// openAiErrorMessage writes an error in the format of the OpenAI API, for the endpoints the gateway serves itself.
+func openAiErrorMessage(c *gin.Context, statusCode int, message string, param string, code string) {
+	c.JSON(statusCode, gin.H{
+		"error": dto.OpenAIError{
+			Message: message,
+			Type:    "invalid_request_error",
+			Param:   param,
+			Code:    code,
+		},
+	})
+}
+
+func openAiServerError(c *gin.Context, err error) {
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"error": dto.OpenAIError{
+			Message: err.Error(),
+			Type:    "new_api_error",
+			Code:    "internal_error",
+		},
+	})
+}
@@ -1,6 +1,8 @@
 package controller
 
 import (
+	"time"
+
 	"github.com/QuantumNous/new-api/model"
 	"github.com/QuantumNous/new-api/setting"
 	"github.com/QuantumNous/new-api/setting/ratio_setting"
@@ -38,6 +40,22 @@ func GetPricing(c *gin.Context) {
 		}
 	}
 
+	// the time-of-day windows running now and in the coming week, for the groups the user can use
+	now := time.Now()
+	pricingWindows := make([]ratio_setting.PricingWindowOccurrence, 0)
+	for _, window := range ratio_setting.GetPricingWindowOccurrences(now, now.AddDate(0, 0, 7)) {
+		usable := len(window.Groups) == 0
+		for _, g := range window.Groups {
+			if _, ok := usableGroup[g]; ok {
+				usable = true
+				break
+			}
+		}
+		if usable {
+			pricingWindows = append(pricingWindows, window)
+		}
+	}
+
 	c.JSON(200, gin.H{
 		"success":            true,
 		"data":               pricing,
@@ -46,6 +64,7 @@ func GetPricing(c *gin.Context) {
 		"usable_group":       usableGroup,
 		"supported_endpoint": model.GetSupportedEndpointMap(),
 		"auto_groups":        setting.AutoGroups,
+		"pricing_windows":    pricingWindows,
 	})
 }
 
@@ -0,0 +1,47 @@
+package controller
+
+import (
+	"strconv"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+func GetQuotaLedger(c *gin.Context) {
+	pageInfo := common.GetPageQuery(c)
+	accountId, _ := strconv.Atoi(c.Query("account_id"))
+	userId, _ := strconv.Atoi(c.Query("user_id"))
+	entries, total, err := model.GetQuotaLedgerEntries(c.Query("account_type"), accountId, userId, c.Query("reference"), pageInfo)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	pageInfo.SetTotal(int(total))
+	pageInfo.SetItems(entries)
+	common.ApiSuccess(c, pageInfo)
+}
+
+// ReconcileQuotaLedger reports the accounts whose balance, ledger and cache disagree.
+func ReconcileQuotaLedger(c *gin.Context) {
+	reconciliation, err := model.ReconcileQuotaLedger(false)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, reconciliation)
+}
+
+// RepairQuotaLedger reconciles the ledger and takes the drifts found into it.
+func RepairQuotaLedger(c *gin.Context) {
+	reconciliation, err := model.ReconcileQuotaLedger(true)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if reconciliation.Repaired > 0 {
+		common.SysLog("quota ledger repaired " + strconv.Itoa(reconciliation.Repaired) + " drifted accounts")
+	}
+	common.ApiSuccess(c, reconciliation)
+}
@@ -0,0 +1,1076 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/relay/helper"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/bytedance/gopkg/util/gopool"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// realtimeBridgeEndpoints are the endpoints the legs of a bridged realtime session are sent to.
+var realtimeBridgeEndpoints = map[string]types.RelayFormat{
+	"/v1/chat/completions":     types.RelayFormatOpenAI,
+	"/v1/audio/transcriptions": types.RelayFormatOpenAIAudio,
+	"/v1/audio/speech":         types.RelayFormatOpenAIAudio,
+}
+
+// text input of one speech request, longer replies are voiced in several requests
+const realtimeBridgeSpeechChunkSize = 4000
+
+var (
+	realtimeBridgeEngine     *gin.Engine
+	realtimeBridgeEngineOnce sync.Once
+)
+
+func getRealtimeBridgeEngine() *gin.Engine {
+	realtimeBridgeEngineOnce.Do(func() {
+		realtimeBridgeEngine = newInternalRelayEngine(realtimeBridgeEndpoints)
+	})
+	return realtimeBridgeEngine
+}
+
+// shouldBridgeRealtime reports whether the realtime session is served by the gateway itself,
+// only OpenAI and Azure channels can open an upstream realtime websocket.
+func shouldBridgeRealtime(c *gin.Context) bool {
+	if !operation_setting.GetRealtimeBridgeSetting().Enabled {
+		return false
+	}
+	switch common.GetContextKeyInt(c, constant.ContextKeyChannelType) {
+	case constant.ChannelTypeOpenAI, constant.ChannelTypeAzure:
+		return false
+	}
+	return true
+}
+
+// relayRealtimeBridge serves a realtime session on the gateway. Input audio is transcribed by a transcription model,
+// replies come from chat completions of the chat model and are voiced by a speech model. Every leg is an internal
+// request billed and logged on its own, so the quota held for the session is returned when it ends.
+func relayRealtimeBridge(c *gin.Context, info *relaycommon.RelayInfo) *types.NewAPIError {
+	if info.ClientWs == nil {
+		return types.NewError(errors.New("invalid websocket connection"), types.ErrorCodeBadResponse, types.ErrOptionWithSkipRetry())
+	}
+	info.IsStream = true
+	// every leg takes the capacity of its own channel, the session holds none for its whole length
+	model.ReleaseChannelCapacity(c)
+	newRealtimeBridgeSession(c, info).run()
+	service.ReturnPreConsumedQuota(c, info)
+	return nil
+}
+
+type realtimeBridgeTurnDetection struct {
+	Type              string  `json:"type"`
+	Threshold         float64 `json:"threshold"`
+	PrefixPaddingMs   int     `json:"prefix_padding_ms"`
+	SilenceDurationMs int     `json:"silence_duration_ms"`
+	CreateResponse    *bool   `json:"create_response,omitempty"`
+	InterruptResponse *bool   `json:"interrupt_response,omitempty"`
+}
+
+type realtimeBridgeSession struct {
+	c    *gin.Context
+	info *relaycommon.RelayInfo
+	ws   *websocket.Conn
+	ctx  context.Context
+
+	writeLock sync.Mutex
+	jobs      chan func()
+
+	// session, items and cancel are shared with the job goroutine
+	lock    sync.Mutex
+	session dto.RealtimeSession
+	items   []*dto.RealtimeItem
+	cancel  context.CancelFunc
+
+	// the input buffer and turn detection state are only used by the reader
+	turnDetection  *realtimeBridgeTurnDetection
+	audio          []int16
+	audioBase      int
+	vadOffset      int
+	silence        int
+	speechItemId   string
+	speechStartPos int
+}
+
+func newRealtimeBridgeSession(c *gin.Context, info *relaycommon.RelayInfo) *realtimeBridgeSession {
+	bridgeSetting := operation_setting.GetRealtimeBridgeSetting()
+	turnDetection := &realtimeBridgeTurnDetection{
+		Type:              "server_vad",
+		Threshold:         0.5,
+		PrefixPaddingMs:   300,
+		SilenceDurationMs: 500,
+	}
+	return &realtimeBridgeSession{
+		c:    c,
+		info: info,
+		ws:   info.ClientWs,
+		jobs: make(chan func(), 64),
+		session: dto.RealtimeSession{
+			Id:                "sess_" + common.GetUUID(),
+			Model:             info.OriginModelName,
+			Modalities:        []string{"text", "audio"},
+			Voice:             bridgeSetting.Voice,
+			InputAudioFormat:  "pcm16",
+			OutputAudioFormat: "pcm16",
+			TurnDetection:     turnDetection,
+			Tools:             []dto.RealTimeTool{},
+			ToolChoice:        "auto",
+			Temperature:       0.8,
+		},
+		turnDetection: turnDetection,
+	}
+}
+
+func (s *realtimeBridgeSession) run() {
+	ctx, cancel := context.WithCancel(s.c.Request.Context())
+	defer cancel()
+	s.ctx = ctx
+
+	jobsDone := make(chan struct{})
+	gopool.Go(func() {
+		defer close(jobsDone)
+		for job := range s.jobs {
+			s.runJob(job)
+		}
+	})
+
+	s.lock.Lock()
+	session := s.session
+	s.lock.Unlock()
+	s.send(&dto.RealtimeEvent{Type: dto.RealtimeEventTypeSessionCreated, Session: &session})
+
+	for {
+		_, message, err := s.ws.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				logger.LogError(s.c, "realtime bridge: error reading from client: "+err.Error())
+			}
+			break
+		}
+		s.handle(message)
+	}
+
+	cancel()
+	close(s.jobs)
+	<-jobsDone
+}
+
+func (s *realtimeBridgeSession) runJob(job func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.LogError(s.c, fmt.Sprintf("realtime bridge: panic in job: %v", r))
+		}
+	}()
+	if s.ctx.Err() != nil {
+		return
+	}
+	job()
+}
+
+func (s *realtimeBridgeSession) send(event *dto.RealtimeEvent) {
+	if event.EventId == "" {
+		event.EventId = "event_" + common.GetUUID()
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if err := helper.WssObject(s.c, s.ws, event); err != nil {
+		logger.LogError(s.c, "realtime bridge: error writing to client: "+err.Error())
+	}
+}
+
+func (s *realtimeBridgeSession) sendError(errorType string, code string, message string) {
+	s.send(&dto.RealtimeEvent{
+		Type: dto.RealtimeEventTypeError,
+		Error: &types.OpenAIError{
+			Type:    errorType,
+			Code:    code,
+			Message: message,
+		},
+	})
+}
+
+func (s *realtimeBridgeSession) handle(message []byte) {
+	event := &dto.RealtimeEvent{}
+	if err := common.Unmarshal(message, event); err != nil {
+		s.sendError("invalid_request_error", "invalid_event", "invalid event: "+err.Error())
+		return
+	}
+	switch event.Type {
+	case dto.RealtimeEventTypeSessionUpdate:
+		s.updateSession(message)
+	case dto.RealtimeEventInputAudioBufferAppend:
+		s.appendAudio(event.Audio)
+	case dto.RealtimeEventInputAudioBufferCommit:
+		if len(s.audio) == 0 {
+			s.sendError("invalid_request_error", "input_audio_buffer_commit_empty", "the input audio buffer is empty")
+			return
+		}
+		itemId := s.speechItemId
+		if itemId == "" {
+			itemId = "item_" + common.GetUUID()
+		}
+		s.commitAudio(itemId, len(s.audio), false)
+	case dto.RealtimeEventInputAudioBufferClear:
+		s.clearAudio()
+		s.send(&dto.RealtimeEvent{Type: dto.RealtimeEventInputAudioBufferCleared})
+	case dto.RealtimeEventTypeConversationCreate:
+		s.createItem(event.Item)
+	case dto.RealtimeEventTypeConversationDelete:
+		s.deleteItem(event.ItemId)
+	case dto.RealtimeEventTypeResponseCreate:
+		options := event.Response
+		s.enqueue(func() {
+			s.respond(options)
+		})
+	case dto.RealtimeEventTypeResponseCancel:
+		s.cancelResponse()
+	default:
+		s.sendError("invalid_request_error", "unsupported_event", fmt.Sprintf("event type %s is not supported by this model", event.Type))
+	}
+}
+
+func (s *realtimeBridgeSession) enqueue(job func()) {
+	select {
+	case s.jobs <- job:
+	case <-s.ctx.Done():
+	}
+}
+
+// updateSession applies the fields present in a session.update event, fields it leaves out keep their value.
+func (s *realtimeBridgeSession) updateSession(message []byte) {
+	var update struct {
+		Session map[string]json.RawMessage `json:"session"`
+	}
+	if err := common.Unmarshal(message, &update); err != nil {
+		s.sendError("invalid_request_error", "invalid_event", "invalid session: "+err.Error())
+		return
+	}
+
+	s.lock.Lock()
+	current, _ := common.Marshal(s.session)
+	merged := map[string]json.RawMessage{}
+	_ = common.Unmarshal(current, &merged)
+	for key, value := range update.Session {
+		if key == "id" || key == "model" {
+			continue
+		}
+		merged[key] = value
+	}
+	data, _ := common.Marshal(merged)
+	session := dto.RealtimeSession{}
+	if err := common.Unmarshal(data, &session); err != nil {
+		s.lock.Unlock()
+		s.sendError("invalid_request_error", "invalid_value", "invalid session: "+err.Error())
+		return
+	}
+	formatChanged := session.InputAudioFormat != s.session.InputAudioFormat
+	s.session = session
+	s.lock.Unlock()
+
+	s.turnDetection = nil
+	if session.TurnDetection != nil {
+		turnDetection := &realtimeBridgeTurnDetection{}
+		if err := common.Unmarshal(merged["turn_detection"], turnDetection); err == nil && turnDetection.Type != "" {
+			s.turnDetection = turnDetection
+		}
+	}
+	if formatChanged {
+		s.clearAudio()
+	}
+
+	s.info.InputAudioFormat = session.InputAudioFormat
+	s.info.OutputAudioFormat = session.OutputAudioFormat
+	s.info.RealtimeTools = session.Tools
+	s.send(&dto.RealtimeEvent{Type: dto.RealtimeEventTypeSessionUpdated, Session: &session})
+}
+
+func (s *realtimeBridgeSession) appendAudio(audio string) {
+	data, err := base64.StdEncoding.DecodeString(audio)
+	if err != nil {
+		s.sendError("invalid_request_error", "invalid_value", "audio is not valid base64: "+err.Error())
+		return
+	}
+	s.audio = append(s.audio, decodeRealtimeAudio(s.session.InputAudioFormat, data)...)
+	if s.turnDetection != nil {
+		s.detectTurn()
+	}
+}
+
+func (s *realtimeBridgeSession) clearAudio() {
+	s.audioBase += len(s.audio)
+	s.audio = nil
+	s.vadOffset = 0
+	s.silence = 0
+	s.speechItemId = ""
+}
+
+func (s *realtimeBridgeSession) audioMs(position int) int {
+	return (s.audioBase + position) * 1000 / realtimeAudioSampleRate(s.session.InputAudioFormat)
+}
+
+// detectTurn runs an energy gate over the new 20ms frames of the input buffer. The threshold of the turn detection
+// scales the gate, the default 0.5 opens at about -34 dBFS.
+func (s *realtimeBridgeSession) detectTurn() {
+	turnDetection := s.turnDetection
+	sampleRate := realtimeAudioSampleRate(s.session.InputAudioFormat)
+	frame := sampleRate / 50
+	threshold := turnDetection.Threshold
+	if threshold <= 0 {
+		threshold = 0.5
+	}
+	gate := threshold * 0.04 * 32768
+	padding := turnDetection.PrefixPaddingMs * sampleRate / 1000
+	silenceLimit := turnDetection.SilenceDurationMs * sampleRate / 1000
+	if silenceLimit <= 0 {
+		silenceLimit = sampleRate / 2
+	}
+
+	for s.vadOffset+frame <= len(s.audio) {
+		var sum float64
+		for _, sample := range s.audio[s.vadOffset : s.vadOffset+frame] {
+			sum += float64(sample) * float64(sample)
+		}
+		loud := math.Sqrt(sum/float64(frame)) >= gate
+		s.vadOffset += frame
+
+		if s.speechItemId == "" {
+			// keep only the prefix padding of the audio before speech
+			if drop := s.vadOffset - frame - padding; drop > 0 {
+				s.audioBase += drop
+				s.audio = s.audio[drop:]
+				s.vadOffset -= drop
+			}
+			if !loud {
+				continue
+			}
+			s.speechItemId = "item_" + common.GetUUID()
+			s.speechStartPos = s.vadOffset - frame
+			s.silence = 0
+			s.send(&dto.RealtimeEvent{
+				Type:         dto.RealtimeEventInputAudioBufferSpeechStarted,
+				AudioStartMs: s.audioMs(s.speechStartPos),
+				ItemId:       s.speechItemId,
+			})
+			if turnDetection.InterruptResponse == nil || *turnDetection.InterruptResponse {
+				s.cancelResponse()
+			}
+			continue
+		}
+
+		if loud {
+			s.silence = 0
+			continue
+		}
+		s.silence += frame
+		if s.silence < silenceLimit {
+			continue
+		}
+		s.send(&dto.RealtimeEvent{
+			Type:       dto.RealtimeEventInputAudioBufferSpeechStopped,
+			AudioEndMs: s.audioMs(s.vadOffset),
+			ItemId:     s.speechItemId,
+		})
+		s.commitAudio(s.speechItemId, s.vadOffset, turnDetection.CreateResponse == nil || *turnDetection.CreateResponse)
+	}
+}
+
+// commitAudio turns the first length samples of the input buffer into a user message and transcribes it.
+func (s *realtimeBridgeSession) commitAudio(itemId string, length int, createResponse bool) {
+	samples := s.audio[:length]
+	sampleRate := realtimeAudioSampleRate(s.session.InputAudioFormat)
+	s.audioBase += length
+	s.audio = append([]int16(nil), s.audio[length:]...)
+	s.vadOffset = 0
+	s.silence = 0
+	s.speechItemId = ""
+
+	item := &dto.RealtimeItem{
+		Id:      itemId,
+		Type:    "message",
+		Status:  "completed",
+		Role:    "user",
+		Content: []dto.RealtimeContent{{Type: "input_audio"}},
+	}
+	previousItemId := s.addItem(item)
+	s.send(&dto.RealtimeEvent{
+		Type:           dto.RealtimeEventInputAudioBufferCommitted,
+		PreviousItemId: previousItemId,
+		ItemId:         item.Id,
+	})
+	s.send(&dto.RealtimeEvent{
+		Type:           dto.RealtimeEventConversationItemCreated,
+		PreviousItemId: previousItemId,
+		Item:           item,
+	})
+
+	wav := pcm16Wav(samples, sampleRate)
+	s.enqueue(func() {
+		s.transcribe(item.Id, 0, wav)
+	})
+	if createResponse {
+		s.enqueue(func() {
+			s.respond(nil)
+		})
+	}
+}
+
+func (s *realtimeBridgeSession) addItem(item *dto.RealtimeItem) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	previousItemId := ""
+	if len(s.items) > 0 {
+		previousItemId = s.items[len(s.items)-1].Id
+	}
+	s.items = append(s.items, item)
+	return previousItemId
+}
+
+func (s *realtimeBridgeSession) createItem(item *dto.RealtimeItem) {
+	if item == nil {
+		s.sendError("invalid_request_error", "missing_required_parameter", "item is required")
+		return
+	}
+	if item.Id == "" {
+		item.Id = "item_" + common.GetUUID()
+	}
+	if item.Type == "" {
+		item.Type = "message"
+	}
+	item.Status = "completed"
+
+	var audioParts []int
+	for i, content := range item.Content {
+		if content.Type == "input_audio" && content.Audio != "" && content.Transcript == "" {
+			audioParts = append(audioParts, i)
+		}
+	}
+	format := s.session.InputAudioFormat
+	audios := make([][]byte, 0, len(audioParts))
+	for _, i := range audioParts {
+		data, err := base64.StdEncoding.DecodeString(item.Content[i].Audio)
+		if err != nil {
+			s.sendError("invalid_request_error", "invalid_value", "audio is not valid base64: "+err.Error())
+			return
+		}
+		audios = append(audios, pcm16Wav(decodeRealtimeAudio(format, data), realtimeAudioSampleRate(format)))
+		item.Content[i].Audio = ""
+	}
+
+	previousItemId := s.addItem(item)
+	s.send(&dto.RealtimeEvent{
+		Type:           dto.RealtimeEventConversationItemCreated,
+		PreviousItemId: previousItemId,
+		Item:           item,
+	})
+	for j, i := range audioParts {
+		contentIndex, wav := i, audios[j]
+		s.enqueue(func() {
+			s.transcribe(item.Id, contentIndex, wav)
+		})
+	}
+}
+
+func (s *realtimeBridgeSession) deleteItem(itemId string) {
+	s.lock.Lock()
+	index := slices.IndexFunc(s.items, func(item *dto.RealtimeItem) bool {
+		return item.Id == itemId
+	})
+	if index >= 0 {
+		s.items = slices.Delete(s.items, index, index+1)
+	}
+	s.lock.Unlock()
+	if index < 0 {
+		s.sendError("invalid_request_error", "item_not_found", fmt.Sprintf("item %s does not exist", itemId))
+		return
+	}
+	s.send(&dto.RealtimeEvent{Type: dto.RealtimeEventConversationItemDeleted, ItemId: itemId})
+}
+
+func (s *realtimeBridgeSession) cancelResponse() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+// transcribe sends a WAV of the committed audio to the transcription model and stores the transcript on the item.
+func (s *realtimeBridgeSession) transcribe(itemId string, contentIndex int, wav []byte) {
+	s.lock.Lock()
+	transcriptionModel := s.session.InputAudioTranscription.Model
+	s.lock.Unlock()
+	if transcriptionModel == "" {
+		transcriptionModel = operation_setting.GetRealtimeBridgeSetting().TranscriptionModel
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	_ = writer.WriteField("model", transcriptionModel)
+	_ = writer.WriteField("response_format", "json")
+	part, _ := writer.CreateFormFile("file", "audio.wav")
+	_, _ = part.Write(wav)
+	_ = writer.Close()
+
+	var transcription struct {
+		Text string `json:"text"`
+	}
+	responseBody, err := s.relayLeg(s.ctx, "/v1/audio/transcriptions", writer.FormDataContentType(), &body, nil)
+	if err == nil {
+		err = common.Unmarshal(responseBody, &transcription)
+	}
+	if err != nil {
+		s.send(&dto.RealtimeEvent{
+			Type:         dto.RealtimeEventInputAudioTranscriptionFailed,
+			ItemId:       itemId,
+			ContentIndex: common.GetPointer(contentIndex),
+			Error: &types.OpenAIError{
+				Type:    "transcription_error",
+				Code:    "audio_unintelligible",
+				Message: err.Error(),
+			},
+		})
+		return
+	}
+
+	s.lock.Lock()
+	for _, item := range s.items {
+		if item.Id == itemId && contentIndex < len(item.Content) {
+			item.Content[contentIndex].Transcript = transcription.Text
+		}
+	}
+	s.lock.Unlock()
+	s.send(&dto.RealtimeEvent{
+		Type:         dto.RealtimeEventInputAudioTranscriptionCompleted,
+		ItemId:       itemId,
+		ContentIndex: common.GetPointer(contentIndex),
+		Transcript:   transcription.Text,
+	})
+}
+
+// chatRequest builds the chat completions request of a response from the conversation, the caller holds the lock.
+func (s *realtimeBridgeSession) chatRequest(instructions string) *dto.GeneralOpenAIRequest {
+	chatModel := operation_setting.GetRealtimeBridgeSetting().ChatModel
+	if chatModel == "" {
+		chatModel = s.info.OriginModelName
+	}
+	request := &dto.GeneralOpenAIRequest{
+		Model:         chatModel,
+		Stream:        true,
+		StreamOptions: &dto.StreamOptions{IncludeUsage: true},
+	}
+	if s.session.Temperature > 0 {
+		request.Temperature = common.GetPointer(s.session.Temperature)
+	}
+	if instructions != "" {
+		message := dto.Message{Role: "system"}
+		message.SetStringContent(instructions)
+		request.Messages = append(request.Messages, message)
+	}
+	for _, tool := range s.session.Tools {
+		request.Tools = append(request.Tools, dto.ToolCallRequest{
+			Type: "function",
+			Function: dto.FunctionRequest{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+			},
+		})
+	}
+	if len(request.Tools) > 0 && s.session.ToolChoice != "" {
+		request.ToolChoice = s.session.ToolChoice
+	}
+
+	var toolCalls []dto.ToolCallRequest
+	flushToolCalls := func() {
+		if len(toolCalls) == 0 {
+			return
+		}
+		message := dto.Message{Role: "assistant"}
+		message.SetNullContent()
+		message.SetToolCalls(toolCalls)
+		request.Messages = append(request.Messages, message)
+		toolCalls = nil
+	}
+	for _, item := range s.items {
+		switch item.Type {
+		case "function_call":
+			name := ""
+			if item.Name != nil {
+				name = *item.Name
+			}
+			toolCalls = append(toolCalls, dto.ToolCallRequest{
+				ID:   item.CallId,
+				Type: "function",
+				Function: dto.FunctionRequest{
+					Name:      name,
+					Arguments: item.Arguments,
+				},
+			})
+		case "function_call_output":
+			flushToolCalls()
+			message := dto.Message{Role: "tool", ToolCallId: item.CallId}
+			message.SetStringContent(item.Output)
+			request.Messages = append(request.Messages, message)
+		default:
+			flushToolCalls()
+			var texts []string
+			for _, content := range item.Content {
+				text := content.Text
+				if text == "" {
+					text = content.Transcript
+				}
+				if text != "" {
+					texts = append(texts, text)
+				}
+			}
+			if len(texts) == 0 {
+				continue
+			}
+			message := dto.Message{Role: item.Role}
+			message.SetStringContent(strings.Join(texts, "\n"))
+			request.Messages = append(request.Messages, message)
+		}
+	}
+	flushToolCalls()
+	return request
+}
+
+// respond runs one response: a streamed chat completion, voiced by the speech model when audio is requested,
+// followed by any function calls the model made.
+func (s *realtimeBridgeSession) respond(options *dto.RealtimeResponse) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	s.lock.Lock()
+	s.cancel = cancel
+	session := s.session
+	instructions := session.Instructions
+	modalities := session.Modalities
+	if options != nil {
+		if options.Instructions != "" {
+			instructions = options.Instructions
+		}
+		if len(options.Modalities) > 0 {
+			modalities = options.Modalities
+		}
+	}
+	request := s.chatRequest(instructions)
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		s.cancel = nil
+		s.lock.Unlock()
+	}()
+
+	output := &realtimeBridgeOutput{
+		session:    s,
+		ctx:        ctx,
+		responseId: "resp_" + common.GetUUID(),
+		audio:      slices.Contains(modalities, "audio"),
+		format:     session.OutputAudioFormat,
+	}
+	s.send(&dto.RealtimeEvent{
+		Type: dto.RealtimeEventResponseCreated,
+		Response: &dto.RealtimeResponse{
+			Id:     output.responseId,
+			Object: "realtime.response",
+			Status: "in_progress",
+		},
+	})
+
+	status := "completed"
+	requestBody, _ := common.Marshal(request)
+	_, err := s.relayLeg(ctx, "/v1/chat/completions", "application/json", bytes.NewReader(requestBody), output.writeChat)
+	if err == nil && output.audio && output.text.Len() > 0 {
+		voice := session.Voice
+		if voice == "" {
+			voice = operation_setting.GetRealtimeBridgeSetting().Voice
+		}
+		for _, chunk := range splitRealtimeSpeech(output.text.String()) {
+			speechBody, _ := common.Marshal(dto.AudioRequest{
+				Model:          operation_setting.GetRealtimeBridgeSetting().SpeechModel,
+				Input:          chunk,
+				Voice:          voice,
+				ResponseFormat: "pcm",
+			})
+			if _, err = s.relayLeg(ctx, "/v1/audio/speech", "application/json", bytes.NewReader(speechBody), output.writeSpeech); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		status = "failed"
+		if ctx.Err() != nil {
+			status = "cancelled"
+		} else {
+			s.sendError("server_error", "upstream_error", err.Error())
+		}
+	}
+
+	items := output.finish(status)
+	response := &dto.RealtimeResponse{
+		Id:     output.responseId,
+		Object: "realtime.response",
+		Status: status,
+		Output: items,
+	}
+	if output.usage != nil {
+		response.Usage = &dto.RealtimeUsage{
+			TotalTokens:  output.usage.TotalTokens,
+			InputTokens:  output.usage.PromptTokens,
+			OutputTokens: output.usage.CompletionTokens,
+		}
+		response.Usage.InputTokenDetails.TextTokens = output.usage.PromptTokens
+		response.Usage.InputTokenDetails.CachedTokens = output.usage.PromptTokensDetails.CachedTokens
+		response.Usage.OutputTokenDetails.TextTokens = output.usage.CompletionTokens
+	}
+	s.send(&dto.RealtimeEvent{Type: dto.RealtimeEventTypeResponseDone, Response: response})
+}
+
+// splitRealtimeSpeech splits a reply into pieces the speech model accepts, breaking at whitespace.
+func splitRealtimeSpeech(text string) []string {
+	var chunks []string
+	for len(text) > realtimeBridgeSpeechChunkSize {
+		cut := strings.LastIndexAny(text[:realtimeBridgeSpeechChunkSize], " \n\t")
+		if cut <= 0 {
+			cut = realtimeBridgeSpeechChunkSize
+			for cut > 0 && !utf8.RuneStart(text[cut]) {
+				cut--
+			}
+		}
+		chunks = append(chunks, text[:cut])
+		text = strings.TrimLeft(text[cut:], " \n\t")
+	}
+	if text != "" {
+		chunks = append(chunks, text)
+	}
+	return chunks
+}
+
+// realtimeBridgeOutput turns the chat and speech legs of a response into realtime events.
+type realtimeBridgeOutput struct {
+	session    *realtimeBridgeSession
+	ctx        context.Context
+	responseId string
+	audio      bool
+	format     string
+
+	pending     []byte
+	messageItem *dto.RealtimeItem
+	text        strings.Builder
+	toolCalls   []*dto.ToolCallResponse
+	usage       *dto.Usage
+	speechCarry []byte
+}
+
+func (o *realtimeBridgeOutput) partType() string {
+	if o.audio {
+		return "audio"
+	}
+	return "text"
+}
+
+func (o *realtimeBridgeOutput) startMessage() {
+	if o.messageItem != nil {
+		return
+	}
+	o.messageItem = &dto.RealtimeItem{
+		Id:      "item_" + common.GetUUID(),
+		Type:    "message",
+		Status:  "in_progress",
+		Role:    "assistant",
+		Content: []dto.RealtimeContent{},
+	}
+	item := *o.messageItem
+	previousItemId := o.session.addItem(o.messageItem)
+	o.session.send(&dto.RealtimeEvent{
+		Type:        dto.RealtimeEventResponseOutputItemAdded,
+		ResponseId:  o.responseId,
+		OutputIndex: common.GetPointer(0),
+		Item:        &item,
+	})
+	o.session.send(&dto.RealtimeEvent{
+		Type:           dto.RealtimeEventConversationItemCreated,
+		PreviousItemId: previousItemId,
+		Item:           &item,
+	})
+	o.session.send(&dto.RealtimeEvent{
+		Type:         dto.RealtimeEventResponseContentPartAdded,
+		ResponseId:   o.responseId,
+		ItemId:       o.messageItem.Id,
+		OutputIndex:  common.GetPointer(0),
+		ContentIndex: common.GetPointer(0),
+		Part:         &dto.RealtimeContent{Type: o.partType()},
+	})
+}
+
+func (o *realtimeBridgeOutput) contentEvent(eventType string) *dto.RealtimeEvent {
+	return &dto.RealtimeEvent{
+		Type:         eventType,
+		ResponseId:   o.responseId,
+		ItemId:       o.messageItem.Id,
+		OutputIndex:  common.GetPointer(0),
+		ContentIndex: common.GetPointer(0),
+	}
+}
+
+// writeChat receives the SSE body of the chat leg.
+func (o *realtimeBridgeOutput) writeChat(data []byte) {
+	if o.ctx.Err() != nil {
+		return
+	}
+	o.pending = append(o.pending, data...)
+	for {
+		end := bytes.IndexByte(o.pending, '\n')
+		if end < 0 {
+			return
+		}
+		line := strings.TrimSpace(string(o.pending[:end]))
+		o.pending = o.pending[end+1:]
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if line == "" || line == "[DONE]" {
+			continue
+		}
+		var chunk dto.ChatCompletionsStreamResponse
+		if err := common.UnmarshalJsonStr(line, &chunk); err != nil {
+			continue
+		}
+		if chunk.Usage != nil {
+			o.usage = chunk.Usage
+		}
+		for _, choice := range chunk.Choices {
+			if content := choice.Delta.GetContentString(); content != "" {
+				o.startMessage()
+				o.text.WriteString(content)
+				eventType := dto.RealtimeEventResponseTextDelta
+				if o.audio {
+					eventType = dto.RealtimeEventResponseAudioTranscriptionDelta
+				}
+				event := o.contentEvent(eventType)
+				event.Delta = content
+				o.session.send(event)
+			}
+			for _, toolCall := range choice.Delta.ToolCalls {
+				index := 0
+				if toolCall.Index != nil {
+					index = *toolCall.Index
+				}
+				for len(o.toolCalls) <= index {
+					o.toolCalls = append(o.toolCalls, &dto.ToolCallResponse{})
+				}
+				call := o.toolCalls[index]
+				if toolCall.ID != "" {
+					call.ID = toolCall.ID
+				}
+				if toolCall.Function.Name != "" {
+					call.Function.Name = toolCall.Function.Name
+				}
+				call.Function.Arguments += toolCall.Function.Arguments
+			}
+		}
+	}
+}
+
+// writeSpeech receives the 24kHz pcm16 body of a speech leg.
+func (o *realtimeBridgeOutput) writeSpeech(data []byte) {
+	if o.ctx.Err() != nil {
+		return
+	}
+	data = append(o.speechCarry, data...)
+	// whole samples, and whole groups of three for the 8kHz formats
+	frameSize := 2
+	if realtimeAudioSampleRate(o.format) == 8000 {
+		frameSize = 6
+	}
+	usable := len(data) - len(data)%frameSize
+	o.speechCarry = append([]byte(nil), data[usable:]...)
+	if usable == 0 {
+		return
+	}
+	o.startMessage()
+	encoded := encodeRealtimeAudio(o.format, decodeRealtimeAudio("pcm16", data[:usable]))
+	event := o.contentEvent(dto.RealtimeEventResponseAudioDelta)
+	event.Delta = base64.StdEncoding.EncodeToString(encoded)
+	o.session.send(event)
+}
+
+// finish closes the message of the response, adds its function calls to the conversation and returns the output items.
+func (o *realtimeBridgeOutput) finish(status string) []dto.RealtimeItem {
+	itemStatus := "completed"
+	if status != "completed" {
+		itemStatus = "incomplete"
+	}
+	var items []dto.RealtimeItem
+	if o.messageItem != nil {
+		text := o.text.String()
+		content := dto.RealtimeContent{Type: "text", Text: text}
+		if o.audio {
+			content = dto.RealtimeContent{Type: "audio", Transcript: text}
+			o.session.send(o.contentEvent(dto.RealtimeEventResponseAudioDone))
+			event := o.contentEvent(dto.RealtimeEventResponseAudioTranscriptionDone)
+			event.Transcript = text
+			o.session.send(event)
+		} else {
+			event := o.contentEvent(dto.RealtimeEventResponseTextDone)
+			event.Text = text
+			o.session.send(event)
+		}
+		event := o.contentEvent(dto.RealtimeEventResponseContentPartDone)
+		event.Part = &content
+		o.session.send(event)
+
+		o.session.lock.Lock()
+		o.messageItem.Status = itemStatus
+		o.messageItem.Content = []dto.RealtimeContent{content}
+		item := *o.messageItem
+		o.session.lock.Unlock()
+		o.session.send(&dto.RealtimeEvent{
+			Type:        dto.RealtimeEventResponseOutputItemDone,
+			ResponseId:  o.responseId,
+			OutputIndex: common.GetPointer(0),
+			Item:        &item,
+		})
+		items = append(items, item)
+	}
+	if status != "completed" {
+		return items
+	}
+
+	for _, call := range o.toolCalls {
+		if call.Function.Name == "" {
+			continue
+		}
+		if call.ID == "" {
+			call.ID = "call_" + common.GetUUID()
+		}
+		outputIndex := len(items)
+		item := &dto.RealtimeItem{
+			Id:        "item_" + common.GetUUID(),
+			Type:      "function_call",
+			Status:    "completed",
+			Name:      common.GetPointer(call.Function.Name),
+			CallId:    call.ID,
+			Arguments: call.Function.Arguments,
+		}
+		itemCopy := *item
+		previousItemId := o.session.addItem(item)
+		o.session.send(&dto.RealtimeEvent{
+			Type:        dto.RealtimeEventResponseOutputItemAdded,
+			ResponseId:  o.responseId,
+			OutputIndex: common.GetPointer(outputIndex),
+			Item:        &itemCopy,
+		})
+		o.session.send(&dto.RealtimeEvent{
+			Type:           dto.RealtimeEventConversationItemCreated,
+			PreviousItemId: previousItemId,
+			Item:           &itemCopy,
+		})
+		o.session.send(&dto.RealtimeEvent{
+			Type:        dto.RealtimeEventResponseFunctionCallArgumentsDone,
+			ResponseId:  o.responseId,
+			ItemId:      item.Id,
+			OutputIndex: common.GetPointer(outputIndex),
+			CallId:      call.ID,
+			Name:        call.Function.Name,
+			Arguments:   call.Function.Arguments,
+		})
+		o.session.send(&dto.RealtimeEvent{
+			Type:        dto.RealtimeEventResponseOutputItemDone,
+			ResponseId:  o.responseId,
+			OutputIndex: common.GetPointer(outputIndex),
+			Item:        &itemCopy,
+		})
+		items = append(items, itemCopy)
+	}
+	return items
+}
+
+// relayLeg sends one leg of the session through the internal relay with the session's token. onData receives the
+// body of a successful response as it is written, without it the body is returned.
+func (s *realtimeBridgeSession) relayLeg(ctx context.Context, path string, contentType string, body io.Reader, onData func([]byte)) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", "Bearer sk-"+s.info.TokenKey)
+	req.RemoteAddr = s.c.Request.RemoteAddr
+	for _, header := range []string{"X-Forwarded-For", "X-Real-IP"} {
+		if value := s.c.Request.Header.Get(header); value != "" {
+			req.Header.Set(header, value)
+		}
+	}
+
+	writer := &realtimeBridgeWriter{header: http.Header{}, onData: onData}
+	getRealtimeBridgeEngine().ServeHTTP(writer, req)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if writer.status != http.StatusOK {
+		var errorBody struct {
+			Error dto.OpenAIError `json:"error"`
+		}
+		message := http.StatusText(writer.status)
+		if err := common.Unmarshal(writer.body.Bytes(), &errorBody); err == nil && errorBody.Error.Message != "" {
+			message = errorBody.Error.Message
+		}
+		return nil, fmt.Errorf("%s failed: %s", strings.TrimPrefix(path, "/v1/"), message)
+	}
+	return writer.body.Bytes(), nil
+}
+
+// realtimeBridgeWriter hands the body of a successful leg to onData as it is written, any other body is kept.
+type realtimeBridgeWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+	onData func([]byte)
+}
+
+func (w *realtimeBridgeWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *realtimeBridgeWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+}
+
+func (w *realtimeBridgeWriter) Write(data []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.status == http.StatusOK && w.onData != nil {
+		w.onData(data)
+		return len(data), nil
+	}
+	return w.body.Write(data)
+}
+
+func (w *realtimeBridgeWriter) Flush() {}
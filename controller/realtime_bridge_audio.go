@@ -0,0 +1,149 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// realtimeAudioSampleRate is the sample rate of a realtime audio format, pcm16 is 24kHz and the G.711 formats are 8kHz.
+func realtimeAudioSampleRate(format string) int {
+	switch format {
+	case "g711_ulaw", "g711_alaw":
+		return 8000
+	default:
+		return 24000
+	}
+}
+
+func decodeRealtimeAudio(format string, data []byte) []int16 {
+	switch format {
+	case "g711_ulaw":
+		samples := make([]int16, len(data))
+		for i, b := range data {
+			samples[i] = ulawToLinear(b)
+		}
+		return samples
+	case "g711_alaw":
+		samples := make([]int16, len(data))
+		for i, b := range data {
+			samples[i] = alawToLinear(b)
+		}
+		return samples
+	default:
+		samples := make([]int16, len(data)/2)
+		for i := range samples {
+			samples[i] = int16(binary.LittleEndian.Uint16(data[2*i:]))
+		}
+		return samples
+	}
+}
+
+// encodeRealtimeAudio encodes 24kHz pcm16 samples in the given format, the G.711 formats are downsampled to 8kHz.
+func encodeRealtimeAudio(format string, samples []int16) []byte {
+	switch format {
+	case "g711_ulaw", "g711_alaw":
+		data := make([]byte, 0, len(samples)/3)
+		for i := 0; i+3 <= len(samples); i += 3 {
+			sample := int16((int(samples[i]) + int(samples[i+1]) + int(samples[i+2])) / 3)
+			if format == "g711_ulaw" {
+				data = append(data, linearToUlaw(sample))
+			} else {
+				data = append(data, linearToAlaw(sample))
+			}
+		}
+		return data
+	default:
+		data := make([]byte, 2*len(samples))
+		for i, sample := range samples {
+			binary.LittleEndian.PutUint16(data[2*i:], uint16(sample))
+		}
+		return data
+	}
+}
+
+// pcm16Wav wraps mono pcm16 samples in a WAV container.
+func pcm16Wav(samples []int16, sampleRate int) []byte {
+	var buf bytes.Buffer
+	dataSize := uint32(2 * len(samples))
+	buf.WriteString("RIFF")
+	_ = binary.Write(&buf, binary.LittleEndian, 36+dataSize)
+	buf.WriteString("WAVEfmt ")
+	_ = binary.Write(&buf, binary.LittleEndian, []any{
+		uint32(16), uint16(1), uint16(1), uint32(sampleRate), uint32(2 * sampleRate), uint16(2), uint16(16),
+	})
+	buf.WriteString("data")
+	_ = binary.Write(&buf, binary.LittleEndian, dataSize)
+	_ = binary.Write(&buf, binary.LittleEndian, samples)
+	return buf.Bytes()
+}
+
+func ulawToLinear(u byte) int16 {
+	u = ^u
+	exponent := (u >> 4) & 0x07
+	sample := ((int(u&0x0F) << 3) + 0x84) << exponent
+	sample -= 0x84
+	if u&0x80 != 0 {
+		return int16(-sample)
+	}
+	return int16(sample)
+}
+
+func linearToUlaw(sample int16) byte {
+	value := int(sample)
+	var sign byte
+	if value < 0 {
+		value = -value
+		sign = 0x80
+	}
+	if value > 32635 {
+		value = 32635
+	}
+	value += 0x84
+	exponent := 7
+	for mask := 0x4000; value&mask == 0 && exponent > 0; mask >>= 1 {
+		exponent--
+	}
+	mantissa := (value >> (exponent + 3)) & 0x0F
+	return ^(sign | byte(exponent<<4) | byte(mantissa))
+}
+
+func alawToLinear(a byte) int16 {
+	a ^= 0x55
+	exponent := int(a>>4) & 0x07
+	sample := int(a&0x0F) << 4
+	switch exponent {
+	case 0:
+		sample += 8
+	default:
+		sample = (sample + 0x108) << (exponent - 1)
+	}
+	if a&0x80 != 0 {
+		return int16(sample)
+	}
+	return int16(-sample)
+}
+
+var alawSegmentEnds = [8]int{0x1F, 0x3F, 0x7F, 0xFF, 0x1FF, 0x3FF, 0x7FF, 0xFFF}
+
+func linearToAlaw(sample int16) byte {
+	value := int(sample) >> 3
+	mask := byte(0xD5)
+	if value < 0 {
+		mask = 0x55
+		value = -value - 1
+	}
+	segment := 0
+	for segment < 8 && value > alawSegmentEnds[segment] {
+		segment++
+	}
+	if segment >= 8 {
+		return 0x7F ^ mask
+	}
+	encoded := byte(segment << 4)
+	if segment < 2 {
+		encoded |= byte(value>>1) & 0x0F
+	} else {
+		encoded |= byte(value>>segment) & 0x0F
+	}
+	return encoded ^ mask
+}
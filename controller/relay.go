@@ -7,6 +7,7 @@ import (
 	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/QuantumNous/new-api/common"
 	"github.com/QuantumNous/new-api/constant"
@@ -20,6 +21,8 @@ import (
 	"github.com/QuantumNous/new-api/relay/helper"
 	"github.com/QuantumNous/new-api/service"
 	"github.com/QuantumNous/new-api/setting"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+	"github.com/QuantumNous/new-api/setting/ratio_setting"
 	"github.com/QuantumNous/new-api/types"
 
 	"github.com/bytedance/gopkg/util/gopool"
@@ -93,6 +96,10 @@ func Relay(c *gin.Context, relayFormat types.RelayFormat) {
 					"type":  "error",
 					"error": newAPIError.ToClaudeError(),
 				})
+			case types.RelayFormatOllama:
+				c.JSON(newAPIError.StatusCode, gin.H{
+					"error": newAPIError.Error(),
+				})
 			default:
 				c.JSON(newAPIError.StatusCode, gin.H{
 					"error": newAPIError.ToOpenAIError(),
@@ -156,37 +163,76 @@ func Relay(c *gin.Context, relayFormat types.RelayFormat) {
 		}
 	}()
 
-	for i := 0; i <= common.RetryTimes; i++ {
-		channel, err := getChannel(c, group, originalModel, i)
-		if err != nil {
-			logger.LogError(c, err.Error())
-			newAPIError = err
-			break
+	relayModels := append([]string{originalModel}, operation_setting.GetModelFallbackChain(group, originalModel)...)
+	for modelIndex, relayModel := range relayModels {
+		if modelIndex > 0 {
+			if !shouldFallback(c, relayInfo, newAPIError) {
+				break
+			}
+			if !switchToFallbackModel(c, relayInfo, originalModel, relayModel, tokens, meta) {
+				continue
+			}
 		}
 
-		addUsedChannel(c, channel.Id)
-		requestBody, _ := common.GetRequestBody(c)
-		c.Request.Body = io.NopCloser(bytes.NewBuffer(requestBody))
+		for i := 0; i <= common.RetryTimes; i++ {
+			var channel *model.Channel
+			var channelErr *types.NewAPIError
+			if modelIndex == 0 {
+				channel, channelErr = getChannel(c, group, originalModel, i)
+			} else {
+				channel, channelErr = selectChannel(c, group, relayModel, i)
+			}
+			if channelErr != nil {
+				logger.LogError(c, channelErr.Error())
+				newAPIError = channelErr
+				break
+			}
 
-		switch relayFormat {
-		case types.RelayFormatOpenAIRealtime:
-			newAPIError = relay.WssHelper(c, relayInfo)
-		case types.RelayFormatClaude:
-			newAPIError = relay.ClaudeHelper(c, relayInfo)
-		case types.RelayFormatGemini:
-			newAPIError = geminiRelayHandler(c, relayInfo)
-		default:
-			newAPIError = relayHandler(c, relayInfo)
-		}
+			addUsedChannel(c, channel.Id)
+			requestBody, _ := common.GetRequestBody(c)
+			c.Request.Body = io.NopCloser(bytes.NewBuffer(requestBody))
+			attemptStartTime := time.Now()
+
+			if shouldHedge(c, relayInfo) {
+				newAPIError = relayHedged(c, relayInfo, channel, group, relayModel, i)
+				if newAPIError == nil {
+					return
+				}
+				if !shouldRetry(c, newAPIError, common.RetryTimes-i) {
+					break
+				}
+				continue
+			}
 
-		if newAPIError == nil {
-			return
-		}
+			switch relayFormat {
+			case types.RelayFormatOpenAIRealtime:
+				if shouldBridgeRealtime(c) {
+					newAPIError = relayRealtimeBridge(c, relayInfo)
+				} else {
+					newAPIError = relay.WssHelper(c, relayInfo)
+				}
+			case types.RelayFormatClaude:
+				newAPIError = relay.ClaudeHelper(c, relayInfo)
+			case types.RelayFormatGemini:
+				newAPIError = geminiRelayHandler(c, relayInfo)
+			case types.RelayFormatOllama:
+				newAPIError = relay.OllamaHelper(c, relayInfo)
+			default:
+				newAPIError = relayHandler(c, relayInfo)
+			}
 
-		processChannelError(c, *types.NewChannelError(channel.Id, channel.Type, channel.Name, channel.ChannelInfo.IsMultiKey, common.GetContextKeyString(c, constant.ContextKeyChannelKey), channel.GetAutoBan()), newAPIError)
+			recordChannelAttempt(c, relayInfo, channel.Id, attemptStartTime, newAPIError)
 
-		if !shouldRetry(c, newAPIError, common.RetryTimes-i) {
-			break
+			if newAPIError == nil {
+				model.UpdateChannelAffinity(c, relayModel, channel.Id, common.GetContextKeyInt(c, constant.ContextKeyChannelMultiKeyIndex))
+				return
+			}
+
+			processChannelError(c, *types.NewChannelError(channel.Id, channel.Type, channel.Name, channel.ChannelInfo.IsMultiKey, common.GetContextKeyString(c, constant.ContextKeyChannelKey), channel.GetAutoBan()), newAPIError)
+
+			if !shouldRetry(c, newAPIError, common.RetryTimes-i) {
+				break
+			}
 		}
 	}
 
@@ -224,20 +270,102 @@ func getChannel(c *gin.Context, group, originalModel string, retryCount int) (*m
 			AutoBan: &autoBanInt,
 		}, nil
 	}
-	channel, selectGroup, err := model.CacheGetRandomSatisfiedChannel(c, group, originalModel, retryCount)
+	return selectChannel(c, group, originalModel, retryCount)
+}
+
+func selectChannel(c *gin.Context, group, modelName string, retryCount int) (*model.Channel, *types.NewAPIError) {
+	channel, selectGroup, err := model.CacheGetRandomSatisfiedChannel(c, group, modelName, retryCount)
 	if err != nil {
-		return nil, types.NewError(fmt.Errorf("Failed to get available channels for model %s in group %s (retry): %s", selectGroup, originalModel, err.Error()), types.ErrorCodeGetChannelFailed, types.ErrOptionWithSkipRetry())
+		return nil, types.NewError(fmt.Errorf("Failed to get available channels for model %s in group %s (retry): %s", selectGroup, modelName, err.Error()), types.ErrorCodeGetChannelFailed, types.ErrOptionWithSkipRetry())
 	}
 	if channel == nil {
-		return nil, types.NewError(fmt.Errorf("The available channels for model %s in group %s do not exist (retry)", selectGroup, originalModel), types.ErrorCodeGetChannelFailed, types.ErrOptionWithSkipRetry())
+		return nil, types.NewError(fmt.Errorf("The available channels for model %s in group %s do not exist (retry)", selectGroup, modelName), types.ErrorCodeGetChannelFailed, types.ErrOptionWithSkipRetry())
 	}
-	newAPIError := middleware.SetupContextForSelectedChannel(c, channel, originalModel)
+	newAPIError := middleware.SetupContextForSelectedChannel(c, channel, modelName)
 	if newAPIError != nil {
 		return nil, newAPIError
 	}
 	return channel, nil
 }
 
+// shouldFallback reports whether a request whose model ran out of channels may move on to the next model of its fallback chain.
+func shouldFallback(c *gin.Context, relayInfo *relaycommon.RelayInfo, err *types.NewAPIError) bool {
+	if err == nil {
+		return false
+	}
+	if _, ok := c.Get("specific_channel_id"); ok {
+		return false
+	}
+	if relayInfo.HasSendResponse() {
+		return false
+	}
+	if err.GetErrorCode() == types.ErrorCodeGetChannelFailed {
+		return true
+	}
+	return shouldRetry(c, err, 1)
+}
+
+// switchToFallbackModel points the request at the fallback model and re-prices it,
+// so that settlement bills the model that actually serves the request.
+func switchToFallbackModel(c *gin.Context, relayInfo *relaycommon.RelayInfo, originalModel string, fallbackModel string, tokens int, meta *types.TokenCountMeta) bool {
+	if !isModelAllowedForToken(c, fallbackModel) {
+		logger.LogInfo(c, fmt.Sprintf("skip fallback model %s: not allowed for this token", fallbackModel))
+		return false
+	}
+	previousModel := relayInfo.OriginModelName
+	previousPriceData := relayInfo.PriceData
+	relayInfo.OriginModelName = fallbackModel
+	if _, err := helper.ModelPriceHelper(c, relayInfo, tokens, meta); err != nil {
+		logger.LogWarn(c, fmt.Sprintf("skip fallback model %s: %s", fallbackModel, err.Error()))
+		relayInfo.OriginModelName = previousModel
+		relayInfo.PriceData = previousPriceData
+		return false
+	}
+	relayInfo.FallbackFromModel = originalModel
+	logger.LogInfo(c, fmt.Sprintf("model %s has no usable channel left, falling back to %s", previousModel, fallbackModel))
+	return true
+}
+
+// recordChannelAttempt feeds the outcome of an attempt into the channel statistics and breakers. Errors of the
+// request itself are not counted, the breaker probe the attempt may hold is given back with its channel capacity
+// whatever the outcome.
+func recordChannelAttempt(c *gin.Context, relayInfo *relaycommon.RelayInfo, channelId int, attemptStartTime time.Time, err *types.NewAPIError) {
+	if err != nil && !isChannelFailure(err) {
+		return
+	}
+	var firstToken time.Duration
+	if relayInfo.IsStream && relayInfo.FirstResponseTime.After(attemptStartTime) {
+		firstToken = relayInfo.FirstResponseTime.Sub(attemptStartTime)
+	}
+	model.RecordChannelResult(channelId, err == nil, time.Since(attemptStartTime), firstToken)
+	model.RecordChannelBreakerResult(channelId, common.GetContextKeyBool(c, constant.ContextKeyChannelIsMultiKey), common.GetContextKeyInt(c, constant.ContextKeyChannelMultiKeyIndex), err == nil)
+}
+
+// isChannelFailure reports whether the error says something about the channel's health
+// rather than about the request itself.
+func isChannelFailure(err *types.NewAPIError) bool {
+	if types.IsChannelError(err) {
+		return true
+	}
+	return err.StatusCode == http.StatusTooManyRequests || err.StatusCode/100 == 5
+}
+
+func isModelAllowedForToken(c *gin.Context, modelName string) bool {
+	if !common.GetContextKeyBool(c, constant.ContextKeyTokenModelLimitEnabled) {
+		return true
+	}
+	s, ok := common.GetContextKey(c, constant.ContextKeyTokenModelLimit)
+	if !ok {
+		return false
+	}
+	tokenModelLimit, ok := s.(map[string]bool)
+	if !ok {
+		return false
+	}
+	_, ok = tokenModelLimit[ratio_setting.FormatMatchingModelName(modelName)]
+	return ok
+}
+
 func shouldRetry(c *gin.Context, openaiErr *types.NewAPIError, retryTimes int) bool {
 	if openaiErr == nil {
 		return false
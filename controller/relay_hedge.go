@@ -0,0 +1,308 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/middleware"
+	"github.com/QuantumNous/new-api/model"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	relayconstant "github.com/QuantumNous/new-api/relay/constant"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// hedgeSelectTries is how many times the hedge tries to find a channel other than the primary one.
+const hedgeSelectTries = 3
+
+// hedgeResponseWriter buffers the response of one copy of a hedged request,
+// only the copy that wins is written to the client.
+type hedgeResponseWriter struct {
+	header      http.Header
+	body        bytes.Buffer
+	status      int
+	wroteHeader bool
+	closeNotify chan bool
+}
+
+func newHedgeResponseWriter() *hedgeResponseWriter {
+	return &hedgeResponseWriter{
+		header:      make(http.Header),
+		status:      http.StatusOK,
+		closeNotify: make(chan bool, 1),
+	}
+}
+
+func (w *hedgeResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *hedgeResponseWriter) Write(data []byte) (int, error) {
+	w.WriteHeaderNow()
+	return w.body.Write(data)
+}
+
+func (w *hedgeResponseWriter) WriteString(s string) (int, error) {
+	w.WriteHeaderNow()
+	return w.body.WriteString(s)
+}
+
+func (w *hedgeResponseWriter) WriteHeader(code int) {
+	if code > 0 && !w.wroteHeader {
+		w.status = code
+	}
+}
+
+func (w *hedgeResponseWriter) WriteHeaderNow() {
+	w.wroteHeader = true
+}
+
+func (w *hedgeResponseWriter) Status() int {
+	return w.status
+}
+
+func (w *hedgeResponseWriter) Size() int {
+	if !w.wroteHeader {
+		return -1
+	}
+	return w.body.Len()
+}
+
+func (w *hedgeResponseWriter) Written() bool {
+	return w.wroteHeader
+}
+
+func (w *hedgeResponseWriter) Flush() {}
+
+func (w *hedgeResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, errors.New("hedged response cannot be hijacked")
+}
+
+func (w *hedgeResponseWriter) CloseNotify() <-chan bool {
+	return w.closeNotify
+}
+
+func (w *hedgeResponseWriter) Pusher() http.Pusher {
+	return nil
+}
+
+// copyTo writes the buffered response to the client.
+func (w *hedgeResponseWriter) copyTo(writer gin.ResponseWriter) {
+	for key, values := range w.header {
+		for _, value := range values {
+			writer.Header().Add(key, value)
+		}
+	}
+	writer.WriteHeader(w.status)
+	_, _ = writer.Write(w.body.Bytes())
+}
+
+// hedgeAttempt is one copy of a hedged request, running on its own context, writer and relay info.
+type hedgeAttempt struct {
+	ctx     *gin.Context
+	info    *relaycommon.RelayInfo
+	writer  *hedgeResponseWriter
+	channel *model.Channel
+	start   time.Time
+	cancel  context.CancelFunc
+}
+
+type hedgeResult struct {
+	attempt *hedgeAttempt
+	err     *types.NewAPIError
+}
+
+// shouldHedge reports whether the request may be sent to a second channel when the first one is slow.
+// Only non-streaming chat and embedding requests are hedged, their responses can be held back until one copy wins.
+func shouldHedge(c *gin.Context, relayInfo *relaycommon.RelayInfo) bool {
+	hedgeSetting := operation_setting.GetHedgeSetting()
+	if !hedgeSetting.Enabled || relayInfo.IsStream {
+		return false
+	}
+	if _, ok := c.Get("specific_channel_id"); ok {
+		return false
+	}
+	switch relayInfo.RelayFormat {
+	case types.RelayFormatOpenAI:
+		if relayInfo.RelayMode != relayconstant.RelayModeChatCompletions {
+			return false
+		}
+	case types.RelayFormatEmbedding:
+	default:
+		return false
+	}
+	return operation_setting.IsHedgeEnabledForGroup(relayInfo.UsingGroup) || common.GetContextKeyBool(c, constant.ContextKeyTokenHedgeEnabled)
+}
+
+// hedgeDelay is how long the primary channel gets before the hedge starts: its observed latency quantile,
+// or the configured delay while there are too few samples.
+func hedgeDelay(channelId int) time.Duration {
+	hedgeSetting := operation_setting.GetHedgeSetting()
+	delay := time.Duration(hedgeSetting.DelayMs) * time.Millisecond
+	if latency, ok := model.GetChannelLatencyQuantile(channelId, hedgeSetting.Quantile); ok {
+		delay = latency
+	}
+	if minDelay := time.Duration(hedgeSetting.MinDelayMs) * time.Millisecond; delay < minDelay {
+		delay = minDelay
+	}
+	return delay
+}
+
+// newHedgeAttempt prepares a copy of the request that runs on its own context and response writer.
+func newHedgeAttempt(c *gin.Context, relayInfo *relaycommon.RelayInfo, hedge *relaycommon.HedgeInfo) (*hedgeAttempt, error) {
+	requestBody, err := common.GetRequestBody(c)
+	if err != nil {
+		return nil, err
+	}
+	info, err := relayInfo.CloneForHedge(hedge)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	attemptCtx := c.Copy()
+	attemptCtx.Request = c.Request.Clone(ctx)
+	attemptCtx.Request.Body = io.NopCloser(bytes.NewBuffer(requestBody))
+	writer := newHedgeResponseWriter()
+	attemptCtx.Writer = writer
+	return &hedgeAttempt{
+		ctx:    attemptCtx,
+		info:   info,
+		writer: writer,
+		cancel: cancel,
+	}, nil
+}
+
+func (a *hedgeAttempt) run(results chan<- hedgeResult, release bool) {
+	a.start = time.Now()
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				common.SysError(fmt.Sprintf("hedged request panic: %v", r))
+				results <- hedgeResult{attempt: a, err: types.NewError(fmt.Errorf("hedged request panic: %v", r), types.ErrorCodeBadResponse)}
+			}
+			if release {
+				model.ReleaseChannelCapacity(a.ctx)
+			}
+		}()
+		results <- hedgeResult{attempt: a, err: relayHandler(a.ctx, a.info)}
+	}()
+}
+
+// startHedgeAttempt selects a second channel for the request and starts it there.
+// It returns nil when no channel other than the primary one is available.
+func startHedgeAttempt(c *gin.Context, relayInfo *relaycommon.RelayInfo, hedge *relaycommon.HedgeInfo, group string, modelName string, primaryId int, retry int) *hedgeAttempt {
+	attempt, err := newHedgeAttempt(c, relayInfo, hedge)
+	if err != nil {
+		logger.LogWarn(c, "skip hedged request: "+err.Error())
+		return nil
+	}
+	// the copy must neither release the primary's capacity nor follow its channel affinity
+	common.SetContextKey(attempt.ctx, constant.ContextKeyChannelCapacityLease, nil)
+	common.SetContextKey(attempt.ctx, constant.ContextKeyChannelAffinityKey, "")
+
+	var channel *model.Channel
+	for i := 0; i < hedgeSelectTries; i++ {
+		selected, _, err := model.CacheGetRandomSatisfiedChannel(attempt.ctx, group, modelName, retry)
+		if err != nil || selected == nil {
+			break
+		}
+		if selected.Id != primaryId {
+			channel = selected
+			break
+		}
+	}
+	if channel == nil {
+		// the primary's channel may have been selected and reserved again
+		model.ReleaseChannelCapacity(attempt.ctx)
+		attempt.cancel()
+		return nil
+	}
+	if newAPIError := middleware.SetupContextForSelectedChannel(attempt.ctx, channel, modelName); newAPIError != nil {
+		logger.LogWarn(c, "skip hedged request: "+newAPIError.Error())
+		model.ReleaseChannelCapacity(attempt.ctx)
+		attempt.cancel()
+		return nil
+	}
+	attempt.channel = channel
+	return attempt
+}
+
+// relayHedged sends the request to the primary channel and, when it has not answered within the hedge delay,
+// to a second channel as well. The first successful response is written to the client and billed,
+// the other copy is cancelled.
+func relayHedged(c *gin.Context, relayInfo *relaycommon.RelayInfo, primary *model.Channel, group string, modelName string, retry int) *types.NewAPIError {
+	hedge := &relaycommon.HedgeInfo{}
+	primaryAttempt, err := newHedgeAttempt(c, relayInfo, hedge)
+	if err != nil {
+		return types.NewError(err, types.ErrorCodeReadRequestBodyFailed, types.ErrOptionWithSkipRetry())
+	}
+	primaryAttempt.channel = primary
+
+	results := make(chan hedgeResult, 2)
+	primaryAttempt.run(results, false)
+	running := 1
+
+	timer := time.NewTimer(hedgeDelay(primary.Id))
+	defer timer.Stop()
+
+	attempts := []*hedgeAttempt{primaryAttempt}
+	defer func() {
+		for _, attempt := range attempts {
+			attempt.cancel()
+		}
+	}()
+
+	var lastErr *types.NewAPIError
+	for running > 0 {
+		select {
+		case <-timer.C:
+			second := startHedgeAttempt(c, relayInfo, hedge, group, modelName, primary.Id, retry)
+			if second == nil {
+				continue
+			}
+			hedge.MarkStarted(primary.Id, second.channel.Id)
+			addUsedChannel(c, second.channel.Id)
+			logger.LogInfo(c, fmt.Sprintf("channel #%d is slow, hedging the request on channel #%d", primary.Id, second.channel.Id))
+			attempts = append(attempts, second)
+			second.run(results, true)
+			running++
+		case result := <-results:
+			running--
+			attempt := result.attempt
+			if result.err == nil && hedge.Claim(attempt.info) {
+				recordChannelAttempt(attempt.ctx, attempt.info, attempt.channel.Id, attempt.start, nil)
+				attempt.writer.copyTo(c.Writer)
+				model.UpdateChannelAffinity(c, modelName, attempt.channel.Id, common.GetContextKeyInt(attempt.ctx, constant.ContextKeyChannelMultiKeyIndex))
+				return nil
+			}
+			if result.err == nil {
+				// the other copy already claimed the request and is finishing up
+				continue
+			}
+			recordChannelAttempt(attempt.ctx, attempt.info, attempt.channel.Id, attempt.start, result.err)
+			if attempt.info.FinalPreConsumedQuota == 0 {
+				// the copy settled what it used before failing, the pre-consumed quota is not returned
+				relayInfo.FinalPreConsumedQuota = 0
+			}
+			processChannelError(attempt.ctx, *types.NewChannelError(attempt.channel.Id, attempt.channel.Type, attempt.channel.Name, common.GetContextKeyBool(attempt.ctx, constant.ContextKeyChannelIsMultiKey), common.GetContextKeyString(attempt.ctx, constant.ContextKeyChannelKey), attempt.channel.GetAutoBan()), result.err)
+			lastErr = result.err
+			if !hedge.Started() {
+				// the primary failed before the hedge was due, the relay loop retries as usual
+				return lastErr
+			}
+		}
+	}
+	return lastErr
+}
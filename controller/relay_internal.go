@@ -0,0 +1,24 @@
+package controller
+
+import (
+	"github.com/QuantumNous/new-api/middleware"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newInternalRelayEngine returns a router for requests the gateway sends on behalf of a user. It runs the same
+// token auth, channel distribution and relay as the public endpoints, so these requests are billed and logged like any other.
+func newInternalRelayEngine(endpoints map[string]types.RelayFormat, middlewares ...gin.HandlerFunc) *gin.Engine {
+	engine := gin.New()
+	engine.Use(gin.Recovery(), middleware.RequestId())
+	engine.Use(middlewares...)
+	engine.Use(middleware.TokenAuth(), middleware.Distribute())
+	for endpoint, relayFormat := range endpoints {
+		relayFormat := relayFormat
+		engine.POST(endpoint, func(c *gin.Context) {
+			Relay(c, relayFormat)
+		})
+	}
+	return engine
+}
@@ -0,0 +1,133 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/service"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const maxResponseInputItemsLimit = 100
+
+func responseNotFound(c *gin.Context, responseId string) {
+	openAiErrorMessage(c, http.StatusNotFound, fmt.Sprintf("Response with id '%s' not found.", responseId), "response_id", "response_not_found")
+}
+
+// getUserStoredResponse loads the response named in the path and writes the error response when the user cannot access it.
+func getUserStoredResponse(c *gin.Context) (*model.StoredResponse, bool) {
+	responseId := c.Param("id")
+	stored, err := model.GetUserStoredResponseById(responseId, c.GetInt("id"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			responseNotFound(c, responseId)
+		} else {
+			openAiServerError(c, err)
+		}
+		return nil, false
+	}
+	return stored, true
+}
+
+func RetrieveResponse(c *gin.Context) {
+	stored, ok := getUserStoredResponse(c)
+	if !ok {
+		return
+	}
+	var response map[string]any
+	if err := common.UnmarshalJsonStr(stored.Response, &response); err != nil {
+		openAiServerError(c, err)
+		return
+	}
+	// the upstream got the expanded conversation, the client sent the previous response id
+	if stored.PreviousResponseId != "" {
+		response["previous_response_id"] = stored.PreviousResponseId
+	}
+	response["store"] = true
+	c.JSON(http.StatusOK, response)
+}
+
+func DeleteResponse(c *gin.Context) {
+	stored, ok := getUserStoredResponse(c)
+	if !ok {
+		return
+	}
+	if err := stored.Delete(); err != nil {
+		openAiServerError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"id":      stored.Id,
+		"object":  "response",
+		"deleted": true,
+	})
+}
+
+func ListResponseInputItems(c *gin.Context) {
+	limit := 20
+	if limitStr := c.Query("limit"); limitStr != "" {
+		parsed, err := strconv.Atoi(limitStr)
+		if err != nil || parsed <= 0 || parsed > maxResponseInputItemsLimit {
+			openAiErrorMessage(c, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxResponseInputItemsLimit), "limit", "invalid_value")
+			return
+		}
+		limit = parsed
+	}
+	order := c.DefaultQuery("order", "desc")
+	if order != "asc" && order != "desc" {
+		openAiErrorMessage(c, http.StatusBadRequest, "order must be asc or desc", "order", "invalid_value")
+		return
+	}
+	stored, ok := getUserStoredResponse(c)
+	if !ok {
+		return
+	}
+	items, err := service.StoredConversationItems(stored.Id, stored.UserId, false)
+	if err != nil {
+		openAiServerError(c, err)
+		return
+	}
+	if order == "desc" {
+		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+			items[i], items[j] = items[j], items[i]
+		}
+	}
+	if after := c.Query("after"); after != "" {
+		start := -1
+		for i, item := range items {
+			if id, _ := item["id"].(string); id == after {
+				start = i + 1
+				break
+			}
+		}
+		if start < 0 {
+			openAiErrorMessage(c, http.StatusNotFound, fmt.Sprintf("Item with id '%s' not found.", after), "after", "item_not_found")
+			return
+		}
+		items = items[start:]
+	}
+	hasMore := len(items) > limit
+	if hasMore {
+		items = items[:limit]
+	}
+	list := gin.H{
+		"object":   "list",
+		"data":     items,
+		"has_more": hasMore,
+		"first_id": nil,
+		"last_id":  nil,
+	}
+	if len(items) > 0 {
+		list["first_id"] = items[0]["id"]
+		list["last_id"] = items[len(items)-1]["id"]
+	} else {
+		list["data"] = []any{}
+	}
+	c.JSON(http.StatusOK, list)
+}
@@ -0,0 +1,448 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+	"github.com/QuantumNous/new-api/setting/ratio_setting"
+	"github.com/QuantumNous/new-api/setting/system_setting"
+
+	"github.com/Calcium-Ion/go-epay/epay"
+	"github.com/gin-gonic/gin"
+	"github.com/samber/lo"
+	"github.com/stripe/stripe-go/v81"
+	"github.com/stripe/stripe-go/v81/checkout/session"
+	stripesubscription "github.com/stripe/stripe-go/v81/subscription"
+	"github.com/thanhpk/randstr"
+)
+
+type SubscriptionPayRequest struct {
+	PlanId        int    `json:"plan_id"`
+	PaymentMethod string `json:"payment_method"`
+}
+
+func validateSubscriptionPlan(plan *model.SubscriptionPlan) error {
+	plan.Name = strings.TrimSpace(plan.Name)
+	if plan.Name == "" || len(plan.Name) > 64 {
+		return errors.New("The plan name must be 1 to 64 characters.")
+	}
+	if plan.PeriodDays <= 0 {
+		return errors.New("The plan period must be at least one day.")
+	}
+	if plan.Price < 0 || plan.Quota < 0 || plan.RolloverLimit < 0 {
+		return errors.New("The price, quota and rollover limit cannot be negative.")
+	}
+	if plan.Group != "" && !ratio_setting.ContainsGroupRatio(plan.Group) {
+		return fmt.Errorf("The group %s does not exist.", plan.Group)
+	}
+	if plan.Status == 0 {
+		plan.Status = model.SubscriptionPlanStatusEnabled
+	}
+	return nil
+}
+
+func GetSubscriptionPlans(c *gin.Context) {
+	plans, err := model.GetAllSubscriptionPlans()
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, plans)
+}
+
+func CreateSubscriptionPlan(c *gin.Context) {
+	var plan model.SubscriptionPlan
+	if err := c.ShouldBindJSON(&plan); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	plan.Id = 0
+	if err := validateSubscriptionPlan(&plan); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if err := plan.Insert(); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, &plan)
+}
+
+func UpdateSubscriptionPlan(c *gin.Context) {
+	var plan model.SubscriptionPlan
+	if err := c.ShouldBindJSON(&plan); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if plan.Id == 0 {
+		common.ApiErrorMsg(c, "Missing plan ID")
+		return
+	}
+	existing, err := model.GetSubscriptionPlanById(plan.Id)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if err := validateSubscriptionPlan(&plan); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	plan.CreatedTime = existing.CreatedTime
+	if err := plan.Update(); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, &plan)
+}
+
+func DeleteSubscriptionPlan(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if err := model.DeleteSubscriptionPlanById(id); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, nil)
+}
+
+func GetAllSubscriptions(c *gin.Context) {
+	pageInfo := common.GetPageQuery(c)
+	subscriptions, total, err := model.GetAllSubscriptions(c.Query("status"), pageInfo)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	pageInfo.SetTotal(int(total))
+	pageInfo.SetItems(subscriptions)
+	common.ApiSuccess(c, pageInfo)
+}
+
+// GetEnabledSubscriptionPlans lists the plans users can subscribe to.
+func GetEnabledSubscriptionPlans(c *gin.Context) {
+	plans, err := model.GetEnabledSubscriptionPlans()
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, gin.H{
+		"plans":          plans,
+		"enable_epay":    operation_setting.PayAddress != "" && operation_setting.EpayId != "" && operation_setting.EpayKey != "",
+		"enable_stripe":  setting.StripeApiSecret != "" && setting.StripeWebhookSecret != "",
+		"epay_methods":   operation_setting.PayMethods,
+		"quota_per_unit": common.QuotaPerUnit,
+	})
+}
+
+// GetSelfSubscription returns the active subscription of the user with its plan, both are null without one.
+func GetSelfSubscription(c *gin.Context) {
+	subscription, err := model.GetUserActiveSubscription(c.GetInt("id"))
+	if err != nil {
+		common.ApiSuccess(c, gin.H{"subscription": nil, "plan": nil})
+		return
+	}
+	plan, _ := model.GetSubscriptionPlanById(subscription.PlanId)
+	common.ApiSuccess(c, gin.H{"subscription": subscription, "plan": plan})
+}
+
+func GetSelfSubscriptions(c *gin.Context) {
+	pageInfo := common.GetPageQuery(c)
+	subscriptions, total, err := model.GetUserSubscriptions(c.GetInt("id"), pageInfo)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	pageInfo.SetTotal(int(total))
+	pageInfo.SetItems(subscriptions)
+	common.ApiSuccess(c, pageInfo)
+}
+
+// getPayableSubscriptionPlan loads the plan a user pays for. The plan the user is subscribed to may be paid in
+// advance through Epay, Stripe renews by itself.
+func getPayableSubscriptionPlan(userId int, planId int, paymentMethod string) (*model.SubscriptionPlan, error) {
+	plan, err := model.GetSubscriptionPlanById(planId)
+	if err != nil || plan.Status != model.SubscriptionPlanStatusEnabled {
+		return nil, errors.New("The plan does not exist.")
+	}
+	subscription, err := model.GetUserActiveSubscription(userId)
+	if err == nil {
+		if subscription.PlanId != plan.Id {
+			return nil, errors.New("You are subscribed to another plan, cancel it and wait for it to end first.")
+		}
+		if paymentMethod == PaymentMethodStripe || subscription.StripeSubscriptionId != "" {
+			return nil, errors.New("You are already subscribed to this plan.")
+		}
+	}
+	return plan, nil
+}
+
+func RequestSubscriptionEpay(c *gin.Context) {
+	var req SubscriptionPayRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(200, gin.H{"message": "error", "data": "Parameter error"})
+		return
+	}
+	id := c.GetInt("id")
+	plan, err := getPayableSubscriptionPlan(id, req.PlanId, req.PaymentMethod)
+	if err != nil {
+		c.JSON(200, gin.H{"message": "error", "data": err.Error()})
+		return
+	}
+	if plan.Price < 0.01 {
+		c.JSON(200, gin.H{"message": "error", "data": "The plan price is too low."})
+		return
+	}
+	if !operation_setting.ContainsPayMethod(req.PaymentMethod) {
+		c.JSON(200, gin.H{"message": "error", "data": "Payment method does not exist"})
+		return
+	}
+	client := GetEpayClient()
+	if client == nil {
+		c.JSON(200, gin.H{"message": "error", "data": "The current administrator has not configured payment information."})
+		return
+	}
+
+	returnUrl, _ := url.Parse(system_setting.ServerAddress + "/console/log")
+	notifyUrl, _ := url.Parse(service.GetCallbackAddress() + "/api/subscription/epay/notify")
+	tradeNo := fmt.Sprintf("SUBUSR%dNO%s%d", id, common.GetRandomString(6), time.Now().Unix())
+	uri, params, err := client.Purchase(&epay.PurchaseArgs{
+		Type:           req.PaymentMethod,
+		ServiceTradeNo: tradeNo,
+		Name:           fmt.Sprintf("SUB%d", plan.Id),
+		Money:          strconv.FormatFloat(plan.Price, 'f', 2, 64),
+		Device:         epay.PC,
+		NotifyUrl:      notifyUrl,
+		ReturnUrl:      returnUrl,
+	})
+	if err != nil {
+		c.JSON(200, gin.H{"message": "error", "data": "Payment initiation failed"})
+		return
+	}
+	order := &model.SubscriptionOrder{
+		UserId:        id,
+		PlanId:        plan.Id,
+		TradeNo:       tradeNo,
+		PaymentMethod: req.PaymentMethod,
+		Money:         plan.Price,
+		Status:        model.SubscriptionOrderStatusPending,
+		CreateTime:    time.Now().Unix(),
+	}
+	if err = order.Insert(); err != nil {
+		c.JSON(200, gin.H{"message": "error", "data": "Order creation failed"})
+		return
+	}
+	c.JSON(200, gin.H{"message": "success", "data": params, "url": uri})
+}
+
+func SubscriptionEpayNotify(c *gin.Context) {
+	params := lo.Reduce(lo.Keys(c.Request.URL.Query()), func(r map[string]string, t string, i int) map[string]string {
+		r[t] = c.Request.URL.Query().Get(t)
+		return r
+	}, map[string]string{})
+	client := GetEpayClient()
+	if client == nil {
+		log.Println("Subscription payment callback failed. Configuration information not found.")
+		_, _ = c.Writer.Write([]byte("fail"))
+		return
+	}
+	verifyInfo, err := client.Verify(params)
+	if err != nil || !verifyInfo.VerifyStatus {
+		_, _ = c.Writer.Write([]byte("fail"))
+		log.Println("Subscription payment callback signature verification failed")
+		return
+	}
+	_, _ = c.Writer.Write([]byte("success"))
+	if verifyInfo.TradeStatus != epay.StatusTradeSuccess {
+		log.Printf("Subscription payment exception callback: %v", verifyInfo)
+		return
+	}
+
+	LockOrder(verifyInfo.ServiceTradeNo)
+	defer UnlockOrder(verifyInfo.ServiceTradeNo)
+	order := model.GetSubscriptionOrderByTradeNo(verifyInfo.ServiceTradeNo)
+	if order == nil {
+		log.Printf("Subscription payment callback: Order not found: %v", verifyInfo)
+		return
+	}
+	if order.Status != model.SubscriptionOrderStatusPending {
+		return
+	}
+	if err = model.CompleteSubscriptionOrder(order.TradeNo, "", ""); err != nil {
+		log.Printf("Subscription payment callback failed: %s, %v", err.Error(), order)
+		return
+	}
+	log.Printf("Subscription payment callback completed order %s", order.TradeNo)
+}
+
+func RequestSubscriptionStripe(c *gin.Context) {
+	var req SubscriptionPayRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(200, gin.H{"message": "error", "data": "Parameter error"})
+		return
+	}
+	id := c.GetInt("id")
+	plan, err := getPayableSubscriptionPlan(id, req.PlanId, PaymentMethodStripe)
+	if err != nil {
+		c.JSON(200, gin.H{"message": "error", "data": err.Error()})
+		return
+	}
+	if plan.StripePriceId == "" {
+		c.JSON(200, gin.H{"message": "error", "data": "The plan cannot be paid through Stripe."})
+		return
+	}
+	user, err := model.GetUserById(id, false)
+	if err != nil {
+		c.JSON(200, gin.H{"message": "error", "data": "Failed to retrieve user"})
+		return
+	}
+
+	reference := fmt.Sprintf("new-api-sub-%d-%d-%s", user.Id, time.Now().UnixMilli(), randstr.String(4))
+	referenceId := "sub_ref_" + common.Sha1([]byte(reference))
+	payLink, err := genStripeSubscriptionLink(referenceId, user.StripeCustomer, user.Email, plan.StripePriceId)
+	if err != nil {
+		log.Println("Failed to obtain Stripe subscription checkout link", err)
+		c.JSON(200, gin.H{"message": "error", "data": "Payment initiation failed"})
+		return
+	}
+	order := &model.SubscriptionOrder{
+		UserId:        id,
+		PlanId:        plan.Id,
+		TradeNo:       referenceId,
+		PaymentMethod: PaymentMethodStripe,
+		Money:         plan.Price,
+		Status:        model.SubscriptionOrderStatusPending,
+		CreateTime:    time.Now().Unix(),
+	}
+	if err = order.Insert(); err != nil {
+		c.JSON(200, gin.H{"message": "error", "data": "Order creation failed"})
+		return
+	}
+	c.JSON(200, gin.H{
+		"message": "success",
+		"data": gin.H{
+			"pay_link": payLink,
+		},
+	})
+}
+
+func genStripeSubscriptionLink(referenceId string, customerId string, email string, priceId string) (string, error) {
+	if !strings.HasPrefix(setting.StripeApiSecret, "sk_") && !strings.HasPrefix(setting.StripeApiSecret, "rk_") {
+		return "", fmt.Errorf("Invalid Stripe API key")
+	}
+	initStripeClient()
+
+	params := &stripe.CheckoutSessionParams{
+		ClientReferenceID: stripe.String(referenceId),
+		SuccessURL:        stripe.String(system_setting.ServerAddress + "/console/log"),
+		CancelURL:         stripe.String(system_setting.ServerAddress + "/topup"),
+		LineItems: []*stripe.CheckoutSessionLineItemParams{
+			{
+				Price:    stripe.String(priceId),
+				Quantity: stripe.Int64(1),
+			},
+		},
+		Mode:                stripe.String(string(stripe.CheckoutSessionModeSubscription)),
+		AllowPromotionCodes: stripe.Bool(setting.StripePromotionCodesEnabled),
+	}
+	// subscription checkouts always create a customer
+	if customerId != "" {
+		params.Customer = stripe.String(customerId)
+	} else if email != "" {
+		params.CustomerEmail = stripe.String(email)
+	}
+
+	result, err := session.New(params)
+	if err != nil {
+		return "", err
+	}
+	return result.URL, nil
+}
+
+// CancelSelfSubscription stops the renewal of the user's subscription, it stays active until its periods end.
+func CancelSelfSubscription(c *gin.Context) {
+	subscription, err := model.GetUserActiveSubscription(c.GetInt("id"))
+	if err != nil {
+		common.ApiErrorMsg(c, "You have no active subscription.")
+		return
+	}
+	if subscription.StripeSubscriptionId != "" && !subscription.CancelAtPeriodEnd {
+		initStripeClient()
+		_, err = stripesubscription.Update(subscription.StripeSubscriptionId, &stripe.SubscriptionParams{
+			CancelAtPeriodEnd: stripe.Bool(true),
+		})
+		if err != nil {
+			common.ApiError(c, err)
+			return
+		}
+	}
+	if err = model.CancelSubscriptionAtPeriodEnd(subscription); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	model.RecordLog(subscription.UserId, model.LogTypeManage, fmt.Sprintf("Subscription canceled, it ends at %s",
+		time.Unix(max(subscription.PaidUntil, subscription.NextGrantAt), 0).Format(time.DateTime)))
+	common.ApiSuccess(c, subscription)
+}
+
+func subscriptionSessionCompleted(event stripe.Event) {
+	referenceId := event.GetObjectValue("client_reference_id")
+	status := event.GetObjectValue("status")
+	if status != "complete" {
+		log.Println("Incorrect Stripe subscription checkout completion status:", status, ",", referenceId)
+		return
+	}
+	LockOrder(referenceId)
+	defer UnlockOrder(referenceId)
+	err := model.CompleteSubscriptionOrder(referenceId, event.GetObjectValue("customer"), event.GetObjectValue("subscription"))
+	if err != nil {
+		log.Println(err.Error(), referenceId)
+		return
+	}
+	log.Printf("Received subscription payment: %s", referenceId)
+}
+
+func subscriptionSessionExpired(event stripe.Event) {
+	referenceId := event.GetObjectValue("client_reference_id")
+	if err := model.ExpireSubscriptionOrder(referenceId); err != nil {
+		log.Println("Expired subscription order failed", referenceId, ", err:", err.Error())
+	}
+}
+
+// subscriptionInvoicePaid renews the subscription on the invoices of the later periods, the first invoice is
+// paid through the checkout. A failed renewal is returned so that Stripe retries the webhook.
+func subscriptionInvoicePaid(event stripe.Event) error {
+	if event.GetObjectValue("billing_reason") != "subscription_cycle" {
+		return nil
+	}
+	invoiceId := event.GetObjectValue("id")
+	LockOrder(invoiceId)
+	defer UnlockOrder(invoiceId)
+	total, _ := strconv.ParseFloat(event.GetObjectValue("amount_paid"), 64)
+	err := model.RenewStripeSubscription(event.GetObjectValue("subscription"), invoiceId, total/100)
+	if err != nil {
+		log.Println("Stripe subscription renewal failed:", err.Error(), invoiceId)
+	}
+	return err
+}
+
+func subscriptionDeleted(event stripe.Event) {
+	subscription, err := model.GetSubscriptionByStripeId(event.GetObjectValue("id"))
+	if err != nil || subscription.Status != model.SubscriptionStatusActive {
+		return
+	}
+	if err = model.CancelSubscriptionAtPeriodEnd(subscription); err != nil {
+		log.Println("Failed to cancel Stripe subscription", subscription.Id, ", err:", err.Error())
+	}
+}
@@ -1,6 +1,7 @@
 package controller
 
 import (
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
@@ -117,6 +118,14 @@ func GetTokenUsage(c *gin.Context) {
 	if expiredAt == -1 {
 		expiredAt = 0
 	}
+	budgets, err := model.GetBudgets(token.UserId, token.Id)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"code":    true,
@@ -131,6 +140,7 @@ func GetTokenUsage(c *gin.Context) {
 			"model_limits":         token.GetModelLimitsMap(),
 			"model_limits_enabled": token.ModelLimitsEnabled,
 			"expires_at":           expiredAt,
+			"budgets":              buildBudgetStatuses(budgets),
 		},
 	})
 }
@@ -171,6 +181,8 @@ func AddToken(c *gin.Context) {
 		ModelLimits:        token.ModelLimits,
 		AllowIps:           token.AllowIps,
 		Group:              token.Group,
+		HedgeEnabled:       token.HedgeEnabled,
+		McpServers:         token.McpServers,
 	}
 	err = cleanToken.Insert()
 	if err != nil {
@@ -236,6 +248,7 @@ func UpdateToken(c *gin.Context) {
 			return
 		}
 	}
+	originRemainQuota := cleanToken.RemainQuota
 	if statusOnly != "" {
 		cleanToken.Status = token.Status
 	} else {
@@ -248,8 +261,13 @@ func UpdateToken(c *gin.Context) {
 		cleanToken.ModelLimits = token.ModelLimits
 		cleanToken.AllowIps = token.AllowIps
 		cleanToken.Group = token.Group
+		cleanToken.HedgeEnabled = token.HedgeEnabled
+		cleanToken.McpServers = token.McpServers
 	}
-	err = cleanToken.Update()
+	err = cleanToken.UpdateWithQuota(cleanToken.RemainQuota-originRemainQuota, model.QuotaMovement{
+		Reason:    model.QuotaReasonTokenEdit,
+		Reference: fmt.Sprintf("user:%d", userId),
+	})
 	if err != nil {
 		common.ApiError(c, err)
 		return
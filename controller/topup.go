@@ -277,7 +277,10 @@ func EpayNotify(c *gin.Context) {
 			dAmount := decimal.NewFromInt(int64(topUp.Amount))
 			dQuotaPerUnit := decimal.NewFromFloat(common.QuotaPerUnit)
 			quotaToAdd := int(dAmount.Mul(dQuotaPerUnit).IntPart())
-			err = model.IncreaseUserQuota(topUp.UserId, quotaToAdd, true)
+			err = model.AdjustUserQuota(topUp.UserId, quotaToAdd, model.QuotaMovement{
+				Reason:    model.QuotaReasonTopUp,
+				Reference: topUp.TradeNo,
+			}, true)
 			if err != nil {
 				log.Printf("Easy payment callback failed to update user: %v", topUp)
 				return
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/QuantumNous/new-api/common"
@@ -147,9 +148,24 @@ func StripeWebhook(c *gin.Context) {
 
 	switch event.Type {
 	case stripe.EventTypeCheckoutSessionCompleted:
-		sessionCompleted(event)
+		if event.GetObjectValue("mode") == string(stripe.CheckoutSessionModeSubscription) {
+			subscriptionSessionCompleted(event)
+		} else {
+			sessionCompleted(event)
+		}
 	case stripe.EventTypeCheckoutSessionExpired:
-		sessionExpired(event)
+		if event.GetObjectValue("mode") == string(stripe.CheckoutSessionModeSubscription) {
+			subscriptionSessionExpired(event)
+		} else {
+			sessionExpired(event)
+		}
+	case stripe.EventTypeInvoicePaid:
+		if err = subscriptionInvoicePaid(event); err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	case stripe.EventTypeCustomerSubscriptionDeleted:
+		subscriptionDeleted(event)
 	default:
 		log.Printf("Unsupported Stripe Webhook event type: %s\\n", event.Type)
 	}
@@ -215,7 +231,7 @@ func genStripeLink(referenceId string, customerId string, email string, amount i
 		return "", fmt.Errorf("Invalid Stripe API key")
 	}
 
-	stripe.Key = setting.StripeApiSecret
+	initStripeClient()
 
 	params := &stripe.CheckoutSessionParams{
 		ClientReferenceID: stripe.String(referenceId),
@@ -249,6 +265,30 @@ func genStripeLink(referenceId string, customerId string, email string, amount i
 	return result.URL, nil
 }
 
+var (
+	stripeApiBase     string
+	stripeApiBaseLock sync.Mutex
+)
+
+// initStripeClient sets the key of the Stripe client and points it at StripeApiBase when one is set.
+func initStripeClient() {
+	stripe.Key = setting.StripeApiSecret
+	stripeApiBaseLock.Lock()
+	defer stripeApiBaseLock.Unlock()
+	if stripeApiBase == setting.StripeApiBase {
+		return
+	}
+	stripeApiBase = setting.StripeApiBase
+	if stripeApiBase == "" {
+		// the default backend is created again on the next call
+		stripe.SetBackend(stripe.APIBackend, nil)
+		return
+	}
+	stripe.SetBackend(stripe.APIBackend, stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{
+		URL: stripe.String(stripeApiBase),
+	}))
+}
+
 func GetChargedAmount(count float64, user model.User) float64 {
 	topUpGroupRatio := common.GetTopupGroupRatio(user.Group)
 	if topUpGroupRatio == 0 {
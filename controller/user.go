@@ -640,7 +640,11 @@ func UpdateUser(c *gin.Context) {
 		updatedUser.Password = "" 
 	}
 	updatePassword := updatedUser.Password != ""
-	if err := updatedUser.Edit(updatePassword); err != nil {
+	err = updatedUser.EditWithQuota(updatePassword, updatedUser.Quota-originUser.Quota, model.QuotaMovement{
+		Reason:    model.QuotaReasonAdmin,
+		Reference: fmt.Sprintf("admin:%d", c.GetInt("id")),
+	})
+	if err != nil {
 		common.ApiError(c, err)
 		return
 	}
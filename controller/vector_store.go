@@ -0,0 +1,639 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const maxVectorStoreListLimit = 100
+
+const (
+	defaultVectorStoreSearchResults = 10
+	maxVectorStoreSearchResults     = 50
+)
+
+var (
+	vectorStoreEngine     *gin.Engine
+	vectorStoreEngineOnce sync.Once
+)
+
+func init() {
+	service.SetVectorStoreEmbedder(embedVectorStoreInputs)
+}
+
+// getVectorStoreEngine returns the router the embedding requests of vector stores are sent through.
+func getVectorStoreEngine() *gin.Engine {
+	vectorStoreEngineOnce.Do(func() {
+		vectorStoreEngine = newInternalRelayEngine(map[string]types.RelayFormat{
+			"/v1/embeddings": types.RelayFormatEmbedding,
+		})
+	})
+	return vectorStoreEngine
+}
+
+// embedVectorStoreInputs embeds the inputs through the relay with the token of the user the vector store belongs to.
+func embedVectorStoreInputs(ctx context.Context, tokenKey string, modelName string, inputs []string) ([][]float64, error) {
+	body, err := common.Marshal(map[string]any{
+		"model":           modelName,
+		"input":           inputs,
+		"encoding_format": "float",
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/v1/embeddings", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer sk-"+tokenKey)
+	recorder := httptest.NewRecorder()
+	getVectorStoreEngine().ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusOK {
+		var errorBody struct {
+			Error dto.OpenAIError `json:"error"`
+		}
+		message := http.StatusText(recorder.Code)
+		if err := common.Unmarshal(recorder.Body.Bytes(), &errorBody); err == nil && errorBody.Error.Message != "" {
+			message = errorBody.Error.Message
+		}
+		return nil, fmt.Errorf("embedding request failed with status %d: %s", recorder.Code, message)
+	}
+	var response dto.OpenAIEmbeddingResponse
+	if err := common.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		return nil, fmt.Errorf("invalid embedding response: %w", err)
+	}
+	vectors := make([][]float64, len(inputs))
+	for _, item := range response.Data {
+		if item.Index >= 0 && item.Index < len(vectors) {
+			vectors[item.Index] = item.Embedding
+		}
+	}
+	for i, vector := range vectors {
+		if len(vector) == 0 {
+			return nil, fmt.Errorf("embedding response has no vector for input %d", i)
+		}
+	}
+	return vectors, nil
+}
+
+func vectorStoresEnabled(c *gin.Context) bool {
+	if !operation_setting.GetVectorStoreSetting().Enabled {
+		openAiErrorMessage(c, http.StatusNotFound, "Vector stores are not enabled", "", "vector_stores_disabled")
+		return false
+	}
+	return true
+}
+
+func toOpenAIVectorStore(store *model.VectorStore) (dto.OpenAIVectorStore, error) {
+	counts, err := model.CountVectorStoreFiles(store.Id)
+	if err != nil {
+		return dto.OpenAIVectorStore{}, err
+	}
+	openAIStore := dto.OpenAIVectorStore{
+		ID:         store.Id,
+		Object:     "vector_store",
+		CreatedAt:  store.CreatedAt,
+		Name:       store.Name,
+		UsageBytes: store.UsageBytes,
+		FileCounts: dto.OpenAIVectorStoreFileCounts{
+			InProgress: counts[model.VectorStoreFileStatusInProgress],
+			Completed:  counts[model.VectorStoreFileStatusCompleted],
+			Failed:     counts[model.VectorStoreFileStatusFailed],
+		},
+		Status:       model.VectorStoreStatusCompleted,
+		LastActiveAt: store.LastActiveAt,
+		Metadata:     map[string]string{},
+	}
+	for _, count := range counts {
+		openAIStore.FileCounts.Total += count
+	}
+	if openAIStore.FileCounts.InProgress > 0 {
+		openAIStore.Status = model.VectorStoreStatusInProgress
+	}
+	if store.ExpiresAfterDays > 0 {
+		openAIStore.ExpiresAfter = &dto.OpenAIVectorStoreExpiresAfter{Anchor: "last_active_at", Days: store.ExpiresAfterDays}
+		expiresAt := store.ExpiresAt
+		openAIStore.ExpiresAt = &expiresAt
+	}
+	if store.IsExpired() {
+		openAIStore.Status = model.VectorStoreStatusExpired
+	}
+	if store.Metadata != "" {
+		_ = common.UnmarshalJsonStr(store.Metadata, &openAIStore.Metadata)
+	}
+	return openAIStore, nil
+}
+
+func toOpenAIVectorStoreFile(file *model.VectorStoreFile) dto.OpenAIVectorStoreFile {
+	openAIFile := dto.OpenAIVectorStoreFile{
+		ID:            file.FileId,
+		Object:        "vector_store.file",
+		UsageBytes:    file.UsageBytes,
+		CreatedAt:     file.CreatedAt,
+		VectorStoreID: file.VectorStoreId,
+		Status:        file.Status,
+		ChunkingStrategy: dto.OpenAIVectorStoreChunkingStrategy{
+			Type: "static",
+			Static: &dto.OpenAIVectorStoreStaticChunking{
+				MaxChunkSizeTokens: file.ChunkSize,
+				ChunkOverlapTokens: file.ChunkOverlap,
+			},
+		},
+		Attributes: map[string]any{},
+	}
+	if file.LastErrorCode != "" {
+		openAIFile.LastError = &dto.OpenAIVectorStoreFileError{Code: file.LastErrorCode, Message: file.LastErrorMessage}
+	}
+	if file.Attributes != "" {
+		_ = common.UnmarshalJsonStr(file.Attributes, &openAIFile.Attributes)
+	}
+	return openAIFile
+}
+
+// getUserVectorStore loads the vector store named in the path and writes the error response when the user cannot access it.
+func getUserVectorStore(c *gin.Context) (*model.VectorStore, bool) {
+	vectorStoreId := c.Param("id")
+	store, err := model.GetUserVectorStoreById(vectorStoreId, c.GetInt("id"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			openAiErrorMessage(c, http.StatusNotFound, fmt.Sprintf("No such vector store: %s", vectorStoreId), "vector_store_id", "vector_store_not_found")
+		} else {
+			openAiServerError(c, err)
+		}
+		return nil, false
+	}
+	return store, true
+}
+
+// vectorStoreChunking reads a chunking strategy, a missing or auto strategy uses the default chunking.
+func vectorStoreChunking(strategy *dto.OpenAIVectorStoreChunkingStrategy) (int, int, error) {
+	if strategy == nil || strategy.Type == "" || strategy.Type == "auto" {
+		return service.DefaultVectorStoreChunkSize, service.DefaultVectorStoreChunkOverlap, nil
+	}
+	if strategy.Type != "static" || strategy.Static == nil {
+		return 0, 0, fmt.Errorf("unsupported chunking strategy: %s", strategy.Type)
+	}
+	size, overlap := strategy.Static.MaxChunkSizeTokens, strategy.Static.ChunkOverlapTokens
+	if size < 100 || size > 4096 {
+		return 0, 0, errors.New("max_chunk_size_tokens must be between 100 and 4096")
+	}
+	if overlap < 0 || overlap > size/2 {
+		return 0, 0, errors.New("chunk_overlap_tokens must not exceed half of max_chunk_size_tokens")
+	}
+	return size, overlap, nil
+}
+
+func vectorStoreExpiresAfterDays(expiresAfter *dto.OpenAIVectorStoreExpiresAfter) (int, error) {
+	if expiresAfter == nil {
+		return 0, nil
+	}
+	if expiresAfter.Anchor != "last_active_at" {
+		return 0, errors.New("expires_after.anchor must be last_active_at")
+	}
+	if expiresAfter.Days < 1 || expiresAfter.Days > 365 {
+		return 0, errors.New("expires_after.days must be between 1 and 365")
+	}
+	return expiresAfter.Days, nil
+}
+
+// addVectorStoreFile adds the file to the store and indexes it right away, a file that is already in the store is
+// returned as it is.
+func addVectorStoreFile(c *gin.Context, store *model.VectorStore, file *model.File, chunkSize int, chunkOverlap int, attributes string) (*model.VectorStoreFile, error) {
+	if existing, err := model.GetVectorStoreFile(store.Id, file.Id); err == nil {
+		return existing, nil
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	storeFile := &model.VectorStoreFile{
+		VectorStoreId: store.Id,
+		FileId:        file.Id,
+		Status:        model.VectorStoreFileStatusInProgress,
+		ChunkSize:     chunkSize,
+		ChunkOverlap:  chunkOverlap,
+		Attributes:    attributes,
+	}
+	if err := storeFile.Insert(); err != nil {
+		return nil, err
+	}
+	if err := service.IndexVectorStoreFile(c.Request.Context(), c.GetString("token_key"), store, storeFile, file); err != nil {
+		// the failure is reported in the status of the file
+		logger.LogWarn(c, fmt.Sprintf("failed to index file %s in vector store %s: %s", file.Id, store.Id, err.Error()))
+	}
+	return storeFile, nil
+}
+
+func CreateVectorStore(c *gin.Context) {
+	if !vectorStoresEnabled(c) {
+		return
+	}
+	var request dto.OpenAIVectorStoreRequest
+	if err := common.UnmarshalBodyReusable(c, &request); err != nil {
+		openAiErrorMessage(c, http.StatusBadRequest, "invalid request body: "+err.Error(), "", "invalid_request")
+		return
+	}
+	chunkSize, chunkOverlap, err := vectorStoreChunking(request.ChunkingStrategy)
+	if err != nil {
+		openAiErrorMessage(c, http.StatusBadRequest, err.Error(), "chunking_strategy", "invalid_value")
+		return
+	}
+	expiresAfterDays, err := vectorStoreExpiresAfterDays(request.ExpiresAfter)
+	if err != nil {
+		openAiErrorMessage(c, http.StatusBadRequest, err.Error(), "expires_after", "invalid_value")
+		return
+	}
+	userId := c.GetInt("id")
+	files := make([]*model.File, 0, len(request.FileIds))
+	for _, fileId := range request.FileIds {
+		file, err := model.GetUserFileById(fileId, userId)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				fileNotFound(c, fileId)
+			} else {
+				openAiServerError(c, err)
+			}
+			return
+		}
+		files = append(files, file)
+	}
+	var metadata string
+	if len(request.Metadata) > 0 {
+		metadataBytes, err := common.Marshal(request.Metadata)
+		if err != nil {
+			openAiErrorMessage(c, http.StatusBadRequest, "invalid metadata: "+err.Error(), "metadata", "invalid_value")
+			return
+		}
+		metadata = string(metadataBytes)
+	}
+	store := &model.VectorStore{
+		Id:               model.NewVectorStoreId(),
+		UserId:           userId,
+		TokenId:          c.GetInt("token_id"),
+		Name:             request.Name,
+		Metadata:         metadata,
+		EmbeddingModel:   operation_setting.GetVectorStoreSetting().EmbeddingModel,
+		ExpiresAfterDays: expiresAfterDays,
+	}
+	if err := store.Insert(); err != nil {
+		openAiServerError(c, err)
+		return
+	}
+	for _, file := range files {
+		if _, err := addVectorStoreFile(c, store, file, chunkSize, chunkOverlap, ""); err != nil {
+			openAiServerError(c, err)
+			return
+		}
+	}
+	respondVectorStore(c, store.Id)
+}
+
+// respondVectorStore writes the store as it is in the database, after its files changed the usage did as well.
+func respondVectorStore(c *gin.Context, vectorStoreId string) {
+	store, err := model.GetUserVectorStoreById(vectorStoreId, c.GetInt("id"))
+	if err != nil {
+		openAiServerError(c, err)
+		return
+	}
+	openAIStore, err := toOpenAIVectorStore(store)
+	if err != nil {
+		openAiServerError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, openAIStore)
+}
+
+func ListVectorStores(c *gin.Context) {
+	if !vectorStoresEnabled(c) {
+		return
+	}
+	limit, ascending, ok := vectorStoreListParams(c)
+	if !ok {
+		return
+	}
+	stores, err := model.GetUserVectorStores(c.GetInt("id"), c.Query("after"), limit+1, ascending)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			openAiErrorMessage(c, http.StatusNotFound, fmt.Sprintf("No such vector store: %s", c.Query("after")), "after", "vector_store_not_found")
+			return
+		}
+		openAiServerError(c, err)
+		return
+	}
+	list := dto.OpenAIVectorStoreList{
+		Object:  "list",
+		Data:    make([]dto.OpenAIVectorStore, 0, len(stores)),
+		HasMore: len(stores) > limit,
+	}
+	if list.HasMore {
+		stores = stores[:limit]
+	}
+	for _, store := range stores {
+		openAIStore, err := toOpenAIVectorStore(store)
+		if err != nil {
+			openAiServerError(c, err)
+			return
+		}
+		list.Data = append(list.Data, openAIStore)
+	}
+	if len(list.Data) > 0 {
+		list.FirstID = list.Data[0].ID
+		list.LastID = list.Data[len(list.Data)-1].ID
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+func vectorStoreListParams(c *gin.Context) (int, bool, bool) {
+	limit := 20
+	if limitStr := c.Query("limit"); limitStr != "" {
+		parsed, err := strconv.Atoi(limitStr)
+		if err != nil || parsed <= 0 {
+			openAiErrorMessage(c, http.StatusBadRequest, "limit must be a positive integer", "limit", "invalid_value")
+			return 0, false, false
+		}
+		limit = min(parsed, maxVectorStoreListLimit)
+	}
+	order := c.DefaultQuery("order", "desc")
+	if order != "asc" && order != "desc" {
+		openAiErrorMessage(c, http.StatusBadRequest, "order must be asc or desc", "order", "invalid_value")
+		return 0, false, false
+	}
+	return limit, order == "asc", true
+}
+
+func RetrieveVectorStore(c *gin.Context) {
+	if !vectorStoresEnabled(c) {
+		return
+	}
+	store, ok := getUserVectorStore(c)
+	if !ok {
+		return
+	}
+	respondVectorStore(c, store.Id)
+}
+
+func ModifyVectorStore(c *gin.Context) {
+	if !vectorStoresEnabled(c) {
+		return
+	}
+	store, ok := getUserVectorStore(c)
+	if !ok {
+		return
+	}
+	var request struct {
+		Name         *string                            `json:"name"`
+		ExpiresAfter *dto.OpenAIVectorStoreExpiresAfter `json:"expires_after"`
+		Metadata     map[string]string                  `json:"metadata"`
+	}
+	if err := common.UnmarshalBodyReusable(c, &request); err != nil {
+		openAiErrorMessage(c, http.StatusBadRequest, "invalid request body: "+err.Error(), "", "invalid_request")
+		return
+	}
+	if request.Name != nil {
+		store.Name = *request.Name
+	}
+	if request.ExpiresAfter != nil {
+		expiresAfterDays, err := vectorStoreExpiresAfterDays(request.ExpiresAfter)
+		if err != nil {
+			openAiErrorMessage(c, http.StatusBadRequest, err.Error(), "expires_after", "invalid_value")
+			return
+		}
+		store.ExpiresAfterDays = expiresAfterDays
+	}
+	if request.Metadata != nil {
+		metadataBytes, err := common.Marshal(request.Metadata)
+		if err != nil {
+			openAiErrorMessage(c, http.StatusBadRequest, "invalid metadata: "+err.Error(), "metadata", "invalid_value")
+			return
+		}
+		store.Metadata = string(metadataBytes)
+	}
+	if err := store.Update(); err != nil {
+		openAiServerError(c, err)
+		return
+	}
+	respondVectorStore(c, store.Id)
+}
+
+func DeleteVectorStore(c *gin.Context) {
+	if !vectorStoresEnabled(c) {
+		return
+	}
+	store, ok := getUserVectorStore(c)
+	if !ok {
+		return
+	}
+	if err := store.Delete(); err != nil {
+		openAiServerError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, dto.OpenAIFileDeleted{
+		ID:      store.Id,
+		Object:  "vector_store.deleted",
+		Deleted: true,
+	})
+}
+
+func CreateVectorStoreFile(c *gin.Context) {
+	if !vectorStoresEnabled(c) {
+		return
+	}
+	store, ok := getUserVectorStore(c)
+	if !ok {
+		return
+	}
+	if store.IsExpired() {
+		openAiErrorMessage(c, http.StatusBadRequest, fmt.Sprintf("Vector store %s is expired", store.Id), "vector_store_id", "vector_store_expired")
+		return
+	}
+	var request dto.OpenAIVectorStoreFileRequest
+	if err := common.UnmarshalBodyReusable(c, &request); err != nil {
+		openAiErrorMessage(c, http.StatusBadRequest, "invalid request body: "+err.Error(), "", "invalid_request")
+		return
+	}
+	chunkSize, chunkOverlap, err := vectorStoreChunking(request.ChunkingStrategy)
+	if err != nil {
+		openAiErrorMessage(c, http.StatusBadRequest, err.Error(), "chunking_strategy", "invalid_value")
+		return
+	}
+	file, err := model.GetUserFileById(request.FileId, c.GetInt("id"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			fileNotFound(c, request.FileId)
+		} else {
+			openAiServerError(c, err)
+		}
+		return
+	}
+	var attributes string
+	if len(request.Attributes) > 0 {
+		attributesBytes, err := common.Marshal(request.Attributes)
+		if err != nil {
+			openAiErrorMessage(c, http.StatusBadRequest, "invalid attributes: "+err.Error(), "attributes", "invalid_value")
+			return
+		}
+		attributes = string(attributesBytes)
+	}
+	storeFile, err := addVectorStoreFile(c, store, file, chunkSize, chunkOverlap, attributes)
+	if err != nil {
+		openAiServerError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, toOpenAIVectorStoreFile(storeFile))
+}
+
+// getVectorStoreFile loads the file named in the path from the store and writes the error response when it is not there.
+func getVectorStoreFile(c *gin.Context, store *model.VectorStore) (*model.VectorStoreFile, bool) {
+	fileId := c.Param("file_id")
+	storeFile, err := model.GetVectorStoreFile(store.Id, fileId)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			openAiErrorMessage(c, http.StatusNotFound, fmt.Sprintf("No such vector store file: %s", fileId), "file_id", "file_not_found")
+		} else {
+			openAiServerError(c, err)
+		}
+		return nil, false
+	}
+	return storeFile, true
+}
+
+func ListVectorStoreFiles(c *gin.Context) {
+	if !vectorStoresEnabled(c) {
+		return
+	}
+	store, ok := getUserVectorStore(c)
+	if !ok {
+		return
+	}
+	limit, ascending, ok := vectorStoreListParams(c)
+	if !ok {
+		return
+	}
+	files, err := model.GetVectorStoreFiles(store.Id, c.Query("filter"), c.Query("after"), limit+1, ascending)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			openAiErrorMessage(c, http.StatusNotFound, fmt.Sprintf("No such vector store file: %s", c.Query("after")), "after", "file_not_found")
+			return
+		}
+		openAiServerError(c, err)
+		return
+	}
+	list := dto.OpenAIVectorStoreFileList{
+		Object:  "list",
+		Data:    make([]dto.OpenAIVectorStoreFile, 0, len(files)),
+		HasMore: len(files) > limit,
+	}
+	if list.HasMore {
+		files = files[:limit]
+	}
+	for _, file := range files {
+		list.Data = append(list.Data, toOpenAIVectorStoreFile(file))
+	}
+	if len(list.Data) > 0 {
+		list.FirstID = list.Data[0].ID
+		list.LastID = list.Data[len(list.Data)-1].ID
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+func RetrieveVectorStoreFile(c *gin.Context) {
+	if !vectorStoresEnabled(c) {
+		return
+	}
+	store, ok := getUserVectorStore(c)
+	if !ok {
+		return
+	}
+	storeFile, ok := getVectorStoreFile(c, store)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, toOpenAIVectorStoreFile(storeFile))
+}
+
+// DeleteVectorStoreFile takes the file out of the store, the file itself stays in the Files API.
+func DeleteVectorStoreFile(c *gin.Context) {
+	if !vectorStoresEnabled(c) {
+		return
+	}
+	store, ok := getUserVectorStore(c)
+	if !ok {
+		return
+	}
+	storeFile, ok := getVectorStoreFile(c, store)
+	if !ok {
+		return
+	}
+	if err := model.RemoveVectorStoreFile(storeFile); err != nil {
+		openAiServerError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, dto.OpenAIFileDeleted{
+		ID:      storeFile.FileId,
+		Object:  "vector_store.file.deleted",
+		Deleted: true,
+	})
+}
+
+func SearchVectorStore(c *gin.Context) {
+	if !vectorStoresEnabled(c) {
+		return
+	}
+	store, ok := getUserVectorStore(c)
+	if !ok {
+		return
+	}
+	if store.IsExpired() {
+		openAiErrorMessage(c, http.StatusBadRequest, fmt.Sprintf("Vector store %s is expired", store.Id), "vector_store_id", "vector_store_expired")
+		return
+	}
+	var request dto.OpenAIVectorStoreSearchRequest
+	if err := common.UnmarshalBodyReusable(c, &request); err != nil {
+		openAiErrorMessage(c, http.StatusBadRequest, "invalid request body: "+err.Error(), "", "invalid_request")
+		return
+	}
+	queries, err := service.VectorStoreSearchQueries(request.Query)
+	if err != nil {
+		openAiErrorMessage(c, http.StatusBadRequest, err.Error(), "query", "invalid_value")
+		return
+	}
+	maxResults := defaultVectorStoreSearchResults
+	if request.MaxNumResults != 0 {
+		if request.MaxNumResults < 1 || request.MaxNumResults > maxVectorStoreSearchResults {
+			openAiErrorMessage(c, http.StatusBadRequest, fmt.Sprintf("max_num_results must be between 1 and %d", maxVectorStoreSearchResults), "max_num_results", "invalid_value")
+			return
+		}
+		maxResults = request.MaxNumResults
+	}
+	var scoreThreshold float64
+	if request.RankingOptions != nil {
+		scoreThreshold = request.RankingOptions.ScoreThreshold
+	}
+	hits, err := service.SearchVectorStores(c.Request.Context(), c.GetString("token_key"), []*model.VectorStore{store}, queries, maxResults, scoreThreshold)
+	if err != nil {
+		openAiServerError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, dto.OpenAIVectorStoreSearchPage{
+		Object:      "vector_store.search_results.page",
+		SearchQuery: queries,
+		Data:        service.VectorStoreSearchResults(hits, c.GetInt("id")),
+	})
+}
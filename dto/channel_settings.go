@@ -7,6 +7,20 @@ type ChannelSettings struct {
 	PassThroughBodyEnabled bool   `json:"pass_through_body_enabled,omitempty"`
 	SystemPrompt           string `json:"system_prompt,omitempty"`
 	SystemPromptOverride   bool   `json:"system_prompt_override,omitempty"`
+	// capacity limits of the whole channel, 0 means unlimited
+	MaxConcurrency int `json:"max_concurrency,omitempty"`
+	RPMLimit       int `json:"rpm_limit,omitempty"`
+	TPMLimit       int `json:"tpm_limit,omitempty"`
+	// capacity limits applied to each key of a multi-key channel, 0 means unlimited
+	KeyMaxConcurrency int `json:"key_max_concurrency,omitempty"`
+	KeyRPMLimit       int `json:"key_rpm_limit,omitempty"`
+	KeyTPMLimit       int `json:"key_tpm_limit,omitempty"`
+	// prompt for json_schema and json_object response formats instead of sending them, for upstreams that ignore them
+	StructuredOutputEmulation bool `json:"structured_output_emulation,omitempty"`
+	// re-prompts with the validation errors when an emulated answer does not match the schema
+	StructuredOutputMaxRepairs int `json:"structured_output_max_repairs,omitempty"`
+	// "force" or "disable" prompt-based tool calls, empty follows the channel types of the tool call emulation setting
+	ToolCallEmulation string `json:"tool_call_emulation,omitempty"`
 }
 
 type VertexKeyType string
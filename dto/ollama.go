@@ -0,0 +1,101 @@
+package dto
+
+import "encoding/json"
+
+// Ollama API as served to clients, the upstream side lives in relay/channel/ollama.
+
+type OllamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	Thinking  string           `json:"thinking,omitempty"`
+	Images    []string         `json:"images,omitempty"`
+	ToolCalls []OllamaToolCall `json:"tool_calls,omitempty"`
+	ToolName  string           `json:"tool_name,omitempty"`
+}
+
+type OllamaToolCall struct {
+	Function OllamaToolCallFunction `json:"function"`
+}
+
+type OllamaToolCallFunction struct {
+	Index     *int   `json:"index,omitempty"`
+	Name      string `json:"name"`
+	Arguments any    `json:"arguments"`
+}
+
+type OllamaChatRequest struct {
+	Model    string            `json:"model"`
+	Messages []OllamaMessage   `json:"messages"`
+	Tools    []ToolCallRequest `json:"tools,omitempty"`
+	Format   json.RawMessage   `json:"format,omitempty"`
+	Options  map[string]any    `json:"options,omitempty"`
+	// streaming is the default of the Ollama API
+	Stream    *bool           `json:"stream,omitempty"`
+	KeepAlive any             `json:"keep_alive,omitempty"`
+	Think     json.RawMessage `json:"think,omitempty"`
+}
+
+type OllamaGenerateRequest struct {
+	Model     string          `json:"model"`
+	Prompt    string          `json:"prompt"`
+	Suffix    string          `json:"suffix,omitempty"`
+	System    string          `json:"system,omitempty"`
+	Images    []string        `json:"images,omitempty"`
+	Format    json.RawMessage `json:"format,omitempty"`
+	Options   map[string]any  `json:"options,omitempty"`
+	Stream    *bool           `json:"stream,omitempty"`
+	Raw       bool            `json:"raw,omitempty"`
+	KeepAlive any             `json:"keep_alive,omitempty"`
+	Think     json.RawMessage `json:"think,omitempty"`
+}
+
+type OllamaEmbedRequest struct {
+	Model      string         `json:"model"`
+	Input      any            `json:"input"`
+	Truncate   *bool          `json:"truncate,omitempty"`
+	Options    map[string]any `json:"options,omitempty"`
+	KeepAlive  any            `json:"keep_alive,omitempty"`
+	Dimensions int            `json:"dimensions,omitempty"`
+}
+
+type OllamaChatResponse struct {
+	Model              string         `json:"model"`
+	CreatedAt          string         `json:"created_at"`
+	Message            *OllamaMessage `json:"message,omitempty"`
+	Response           *string        `json:"response,omitempty"`
+	Thinking           string         `json:"thinking,omitempty"`
+	Done               bool           `json:"done"`
+	DoneReason         string         `json:"done_reason,omitempty"`
+	TotalDuration      int64          `json:"total_duration,omitempty"`
+	LoadDuration       int64          `json:"load_duration,omitempty"`
+	PromptEvalCount    int            `json:"prompt_eval_count,omitempty"`
+	PromptEvalDuration int64          `json:"prompt_eval_duration,omitempty"`
+	EvalCount          int            `json:"eval_count,omitempty"`
+	EvalDuration       int64          `json:"eval_duration,omitempty"`
+}
+
+type OllamaEmbedResponse struct {
+	Model           string      `json:"model"`
+	Embeddings      [][]float64 `json:"embeddings"`
+	TotalDuration   int64       `json:"total_duration,omitempty"`
+	LoadDuration    int64       `json:"load_duration,omitempty"`
+	PromptEvalCount int         `json:"prompt_eval_count,omitempty"`
+}
+
+type OllamaModel struct {
+	Name       string             `json:"name"`
+	Model      string             `json:"model"`
+	ModifiedAt string             `json:"modified_at"`
+	Size       int64              `json:"size"`
+	Digest     string             `json:"digest"`
+	Details    OllamaModelDetails `json:"details"`
+}
+
+type OllamaModelDetails struct {
+	ParentModel       string   `json:"parent_model"`
+	Format            string   `json:"format"`
+	Family            string   `json:"family"`
+	Families          []string `json:"families"`
+	ParameterSize     string   `json:"parameter_size"`
+	QuantizationLevel string   `json:"quantization_level"`
+}
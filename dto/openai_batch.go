@@ -0,0 +1,81 @@
+package dto
+
+import "encoding/json"
+
+type OpenAIBatchRequest struct {
+	InputFileId      string            `json:"input_file_id"`
+	Endpoint         string            `json:"endpoint"`
+	CompletionWindow string            `json:"completion_window"`
+	Metadata         map[string]string `json:"metadata,omitempty"`
+}
+
+type OpenAIBatchError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Param   string `json:"param,omitempty"`
+	Line    int    `json:"line,omitempty"`
+}
+
+type OpenAIBatchErrors struct {
+	Object string             `json:"object"`
+	Data   []OpenAIBatchError `json:"data"`
+}
+
+type OpenAIBatchRequestCounts struct {
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+}
+
+type OpenAIBatch struct {
+	ID               string                   `json:"id"`
+	Object           string                   `json:"object"`
+	Endpoint         string                   `json:"endpoint"`
+	Errors           *OpenAIBatchErrors       `json:"errors"`
+	InputFileID      string                   `json:"input_file_id"`
+	CompletionWindow string                   `json:"completion_window"`
+	Status           string                   `json:"status"`
+	OutputFileID     string                   `json:"output_file_id,omitempty"`
+	ErrorFileID      string                   `json:"error_file_id,omitempty"`
+	CreatedAt        int64                    `json:"created_at"`
+	InProgressAt     int64                    `json:"in_progress_at,omitempty"`
+	ExpiresAt        int64                    `json:"expires_at,omitempty"`
+	FinalizingAt     int64                    `json:"finalizing_at,omitempty"`
+	CompletedAt      int64                    `json:"completed_at,omitempty"`
+	FailedAt         int64                    `json:"failed_at,omitempty"`
+	ExpiredAt        int64                    `json:"expired_at,omitempty"`
+	CancellingAt     int64                    `json:"cancelling_at,omitempty"`
+	CancelledAt      int64                    `json:"cancelled_at,omitempty"`
+	RequestCounts    OpenAIBatchRequestCounts `json:"request_counts"`
+	Metadata         map[string]string        `json:"metadata"`
+}
+
+type OpenAIBatchList struct {
+	Object  string        `json:"object"`
+	Data    []OpenAIBatch `json:"data"`
+	FirstID string        `json:"first_id,omitempty"`
+	LastID  string        `json:"last_id,omitempty"`
+	HasMore bool          `json:"has_more"`
+}
+
+// OpenAIBatchInputLine is one request of a batch input file.
+type OpenAIBatchInputLine struct {
+	CustomId string          `json:"custom_id"`
+	Method   string          `json:"method"`
+	Url      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// OpenAIBatchOutputLine is one result of a batch output or error file.
+type OpenAIBatchOutputLine struct {
+	ID       string                   `json:"id"`
+	CustomId string                   `json:"custom_id"`
+	Response *OpenAIBatchLineResponse `json:"response"`
+	Error    *OpenAIBatchError        `json:"error"`
+}
+
+type OpenAIBatchLineResponse struct {
+	StatusCode int             `json:"status_code"`
+	RequestId  string          `json:"request_id"`
+	Body       json.RawMessage `json:"body"`
+}
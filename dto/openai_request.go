@@ -236,6 +236,9 @@ type ToolCallRequest struct {
 	ID       string          `json:"id,omitempty"`
 	Type     string          `json:"type"`
 	Function FunctionRequest `json:"function"`
+	// a tool of type mcp names an MCP server registered in the gateway, the relay resolves its tools
+	ServerLabel  string   `json:"server_label,omitempty"`
+	AllowedTools []string `json:"allowed_tools,omitempty"`
 }
 
 type FunctionRequest struct {
@@ -336,6 +336,12 @@ type ResponsesOutput struct {
 	Content []ResponsesOutputContent `json:"content"`
 	Quality string                   `json:"quality"`
 	Size    string                   `json:"size"`
+	// function_call items
+	CallId    string `json:"call_id,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments,omitempty"`
+	// reasoning items
+	Summary []ResponsesOutputContent `json:"summary,omitempty"`
 }
 
 type ResponsesOutputContent struct {
@@ -360,10 +366,18 @@ const (
 
 
 type ResponsesStreamResponse struct {
-	Type     string                   `json:"type"`
-	Response *OpenAIResponsesResponse `json:"response,omitempty"`
-	Delta    string                   `json:"delta,omitempty"`
-	Item     *ResponsesOutput         `json:"item,omitempty"`
+	Type           string                   `json:"type"`
+	SequenceNumber int                      `json:"sequence_number"`
+	Response       *OpenAIResponsesResponse `json:"response,omitempty"`
+	OutputIndex    *int                     `json:"output_index,omitempty"`
+	ContentIndex   *int                     `json:"content_index,omitempty"`
+	SummaryIndex   *int                     `json:"summary_index,omitempty"`
+	ItemId         string                   `json:"item_id,omitempty"`
+	Delta          string                   `json:"delta,omitempty"`
+	Text           string                   `json:"text,omitempty"`
+	Arguments      string                   `json:"arguments,omitempty"`
+	Part           *ResponsesOutputContent  `json:"part,omitempty"`
+	Item           *ResponsesOutput         `json:"item,omitempty"`
 }
 
 
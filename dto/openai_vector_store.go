@@ -0,0 +1,121 @@
+package dto
+
+import "encoding/json"
+
+type OpenAIVectorStoreExpiresAfter struct {
+	Anchor string `json:"anchor"`
+	Days   int    `json:"days"`
+}
+
+type OpenAIVectorStoreStaticChunking struct {
+	MaxChunkSizeTokens int `json:"max_chunk_size_tokens"`
+	ChunkOverlapTokens int `json:"chunk_overlap_tokens"`
+}
+
+type OpenAIVectorStoreChunkingStrategy struct {
+	Type   string                           `json:"type"`
+	Static *OpenAIVectorStoreStaticChunking `json:"static,omitempty"`
+}
+
+type OpenAIVectorStoreRequest struct {
+	Name             string                             `json:"name"`
+	FileIds          []string                           `json:"file_ids,omitempty"`
+	ExpiresAfter     *OpenAIVectorStoreExpiresAfter     `json:"expires_after,omitempty"`
+	ChunkingStrategy *OpenAIVectorStoreChunkingStrategy `json:"chunking_strategy,omitempty"`
+	Metadata         map[string]string                  `json:"metadata,omitempty"`
+}
+
+type OpenAIVectorStoreFileCounts struct {
+	InProgress int `json:"in_progress"`
+	Completed  int `json:"completed"`
+	Failed     int `json:"failed"`
+	Cancelled  int `json:"cancelled"`
+	Total      int `json:"total"`
+}
+
+type OpenAIVectorStore struct {
+	ID           string                         `json:"id"`
+	Object       string                         `json:"object"`
+	CreatedAt    int64                          `json:"created_at"`
+	Name         string                         `json:"name"`
+	UsageBytes   int64                          `json:"usage_bytes"`
+	FileCounts   OpenAIVectorStoreFileCounts    `json:"file_counts"`
+	Status       string                         `json:"status"`
+	ExpiresAfter *OpenAIVectorStoreExpiresAfter `json:"expires_after"`
+	ExpiresAt    *int64                         `json:"expires_at"`
+	LastActiveAt int64                          `json:"last_active_at"`
+	Metadata     map[string]string              `json:"metadata"`
+}
+
+type OpenAIVectorStoreList struct {
+	Object  string              `json:"object"`
+	Data    []OpenAIVectorStore `json:"data"`
+	FirstID string              `json:"first_id,omitempty"`
+	LastID  string              `json:"last_id,omitempty"`
+	HasMore bool                `json:"has_more"`
+}
+
+type OpenAIVectorStoreFileRequest struct {
+	FileId           string                             `json:"file_id"`
+	ChunkingStrategy *OpenAIVectorStoreChunkingStrategy `json:"chunking_strategy,omitempty"`
+	Attributes       map[string]any                     `json:"attributes,omitempty"`
+}
+
+type OpenAIVectorStoreFileError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type OpenAIVectorStoreFile struct {
+	ID               string                            `json:"id"`
+	Object           string                            `json:"object"`
+	UsageBytes       int64                             `json:"usage_bytes"`
+	CreatedAt        int64                             `json:"created_at"`
+	VectorStoreID    string                            `json:"vector_store_id"`
+	Status           string                            `json:"status"`
+	LastError        *OpenAIVectorStoreFileError       `json:"last_error"`
+	ChunkingStrategy OpenAIVectorStoreChunkingStrategy `json:"chunking_strategy"`
+	Attributes       map[string]any                    `json:"attributes"`
+}
+
+type OpenAIVectorStoreFileList struct {
+	Object  string                  `json:"object"`
+	Data    []OpenAIVectorStoreFile `json:"data"`
+	FirstID string                  `json:"first_id,omitempty"`
+	LastID  string                  `json:"last_id,omitempty"`
+	HasMore bool                    `json:"has_more"`
+}
+
+type OpenAIVectorStoreRankingOptions struct {
+	Ranker         string  `json:"ranker,omitempty"`
+	ScoreThreshold float64 `json:"score_threshold,omitempty"`
+}
+
+type OpenAIVectorStoreSearchRequest struct {
+	// a string or a list of strings
+	Query          json.RawMessage                  `json:"query"`
+	MaxNumResults  int                              `json:"max_num_results,omitempty"`
+	RankingOptions *OpenAIVectorStoreRankingOptions `json:"ranking_options,omitempty"`
+	RewriteQuery   bool                             `json:"rewrite_query,omitempty"`
+}
+
+type OpenAIVectorStoreSearchContent struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type OpenAIVectorStoreSearchResult struct {
+	FileID     string                           `json:"file_id"`
+	Filename   string                           `json:"filename"`
+	Score      float64                          `json:"score"`
+	Attributes map[string]any                   `json:"attributes"`
+	Content    []OpenAIVectorStoreSearchContent `json:"content"`
+}
+
+type OpenAIVectorStoreSearchPage struct {
+	Object      string                          `json:"object"`
+	SearchQuery []string                        `json:"search_query"`
+	Data        []OpenAIVectorStoreSearchResult `json:"data"`
+	HasMore     bool                            `json:"has_more"`
+	NextPage    *string                         `json:"next_page"`
+}
@@ -84,6 +84,8 @@ func main() {
 		}()
 
 		go model.SyncChannelCache(common.SyncFrequency)
+	} else {
+		model.InitChannelCache()
 	}
 
 	
@@ -110,6 +112,17 @@ func main() {
 			controller.UpdateTaskBulk()
 		})
 	}
+	if common.IsMasterNode {
+		gopool.Go(func() {
+			controller.RunBatchWorker()
+		})
+		gopool.Go(func() {
+			model.RunStoredResponseCleanup()
+		})
+		gopool.Go(func() {
+			model.RunSubscriptionScheduler()
+		})
+	}
 	if os.Getenv("BATCH_UPDATE_ENABLED") == "true" {
 		common.BatchUpdateEnabled = true
 		common.SysLog("batch update enabled with interval " + strconv.Itoa(common.BatchUpdateInterval) + "s")
@@ -0,0 +1,122 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+
+	"github.com/gin-gonic/gin"
+)
+
+// affinityRequest holds the request fields that can identify a conversation,
+// across the OpenAI, Responses, Claude and Gemini request formats.
+type affinityRequest struct {
+	User              string            `json:"user"`
+	PromptCacheKey    string            `json:"prompt_cache_key"`
+	Metadata          json.RawMessage   `json:"metadata"`
+	System            json.RawMessage   `json:"system"`
+	Instructions      json.RawMessage   `json:"instructions"`
+	SystemInstruction json.RawMessage   `json:"systemInstruction"`
+	Messages          []json.RawMessage `json:"messages"`
+	Contents          []json.RawMessage `json:"contents"`
+	Input             json.RawMessage   `json:"input"`
+}
+
+// setupChannelAffinityKey derives the stable key used to pin the request to a channel and key,
+// trying the configured sources in order. Requests without any usable source are routed normally.
+func setupChannelAffinityKey(c *gin.Context, group string) {
+	if !operation_setting.IsChannelAffinityEnabled(group) {
+		return
+	}
+	affinitySetting := operation_setting.GetChannelAffinitySetting()
+	userId := common.GetContextKeyInt(c, constant.ContextKeyUserId)
+
+	var request *affinityRequest
+	getRequest := func() *affinityRequest {
+		if request == nil {
+			request = &affinityRequest{}
+			if !strings.HasPrefix(c.Request.Header.Get("Content-Type"), "application/json") {
+				return request
+			}
+			if err := common.UnmarshalBodyReusable(c, request); err != nil {
+				request = &affinityRequest{}
+			}
+		}
+		return request
+	}
+
+	for _, source := range affinitySetting.KeySources {
+		var key string
+		switch source {
+		case operation_setting.ChannelAffinitySourceHeader:
+			if affinitySetting.HeaderName == "" {
+				continue
+			}
+			if value := c.Request.Header.Get(affinitySetting.HeaderName); value != "" {
+				key = fmt.Sprintf("session:%d:%s", userId, value)
+			}
+		case operation_setting.ChannelAffinitySourceUser:
+			if value := getRequest().affinityUser(); value != "" {
+				key = fmt.Sprintf("user:%d:%s", userId, value)
+			}
+		case operation_setting.ChannelAffinitySourcePrompt:
+			if prefix := getRequest().promptPrefix(affinitySetting.PromptMessages); len(prefix) > 0 {
+				key = "prompt:" + common.Sha1(prefix)
+			}
+		}
+		if key != "" {
+			common.SetContextKey(c, constant.ContextKeyChannelAffinityKey, common.Sha1([]byte(key)))
+			return
+		}
+	}
+}
+
+func (r *affinityRequest) affinityUser() string {
+	if r.PromptCacheKey != "" {
+		return r.PromptCacheKey
+	}
+	if r.User != "" {
+		return r.User
+	}
+	if len(r.Metadata) > 0 {
+		var metadata struct {
+			UserId string `json:"user_id"`
+		}
+		if err := common.Unmarshal(r.Metadata, &metadata); err == nil {
+			return metadata.UserId
+		}
+	}
+	return ""
+}
+
+// promptPrefix concatenates the system prompt and the first messages, the part of a conversation
+// that stays the same from turn to turn and that upstream prompt caches key on.
+func (r *affinityRequest) promptPrefix(messageCount int) []byte {
+	if messageCount <= 0 {
+		messageCount = 1
+	}
+	var prefix []byte
+	for _, system := range []json.RawMessage{r.System, r.Instructions, r.SystemInstruction} {
+		prefix = append(prefix, system...)
+	}
+	messages := r.Messages
+	if len(messages) == 0 {
+		messages = r.Contents
+	}
+	if len(messages) == 0 && len(r.Input) > 0 {
+		var inputItems []json.RawMessage
+		if err := common.Unmarshal(r.Input, &inputItems); err == nil {
+			messages = inputItems
+		} else {
+			messages = []json.RawMessage{r.Input}
+		}
+	}
+	for i := 0; i < len(messages) && i < messageCount; i++ {
+		prefix = append(prefix, messages[i]...)
+	}
+	return prefix
+}
@@ -97,6 +97,7 @@ func Distribute() func(c *gin.Context) {
 						userGroup = playgroundRequest.Group
 					}
 				}
+				setupChannelAffinityKey(c, userGroup)
 				channel, selectGroup, err = model.CacheGetRandomSatisfiedChannel(c, userGroup, modelRequest.Model, 0)
 				if err != nil {
 					showGroup := userGroup
@@ -119,8 +120,23 @@ func Distribute() func(c *gin.Context) {
 			}
 		}
 		common.SetContextKey(c, constant.ContextKeyRequestStartTime, time.Now())
-		SetupContextForSelectedChannel(c, channel, modelRequest.Model)
+		if newAPIError := SetupContextForSelectedChannel(c, channel, modelRequest.Model); newAPIError != nil && channel != nil {
+			model.ReleaseChannelCapacity(c)
+			abortWithOpenAiMessage(c, newAPIError.StatusCode, newAPIError.Error(), string(newAPIError.GetErrorCode()))
+			return
+		}
 		c.Next()
+		model.ReleaseChannelCapacity(c)
+	}
+}
+
+// DistributeWithoutReservation routes like Distribute for requests that do not call the model, e.g. token counting,
+// they take neither the capacity nor the breaker probes of the channel they are routed to.
+func DistributeWithoutReservation() func(c *gin.Context) {
+	distribute := Distribute()
+	return func(c *gin.Context) {
+		common.SetContextKey(c, constant.ContextKeyChannelNoReservation, true)
+		distribute(c)
 	}
 }
 
@@ -297,7 +313,7 @@ func SetupContextForSelectedChannel(c *gin.Context, channel *model.Channel, mode
 	common.SetContextKey(c, constant.ContextKeyChannelModelMapping, channel.GetModelMapping())
 	common.SetContextKey(c, constant.ContextKeyChannelStatusCodeMapping, channel.GetStatusCodeMapping())
 
-	key, index, newAPIError := channel.GetNextEnabledKey()
+	key, index, newAPIError := model.GetChannelKeyForRequest(c, channel)
 	if newAPIError != nil {
 		return newAPIError
 	}
@@ -309,6 +325,7 @@ func SetupContextForSelectedChannel(c *gin.Context, channel *model.Channel, mode
 		common.SetContextKey(c, constant.ContextKeyChannelIsMultiKey, false)
 	}
 	
+	model.AcquireChannelCapacity(c, channel, index)
 	common.SetContextKey(c, constant.ContextKeyChannelKey, key)
 	common.SetContextKey(c, constant.ContextKeyChannelBaseUrl, channel.GetBaseURL())
 
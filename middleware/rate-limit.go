@@ -112,3 +112,7 @@ func DownloadRateLimit() func(c *gin.Context) {
 func UploadRateLimit() func(c *gin.Context) {
 	return rateLimitFactory(common.UploadRateLimitNum, common.UploadRateLimitDuration, "UP")
 }
+
+func CountTokensRateLimit() func(c *gin.Context) {
+	return rateLimitFactory(common.CountTokensRateLimitNum, common.CountTokensRateLimitDuration, "CN")
+}
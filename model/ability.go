@@ -3,10 +3,12 @@ package model
 import (
 	"errors"
 	"fmt"
+	"slices"
 	"strings"
 	"sync"
 
 	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
 
 	"github.com/samber/lo"
 	"gorm.io/gorm"
@@ -103,13 +105,14 @@ func getChannelQuery(group string, model string, retry int) (*gorm.DB, error) {
 	return channelQuery, nil
 }
 
-func GetRandomSatisfiedChannel(group string, model string, retry int) (*Channel, error) {
+// GetRandomSatisfiedChannel picks a channel of the group for the model and, when reserve is set, reserves its capacity.
+func GetRandomSatisfiedChannel(group string, model string, retry int, reserve bool) (*Channel, *channelCapacityLease, error) {
 	var abilities []Ability
 
 	var err error = nil
 	channelQuery, err := getChannelQuery(group, model, retry)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if common.UsingSQLite || common.UsingPostgreSQL {
 		err = channelQuery.Order("weight DESC").Find(&abilities).Error
@@ -117,30 +120,95 @@ func GetRandomSatisfiedChannel(group string, model string, retry int) (*Channel,
 		err = channelQuery.Order("weight DESC").Find(&abilities).Error
 	}
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	channel := Channel{}
+	var lease *channelCapacityLease
+	abilities = filterSaturatedAbilities(abilities)
 	if len(abilities) > 0 {
-		
-		weightSum := uint(0)
-		for _, ability_ := range abilities {
-			weightSum += ability_.Weight + 10
+		abilities = filterAbilitiesByBreaker(abilities)
+		smoothingFactor := operation_setting.GetChannelSelectSetting().SmoothingFactor
+		if smoothingFactor < 0 {
+			smoothingFactor = 0
 		}
-		
-		weight := common.GetRandomInt(int(weightSum))
-		for _, ability_ := range abilities {
-			weight -= int(ability_.Weight) + 10
-			
-			if weight <= 0 {
-				channel.Id = ability_.ChannelId
-				break
+		channelIds := make([]int, len(abilities))
+		weights := make([]float64, len(abilities))
+		for i, ability_ := range abilities {
+			channelIds[i] = ability_.ChannelId
+			weights[i] = float64(int(ability_.Weight) + smoothingFactor)
+		}
+		if operation_setting.IsAdaptiveChannelSelectEnabled(group) {
+			weights = adaptiveChannelWeights(channelIds, weights)
+		}
+		for lease == nil && len(abilities) > 0 {
+			idx := pickWeightedChannel(weights)
+			if idx < 0 {
+				idx = common.GetRandomInt(len(abilities))
 			}
+			channel.Id = abilities[idx].ChannelId
+			lease, _ = reserveSelectedChannel(channel.Id, reserve)
+			// another request took the last of its capacity since the channel was filtered
+			abilities = slices.Delete(abilities, idx, idx+1)
+			weights = slices.Delete(weights, idx, idx+1)
+		}
+		if lease == nil {
+			return nil, nil, nil
 		}
 	} else {
-		return nil, nil
+		return nil, nil, nil
+	}
+	if err = DB.First(&channel, "id = ?", channel.Id).Error; err != nil {
+		lease.release()
+		return nil, nil, err
+	}
+	return &channel, lease, nil
+}
+
+func filterAbilitiesByBreaker(abilities []Ability) []Ability {
+	channelIds := make([]int, len(abilities))
+	for i, ability_ := range abilities {
+		channelIds[i] = ability_.ChannelId
+	}
+	available := filterChannelsByBreaker(channelIds)
+	if len(available) == len(abilities) {
+		return abilities
+	}
+	availableSet := make(map[int]bool, len(available))
+	for _, id := range available {
+		availableSet[id] = true
+	}
+	filtered := make([]Ability, 0, len(available))
+	for _, ability_ := range abilities {
+		if availableSet[ability_.ChannelId] {
+			filtered = append(filtered, ability_)
+		}
+	}
+	return filtered
+}
+
+func filterSaturatedAbilities(abilities []Ability) []Ability {
+	if len(abilities) == 0 {
+		return abilities
+	}
+	channelIds := make([]int, len(abilities))
+	for i, ability_ := range abilities {
+		channelIds[i] = ability_.ChannelId
+	}
+	available := filterSaturatedChannels(channelIds)
+	if len(available) == len(abilities) {
+		return abilities
+	}
+	availableSet := make(map[int]bool, len(available))
+	for _, id := range available {
+		availableSet[id] = true
+	}
+	filtered := make([]Ability, 0, len(available))
+	for _, ability_ := range abilities {
+		if availableSet[ability_.ChannelId] {
+			filtered = append(filtered, ability_)
+		}
 	}
-	err = DB.First(&channel, "id = ?", channel.Id).Error
-	return &channel, err
+	return filtered
 }
 
 func (channel *Channel) AddAbilities(tx *gorm.DB) error {
@@ -0,0 +1,125 @@
+package model
+
+import (
+	"errors"
+
+	"github.com/QuantumNous/new-api/common"
+)
+
+const (
+	BatchStatusValidating = "validating"
+	BatchStatusFailed     = "failed"
+	BatchStatusInProgress = "in_progress"
+	BatchStatusFinalizing = "finalizing"
+	BatchStatusCompleted  = "completed"
+	BatchStatusExpired    = "expired"
+	BatchStatusCancelling = "cancelling"
+	BatchStatusCancelled  = "cancelled"
+)
+
+// Batch is a Batch API job, its requests are run by the gateway's batch worker. They are sent from ClientIp,
+// the address the batch was created from, so that the IP restrictions of the token apply to them.
+type Batch struct {
+	Id               string `json:"id" gorm:"type:varchar(64);primaryKey"`
+	UserId           int    `json:"-" gorm:"index"`
+	TokenId          int    `json:"-" gorm:"index"`
+	ClientIp         string `json:"-" gorm:"type:varchar(64)"`
+	Endpoint         string `json:"endpoint" gorm:"type:varchar(64)"`
+	InputFileId      string `json:"input_file_id" gorm:"type:varchar(64)"`
+	CompletionWindow string `json:"completion_window" gorm:"type:varchar(16)"`
+	Status           string `json:"status" gorm:"type:varchar(32);index"`
+	OutputFileId     string `json:"output_file_id" gorm:"type:varchar(64)"`
+	ErrorFileId      string `json:"error_file_id" gorm:"type:varchar(64)"`
+	// errors that failed the whole batch, e.g. invalid lines of the input file, as a JSON list
+	Errors         string `json:"errors" gorm:"type:text"`
+	Metadata       string `json:"metadata" gorm:"type:text"`
+	TotalCount     int    `json:"total_count"`
+	CompletedCount int    `json:"completed_count"`
+	FailedCount    int    `json:"failed_count"`
+	CreatedAt      int64  `json:"created_at" gorm:"bigint;index"`
+	InProgressAt   int64  `json:"in_progress_at" gorm:"bigint"`
+	ExpiresAt      int64  `json:"expires_at" gorm:"bigint"`
+	FinalizingAt   int64  `json:"finalizing_at" gorm:"bigint"`
+	CompletedAt    int64  `json:"completed_at" gorm:"bigint"`
+	FailedAt       int64  `json:"failed_at" gorm:"bigint"`
+	ExpiredAt      int64  `json:"expired_at" gorm:"bigint"`
+	CancellingAt   int64  `json:"cancelling_at" gorm:"bigint"`
+	CancelledAt    int64  `json:"cancelled_at" gorm:"bigint"`
+}
+
+func NewBatchId() string {
+	return "batch_" + common.GetRandomString(24)
+}
+
+func (batch *Batch) Insert() error {
+	if batch.CreatedAt == 0 {
+		batch.CreatedAt = common.GetTimestamp()
+	}
+	return DB.Create(batch).Error
+}
+
+func GetUserBatchById(id string, userId int) (*Batch, error) {
+	if id == "" {
+		return nil, errors.New("batch id is empty")
+	}
+	var batch Batch
+	err := DB.Where("id = ? and user_id = ?", id, userId).First(&batch).Error
+	if err != nil {
+		return nil, err
+	}
+	return &batch, nil
+}
+
+func GetBatchById(id string) (*Batch, error) {
+	var batch Batch
+	err := DB.Where("id = ?", id).First(&batch).Error
+	if err != nil {
+		return nil, err
+	}
+	return &batch, nil
+}
+
+// GetUserBatches lists the user's batches, newest first, starting after the batch with id after.
+func GetUserBatches(userId int, after string, limit int) ([]*Batch, error) {
+	var batches []*Batch
+	tx := DB.Where("user_id = ?", userId)
+	if after != "" {
+		cursor, err := GetUserBatchById(after, userId)
+		if err != nil {
+			return nil, err
+		}
+		tx = tx.Where("created_at < ? or (created_at = ? and id < ?)", cursor.CreatedAt, cursor.CreatedAt, cursor.Id)
+	}
+	err := tx.Order("created_at desc, id desc").Limit(limit).Find(&batches).Error
+	return batches, err
+}
+
+func GetBatchesByStatus(statuses []string, limit int) ([]*Batch, error) {
+	var batches []*Batch
+	err := DB.Where("status in ?", statuses).Order("created_at asc").Limit(limit).Find(&batches).Error
+	return batches, err
+}
+
+// TransitionBatchStatus moves the batch from one of the given statuses to the new one,
+// it returns false when the batch is no longer in any of them.
+func TransitionBatchStatus(id string, from []string, to string, fields map[string]any) (bool, error) {
+	updates := map[string]any{"status": to}
+	for key, value := range fields {
+		updates[key] = value
+	}
+	result := DB.Model(&Batch{}).Where("id = ? and status in ?", id, from).Updates(updates)
+	return result.RowsAffected > 0, result.Error
+}
+
+func UpdateBatchProgress(id string, completed int, failed int) error {
+	return DB.Model(&Batch{}).Where("id = ?", id).Updates(map[string]any{
+		"completed_count": completed,
+		"failed_count":    failed,
+	}).Error
+}
+
+func GetBatchStatus(id string) (string, error) {
+	var status string
+	err := DB.Model(&Batch{}).Where("id = ?", id).Select("status").Scan(&status).Error
+	return status, err
+}
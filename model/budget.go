@@ -0,0 +1,203 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+
+	"gorm.io/gorm"
+)
+
+const (
+	BudgetPeriodDay   = "day"
+	BudgetPeriodWeek  = "week"
+	BudgetPeriodMonth = "month"
+)
+
+var BudgetPeriods = []string{BudgetPeriodDay, BudgetPeriodWeek, BudgetPeriodMonth}
+
+// Budget caps the quota a token, or all tokens of a user when TokenId is 0, may spend in a day, a week or a
+// month. Used counts the spending of the window started at WindowStart, it starts over in the next window.
+type Budget struct {
+	Id          int    `json:"id"`
+	UserId      int    `json:"user_id" gorm:"uniqueIndex:idx_budget_subject"`
+	TokenId     int    `json:"token_id" gorm:"uniqueIndex:idx_budget_subject"`
+	Period      string `json:"period" gorm:"type:varchar(16);uniqueIndex:idx_budget_subject"`
+	Quota       int    `json:"quota"`
+	Used        int    `json:"used" gorm:"default:0"`
+	WindowStart int64  `json:"window_start" gorm:"bigint"`
+	CreatedTime int64  `json:"created_time" gorm:"bigint"`
+	UpdatedTime int64  `json:"updated_time" gorm:"bigint"`
+}
+
+// BudgetWindowStart returns the start of the window of the period that t falls in, weeks start on Monday.
+func BudgetWindowStart(period string, t time.Time) time.Time {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	switch period {
+	case BudgetPeriodWeek:
+		return midnight.AddDate(0, 0, -(int(midnight.Weekday())+6)%7)
+	case BudgetPeriodMonth:
+		return midnight.AddDate(0, 0, 1-midnight.Day())
+	default:
+		return midnight
+	}
+}
+
+func budgetWindowEnd(period string, start time.Time) time.Time {
+	switch period {
+	case BudgetPeriodWeek:
+		return start.AddDate(0, 0, 7)
+	case BudgetPeriodMonth:
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+func IsValidBudgetPeriod(period string) bool {
+	return common.StringsContains(BudgetPeriods, period)
+}
+
+// refresh starts the current window when the stored one is over, the row itself is reset on the next spending.
+func (budget *Budget) refresh(now time.Time) {
+	windowStart := BudgetWindowStart(budget.Period, now).Unix()
+	if budget.WindowStart != windowStart {
+		budget.WindowStart = windowStart
+		budget.Used = 0
+	}
+}
+
+func (budget *Budget) Remaining() int {
+	return max(budget.Quota-budget.Used, 0)
+}
+
+// ResetAt returns when the current window ends.
+func (budget *Budget) ResetAt() int64 {
+	return budgetWindowEnd(budget.Period, time.Unix(budget.WindowStart, 0)).Unix()
+}
+
+func (budget *Budget) Subject() string {
+	if budget.TokenId == 0 {
+		return "user"
+	}
+	return "token"
+}
+
+// GetBudgets returns the budgets a request of the token is checked against, the budgets of the token and those
+// of its user, in their current windows.
+func GetBudgets(userId int, tokenId int) ([]*Budget, error) {
+	var budgets []*Budget
+	err := DB.Where("user_id = ? AND token_id IN ?", userId, []int{0, tokenId}).Order("token_id desc, id asc").Find(&budgets).Error
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, budget := range budgets {
+		budget.refresh(now)
+	}
+	return budgets, nil
+}
+
+// GetSubjectBudgets returns the budgets of the token, or the user-wide budgets when tokenId is 0.
+func GetSubjectBudgets(userId int, tokenId int) ([]*Budget, error) {
+	var budgets []*Budget
+	err := DB.Where("user_id = ? AND token_id = ?", userId, tokenId).Order("id asc").Find(&budgets).Error
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, budget := range budgets {
+		budget.refresh(now)
+	}
+	return budgets, nil
+}
+
+// SetBudgets sets the quota of each period of the token, or of the user when tokenId is 0. A quota of 0 removes
+// the budget of the period, the spending of a kept budget is left as it is.
+func SetBudgets(userId int, tokenId int, quotas map[string]int) error {
+	now := common.GetTimestamp()
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		for period, quota := range quotas {
+			if !IsValidBudgetPeriod(period) {
+				return fmt.Errorf("invalid budget period %s", period)
+			}
+			if quota < 0 {
+				return errors.New("budget quota cannot be negative")
+			}
+			query := tx.Where("user_id = ? AND token_id = ? AND period = ?", userId, tokenId, period)
+			if quota == 0 {
+				if err := query.Delete(&Budget{}).Error; err != nil {
+					return err
+				}
+				continue
+			}
+			var budget Budget
+			err := query.First(&budget).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				budget = Budget{
+					UserId:      userId,
+					TokenId:     tokenId,
+					Period:      period,
+					Quota:       quota,
+					WindowStart: BudgetWindowStart(period, time.Now()).Unix(),
+					CreatedTime: now,
+					UpdatedTime: now,
+				}
+				if err = tx.Create(&budget).Error; err != nil {
+					return err
+				}
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			err = tx.Model(&budget).Updates(map[string]interface{}{"quota": quota, "updated_time": now}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return invalidateBudgetCache(userId, tokenId)
+}
+
+func DeleteTokenBudgets(tokenIds []int) error {
+	if len(tokenIds) == 0 {
+		return nil
+	}
+	return DB.Where("token_id IN ?", tokenIds).Delete(&Budget{}).Error
+}
+
+// AddBudgetUsage counts quota spent, or refunded when negative, by the token against its budgets and those of its
+// user. Windows that are over are started again first.
+func AddBudgetUsage(userId int, tokenId int, quota int) error {
+	if quota == 0 {
+		return nil
+	}
+	now := time.Now()
+	windowStart := gorm.Expr("CASE period WHEN ? THEN ? WHEN ? THEN ? ELSE ? END",
+		BudgetPeriodDay, BudgetWindowStart(BudgetPeriodDay, now).Unix(),
+		BudgetPeriodWeek, BudgetWindowStart(BudgetPeriodWeek, now).Unix(),
+		BudgetWindowStart(BudgetPeriodMonth, now).Unix())
+	subject := DB.Model(&Budget{}).Where("user_id = ? AND token_id IN ?", userId, []int{0, tokenId}).Session(&gorm.Session{})
+	err := subject.Where("window_start <> ?", windowStart).
+		Updates(map[string]interface{}{"used": 0, "window_start": windowStart}).Error
+	if err != nil {
+		return err
+	}
+	err = subject.Update("used", gorm.Expr("CASE WHEN used + ? < 0 THEN 0 ELSE used + ? END", quota, quota)).Error
+	if err != nil || !common.RedisEnabled {
+		return err
+	}
+	// the cache is written through, the next check of the subject sees the spending without a query
+	budgets, err := GetBudgets(userId, tokenId)
+	if err != nil {
+		return err
+	}
+	return updateBudgetCache(userId, tokenId, budgets)
+}
@@ -0,0 +1,89 @@
+package model
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+
+	"github.com/bytedance/gopkg/util/gopool"
+)
+
+// The budgets of a token and those of its user are cached apart, a user-wide budget is shared by all tokens.
+func getBudgetCacheKey(userId int, tokenId int) string {
+	return fmt.Sprintf("budgets:%d:%d", userId, tokenId)
+}
+
+func invalidateBudgetCache(userId int, tokenId int) error {
+	if !common.RedisEnabled {
+		return nil
+	}
+	return common.RedisDelKey(getBudgetCacheKey(userId, tokenId))
+}
+
+// updateBudgetCache stores the budgets returned by GetBudgets, the subjects without budgets are cached as well.
+func updateBudgetCache(userId int, tokenId int, budgets []*Budget) error {
+	if !common.RedisEnabled {
+		return nil
+	}
+	subjects := map[int][]*Budget{0: {}, tokenId: {}}
+	for _, budget := range budgets {
+		subjects[budget.TokenId] = append(subjects[budget.TokenId], budget)
+	}
+	for subject, subjectBudgets := range subjects {
+		data, err := common.Marshal(subjectBudgets)
+		if err != nil {
+			return err
+		}
+		err = common.RedisSet(getBudgetCacheKey(userId, subject), string(data), time.Duration(common.RedisKeyCacheSeconds())*time.Second)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cacheGetSubjectBudgets(userId int, tokenId int) ([]*Budget, error) {
+	data, err := common.RedisGet(getBudgetCacheKey(userId, tokenId))
+	if err != nil {
+		return nil, err
+	}
+	var budgets []*Budget
+	if err = common.UnmarshalJsonStr(data, &budgets); err != nil {
+		return nil, err
+	}
+	return budgets, nil
+}
+
+// GetBudgetsCache is GetBudgets read through the cache, the relay checks the budgets of every request.
+func GetBudgetsCache(userId int, tokenId int) ([]*Budget, error) {
+	if !common.RedisEnabled {
+		return GetBudgets(userId, tokenId)
+	}
+	var (
+		tokenBudgets []*Budget
+		tokenErr     error
+	)
+	if tokenId != 0 {
+		tokenBudgets, tokenErr = cacheGetSubjectBudgets(userId, tokenId)
+	}
+	userBudgets, userErr := cacheGetSubjectBudgets(userId, 0)
+	if tokenErr != nil || userErr != nil {
+		budgets, err := GetBudgets(userId, tokenId)
+		if err != nil {
+			return nil, err
+		}
+		gopool.Go(func() {
+			if err := updateBudgetCache(userId, tokenId, budgets); err != nil {
+				common.SysLog("failed to update budget cache: " + err.Error())
+			}
+		})
+		return budgets, nil
+	}
+	budgets := append(tokenBudgets, userBudgets...)
+	now := time.Now()
+	for _, budget := range budgets {
+		budget.refresh(now)
+	}
+	return budgets, nil
+}
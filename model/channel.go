@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"net/http"
 	"strings"
 	"sync"
 
@@ -103,6 +104,11 @@ func (channel *Channel) GetKeys() []string {
 }
 
 func (channel *Channel) GetNextEnabledKey() (string, int, *types.NewAPIError) {
+	return channel.getNextEnabledKey(true)
+}
+
+// getNextEnabledKey picks a key of the channel and, when reserve is set, reserves its capacity.
+func (channel *Channel) getNextEnabledKey(reserve bool) (string, int, *types.NewAPIError) {
 	
 	if !channel.ChannelInfo.IsMultiKey {
 		return channel.Key, 0, nil
@@ -143,11 +149,46 @@ func (channel *Channel) GetNextEnabledKey() (string, int, *types.NewAPIError) {
 		return keys[0], 0, nil
 	}
 
+	reserveKey := func(idx int) bool {
+		return !reserve || reserveChannelKeyCapacity(channel, idx)
+	}
+	saturatedIdx := make(map[int]bool)
+	for _, idx := range enabledIdx {
+		if isChannelKeySaturated(channel, idx) {
+			saturatedIdx[idx] = true
+		}
+	}
+	if len(saturatedIdx) == len(enabledIdx) {
+		return "", 0, channelKeysSaturatedError(channel)
+	} else if len(saturatedIdx) > 0 {
+		enabledIdx = lo.Filter(enabledIdx, func(idx int, _ int) bool {
+			return !saturatedIdx[idx]
+		})
+	}
+
+	breakerOpenIdx := make(map[int]bool)
+	for _, idx := range enabledIdx {
+		if !isChannelBreakerAvailable(channel.Id, idx) {
+			breakerOpenIdx[idx] = true
+		}
+	}
+	if len(breakerOpenIdx) == len(enabledIdx) {
+		// every key is tripped, keep serving rather than failing the request
+		breakerOpenIdx = map[int]bool{}
+	} else if len(breakerOpenIdx) > 0 {
+		enabledIdx = lo.Filter(enabledIdx, func(idx int, _ int) bool {
+			return !breakerOpenIdx[idx]
+		})
+	}
+
 	switch channel.ChannelInfo.MultiKeyMode {
 	case constant.MultiKeyModeRandom:
 		
-		selectedIdx := enabledIdx[rand.Intn(len(enabledIdx))]
-		return keys[selectedIdx], selectedIdx, nil
+		for _, pos := range rand.Perm(len(enabledIdx)) {
+			if selectedIdx := enabledIdx[pos]; reserveKey(selectedIdx) {
+				return keys[selectedIdx], selectedIdx, nil
+			}
+		}
 	case constant.MultiKeyModePolling:
 		
 
@@ -173,18 +214,42 @@ func (channel *Channel) GetNextEnabledKey() (string, int, *types.NewAPIError) {
 		}
 		for i := 0; i < len(keys); i++ {
 			idx := (start + i) % len(keys)
-			if getStatus(idx) == common.ChannelStatusEnabled {
+			if getStatus(idx) == common.ChannelStatusEnabled && !breakerOpenIdx[idx] && !saturatedIdx[idx] && reserveKey(idx) {
 				
 				channel.ChannelInfo.MultiKeyPollingIndex = (idx + 1) % len(keys)
 				return keys[idx], idx, nil
 			}
 		}
-		
-		return keys[enabledIdx[0]], enabledIdx[0], nil
-	default:
-		
-		return keys[enabledIdx[0]], enabledIdx[0], nil
 	}
+	// the first enabled key whose capacity can be taken, keys filled by racing requests are passed over
+	for _, idx := range enabledIdx {
+		if reserveKey(idx) {
+			return keys[idx], idx, nil
+		}
+	}
+	return "", 0, channelKeysSaturatedError(channel)
+}
+
+func channelKeysSaturatedError(channel *Channel) *types.NewAPIError {
+	return types.NewErrorWithStatusCode(fmt.Errorf("every key of channel #%d is at its capacity limit", channel.Id), types.ErrorCodeChannelNoAvailableKey, http.StatusTooManyRequests)
+}
+
+// getEnabledKeyAt returns the key at idx when it is enabled, below its capacity limits and its breaker lets requests through.
+func (channel *Channel) getEnabledKeyAt(idx int, reserve bool) (string, bool) {
+	keys := channel.GetKeys()
+	if idx < 0 || idx >= len(keys) {
+		return "", false
+	}
+	lock := GetChannelPollingLock(channel.Id)
+	lock.Lock()
+	defer lock.Unlock()
+	if status, ok := channel.ChannelInfo.MultiKeyStatusList[idx]; ok && status != common.ChannelStatusEnabled {
+		return "", false
+	}
+	if !isChannelBreakerAvailable(channel.Id, idx) || (reserve && !reserveChannelKeyCapacity(channel, idx)) {
+		return "", false
+	}
+	return keys[idx], true
 }
 
 func (channel *Channel) SaveChannelInfo() error {
@@ -0,0 +1,199 @@
+package model
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+	"github.com/QuantumNous/new-api/setting/ratio_setting"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/bytedance/gopkg/util/gopool"
+	"github.com/gin-gonic/gin"
+)
+
+// ChannelAffinityTarget is the channel and key a stable request key is pinned to.
+type ChannelAffinityTarget struct {
+	ChannelId int
+	KeyIndex  int
+}
+
+type channelAffinityEntry struct {
+	Target   ChannelAffinityTarget
+	ExpireAt time.Time
+}
+
+var (
+	channelAffinityStore       = make(map[string]channelAffinityEntry)
+	channelAffinityLock        sync.Mutex
+	channelAffinityCleanupOnce sync.Once
+)
+
+func channelAffinityTTL() time.Duration {
+	seconds := operation_setting.GetChannelAffinitySetting().TTLSeconds
+	if seconds <= 0 {
+		seconds = 3600
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func channelAffinityStoreKey(affinityKey string, modelName string) string {
+	return fmt.Sprintf("channel_affinity:%s:%s", modelName, affinityKey)
+}
+
+func startChannelAffinityCleanupTask() {
+	gopool.Go(func() {
+		for {
+			time.Sleep(time.Minute)
+			now := time.Now()
+			channelAffinityLock.Lock()
+			for key, entry := range channelAffinityStore {
+				if now.After(entry.ExpireAt) {
+					delete(channelAffinityStore, key)
+				}
+			}
+			channelAffinityLock.Unlock()
+		}
+	})
+}
+
+func getChannelAffinity(key string) (ChannelAffinityTarget, bool) {
+	if common.RedisEnabled {
+		value, err := common.RedisGet(key)
+		if err != nil || value == "" {
+			return ChannelAffinityTarget{}, false
+		}
+		parts := strings.Split(value, ":")
+		if len(parts) != 2 {
+			return ChannelAffinityTarget{}, false
+		}
+		channelId, err1 := strconv.Atoi(parts[0])
+		keyIndex, err2 := strconv.Atoi(parts[1])
+		if err1 != nil || err2 != nil {
+			return ChannelAffinityTarget{}, false
+		}
+		return ChannelAffinityTarget{ChannelId: channelId, KeyIndex: keyIndex}, true
+	}
+	channelAffinityLock.Lock()
+	defer channelAffinityLock.Unlock()
+	entry, ok := channelAffinityStore[key]
+	if !ok || time.Now().After(entry.ExpireAt) {
+		return ChannelAffinityTarget{}, false
+	}
+	return entry.Target, true
+}
+
+func setChannelAffinity(key string, target ChannelAffinityTarget) {
+	if common.RedisEnabled {
+		err := common.RedisSet(key, fmt.Sprintf("%d:%d", target.ChannelId, target.KeyIndex), channelAffinityTTL())
+		if err != nil {
+			common.SysError("failed to save channel affinity: " + err.Error())
+		}
+		return
+	}
+	channelAffinityCleanupOnce.Do(startChannelAffinityCleanupTask)
+	channelAffinityLock.Lock()
+	defer channelAffinityLock.Unlock()
+	channelAffinityStore[key] = channelAffinityEntry{Target: target, ExpireAt: time.Now().Add(channelAffinityTTL())}
+}
+
+// UpdateChannelAffinity pins the request's affinity key to the channel and key that served it
+// and refreshes the TTL. It does nothing when the request carries no affinity key.
+func UpdateChannelAffinity(c *gin.Context, modelName string, channelId int, keyIndex int) {
+	affinityKey := common.GetContextKeyString(c, constant.ContextKeyChannelAffinityKey)
+	if affinityKey == "" || channelId <= 0 {
+		return
+	}
+	setChannelAffinity(channelAffinityStoreKey(affinityKey, modelName), ChannelAffinityTarget{ChannelId: channelId, KeyIndex: keyIndex})
+}
+
+// getAffinityChannel returns the channel the request is pinned to with its capacity reserved, or nil when there
+// is no pin or the pinned channel can no longer serve the model in the group.
+func getAffinityChannel(c *gin.Context, group string, modelName string) (*Channel, *channelCapacityLease) {
+	affinityKey := common.GetContextKeyString(c, constant.ContextKeyChannelAffinityKey)
+	if affinityKey == "" {
+		return nil, nil
+	}
+	target, ok := getChannelAffinity(channelAffinityStoreKey(affinityKey, modelName))
+	if !ok {
+		return nil, nil
+	}
+	if !isChannelBreakerAvailable(target.ChannelId, breakerChannelKeyIndex) {
+		return nil, nil
+	}
+	channel := getSatisfiedChannelById(group, modelName, target.ChannelId)
+	if channel == nil || isChannelSaturated(channel) {
+		return nil, nil
+	}
+	lease, ok := reserveSelectedChannel(channel.Id, shouldReserveChannel(c))
+	if !ok {
+		return nil, nil
+	}
+	common.SetContextKey(c, constant.ContextKeyChannelAffinityTarget, &target)
+	return channel, lease
+}
+
+// getSatisfiedChannelById returns the channel if it is enabled and serves the model in the group.
+func getSatisfiedChannelById(group string, modelName string, channelId int) *Channel {
+	if !common.MemoryCacheEnabled {
+		var count int64
+		err := DB.Model(&Ability{}).Where(commonGroupCol+" = ? and model = ? and channel_id = ? and enabled = ?", group, modelName, channelId, true).Count(&count).Error
+		if err != nil || count == 0 {
+			return nil
+		}
+		channel, err := GetChannelById(channelId, true)
+		if err != nil || channel.Status != common.ChannelStatusEnabled {
+			return nil
+		}
+		return channel
+	}
+
+	channelSyncLock.RLock()
+	defer channelSyncLock.RUnlock()
+	channels := group2model2channels[group][modelName]
+	if len(channels) == 0 {
+		channels = group2model2channels[group][ratio_setting.FormatMatchingModelName(modelName)]
+	}
+	for _, id := range channels {
+		if id != channelId {
+			continue
+		}
+		if channel, ok := channelsIDM[id]; ok && channel.Status == common.ChannelStatusEnabled {
+			return channel
+		}
+		return nil
+	}
+	return nil
+}
+
+// getChannelAffinityTarget returns the pin chosen for this request when it points at the channel.
+func getChannelAffinityTarget(c *gin.Context, channelId int) (*ChannelAffinityTarget, bool) {
+	value, ok := common.GetContextKey(c, constant.ContextKeyChannelAffinityTarget)
+	if !ok {
+		return nil, false
+	}
+	target, ok := value.(*ChannelAffinityTarget)
+	if !ok || target == nil || target.ChannelId != channelId {
+		return nil, false
+	}
+	return target, true
+}
+
+// GetChannelKeyForRequest returns the key pinned for the request when it is still usable,
+// otherwise the next enabled key of the channel.
+func GetChannelKeyForRequest(c *gin.Context, channel *Channel) (string, int, *types.NewAPIError) {
+	reserve := shouldReserveChannel(c)
+	if channel.ChannelInfo.IsMultiKey {
+		if target, ok := getChannelAffinityTarget(c, channel.Id); ok {
+			if key, ok := channel.getEnabledKeyAt(target.KeyIndex, reserve); ok {
+				return key, target.KeyIndex, nil
+			}
+		}
+	}
+	return channel.getNextEnabledKey(reserve)
+}
@@ -0,0 +1,310 @@
+package model
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+)
+
+type BreakerState string
+
+const (
+	BreakerStateClosed   BreakerState = "closed"
+	BreakerStateOpen     BreakerState = "open"
+	BreakerStateHalfOpen BreakerState = "half_open"
+)
+
+// breakerChannelKeyIndex marks a breaker that covers the whole channel rather than one key.
+const breakerChannelKeyIndex = -1
+
+type breakerKey struct {
+	ChannelId int
+	KeyIndex  int
+}
+
+type circuitBreaker struct {
+	State               BreakerState
+	ConsecutiveFailures int
+	WindowStart         time.Time
+	WindowRequests      int
+	WindowFailures      int
+	OpenedAt            time.Time
+	HalfOpenAt          time.Time
+	ProbesInFlight      int
+	ProbeSuccesses      int
+	// counts the half-open periods, so that a probe released late does not free a slot of a later one
+	ProbeRound int
+}
+
+// ChannelBreakerInfo is the externally visible state of one breaker.
+type ChannelBreakerInfo struct {
+	ChannelId           int          `json:"channel_id"`
+	KeyIndex            int          `json:"key_index"`
+	State               BreakerState `json:"state"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	WindowRequests      int          `json:"window_requests"`
+	WindowFailures      int          `json:"window_failures"`
+	OpenedAt            int64        `json:"opened_at,omitempty"`
+}
+
+var channelBreakers = make(map[breakerKey]*circuitBreaker)
+var channelBreakersLock sync.Mutex
+
+func breakerCooldown() time.Duration {
+	seconds := operation_setting.GetCircuitBreakerSetting().CooldownSeconds
+	if seconds <= 0 {
+		seconds = 30
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func breakerHalfOpenProbes() int {
+	probes := operation_setting.GetCircuitBreakerSetting().HalfOpenProbes
+	if probes <= 0 {
+		probes = 1
+	}
+	return probes
+}
+
+// available reports whether a request may be routed through the breaker right now, without changing it.
+func (b *circuitBreaker) available(now time.Time) bool {
+	switch b.State {
+	case BreakerStateOpen:
+		return now.Sub(b.OpenedAt) >= breakerCooldown()
+	case BreakerStateHalfOpen:
+		// a probe that never reported back must not keep the breaker half-open forever
+		if now.Sub(b.HalfOpenAt) >= breakerCooldown() {
+			return true
+		}
+		return b.ProbesInFlight < breakerHalfOpenProbes()
+	default:
+		return true
+	}
+}
+
+// acquire takes a probe slot when the breaker is or becomes half-open and returns its round, 0 when no slot
+// was taken. It fails when every probe slot of a half-open breaker is taken.
+func (b *circuitBreaker) acquire(now time.Time) (int, bool) {
+	switch b.State {
+	case BreakerStateOpen:
+		if now.Sub(b.OpenedAt) >= breakerCooldown() {
+			b.State = BreakerStateHalfOpen
+			b.HalfOpenAt = now
+			b.ProbesInFlight = 1
+			b.ProbeSuccesses = 0
+			b.ProbeRound++
+			return b.ProbeRound, true
+		}
+	case BreakerStateHalfOpen:
+		if now.Sub(b.HalfOpenAt) >= breakerCooldown() {
+			b.HalfOpenAt = now
+			b.ProbesInFlight = 0
+			b.ProbeRound++
+		}
+		if b.ProbesInFlight >= breakerHalfOpenProbes() {
+			return 0, false
+		}
+		b.ProbesInFlight++
+		return b.ProbeRound, true
+	}
+	return 0, true
+}
+
+// release gives back a probe slot taken in round.
+func (b *circuitBreaker) release(round int) {
+	if b.State == BreakerStateHalfOpen && b.ProbeRound == round && b.ProbesInFlight > 0 {
+		b.ProbesInFlight--
+	}
+}
+
+func (b *circuitBreaker) open(now time.Time) {
+	b.State = BreakerStateOpen
+	b.OpenedAt = now
+	b.ProbesInFlight = 0
+	b.ProbeSuccesses = 0
+}
+
+func (b *circuitBreaker) reset(now time.Time) {
+	b.State = BreakerStateClosed
+	b.ConsecutiveFailures = 0
+	b.WindowStart = now
+	b.WindowRequests = 0
+	b.WindowFailures = 0
+	b.ProbesInFlight = 0
+	b.ProbeSuccesses = 0
+}
+
+// record applies one request outcome and returns true when the breaker state changed.
+func (b *circuitBreaker) record(success bool, now time.Time) bool {
+	setting := operation_setting.GetCircuitBreakerSetting()
+	switch b.State {
+	case BreakerStateOpen:
+		// late results of requests sent before the breaker opened
+		return false
+	case BreakerStateHalfOpen:
+		// the probe slot is given back with the capacity of the request, see channelCapacityLease
+		if !success {
+			b.open(now)
+			return true
+		}
+		b.ProbeSuccesses++
+		if b.ProbeSuccesses >= breakerHalfOpenProbes() {
+			b.reset(now)
+			return true
+		}
+		return false
+	}
+
+	window := time.Duration(setting.WindowSeconds) * time.Second
+	if window <= 0 || now.Sub(b.WindowStart) > window {
+		b.WindowStart = now
+		b.WindowRequests = 0
+		b.WindowFailures = 0
+	}
+	b.WindowRequests++
+	if success {
+		b.ConsecutiveFailures = 0
+		return false
+	}
+	b.WindowFailures++
+	b.ConsecutiveFailures++
+	if setting.ConsecutiveFailures > 0 && b.ConsecutiveFailures >= setting.ConsecutiveFailures {
+		b.open(now)
+		return true
+	}
+	if setting.ErrorRateThreshold > 0 && b.WindowRequests >= setting.MinRequests &&
+		float64(b.WindowFailures)/float64(b.WindowRequests) >= setting.ErrorRateThreshold {
+		b.open(now)
+		return true
+	}
+	return false
+}
+
+func isChannelBreakerAvailable(channelId int, keyIndex int) bool {
+	if !operation_setting.GetCircuitBreakerSetting().Enabled {
+		return true
+	}
+	channelBreakersLock.Lock()
+	defer channelBreakersLock.Unlock()
+	b, ok := channelBreakers[breakerKey{ChannelId: channelId, KeyIndex: keyIndex}]
+	if !ok {
+		return true
+	}
+	return b.available(time.Now())
+}
+
+// acquireChannelBreaker takes a probe slot of a half-open breaker and returns its round, 0 when none was taken.
+// It fails when the breaker has no probe slot left.
+func acquireChannelBreaker(channelId int, keyIndex int) (int, bool) {
+	if !operation_setting.GetCircuitBreakerSetting().Enabled {
+		return 0, true
+	}
+	channelBreakersLock.Lock()
+	defer channelBreakersLock.Unlock()
+	if b, ok := channelBreakers[breakerKey{ChannelId: channelId, KeyIndex: keyIndex}]; ok {
+		return b.acquire(time.Now())
+	}
+	return 0, true
+}
+
+func releaseChannelBreaker(channelId int, keyIndex int, round int) {
+	if round == 0 {
+		return
+	}
+	channelBreakersLock.Lock()
+	defer channelBreakersLock.Unlock()
+	if b, ok := channelBreakers[breakerKey{ChannelId: channelId, KeyIndex: keyIndex}]; ok {
+		b.release(round)
+	}
+}
+
+// filterChannelsByBreaker drops channels whose breaker is open. When every channel is open
+// the original list is returned, so a full outage degrades to normal selection instead of failing fast.
+func filterChannelsByBreaker(channelIds []int) []int {
+	if !operation_setting.GetCircuitBreakerSetting().Enabled {
+		return channelIds
+	}
+	available := make([]int, 0, len(channelIds))
+	for _, id := range channelIds {
+		if isChannelBreakerAvailable(id, breakerChannelKeyIndex) {
+			available = append(available, id)
+		}
+	}
+	if len(available) == 0 {
+		return channelIds
+	}
+	return available
+}
+
+// RecordChannelBreakerResult feeds a relay outcome into the channel breaker and,
+// for multi-key channels, into the breaker of the key that was used.
+func RecordChannelBreakerResult(channelId int, isMultiKey bool, keyIndex int, success bool) {
+	if channelId <= 0 || !operation_setting.GetCircuitBreakerSetting().Enabled {
+		return
+	}
+	recordBreaker(channelId, breakerChannelKeyIndex, success)
+	if isMultiKey {
+		recordBreaker(channelId, keyIndex, success)
+	}
+}
+
+func recordBreaker(channelId int, keyIndex int, success bool) {
+	now := time.Now()
+	channelBreakersLock.Lock()
+	key := breakerKey{ChannelId: channelId, KeyIndex: keyIndex}
+	b, ok := channelBreakers[key]
+	if !ok {
+		if success {
+			channelBreakersLock.Unlock()
+			return
+		}
+		b = &circuitBreaker{State: BreakerStateClosed, WindowStart: now}
+		channelBreakers[key] = b
+	}
+	changed := b.record(success, now)
+	state := b.State
+	channelBreakersLock.Unlock()
+
+	if changed {
+		if keyIndex == breakerChannelKeyIndex {
+			common.SysLog(fmt.Sprintf("circuit breaker of channel #%d is now %s", channelId, state))
+		} else {
+			common.SysLog(fmt.Sprintf("circuit breaker of channel #%d key #%d is now %s", channelId, keyIndex, state))
+		}
+	}
+}
+
+func GetChannelBreakers() []ChannelBreakerInfo {
+	channelBreakersLock.Lock()
+	defer channelBreakersLock.Unlock()
+	result := make([]ChannelBreakerInfo, 0, len(channelBreakers))
+	for key, b := range channelBreakers {
+		info := ChannelBreakerInfo{
+			ChannelId:           key.ChannelId,
+			KeyIndex:            key.KeyIndex,
+			State:               b.State,
+			ConsecutiveFailures: b.ConsecutiveFailures,
+			WindowRequests:      b.WindowRequests,
+			WindowFailures:      b.WindowFailures,
+		}
+		if b.State != BreakerStateClosed {
+			info.OpenedAt = b.OpenedAt.Unix()
+		}
+		result = append(result, info)
+	}
+	return result
+}
+
+// ResetChannelBreakers closes every breaker of the channel, including its key breakers.
+func ResetChannelBreakers(channelId int) {
+	channelBreakersLock.Lock()
+	defer channelBreakersLock.Unlock()
+	for key := range channelBreakers {
+		if key.ChannelId == channelId {
+			delete(channelBreakers, key)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
@@ -12,6 +13,7 @@ import (
 	"github.com/QuantumNous/new-api/common"
 	"github.com/QuantumNous/new-api/constant"
 	"github.com/QuantumNous/new-api/setting"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
 	"github.com/QuantumNous/new-api/setting/ratio_setting"
 
 	"github.com/gin-gonic/gin"
@@ -23,6 +25,13 @@ var channelSyncLock sync.RWMutex
 
 func InitChannelCache() {
 	if !common.MemoryCacheEnabled {
+		// selection reads the channels from the database, only their capacity limits are kept in memory
+		var channels []*Channel
+		if err := DB.Find(&channels).Error; err != nil {
+			common.SysError("failed to load channel capacity limits: " + err.Error())
+			return
+		}
+		setCapacityLimitedChannels(channels)
 		return
 	}
 	newChannelId2channel := make(map[int]*Channel)
@@ -85,6 +94,7 @@ func InitChannelCache() {
 	}
 	channelsIDM = newChannelId2channel
 	channelSyncLock.Unlock()
+	setCapacityLimitedChannels(channels)
 	common.SysLog("channels synced from database")
 }
 
@@ -98,8 +108,22 @@ func SyncChannelCache(frequency int) {
 
 func CacheGetRandomSatisfiedChannel(c *gin.Context, group string, model string, retry int) (*Channel, string, error) {
 	var channel *Channel
+	var lease *channelCapacityLease
 	var err error
 	selectGroup := group
+	reserve := shouldReserveChannel(c)
+	// the capacity held by an earlier attempt is given back before the next channel is reserved
+	ReleaseChannelCapacity(c)
+	defer func() {
+		if channel != nil {
+			setChannelCapacityLease(c, lease)
+		}
+	}()
+	useAffinity := retry == 0 && common.GetContextKeyString(c, constant.ContextKeyChannelAffinityKey) != ""
+	if useAffinity {
+		// a pin only applies to the first attempt, retries go through normal selection
+		common.SetContextKey(c, constant.ContextKeyChannelAffinityTarget, (*ChannelAffinityTarget)(nil))
+	}
 	if group == "auto" {
 		if len(setting.AutoGroups) == 0 {
 			return nil, selectGroup, errors.New("auto groups is not enabled")
@@ -108,7 +132,13 @@ func CacheGetRandomSatisfiedChannel(c *gin.Context, group string, model string,
 			if common.DebugEnabled {
 				println("autoGroup:", autoGroup)
 			}
-			channel, _ = getRandomSatisfiedChannel(autoGroup, model, retry)
+			channel = nil
+			if useAffinity {
+				channel, lease = getAffinityChannel(c, autoGroup, model)
+			}
+			if channel == nil {
+				channel, lease, _ = getRandomSatisfiedChannel(autoGroup, model, retry, reserve)
+			}
 			if channel == nil {
 				continue
 			} else {
@@ -121,18 +151,24 @@ func CacheGetRandomSatisfiedChannel(c *gin.Context, group string, model string,
 			}
 		}
 	} else {
-		channel, err = getRandomSatisfiedChannel(group, model, retry)
-		if err != nil {
-			return nil, group, err
+		if useAffinity {
+			channel, lease = getAffinityChannel(c, group, model)
+		}
+		if channel == nil {
+			channel, lease, err = getRandomSatisfiedChannel(group, model, retry, reserve)
+			if err != nil {
+				return nil, group, err
+			}
 		}
 	}
 	return channel, selectGroup, nil
 }
 
-func getRandomSatisfiedChannel(group string, model string, retry int) (*Channel, error) {
+// getRandomSatisfiedChannel picks a channel of the group for the model and, when reserve is set, reserves its capacity.
+func getRandomSatisfiedChannel(group string, model string, retry int, reserve bool) (*Channel, *channelCapacityLease, error) {
 	
 	if !common.MemoryCacheEnabled {
-		return GetRandomSatisfiedChannel(group, model, retry)
+		return GetRandomSatisfiedChannel(group, model, retry, reserve)
 	}
 
 	channelSyncLock.RLock()
@@ -148,14 +184,24 @@ func getRandomSatisfiedChannel(group string, model string, retry int) (*Channel,
 	}
 
 	if len(channels) == 0 {
-		return nil, nil
+		return nil, nil, nil
+	}
+
+	channels = filterSaturatedChannels(channels)
+	if len(channels) == 0 {
+		return nil, nil, nil
 	}
+	channels = filterChannelsByBreaker(channels)
 
 	if len(channels) == 1 {
 		if channel, ok := channelsIDM[channels[0]]; ok {
-			return channel, nil
+			lease, ok := reserveSelectedChannel(channel.Id, reserve)
+			if !ok {
+				return nil, nil, nil
+			}
+			return channel, lease, nil
 		}
-		return nil, fmt.Errorf("Database consistency error, channel # %d does not exist, please contact the administrator for repair.", channels[0])
+		return nil, nil, fmt.Errorf("Database consistency error, channel # %d does not exist, please contact the administrator for repair.", channels[0])
 	}
 
 	uniquePriorities := make(map[int]bool)
@@ -163,7 +209,7 @@ func getRandomSatisfiedChannel(group string, model string, retry int) (*Channel,
 		if channel, ok := channelsIDM[channelId]; ok {
 			uniquePriorities[int(channel.GetPriority())] = true
 		} else {
-			return nil, fmt.Errorf("Database consistency error, channel # %d does not exist, please contact the administrator for repair.", channelId)
+			return nil, nil, fmt.Errorf("Database consistency error, channel # %d does not exist, please contact the administrator for repair.", channelId)
 		}
 	}
 	var sortedUniquePriorities []int
@@ -185,29 +231,40 @@ func getRandomSatisfiedChannel(group string, model string, retry int) (*Channel,
 				targetChannels = append(targetChannels, channel)
 			}
 		} else {
-			return nil, fmt.Errorf("Database consistency error, channel # %d does not exist, please contact the administrator for repair.", channelId)
+			return nil, nil, fmt.Errorf("Database consistency error, channel # %d does not exist, please contact the administrator for repair.", channelId)
 		}
 	}
 
 	
-	smoothingFactor := 10
-	
-	totalWeight := 0
-	for _, channel := range targetChannels {
-		totalWeight += channel.GetWeight() + smoothingFactor
+	smoothingFactor := operation_setting.GetChannelSelectSetting().SmoothingFactor
+	if smoothingFactor < 0 {
+		smoothingFactor = 0
+	}
+	channelIds := make([]int, len(targetChannels))
+	weights := make([]float64, len(targetChannels))
+	for i, channel := range targetChannels {
+		channelIds[i] = channel.Id
+		weights[i] = float64(channel.GetWeight() + smoothingFactor)
+	}
+	if operation_setting.IsAdaptiveChannelSelectEnabled(group) {
+		weights = adaptiveChannelWeights(channelIds, weights)
 	}
-	
-	randomWeight := rand.Intn(totalWeight)
 
-	
-	for _, channel := range targetChannels {
-		randomWeight -= channel.GetWeight() + smoothingFactor
-		if randomWeight < 0 {
-			return channel, nil
+	for len(targetChannels) > 0 {
+		idx := pickWeightedChannel(weights)
+		if idx < 0 {
+			// every weight is zero, fall back to a uniform pick
+			idx = rand.Intn(len(targetChannels))
 		}
+		channel := targetChannels[idx]
+		if lease, ok := reserveSelectedChannel(channel.Id, reserve); ok {
+			return channel, lease, nil
+		}
+		// another request took the last of its capacity since the channel was filtered
+		targetChannels = slices.Delete(targetChannels, idx, idx+1)
+		weights = slices.Delete(weights, idx, idx+1)
 	}
-	
-	return nil, errors.New("channel not found")
+	return nil, nil, nil
 }
 
 func CacheGetChannel(id int) (*Channel, error) {
@@ -281,5 +338,6 @@ func CacheUpdateChannel(channel *Channel) {
 
 	println("before:", channelsIDM[channel.Id].ChannelInfo.MultiKeyPollingIndex)
 	channelsIDM[channel.Id] = channel
+	updateCapacityLimitedChannel(channel)
 	println("after :", channelsIDM[channel.Id].ChannelInfo.MultiKeyPollingIndex)
 }
@@ -0,0 +1,397 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/common/limiter"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+
+	"github.com/bytedance/gopkg/util/gopool"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	channelCapacityConcurrency = "concurrency"
+	channelCapacityRPM         = "rpm"
+	channelCapacityTPM         = "tpm"
+)
+
+// in-flight counters expire on their own in case a release is lost, e.g. when an instance crashes
+const channelConcurrencyExpiration = 10 * time.Minute
+
+const channelMinuteExpiration = 2 * time.Minute
+
+// channelCapacityKeyIndex marks counters that cover the whole channel rather than one key.
+const channelCapacityKeyIndex = -1
+
+// channelCapacityLease is the capacity held by a request, released when the attempt or the request ends.
+// Until the key is chosen KeyIndex is channelCapacityKeyIndex.
+type channelCapacityLease struct {
+	ChannelId int
+	KeyIndex  int
+	// whether an in-flight slot is held on the channel and on the key
+	Channel bool
+	Key     bool
+	// the rounds of the half-open breaker probes taken on the channel and on the key, 0 for none
+	ChannelProbe int
+	KeyProbe     int
+}
+
+type channelCounter struct {
+	Value    int64
+	ExpireAt time.Time
+}
+
+var (
+	channelCounters            = make(map[string]*channelCounter)
+	channelCountersLock        sync.Mutex
+	channelCountersCleanupOnce sync.Once
+)
+
+var (
+	capacityLimitedChannels     map[int]*Channel
+	capacityLimitedChannelsLock sync.RWMutex
+)
+
+type channelCapacityLimits struct {
+	MaxConcurrency int
+	RPMLimit       int
+	TPMLimit       int
+}
+
+func (l channelCapacityLimits) enabled() bool {
+	return l.MaxConcurrency > 0 || l.RPMLimit > 0 || l.TPMLimit > 0
+}
+
+func channelLimits(setting dto.ChannelSettings) channelCapacityLimits {
+	return channelCapacityLimits{
+		MaxConcurrency: setting.MaxConcurrency,
+		RPMLimit:       setting.RPMLimit,
+		TPMLimit:       setting.TPMLimit,
+	}
+}
+
+func channelKeyLimits(setting dto.ChannelSettings) channelCapacityLimits {
+	return channelCapacityLimits{
+		MaxConcurrency: setting.KeyMaxConcurrency,
+		RPMLimit:       setting.KeyRPMLimit,
+		TPMLimit:       setting.KeyTPMLimit,
+	}
+}
+
+func channelCounterKey(kind string, channelId int, keyIndex int) string {
+	key := fmt.Sprintf("channel_capacity:%s:%d:%d", kind, channelId, keyIndex)
+	if kind != channelCapacityConcurrency {
+		key = fmt.Sprintf("%s:%d", key, time.Now().Unix()/60)
+	}
+	return key
+}
+
+func startChannelCountersCleanupTask() {
+	gopool.Go(func() {
+		for {
+			time.Sleep(time.Minute)
+			now := time.Now()
+			channelCountersLock.Lock()
+			for key, counter := range channelCounters {
+				if now.After(counter.ExpireAt) {
+					delete(channelCounters, key)
+				}
+			}
+			channelCountersLock.Unlock()
+		}
+	})
+}
+
+// reserveChannelCounter adds amount to the counter when the result stays within limit, see limiter.Reserve.
+// Redis errors let the request through, capacity limits must not take the relay down.
+func reserveChannelCounter(key string, amount int64, limit int64, expiration time.Duration) bool {
+	if common.RedisEnabled {
+		ctx := context.Background()
+		allowed, err := limiter.New(ctx, common.RDB).Reserve(ctx, key, amount, limit, expiration)
+		if err != nil {
+			common.SysError("channel capacity check failed: " + err.Error())
+			return true
+		}
+		return allowed
+	}
+
+	channelCountersCleanupOnce.Do(startChannelCountersCleanupTask)
+	channelCountersLock.Lock()
+	defer channelCountersLock.Unlock()
+	now := time.Now()
+	counter, ok := channelCounters[key]
+	if !ok || now.After(counter.ExpireAt) {
+		counter = &channelCounter{ExpireAt: now.Add(expiration)}
+		channelCounters[key] = counter
+	}
+	if limit > 0 && counter.Value+max(amount, 1) > limit {
+		return false
+	}
+	if amount != 0 {
+		counter.Value = max(counter.Value+amount, 0)
+		counter.ExpireAt = now.Add(expiration)
+	}
+	return true
+}
+
+func isCapacitySaturated(limits channelCapacityLimits, channelId int, keyIndex int) bool {
+	if limits.MaxConcurrency > 0 && !reserveChannelCounter(channelCounterKey(channelCapacityConcurrency, channelId, keyIndex), 0, int64(limits.MaxConcurrency), channelConcurrencyExpiration) {
+		return true
+	}
+	if limits.RPMLimit > 0 && !reserveChannelCounter(channelCounterKey(channelCapacityRPM, channelId, keyIndex), 0, int64(limits.RPMLimit), channelMinuteExpiration) {
+		return true
+	}
+	if limits.TPMLimit > 0 && !reserveChannelCounter(channelCounterKey(channelCapacityTPM, channelId, keyIndex), 0, int64(limits.TPMLimit), channelMinuteExpiration) {
+		return true
+	}
+	return false
+}
+
+// reserveCapacity takes an in-flight slot and a request of the current minute, each checked against its limit by
+// the counter call that takes it, and gives the slot back when the minute is full. TPM is only checked, the tokens
+// are counted once the request is settled.
+func reserveCapacity(limits channelCapacityLimits, channelId int, keyIndex int) bool {
+	if limits.TPMLimit > 0 && !reserveChannelCounter(channelCounterKey(channelCapacityTPM, channelId, keyIndex), 0, int64(limits.TPMLimit), channelMinuteExpiration) {
+		return false
+	}
+	concurrencyKey := channelCounterKey(channelCapacityConcurrency, channelId, keyIndex)
+	if limits.MaxConcurrency > 0 && !reserveChannelCounter(concurrencyKey, 1, int64(limits.MaxConcurrency), channelConcurrencyExpiration) {
+		return false
+	}
+	if limits.RPMLimit > 0 && !reserveChannelCounter(channelCounterKey(channelCapacityRPM, channelId, keyIndex), 1, int64(limits.RPMLimit), channelMinuteExpiration) {
+		if limits.MaxConcurrency > 0 {
+			reserveChannelCounter(concurrencyKey, -1, 0, channelConcurrencyExpiration)
+		}
+		return false
+	}
+	return true
+}
+
+// acquireCapacity counts a request without checking the limits.
+func acquireCapacity(limits channelCapacityLimits, channelId int, keyIndex int) {
+	if limits.MaxConcurrency > 0 {
+		reserveChannelCounter(channelCounterKey(channelCapacityConcurrency, channelId, keyIndex), 1, 0, channelConcurrencyExpiration)
+	}
+	if limits.RPMLimit > 0 {
+		reserveChannelCounter(channelCounterKey(channelCapacityRPM, channelId, keyIndex), 1, 0, channelMinuteExpiration)
+	}
+}
+
+// getCapacityLimitedChannels returns the channels with a capacity limit set, kept with the channel cache so that
+// selection neither queries nor decodes the settings of every candidate.
+func getCapacityLimitedChannels() map[int]*Channel {
+	capacityLimitedChannelsLock.RLock()
+	defer capacityLimitedChannelsLock.RUnlock()
+	return capacityLimitedChannels
+}
+
+func isCapacityLimitedChannel(channel *Channel) bool {
+	setting := channel.GetSetting()
+	return channelLimits(setting).enabled() || channelKeyLimits(setting).enabled()
+}
+
+// setCapacityLimitedChannels replaces the capacity limited channels with those among channels.
+func setCapacityLimitedChannels(channels []*Channel) {
+	limited := make(map[int]*Channel)
+	for _, channel := range channels {
+		if isCapacityLimitedChannel(channel) {
+			limited[channel.Id] = channel
+		}
+	}
+	capacityLimitedChannelsLock.Lock()
+	defer capacityLimitedChannelsLock.Unlock()
+	capacityLimitedChannels = limited
+}
+
+// updateCapacityLimitedChannel follows a change of a single cached channel.
+func updateCapacityLimitedChannel(channel *Channel) {
+	capacityLimitedChannelsLock.Lock()
+	defer capacityLimitedChannelsLock.Unlock()
+	limited := make(map[int]*Channel, len(capacityLimitedChannels)+1)
+	for id, limitedChannel := range capacityLimitedChannels {
+		limited[id] = limitedChannel
+	}
+	delete(limited, channel.Id)
+	if isCapacityLimitedChannel(channel) {
+		limited[channel.Id] = channel
+	}
+	capacityLimitedChannels = limited
+}
+
+// isChannelSaturated reports whether the channel is at one of its capacity limits,
+// or, for a multi-key channel with key limits, whether every enabled key is.
+func isChannelSaturated(channel *Channel) bool {
+	setting := channel.GetSetting()
+	if limits := channelLimits(setting); limits.enabled() && isCapacitySaturated(limits, channel.Id, channelCapacityKeyIndex) {
+		return true
+	}
+	keyLimits := channelKeyLimits(setting)
+	if !channel.ChannelInfo.IsMultiKey || !keyLimits.enabled() {
+		return false
+	}
+	keyCount := channel.ChannelInfo.MultiKeySize
+	if keyCount <= 0 {
+		keyCount = len(channel.GetKeys())
+	}
+	for idx := 0; idx < keyCount; idx++ {
+		if status, ok := channel.ChannelInfo.MultiKeyStatusList[idx]; ok && status != common.ChannelStatusEnabled {
+			continue
+		}
+		if !isCapacitySaturated(keyLimits, channel.Id, idx) {
+			return false
+		}
+	}
+	return true
+}
+
+func isChannelKeySaturated(channel *Channel, keyIndex int) bool {
+	keyLimits := channelKeyLimits(channel.GetSetting())
+	return keyLimits.enabled() && isCapacitySaturated(keyLimits, channel.Id, keyIndex)
+}
+
+// filterSaturatedChannels drops the channels that are at capacity. It only skips channels cheaply,
+// reserveChannelCapacity decides when one is picked.
+func filterSaturatedChannels(channelIds []int) []int {
+	limited := getCapacityLimitedChannels()
+	if len(limited) == 0 {
+		return channelIds
+	}
+	available := make([]int, 0, len(channelIds))
+	for _, id := range channelIds {
+		if channel, ok := limited[id]; ok && isChannelSaturated(channel) {
+			continue
+		}
+		available = append(available, id)
+	}
+	return available
+}
+
+// reserveChannelCapacity takes the capacity of the picked channel, it fails when another request took the last
+// of it since the channel was filtered.
+func reserveChannelCapacity(channelId int) (*channelCapacityLease, bool) {
+	lease := &channelCapacityLease{ChannelId: channelId, KeyIndex: channelCapacityKeyIndex}
+	channel, ok := getCapacityLimitedChannels()[channelId]
+	if !ok {
+		return lease, true
+	}
+	limits := channelLimits(channel.GetSetting())
+	if !limits.enabled() {
+		return lease, true
+	}
+	if !reserveCapacity(limits, channelId, channelCapacityKeyIndex) {
+		return nil, false
+	}
+	lease.Channel = limits.MaxConcurrency > 0
+	return lease, true
+}
+
+// reserveSelectedChannel takes the capacity and a half-open breaker probe of the picked channel, a request that
+// does not reserve is routed to the channel without holding anything on it.
+func reserveSelectedChannel(channelId int, reserve bool) (*channelCapacityLease, bool) {
+	if !reserve {
+		return &channelCapacityLease{ChannelId: channelId, KeyIndex: channelCapacityKeyIndex}, true
+	}
+	lease, ok := reserveChannelCapacity(channelId)
+	if !ok {
+		return nil, false
+	}
+	if lease.ChannelProbe, ok = acquireChannelBreaker(channelId, breakerChannelKeyIndex); !ok {
+		// the probes of the half-open channel were taken since it was filtered
+		lease.release()
+		return nil, false
+	}
+	return lease, true
+}
+
+func shouldReserveChannel(c *gin.Context) bool {
+	return !common.GetContextKeyBool(c, constant.ContextKeyChannelNoReservation)
+}
+
+// reserveChannelKeyCapacity takes the capacity of the picked key of a multi-key channel.
+func reserveChannelKeyCapacity(channel *Channel, keyIndex int) bool {
+	keyLimits := channelKeyLimits(channel.GetSetting())
+	return !channel.ChannelInfo.IsMultiKey || !keyLimits.enabled() || reserveCapacity(keyLimits, channel.Id, keyIndex)
+}
+
+func setChannelCapacityLease(c *gin.Context, lease *channelCapacityLease) {
+	common.SetContextKey(c, constant.ContextKeyChannelCapacityLease, lease)
+}
+
+func getChannelCapacityLease(c *gin.Context) *channelCapacityLease {
+	value, ok := common.GetContextKey(c, constant.ContextKeyChannelCapacityLease)
+	if !ok {
+		return nil
+	}
+	lease, _ := value.(*channelCapacityLease)
+	return lease
+}
+
+// AcquireChannelCapacity records the capacity the request holds on the channel and key it was routed to. Both are
+// reserved when they are selected, a channel the request is pinned to is counted here without checking its limits.
+func AcquireChannelCapacity(c *gin.Context, channel *Channel, keyIndex int) {
+	if !shouldReserveChannel(c) {
+		return
+	}
+	setting := channel.GetSetting()
+	lease := getChannelCapacityLease(c)
+	if lease == nil || lease.ChannelId != channel.Id || lease.KeyIndex != channelCapacityKeyIndex {
+		ReleaseChannelCapacity(c)
+		lease = &channelCapacityLease{ChannelId: channel.Id}
+		if limits := channelLimits(setting); limits.enabled() {
+			acquireCapacity(limits, channel.Id, channelCapacityKeyIndex)
+			lease.Channel = limits.MaxConcurrency > 0
+		}
+	}
+	lease.KeyIndex = keyIndex
+	if channel.ChannelInfo.IsMultiKey {
+		lease.Key = channelKeyLimits(setting).MaxConcurrency > 0
+		// the key is already picked, it is routed to even when its probes were taken meanwhile
+		lease.KeyProbe, _ = acquireChannelBreaker(channel.Id, keyIndex)
+	}
+	setChannelCapacityLease(c, lease)
+}
+
+// ReleaseChannelCapacity gives back the in-flight slots held by the request, if any.
+func ReleaseChannelCapacity(c *gin.Context) {
+	lease := getChannelCapacityLease(c)
+	if lease == nil {
+		return
+	}
+	lease.release()
+	setChannelCapacityLease(c, nil)
+}
+
+func (lease *channelCapacityLease) release() {
+	if lease.Channel {
+		reserveChannelCounter(channelCounterKey(channelCapacityConcurrency, lease.ChannelId, channelCapacityKeyIndex), -1, 0, channelConcurrencyExpiration)
+	}
+	if lease.Key {
+		reserveChannelCounter(channelCounterKey(channelCapacityConcurrency, lease.ChannelId, lease.KeyIndex), -1, 0, channelConcurrencyExpiration)
+	}
+	releaseChannelBreaker(lease.ChannelId, breakerChannelKeyIndex, lease.ChannelProbe)
+	releaseChannelBreaker(lease.ChannelId, lease.KeyIndex, lease.KeyProbe)
+}
+
+// recordChannelTokenUsage counts consumed tokens against the TPM limits of the channel and key that served the request.
+func recordChannelTokenUsage(c *gin.Context, channelId int, tokens int) {
+	if channelId <= 0 || tokens <= 0 || common.GetContextKeyInt(c, constant.ContextKeyChannelId) != channelId {
+		return
+	}
+	setting, ok := common.GetContextKeyType[dto.ChannelSettings](c, constant.ContextKeyChannelSetting)
+	if !ok {
+		return
+	}
+	if setting.TPMLimit > 0 {
+		reserveChannelCounter(channelCounterKey(channelCapacityTPM, channelId, channelCapacityKeyIndex), int64(tokens), 0, channelMinuteExpiration)
+	}
+	if setting.KeyTPMLimit > 0 && common.GetContextKeyBool(c, constant.ContextKeyChannelIsMultiKey) {
+		keyIndex := common.GetContextKeyInt(c, constant.ContextKeyChannelMultiKeyIndex)
+		reserveChannelCounter(channelCounterKey(channelCapacityTPM, channelId, keyIndex), int64(tokens), 0, channelMinuteExpiration)
+	}
+}
@@ -0,0 +1,209 @@
+package model
+
+import (
+	"math"
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+)
+
+// ChannelStats holds rolling per-channel statistics used by adaptive channel selection.
+type ChannelStats struct {
+	LatencyMs      float64   `json:"latency_ms"`
+	FirstTokenMs   float64   `json:"first_token_ms"`
+	SuccessRatio   float64   `json:"success_ratio"`
+	Samples        int64     `json:"samples"`
+	LastUpdateTime time.Time `json:"last_update_time"`
+
+	// ring of recent successful latencies, used for quantiles
+	recentLatencies []float64
+	recentIndex     int
+}
+
+const channelRecentLatencySize = 100
+
+var channelStatsMap = make(map[int]*ChannelStats)
+var channelStatsLock sync.RWMutex
+
+func ewma(old float64, value float64, alpha float64) float64 {
+	return alpha*value + (1-alpha)*old
+}
+
+// RecordChannelResult feeds the outcome of one relay attempt into the channel's rolling stats.
+// firstToken is ignored when it is not positive, e.g. for non-streaming requests.
+func RecordChannelResult(channelId int, success bool, latency time.Duration, firstToken time.Duration) {
+	if channelId <= 0 {
+		return
+	}
+	alpha := operation_setting.GetChannelSelectSetting().EwmaAlpha
+	if alpha <= 0 || alpha > 1 {
+		alpha = 0.2
+	}
+	successValue := 0.0
+	if success {
+		successValue = 1
+	}
+	latencyMs := float64(latency.Milliseconds())
+	firstTokenMs := float64(firstToken.Milliseconds())
+
+	channelStatsLock.Lock()
+	defer channelStatsLock.Unlock()
+	stats, ok := channelStatsMap[channelId]
+	if !ok || isChannelStatsExpired(stats) {
+		stats = &ChannelStats{SuccessRatio: successValue}
+		channelStatsMap[channelId] = stats
+	} else {
+		stats.SuccessRatio = ewma(stats.SuccessRatio, successValue, alpha)
+	}
+	// failed attempts usually return early, so only successful ones say anything about latency
+	if success {
+		if stats.LatencyMs == 0 {
+			stats.LatencyMs = latencyMs
+		} else {
+			stats.LatencyMs = ewma(stats.LatencyMs, latencyMs, alpha)
+		}
+		if len(stats.recentLatencies) < channelRecentLatencySize {
+			stats.recentLatencies = append(stats.recentLatencies, latencyMs)
+		} else {
+			stats.recentLatencies[stats.recentIndex] = latencyMs
+			stats.recentIndex = (stats.recentIndex + 1) % channelRecentLatencySize
+		}
+		if firstTokenMs > 0 {
+			if stats.FirstTokenMs == 0 {
+				stats.FirstTokenMs = firstTokenMs
+			} else {
+				stats.FirstTokenMs = ewma(stats.FirstTokenMs, firstTokenMs, alpha)
+			}
+		}
+	}
+	stats.Samples++
+	stats.LastUpdateTime = time.Now()
+}
+
+func isChannelStatsExpired(stats *ChannelStats) bool {
+	ttl := operation_setting.GetChannelSelectSetting().StatsTTLSeconds
+	if ttl <= 0 {
+		return false
+	}
+	return time.Since(stats.LastUpdateTime) > time.Duration(ttl)*time.Second
+}
+
+func GetChannelStats(channelId int) (ChannelStats, bool) {
+	channelStatsLock.RLock()
+	defer channelStatsLock.RUnlock()
+	stats, ok := channelStatsMap[channelId]
+	if !ok || isChannelStatsExpired(stats) {
+		return ChannelStats{}, false
+	}
+	return *stats, true
+}
+
+func GetAllChannelStats() map[int]ChannelStats {
+	channelStatsLock.RLock()
+	defer channelStatsLock.RUnlock()
+	result := make(map[int]ChannelStats, len(channelStatsMap))
+	for id, stats := range channelStatsMap {
+		if isChannelStatsExpired(stats) {
+			continue
+		}
+		result[id] = *stats
+	}
+	return result
+}
+
+// GetChannelLatencyQuantile returns the q quantile of the channel's recent successful latencies,
+// or false when fewer than the configured minimum samples were recorded.
+func GetChannelLatencyQuantile(channelId int, q float64) (time.Duration, bool) {
+	channelStatsLock.RLock()
+	stats, ok := channelStatsMap[channelId]
+	if !ok || isChannelStatsExpired(stats) || len(stats.recentLatencies) < operation_setting.GetChannelSelectSetting().MinSamples {
+		channelStatsLock.RUnlock()
+		return 0, false
+	}
+	latencies := slices.Clone(stats.recentLatencies)
+	channelStatsLock.RUnlock()
+
+	if len(latencies) == 0 {
+		return 0, false
+	}
+	slices.Sort(latencies)
+	idx := int(math.Ceil(q*float64(len(latencies)))) - 1
+	idx = max(0, min(idx, len(latencies)-1))
+	return time.Duration(latencies[idx]) * time.Millisecond, true
+}
+
+func ResetChannelStats(channelId int) {
+	channelStatsLock.Lock()
+	defer channelStatsLock.Unlock()
+	delete(channelStatsMap, channelId)
+}
+
+// channelResponseScore is the latency used to compare channels, preferring time to first token.
+func channelResponseScore(stats ChannelStats) float64 {
+	if stats.FirstTokenMs > 0 {
+		return stats.FirstTokenMs
+	}
+	return stats.LatencyMs
+}
+
+// adaptiveChannelWeights scales the static weights of channels in the same priority tier
+// by their observed success ratio and their latency relative to the fastest channel.
+func adaptiveChannelWeights(channelIds []int, baseWeights []float64) []float64 {
+	setting := operation_setting.GetChannelSelectSetting()
+	minFactor := setting.MinWeightFactor
+	if minFactor <= 0 {
+		minFactor = 0.01
+	}
+	minSamples := int64(setting.MinSamples)
+
+	statsList := make([]ChannelStats, len(channelIds))
+	hasStats := make([]bool, len(channelIds))
+	bestScore := math.MaxFloat64
+	for i, id := range channelIds {
+		stats, ok := GetChannelStats(id)
+		if !ok || stats.Samples < minSamples {
+			continue
+		}
+		statsList[i] = stats
+		hasStats[i] = true
+		if score := channelResponseScore(stats); score > 0 && score < bestScore {
+			bestScore = score
+		}
+	}
+
+	weights := make([]float64, len(channelIds))
+	for i := range channelIds {
+		weights[i] = baseWeights[i]
+		if !hasStats[i] {
+			continue
+		}
+		factor := statsList[i].SuccessRatio * statsList[i].SuccessRatio
+		if score := channelResponseScore(statsList[i]); score > 0 && bestScore != math.MaxFloat64 {
+			factor *= bestScore / score
+		}
+		weights[i] = baseWeights[i] * math.Max(factor, minFactor)
+	}
+	return weights
+}
+
+// pickWeightedChannel returns the index chosen by a weighted random draw, or -1 when weights are empty.
+func pickWeightedChannel(weights []float64) int {
+	total := 0.0
+	for _, w := range weights {
+		total += w
+	}
+	if total <= 0 {
+		return -1
+	}
+	r := rand.Float64() * total
+	for i, w := range weights {
+		r -= w
+		if r < 0 {
+			return i
+		}
+	}
+	return len(weights) - 1
+}
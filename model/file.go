@@ -0,0 +1,122 @@
+package model
+
+import (
+	"errors"
+
+	"github.com/QuantumNous/new-api/common"
+
+	"gorm.io/gorm"
+)
+
+const (
+	FileStatusUploaded  = "uploaded"
+	FileStatusProcessed = "processed"
+)
+
+// File is a file uploaded through the Files API, its content lives in the configured file storage.
+type File struct {
+	Id         string `json:"id" gorm:"type:varchar(64);primaryKey"`
+	UserId     int    `json:"-" gorm:"index"`
+	TokenId    int    `json:"-" gorm:"index"`
+	Filename   string `json:"filename" gorm:"type:varchar(255)"`
+	Purpose    string `json:"purpose" gorm:"type:varchar(32);index"`
+	Bytes      int64  `json:"bytes"`
+	MimeType   string `json:"-" gorm:"type:varchar(128)"`
+	StorageKey string `json:"-" gorm:"type:varchar(255)"`
+	Status     string `json:"status" gorm:"type:varchar(32)"`
+	CreatedAt  int64  `json:"created_at" gorm:"bigint;index"`
+	ExpiresAt  int64  `json:"expires_at,omitempty" gorm:"bigint"`
+}
+
+// FileUpstream remembers the id a file got when it was uploaded to an upstream channel.
+type FileUpstream struct {
+	Id             int    `json:"id"`
+	FileId         string `json:"file_id" gorm:"type:varchar(64);uniqueIndex:idx_file_upstream_channel"`
+	ChannelId      int    `json:"channel_id" gorm:"uniqueIndex:idx_file_upstream_channel;index"`
+	UpstreamFileId string `json:"upstream_file_id" gorm:"type:varchar(255)"`
+	CreatedAt      int64  `json:"created_at" gorm:"bigint"`
+}
+
+func NewFileId() string {
+	return "file-" + common.GetRandomString(24)
+}
+
+func (file *File) Insert() error {
+	if file.CreatedAt == 0 {
+		file.CreatedAt = common.GetTimestamp()
+	}
+	return DB.Create(file).Error
+}
+
+// GetUserFileById returns the file when it belongs to the user.
+func GetUserFileById(id string, userId int) (*File, error) {
+	if id == "" {
+		return nil, errors.New("file id is empty")
+	}
+	var file File
+	err := DB.Where("id = ? and user_id = ?", id, userId).First(&file).Error
+	if err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// GetUserFiles lists the user's files in the given order of creation, starting after the file with id after.
+func GetUserFiles(userId int, purpose string, after string, limit int, ascending bool) ([]*File, error) {
+	var files []*File
+	tx := DB.Where("user_id = ?", userId)
+	if purpose != "" {
+		tx = tx.Where("purpose = ?", purpose)
+	}
+	order := "created_at desc, id desc"
+	if ascending {
+		order = "created_at asc, id asc"
+	}
+	if after != "" {
+		cursor, err := GetUserFileById(after, userId)
+		if err != nil {
+			return nil, err
+		}
+		if ascending {
+			tx = tx.Where("created_at > ? or (created_at = ? and id > ?)", cursor.CreatedAt, cursor.CreatedAt, cursor.Id)
+		} else {
+			tx = tx.Where("created_at < ? or (created_at = ? and id < ?)", cursor.CreatedAt, cursor.CreatedAt, cursor.Id)
+		}
+	}
+	err := tx.Order(order).Limit(limit).Find(&files).Error
+	return files, err
+}
+
+func (file *File) Delete() error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("file_id = ?", file.Id).Delete(&FileUpstream{}).Error; err != nil {
+			return err
+		}
+		if err := removeFileFromVectorStores(tx, file.Id); err != nil {
+			return err
+		}
+		return tx.Delete(file).Error
+	})
+}
+
+// GetFileUpstreamId returns the id the file has on the channel, if it was uploaded there before.
+func GetFileUpstreamId(fileId string, channelId int) (string, bool) {
+	var upstream FileUpstream
+	err := DB.Where("file_id = ? and channel_id = ?", fileId, channelId).First(&upstream).Error
+	if err != nil {
+		return "", false
+	}
+	return upstream.UpstreamFileId, true
+}
+
+func SaveFileUpstreamId(fileId string, channelId int, upstreamFileId string) error {
+	upstream := FileUpstream{
+		FileId:         fileId,
+		ChannelId:      channelId,
+		UpstreamFileId: upstreamFileId,
+		CreatedAt:      common.GetTimestamp(),
+	}
+	return DB.Where("file_id = ? and channel_id = ?", fileId, channelId).
+		Assign(FileUpstream{UpstreamFileId: upstreamFileId}).
+		FirstOrCreate(&upstream).Error
+}
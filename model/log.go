@@ -154,6 +154,7 @@ type RecordConsumeLogParams struct {
 }
 
 func RecordConsumeLog(c *gin.Context, userId int, params RecordConsumeLogParams) {
+	recordChannelTokenUsage(c, params.ChannelId, params.PromptTokens+params.CompletionTokens)
 	if !common.LogConsumeEnabled {
 		return
 	}
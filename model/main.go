@@ -267,10 +267,24 @@ func migrateDB() error {
 		&Setup{},
 		&TwoFA{},
 		&TwoFABackupCode{},
+		&File{},
+		&FileUpstream{},
+		&Batch{},
+		&StoredResponse{},
+		&McpServer{},
+		&VectorStore{},
+		&VectorStoreFile{},
+		&VectorStoreChunk{},
+		&SubscriptionPlan{},
+		&Subscription{},
+		&SubscriptionOrder{},
+		&Budget{},
+		&QuotaLedgerEntry{},
 	)
 	if err != nil {
 		return err
 	}
+	migrateVectorStoreIndex()
 	return nil
 }
 
@@ -300,6 +314,19 @@ func migrateDBFast() error {
 		{&Setup{}, "Setup"},
 		{&TwoFA{}, "TwoFA"},
 		{&TwoFABackupCode{}, "TwoFABackupCode"},
+		{&File{}, "File"},
+		{&FileUpstream{}, "FileUpstream"},
+		{&Batch{}, "Batch"},
+		{&StoredResponse{}, "StoredResponse"},
+		{&McpServer{}, "McpServer"},
+		{&VectorStore{}, "VectorStore"},
+		{&VectorStoreFile{}, "VectorStoreFile"},
+		{&VectorStoreChunk{}, "VectorStoreChunk"},
+		{&SubscriptionPlan{}, "SubscriptionPlan"},
+		{&Subscription{}, "Subscription"},
+		{&SubscriptionOrder{}, "SubscriptionOrder"},
+		{&Budget{}, "Budget"},
+		{&QuotaLedgerEntry{}, "QuotaLedgerEntry"},
 	}
 	
 	errChan := make(chan error, len(migrations))
@@ -324,6 +351,7 @@ func migrateDBFast() error {
 			return err
 		}
 	}
+	migrateVectorStoreIndex()
 	common.SysLog("database migrated")
 	return nil
 }
@@ -0,0 +1,102 @@
+package model
+
+import (
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+)
+
+const (
+	McpServerStatusEnabled  = 1
+	McpServerStatusDisabled = 2
+)
+
+const (
+	McpTransportStreamableHttp = "streamable_http"
+	McpTransportSse            = "sse"
+)
+
+// McpServer is an MCP server the gateway exposes on /mcp, its tools are named <name>__<tool> there.
+type McpServer struct {
+	Id          int    `json:"id"`
+	Name        string `json:"name" gorm:"type:varchar(64);uniqueIndex"`
+	Description string `json:"description" gorm:"type:varchar(255)"`
+	Transport   string `json:"transport" gorm:"type:varchar(32)"`
+	Url         string `json:"url" gorm:"type:varchar(1024)"`
+	// JSON object of headers sent with every request, for the credentials of the server
+	Headers string `json:"headers" gorm:"type:text"`
+	// comma separated groups that may use the server, empty for all groups
+	Groups string `json:"groups" gorm:"type:varchar(1024);default:''"`
+	// price of one tool call in USD, 0 only meters the calls
+	CallPrice   float64 `json:"call_price" gorm:"default:0"`
+	Status      int     `json:"status" gorm:"default:1"`
+	CreatedTime int64   `json:"created_time" gorm:"bigint"`
+	UpdatedTime int64   `json:"updated_time" gorm:"bigint"`
+}
+
+func (server *McpServer) Insert() error {
+	now := common.GetTimestamp()
+	server.CreatedTime = now
+	server.UpdatedTime = now
+	return DB.Create(server).Error
+}
+
+func (server *McpServer) Update() error {
+	server.UpdatedTime = common.GetTimestamp()
+	return DB.Save(server).Error
+}
+
+func IsMcpServerNameDuplicated(id int, name string) (bool, error) {
+	var cnt int64
+	err := DB.Model(&McpServer{}).Where("name = ? AND id <> ?", name, id).Count(&cnt).Error
+	return cnt > 0, err
+}
+
+func DeleteMcpServerById(id int) error {
+	return DB.Delete(&McpServer{}, id).Error
+}
+
+func GetMcpServerById(id int) (*McpServer, error) {
+	var server McpServer
+	if err := DB.First(&server, id).Error; err != nil {
+		return nil, err
+	}
+	return &server, nil
+}
+
+func GetAllMcpServers() ([]*McpServer, error) {
+	var servers []*McpServer
+	err := DB.Order("id asc").Find(&servers).Error
+	return servers, err
+}
+
+func GetEnabledMcpServers() ([]*McpServer, error) {
+	var servers []*McpServer
+	err := DB.Where("status = ?", McpServerStatusEnabled).Order("id asc").Find(&servers).Error
+	return servers, err
+}
+
+// GetHeaders returns the configured headers, a malformed value sends none.
+func (server *McpServer) GetHeaders() map[string]string {
+	headers := make(map[string]string)
+	if strings.TrimSpace(server.Headers) == "" {
+		return headers
+	}
+	if err := common.UnmarshalJsonStr(server.Headers, &headers); err != nil {
+		common.SysError("invalid headers of mcp server " + server.Name + ": " + err.Error())
+	}
+	return headers
+}
+
+// AllowsGroup reports whether users of the group may call the tools of the server.
+func (server *McpServer) AllowsGroup(group string) bool {
+	if strings.TrimSpace(server.Groups) == "" {
+		return true
+	}
+	for _, allowed := range strings.Split(server.Groups, ",") {
+		if strings.TrimSpace(allowed) == group {
+			return true
+		}
+	}
+	return false
+}
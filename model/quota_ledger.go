@@ -0,0 +1,366 @@
+package model
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/QuantumNous/new-api/common"
+
+	"github.com/bytedance/gopkg/util/gopool"
+	"gorm.io/gorm"
+)
+
+const (
+	QuotaAccountUser  = "user"
+	QuotaAccountToken = "token"
+	// the counter account of every movement, its legs are grouped by reason
+	QuotaAccountSystem = "system"
+)
+
+const (
+	// the balance an account had when its first movement was recorded
+	QuotaReasonOpening      = "opening"
+	QuotaReasonPreConsume   = "pre_consume"
+	QuotaReasonConsume      = "consume"
+	QuotaReasonRefund       = "refund"
+	QuotaReasonTaskRefund   = "task_refund"
+	QuotaReasonTopUp        = "topup"
+	QuotaReasonRedeem       = "redeem"
+	QuotaReasonSubscription = "subscription"
+	QuotaReasonAdmin        = "admin"
+	QuotaReasonTokenEdit    = "token_edit"
+	// written by a repair of the reconciliation to take a drift into the ledger
+	QuotaReasonReconcile = "reconcile"
+)
+
+// QuotaLedgerEntry is one leg of a quota movement. Every movement is a transaction of two legs that sum to zero,
+// one on the user or token account with the balance the account has after it, one on the system account.
+type QuotaLedgerEntry struct {
+	Id            int64  `json:"id"`
+	TransactionId string `json:"transaction_id" gorm:"type:varchar(64);index"`
+	AccountType   string `json:"account_type" gorm:"type:varchar(16);index:idx_ledger_account,priority:1"`
+	AccountId     int    `json:"account_id" gorm:"index:idx_ledger_account,priority:2"`
+	UserId        int    `json:"user_id" gorm:"index"`
+	Delta         int    `json:"delta"`
+	Balance       int    `json:"balance"`
+	Reason        string `json:"reason" gorm:"type:varchar(32)"`
+	Reference     string `json:"reference" gorm:"type:varchar(128);index"`
+	CreatedAt     int64  `json:"created_at" gorm:"bigint;index"`
+}
+
+// QuotaMovement says why a balance changes, Reference points at what caused it: a request id, a trade no or a
+// task id.
+type QuotaMovement struct {
+	Reason    string
+	Reference string
+}
+
+type quotaLedgerAccount struct {
+	accountType string
+	accountId   int
+}
+
+type pendingQuotaMovement struct {
+	delta     int
+	movement  QuotaMovement
+	createdAt int64
+}
+
+var (
+	quotaLedgerBatch     = make(map[quotaLedgerAccount][]pendingQuotaMovement)
+	quotaLedgerBatchLock sync.Mutex
+	// accounts known to have their opening entry, entries are never deleted
+	quotaLedgerOpened sync.Map
+)
+
+func quotaLedgerLegs(account quotaLedgerAccount, userId int, delta int, balance int, movement QuotaMovement, createdAt int64) []*QuotaLedgerEntry {
+	transactionId := common.GetUUID()
+	return []*QuotaLedgerEntry{
+		{
+			TransactionId: transactionId,
+			AccountType:   account.accountType,
+			AccountId:     account.accountId,
+			UserId:        userId,
+			Delta:         delta,
+			Balance:       balance,
+			Reason:        movement.Reason,
+			Reference:     movement.Reference,
+			CreatedAt:     createdAt,
+		},
+		{
+			TransactionId: transactionId,
+			AccountType:   QuotaAccountSystem,
+			UserId:        userId,
+			Delta:         -delta,
+			Reason:        movement.Reason,
+			Reference:     movement.Reference,
+			CreatedAt:     createdAt,
+		},
+	}
+}
+
+// openingQuotaLedgerLegs returns the opening transaction of an account without entries, the balance it had
+// before the movements being recorded.
+func openingQuotaLedgerLegs(tx *gorm.DB, account quotaLedgerAccount, userId int, balanceBefore int) ([]*QuotaLedgerEntry, error) {
+	if _, ok := quotaLedgerOpened.Load(account); ok {
+		return nil, nil
+	}
+	var ids []int64
+	err := tx.Model(&QuotaLedgerEntry{}).Where("account_type = ? AND account_id = ?", account.accountType, account.accountId).
+		Limit(1).Pluck("id", &ids).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) > 0 {
+		quotaLedgerOpened.Store(account, true)
+		return nil, nil
+	}
+	if balanceBefore == 0 {
+		return nil, nil
+	}
+	return quotaLedgerLegs(account, userId, balanceBefore, balanceBefore, QuotaMovement{Reason: QuotaReasonOpening}, common.GetTimestamp()), nil
+}
+
+// applyQuotaMovements changes the balance of the account by the movements and records them in the transaction.
+func applyQuotaMovements(tx *gorm.DB, account quotaLedgerAccount, movements []pendingQuotaMovement) error {
+	total := 0
+	for _, movement := range movements {
+		total += movement.delta
+	}
+	var (
+		result  *gorm.DB
+		userId  int
+		balance int
+	)
+	switch account.accountType {
+	case QuotaAccountUser:
+		result = tx.Model(&User{}).Where("id = ?", account.accountId).Update("quota", gorm.Expr("quota + ?", total))
+		if result.Error == nil && result.RowsAffected > 0 {
+			userId = account.accountId
+			result = tx.Model(&User{}).Where("id = ?", account.accountId).Select("quota").Find(&balance)
+		}
+	case QuotaAccountToken:
+		result = tx.Model(&Token{}).Where("id = ?", account.accountId).Updates(
+			map[string]interface{}{
+				"remain_quota":  gorm.Expr("remain_quota + ?", total),
+				"used_quota":    gorm.Expr("used_quota - ?", total),
+				"accessed_time": common.GetTimestamp(),
+			},
+		)
+		if result.Error == nil && result.RowsAffected > 0 {
+			token := Token{}
+			result = tx.Select("id", "user_id", "remain_quota").Where("id = ?", account.accountId).First(&token)
+			userId, balance = token.UserId, token.RemainQuota
+		}
+	default:
+		return fmt.Errorf("unknown quota account type %s", account.accountType)
+	}
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil
+	}
+	return recordQuotaMovements(tx, account, userId, balance, movements)
+}
+
+// recordQuotaMovements writes the legs of movements that brought the account to balance.
+func recordQuotaMovements(tx *gorm.DB, account quotaLedgerAccount, userId int, balance int, movements []pendingQuotaMovement) error {
+	running := balance
+	for _, movement := range movements {
+		running -= movement.delta
+	}
+	entries, err := openingQuotaLedgerLegs(tx, account, userId, running)
+	if err != nil {
+		return err
+	}
+	for _, movement := range movements {
+		running += movement.delta
+		entries = append(entries, quotaLedgerLegs(account, userId, movement.delta, running, movement.movement, movement.createdAt)...)
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	return tx.Create(&entries).Error
+}
+
+func addQuotaLedgerRecord(account quotaLedgerAccount, delta int, movement QuotaMovement) {
+	quotaLedgerBatchLock.Lock()
+	defer quotaLedgerBatchLock.Unlock()
+	quotaLedgerBatch[account] = append(quotaLedgerBatch[account], pendingQuotaMovement{
+		delta:     delta,
+		movement:  movement,
+		createdAt: common.GetTimestamp(),
+	})
+}
+
+// flushQuotaLedgerBatch writes the movements held by the batch updater, each account with its entries in one
+// transaction.
+func flushQuotaLedgerBatch() {
+	quotaLedgerBatchLock.Lock()
+	batch := quotaLedgerBatch
+	quotaLedgerBatch = make(map[quotaLedgerAccount][]pendingQuotaMovement)
+	quotaLedgerBatchLock.Unlock()
+	for account, movements := range batch {
+		err := DB.Transaction(func(tx *gorm.DB) error {
+			return applyQuotaMovements(tx, account, movements)
+		})
+		if err != nil {
+			common.SysLog(fmt.Sprintf("failed to batch update %s %d quota: %s", account.accountType, account.accountId, err.Error()))
+		}
+	}
+}
+
+func hasQuotaLedgerBatch() bool {
+	quotaLedgerBatchLock.Lock()
+	defer quotaLedgerBatchLock.Unlock()
+	return len(quotaLedgerBatch) > 0
+}
+
+// AdjustUserQuota changes the quota of the user by delta and records the movement in the ledger, with the batch
+// updater both are written at the next batch unless db is set.
+func AdjustUserQuota(userId int, delta int, movement QuotaMovement, db bool) error {
+	if delta == 0 {
+		return nil
+	}
+	gopool.Go(func() {
+		var err error
+		if delta > 0 {
+			err = cacheIncrUserQuota(userId, int64(delta))
+		} else {
+			err = cacheDecrUserQuota(userId, int64(-delta))
+		}
+		if err != nil {
+			common.SysLog("failed to update user quota cache: " + err.Error())
+		}
+	})
+	account := quotaLedgerAccount{accountType: QuotaAccountUser, accountId: userId}
+	if !db && common.BatchUpdateEnabled {
+		addQuotaLedgerRecord(account, delta, movement)
+		return nil
+	}
+	return DB.Transaction(func(tx *gorm.DB) error {
+		return adjustUserQuota(tx, userId, delta, movement)
+	})
+}
+
+// adjustUserQuota changes the quota of the user in the transaction of the caller, who takes care of the cache.
+func adjustUserQuota(tx *gorm.DB, userId int, delta int, movement QuotaMovement) error {
+	if delta == 0 {
+		return nil
+	}
+	account := quotaLedgerAccount{accountType: QuotaAccountUser, accountId: userId}
+	return applyQuotaMovements(tx, account, []pendingQuotaMovement{{delta: delta, movement: movement, createdAt: common.GetTimestamp()}})
+}
+
+// AdjustTokenQuota changes the remaining quota of the token by delta, its used quota by the opposite, and records
+// the movement in the ledger.
+func AdjustTokenQuota(tokenId int, key string, delta int, movement QuotaMovement) error {
+	if delta == 0 {
+		return nil
+	}
+	if common.RedisEnabled {
+		gopool.Go(func() {
+			var err error
+			if delta > 0 {
+				err = cacheIncrTokenQuota(key, int64(delta))
+			} else {
+				err = cacheDecrTokenQuota(key, int64(-delta))
+			}
+			if err != nil {
+				common.SysLog("failed to update token quota cache: " + err.Error())
+			}
+		})
+	}
+	account := quotaLedgerAccount{accountType: QuotaAccountToken, accountId: tokenId}
+	if common.BatchUpdateEnabled {
+		addQuotaLedgerRecord(account, delta, movement)
+		return nil
+	}
+	return DB.Transaction(func(tx *gorm.DB) error {
+		return applyQuotaMovements(tx, account, []pendingQuotaMovement{{delta: delta, movement: movement, createdAt: common.GetTimestamp()}})
+	})
+}
+
+// adjustTokenRemainQuota changes the remaining quota of the token in the transaction of the caller without counting
+// it as used, as when its owner edits it, and returns the new remaining quota.
+func adjustTokenRemainQuota(tx *gorm.DB, tokenId int, delta int, movement QuotaMovement) (int, error) {
+	account := quotaLedgerAccount{accountType: QuotaAccountToken, accountId: tokenId}
+	err := tx.Model(&Token{}).Where("id = ?", tokenId).Update("remain_quota", gorm.Expr("remain_quota + ?", delta)).Error
+	if err != nil {
+		return 0, err
+	}
+	userId, balance, err := getQuotaAccountBalance(tx, account)
+	if err != nil {
+		return 0, err
+	}
+	err = recordQuotaMovements(tx, account, userId, balance, []pendingQuotaMovement{{delta: delta, movement: movement, createdAt: common.GetTimestamp()}})
+	return balance, err
+}
+
+// EditWithQuota saves the user like Edit, but its quota is changed by delta in the same transaction and recorded
+// in the ledger instead of being overwritten.
+func (user *User) EditWithQuota(updatePassword bool, delta int, movement QuotaMovement) error {
+	var err error
+	if updatePassword {
+		user.Password, err = common.Password2Hash(user.Password)
+		if err != nil {
+			return err
+		}
+	}
+	updates := map[string]interface{}{
+		"username":     user.Username,
+		"display_name": user.DisplayName,
+		"group":        user.Group,
+		"remark":       user.Remark,
+	}
+	if updatePassword {
+		updates["password"] = user.Password
+	}
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&User{}).Where("id = ?", user.Id).Updates(updates).Error; err != nil {
+			return err
+		}
+		return adjustUserQuota(tx, user.Id, delta, movement)
+	})
+	if err != nil {
+		return err
+	}
+	return invalidateUserCache(user.Id)
+}
+
+func getQuotaAccountBalance(tx *gorm.DB, account quotaLedgerAccount) (userId int, balance int, err error) {
+	switch account.accountType {
+	case QuotaAccountUser:
+		err = tx.Set("gorm:query_option", "FOR UPDATE").Model(&User{}).Where("id = ?", account.accountId).Select("quota").Find(&balance).Error
+		return account.accountId, balance, err
+	case QuotaAccountToken:
+		token := Token{}
+		err = tx.Set("gorm:query_option", "FOR UPDATE").Unscoped().Select("id", "user_id", "remain_quota").
+			Where("id = ?", account.accountId).First(&token).Error
+		return token.UserId, token.RemainQuota, err
+	default:
+		return 0, 0, fmt.Errorf("unknown quota account type %s", account.accountType)
+	}
+}
+
+func GetQuotaLedgerEntries(accountType string, accountId int, userId int, reference string, pageInfo *common.PageInfo) (entries []*QuotaLedgerEntry, total int64, err error) {
+	query := DB.Model(&QuotaLedgerEntry{})
+	if accountType != "" {
+		query = query.Where("account_type = ?", accountType)
+	}
+	if accountId != 0 {
+		query = query.Where("account_id = ?", accountId)
+	}
+	if userId != 0 {
+		query = query.Where("user_id = ?", userId)
+	}
+	if reference != "" {
+		query = query.Where("reference = ?", reference)
+	}
+	if err = query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	err = query.Order("id desc").Limit(pageInfo.GetPageSize()).Offset(pageInfo.GetStartIdx()).Find(&entries).Error
+	return entries, total, err
+}
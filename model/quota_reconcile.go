@@ -0,0 +1,220 @@
+package model
+
+import (
+	"fmt"
+
+	"github.com/QuantumNous/new-api/common"
+
+	"gorm.io/gorm"
+)
+
+// QuotaDrift is an account whose balance, ledger and cache do not agree.
+type QuotaDrift struct {
+	AccountType string `json:"account_type"`
+	AccountId   int    `json:"account_id"`
+	UserId      int    `json:"user_id"`
+	// users.quota or tokens.remain_quota
+	Balance int `json:"balance"`
+	// sum of the legs of the account
+	LedgerSum int `json:"ledger_sum"`
+	// balance recorded with the last leg of the account
+	LedgerBalance int  `json:"ledger_balance"`
+	CachedBalance *int `json:"cached_balance,omitempty"`
+
+	tokenKey string
+}
+
+func (drift *QuotaDrift) ledgerDrifted() bool {
+	return drift.Balance != drift.LedgerSum || drift.LedgerBalance != drift.LedgerSum
+}
+
+func (drift *QuotaDrift) cacheDrifted() bool {
+	return drift.CachedBalance != nil && *drift.CachedBalance != drift.Balance
+}
+
+type QuotaReconciliation struct {
+	CheckedAt int64 `json:"checked_at"`
+	// accounts with ledger entries, those never moved since the ledger exists are not checked
+	Accounts int `json:"accounts"`
+	// sum of the legs of all transactions, anything but 0 means a leg is missing
+	Imbalance int64        `json:"imbalance"`
+	Drifts    []QuotaDrift `json:"drifts"`
+	Repaired  int          `json:"repaired"`
+}
+
+type quotaLedgerSum struct {
+	AccountType string
+	AccountId   int
+	LedgerSum   int
+	LastId      int64
+}
+
+const quotaReconcileChunk = 500
+
+// ReconcileQuotaLedger compares the balance of every account in the ledger with the sum of its legs and with the
+// Redis cache. Movements held by the batch updater of other nodes show as cache drift until they are written.
+// With repair, a reconcile movement takes each balance drift into the ledger and drifted caches are dropped.
+func ReconcileQuotaLedger(repair bool) (*QuotaReconciliation, error) {
+	flushQuotaLedgerBatch()
+	reconciliation := &QuotaReconciliation{CheckedAt: common.GetTimestamp(), Drifts: make([]QuotaDrift, 0)}
+	err := DB.Model(&QuotaLedgerEntry{}).Select("COALESCE(SUM(delta), 0)").Scan(&reconciliation.Imbalance).Error
+	if err != nil {
+		return nil, err
+	}
+	var sums []quotaLedgerSum
+	err = DB.Model(&QuotaLedgerEntry{}).Select("account_type, account_id, SUM(delta) AS ledger_sum, MAX(id) AS last_id").
+		Where("account_type IN ?", []string{QuotaAccountUser, QuotaAccountToken}).
+		Group("account_type, account_id").Scan(&sums).Error
+	if err != nil {
+		return nil, err
+	}
+	reconciliation.Accounts = len(sums)
+	for start := 0; start < len(sums); start += quotaReconcileChunk {
+		drifts, err := findQuotaDrifts(sums[start:min(start+quotaReconcileChunk, len(sums))])
+		if err != nil {
+			return nil, err
+		}
+		for _, drift := range drifts {
+			// a movement may have landed between the reads, the account is checked again under its lock
+			account := quotaLedgerAccount{accountType: drift.AccountType, accountId: drift.AccountId}
+			var confirmed *QuotaDrift
+			err = DB.Transaction(func(tx *gorm.DB) error {
+				var err error
+				confirmed, err = checkQuotaAccount(tx, account, drift.CachedBalance)
+				if err != nil || confirmed == nil || !repair || !confirmed.ledgerDrifted() {
+					return err
+				}
+				return recordQuotaMovements(tx, account, confirmed.UserId, confirmed.Balance, []pendingQuotaMovement{{
+					delta:     confirmed.Balance - confirmed.LedgerSum,
+					movement:  QuotaMovement{Reason: QuotaReasonReconcile},
+					createdAt: common.GetTimestamp(),
+				}})
+			})
+			if err != nil {
+				return nil, err
+			}
+			if confirmed == nil {
+				continue
+			}
+			reconciliation.Drifts = append(reconciliation.Drifts, *confirmed)
+			if !repair {
+				continue
+			}
+			if confirmed.cacheDrifted() {
+				if drift.AccountType == QuotaAccountUser {
+					err = invalidateUserCache(drift.AccountId)
+				} else {
+					err = cacheDeleteToken(drift.tokenKey)
+				}
+				if err != nil {
+					common.SysLog(fmt.Sprintf("failed to drop the cache of %s %d: %s", drift.AccountType, drift.AccountId, err.Error()))
+				}
+			}
+			reconciliation.Repaired++
+		}
+	}
+	return reconciliation, nil
+}
+
+// findQuotaDrifts reads the balances of a chunk of accounts and returns those that look drifted.
+func findQuotaDrifts(sums []quotaLedgerSum) ([]QuotaDrift, error) {
+	lastIds := make([]int64, 0, len(sums))
+	userIds := make([]int, 0, len(sums))
+	tokenIds := make([]int, 0, len(sums))
+	for _, sum := range sums {
+		lastIds = append(lastIds, sum.LastId)
+		if sum.AccountType == QuotaAccountUser {
+			userIds = append(userIds, sum.AccountId)
+		} else {
+			tokenIds = append(tokenIds, sum.AccountId)
+		}
+	}
+	var lastEntries []QuotaLedgerEntry
+	if err := DB.Select("id", "balance").Where("id IN ?", lastIds).Find(&lastEntries).Error; err != nil {
+		return nil, err
+	}
+	lastBalances := make(map[int64]int, len(lastEntries))
+	for _, entry := range lastEntries {
+		lastBalances[entry.Id] = entry.Balance
+	}
+	var users []User
+	if len(userIds) > 0 {
+		if err := DB.Unscoped().Select("id", "quota").Where("id IN ?", userIds).Find(&users).Error; err != nil {
+			return nil, err
+		}
+	}
+	userBalances := make(map[int]int, len(users))
+	for _, user := range users {
+		userBalances[user.Id] = user.Quota
+	}
+	var tokens []Token
+	if len(tokenIds) > 0 {
+		if err := DB.Unscoped().Select("id", "user_id", commonKeyCol, "remain_quota").Where("id IN ?", tokenIds).Find(&tokens).Error; err != nil {
+			return nil, err
+		}
+	}
+	tokensById := make(map[int]Token, len(tokens))
+	for _, token := range tokens {
+		tokensById[token.Id] = token
+	}
+
+	drifts := make([]QuotaDrift, 0)
+	for _, sum := range sums {
+		drift := QuotaDrift{
+			AccountType:   sum.AccountType,
+			AccountId:     sum.AccountId,
+			UserId:        sum.AccountId,
+			LedgerSum:     sum.LedgerSum,
+			LedgerBalance: lastBalances[sum.LastId],
+		}
+		if sum.AccountType == QuotaAccountUser {
+			drift.Balance = userBalances[sum.AccountId]
+			if common.RedisEnabled {
+				if cached, err := getUserQuotaCache(sum.AccountId); err == nil {
+					drift.CachedBalance = &cached
+				}
+			}
+		} else {
+			token := tokensById[sum.AccountId]
+			drift.UserId = token.UserId
+			drift.Balance = token.RemainQuota
+			drift.tokenKey = token.Key
+			if common.RedisEnabled && token.Key != "" {
+				if cached, err := cacheGetTokenByKey(token.Key); err == nil {
+					drift.CachedBalance = &cached.RemainQuota
+				}
+			}
+		}
+		if drift.ledgerDrifted() || drift.cacheDrifted() {
+			drifts = append(drifts, drift)
+		}
+	}
+	return drifts, nil
+}
+
+// checkQuotaAccount reads the account again with its row locked, nil is returned when its ledger agrees with the
+// balance and the cache.
+func checkQuotaAccount(tx *gorm.DB, account quotaLedgerAccount, cachedBalance *int) (*QuotaDrift, error) {
+	userId, balance, err := getQuotaAccountBalance(tx, account)
+	if err != nil {
+		return nil, err
+	}
+	drift := &QuotaDrift{
+		AccountType:   account.accountType,
+		AccountId:     account.accountId,
+		UserId:        userId,
+		Balance:       balance,
+		CachedBalance: cachedBalance,
+	}
+	query := tx.Model(&QuotaLedgerEntry{}).Where("account_type = ? AND account_id = ?", account.accountType, account.accountId)
+	if err = query.Session(&gorm.Session{}).Select("COALESCE(SUM(delta), 0)").Scan(&drift.LedgerSum).Error; err != nil {
+		return nil, err
+	}
+	if err = query.Session(&gorm.Session{}).Select("balance").Order("id desc").Limit(1).Scan(&drift.LedgerBalance).Error; err != nil {
+		return nil, err
+	}
+	if !drift.ledgerDrifted() && !drift.cacheDrifted() {
+		return nil, nil
+	}
+	return drift, nil
+}
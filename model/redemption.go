@@ -137,7 +137,10 @@ func Redeem(key string, userId int) (quota int, err error) {
 		if redemption.ExpiredTime != 0 && redemption.ExpiredTime < common.GetTimestamp() {
 			return errors.New("The redemption code has expired.")
 		}
-		err = tx.Model(&User{}).Where("id = ?", userId).Update("quota", gorm.Expr("quota + ?", redemption.Quota)).Error
+		err = adjustUserQuota(tx, userId, redemption.Quota, QuotaMovement{
+			Reason:    QuotaReasonRedeem,
+			Reference: fmt.Sprintf("redemption:%d", redemption.Id),
+		})
 		if err != nil {
 			return err
 		}
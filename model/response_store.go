@@ -0,0 +1,78 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+)
+
+// StoredResponse is a Responses API call kept by the gateway, the input holds only the items sent with
+// this call, the earlier turns are found by following the previous response ids. ConversationId is the id of the
+// first response of the conversation, the turns of a conversation are loaded together.
+type StoredResponse struct {
+	Id                 string `json:"id" gorm:"type:varchar(64);primaryKey"`
+	UserId             int    `json:"-" gorm:"index"`
+	TokenId            int    `json:"-" gorm:"index"`
+	Model              string `json:"model" gorm:"type:varchar(255)"`
+	PreviousResponseId string `json:"previous_response_id" gorm:"type:varchar(64)"`
+	ConversationId     string `json:"-" gorm:"type:varchar(64);index"`
+	Input              string `json:"input" gorm:"type:text"`
+	Response           string `json:"response" gorm:"type:text"`
+	CreatedAt          int64  `json:"created_at" gorm:"bigint;index"`
+	ExpiresAt          int64  `json:"expires_at,omitempty" gorm:"bigint;index"`
+}
+
+func (response *StoredResponse) Insert() error {
+	if response.CreatedAt == 0 {
+		response.CreatedAt = common.GetTimestamp()
+	}
+	// a response id is unique upstream, saving it again replaces the earlier record
+	return DB.Save(response).Error
+}
+
+// GetUserStoredResponseById returns the stored response when it belongs to the user and has not expired.
+func GetUserStoredResponseById(id string, userId int) (*StoredResponse, error) {
+	if id == "" {
+		return nil, errors.New("response id is empty")
+	}
+	var response StoredResponse
+	err := DB.Where("id = ? and user_id = ? and (expires_at = 0 or expires_at > ?)", id, userId, common.GetTimestamp()).
+		First(&response).Error
+	if err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// GetUserStoredConversation returns the stored responses of the user that belong to the conversation and have
+// not expired, in no particular order.
+func GetUserStoredConversation(conversationId string, userId int) ([]*StoredResponse, error) {
+	var responses []*StoredResponse
+	err := DB.Where("conversation_id = ? and user_id = ? and (expires_at = 0 or expires_at > ?)", conversationId, userId, common.GetTimestamp()).
+		Find(&responses).Error
+	return responses, err
+}
+
+func (response *StoredResponse) Delete() error {
+	return DB.Delete(response).Error
+}
+
+func DeleteExpiredStoredResponses() (int64, error) {
+	result := DB.Where("expires_at > 0 and expires_at <= ?", common.GetTimestamp()).Delete(&StoredResponse{})
+	return result.RowsAffected, result.Error
+}
+
+// RunStoredResponseCleanup removes the stored responses that are past their retention, it runs on the master node.
+func RunStoredResponseCleanup() {
+	for {
+		deleted, err := DeleteExpiredStoredResponses()
+		if err != nil {
+			common.SysError("failed to delete expired responses: " + err.Error())
+		} else if deleted > 0 {
+			common.SysLog(fmt.Sprintf("deleted %d expired responses", deleted))
+		}
+		time.Sleep(time.Hour)
+	}
+}
@@ -0,0 +1,485 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/logger"
+
+	"gorm.io/gorm"
+)
+
+const (
+	SubscriptionPlanStatusEnabled  = 1
+	SubscriptionPlanStatusDisabled = 2
+)
+
+const (
+	SubscriptionStatusActive  = "active"
+	SubscriptionStatusExpired = "expired"
+)
+
+const (
+	SubscriptionOrderStatusPending = "pending"
+	SubscriptionOrderStatusSuccess = "success"
+	SubscriptionOrderStatusExpired = "expired"
+)
+
+// a Stripe renewal is paid when the period ends, the invoice webhook gets this long before the plan lapses
+const subscriptionRenewalGrace = 24 * time.Hour
+
+// SubscriptionPlan is a recurring plan that grants quota every period.
+type SubscriptionPlan struct {
+	Id          int    `json:"id"`
+	Name        string `json:"name" gorm:"type:varchar(64)"`
+	Description string `json:"description" gorm:"type:varchar(255)"`
+	// price of one period, charged as is by Epay, Stripe charges the recurring price StripePriceId
+	Price      float64 `json:"price"`
+	PeriodDays int     `json:"period_days"`
+	// quota granted at the start of every period
+	Quota int `json:"quota"`
+	// group subscribers are moved to, empty keeps their group
+	Group string `json:"group" gorm:"type:varchar(64);default:''"`
+	// unused plan quota is carried into the next period, up to RolloverLimit when it is above 0, and forfeited otherwise
+	Rollover      bool   `json:"rollover"`
+	RolloverLimit int    `json:"rollover_limit"`
+	StripePriceId string `json:"stripe_price_id" gorm:"type:varchar(255);default:''"`
+	Status        int    `json:"status" gorm:"default:1"`
+	CreatedTime   int64  `json:"created_time" gorm:"bigint"`
+	UpdatedTime   int64  `json:"updated_time" gorm:"bigint"`
+}
+
+// Subscription is the plan of a user, a user has at most one active subscription.
+type Subscription struct {
+	Id                   int    `json:"id"`
+	UserId               int    `json:"user_id" gorm:"index"`
+	PlanId               int    `json:"plan_id" gorm:"index"`
+	Status               string `json:"status" gorm:"type:varchar(16);index"`
+	PaymentMethod        string `json:"payment_method" gorm:"type:varchar(50)"`
+	StripeSubscriptionId string `json:"-" gorm:"type:varchar(255);index"`
+	// group the user had before the plan moved them, restored when the plan lapses
+	PreviousGroup string `json:"-" gorm:"type:varchar(64);default:''"`
+	// plan quota of the current period, the rollover included
+	PeriodQuota int   `json:"period_quota"`
+	PeriodStart int64 `json:"period_start" gorm:"bigint"`
+	NextGrantAt int64 `json:"next_grant_at" gorm:"bigint;index"`
+	// end of the periods paid for
+	PaidUntil         int64 `json:"paid_until" gorm:"bigint"`
+	CancelAtPeriodEnd bool  `json:"cancel_at_period_end"`
+	CreatedTime       int64 `json:"created_time" gorm:"bigint"`
+	UpdatedTime       int64 `json:"updated_time" gorm:"bigint"`
+}
+
+// SubscriptionOrder is a payment for a plan, the first one starts the subscription and the later ones renew it.
+type SubscriptionOrder struct {
+	Id             int     `json:"id"`
+	UserId         int     `json:"user_id" gorm:"index"`
+	PlanId         int     `json:"plan_id"`
+	SubscriptionId int     `json:"subscription_id" gorm:"index"`
+	TradeNo        string  `json:"trade_no" gorm:"unique;type:varchar(255);index"`
+	PaymentMethod  string  `json:"payment_method" gorm:"type:varchar(50)"`
+	Money          float64 `json:"money"`
+	Status         string  `json:"status" gorm:"type:varchar(16)"`
+	CreateTime     int64   `json:"create_time"`
+	CompleteTime   int64   `json:"complete_time"`
+}
+
+func (plan *SubscriptionPlan) Insert() error {
+	now := common.GetTimestamp()
+	plan.CreatedTime = now
+	plan.UpdatedTime = now
+	return DB.Create(plan).Error
+}
+
+func (plan *SubscriptionPlan) Update() error {
+	plan.UpdatedTime = common.GetTimestamp()
+	return DB.Save(plan).Error
+}
+
+func (plan *SubscriptionPlan) period() int64 {
+	return int64(plan.PeriodDays) * 24 * 3600
+}
+
+func GetSubscriptionPlanById(id int) (*SubscriptionPlan, error) {
+	var plan SubscriptionPlan
+	if err := DB.First(&plan, id).Error; err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+func GetAllSubscriptionPlans() ([]*SubscriptionPlan, error) {
+	var plans []*SubscriptionPlan
+	err := DB.Order("id asc").Find(&plans).Error
+	return plans, err
+}
+
+func GetEnabledSubscriptionPlans() ([]*SubscriptionPlan, error) {
+	var plans []*SubscriptionPlan
+	err := DB.Where("status = ?", SubscriptionPlanStatusEnabled).Order("price asc, id asc").Find(&plans).Error
+	return plans, err
+}
+
+// DeleteSubscriptionPlanById deletes a plan nobody is subscribed to.
+func DeleteSubscriptionPlanById(id int) error {
+	var cnt int64
+	if err := DB.Model(&Subscription{}).Where("plan_id = ? AND status = ?", id, SubscriptionStatusActive).Count(&cnt).Error; err != nil {
+		return err
+	}
+	if cnt > 0 {
+		return errors.New("The plan has active subscriptions, disable it instead.")
+	}
+	return DB.Delete(&SubscriptionPlan{}, id).Error
+}
+
+func GetUserActiveSubscription(userId int) (*Subscription, error) {
+	var subscription Subscription
+	err := DB.Where("user_id = ? AND status = ?", userId, SubscriptionStatusActive).First(&subscription).Error
+	if err != nil {
+		return nil, err
+	}
+	return &subscription, nil
+}
+
+func GetSubscriptionByStripeId(stripeSubscriptionId string) (*Subscription, error) {
+	var subscription Subscription
+	err := DB.Where("stripe_subscription_id = ?", stripeSubscriptionId).Order("id desc").First(&subscription).Error
+	if err != nil {
+		return nil, err
+	}
+	return &subscription, nil
+}
+
+func GetUserSubscriptions(userId int, pageInfo *common.PageInfo) (subscriptions []*Subscription, total int64, err error) {
+	query := DB.Model(&Subscription{}).Where("user_id = ?", userId)
+	if err = query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	err = query.Order("id desc").Limit(pageInfo.GetPageSize()).Offset(pageInfo.GetStartIdx()).Find(&subscriptions).Error
+	return subscriptions, total, err
+}
+
+func GetAllSubscriptions(status string, pageInfo *common.PageInfo) (subscriptions []*Subscription, total int64, err error) {
+	query := DB.Model(&Subscription{})
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if err = query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	err = query.Order("id desc").Limit(pageInfo.GetPageSize()).Offset(pageInfo.GetStartIdx()).Find(&subscriptions).Error
+	return subscriptions, total, err
+}
+
+func (order *SubscriptionOrder) Insert() error {
+	return DB.Create(order).Error
+}
+
+func GetSubscriptionOrderByTradeNo(tradeNo string) *SubscriptionOrder {
+	var order SubscriptionOrder
+	if err := DB.Where("trade_no = ?", tradeNo).First(&order).Error; err != nil {
+		return nil
+	}
+	return &order
+}
+
+// ExpireSubscriptionOrder closes a pending order whose checkout expired.
+func ExpireSubscriptionOrder(tradeNo string) error {
+	return DB.Model(&SubscriptionOrder{}).Where("trade_no = ? AND status = ?", tradeNo, SubscriptionOrderStatusPending).
+		Update("status", SubscriptionOrderStatusExpired).Error
+}
+
+// setUserGroup changes the group in the transaction, the caller invalidates the user cache once it commits.
+func setUserGroup(tx *gorm.DB, userId int, group string) error {
+	return tx.Model(&User{}).Where("id = ?", userId).Update("group", group).Error
+}
+
+// grantSubscriptionPeriod starts the next period of the subscription and grants the plan quota. The quota the user
+// bought is taken to be spent first, the balance up to the quota of the period is carried over or forfeited.
+func grantSubscriptionPeriod(tx *gorm.DB, subscription *Subscription, plan *SubscriptionPlan, start int64) (granted int, forfeited int, err error) {
+	rollover := 0
+	if subscription.PeriodQuota > 0 {
+		var user User
+		if err = tx.Select("id", "quota").Where("id = ?", subscription.UserId).First(&user).Error; err != nil {
+			return 0, 0, err
+		}
+		leftover := max(min(user.Quota, subscription.PeriodQuota), 0)
+		if plan.Rollover {
+			rollover = leftover
+			if plan.RolloverLimit > 0 {
+				rollover = min(rollover, plan.RolloverLimit)
+			}
+		}
+		forfeited = leftover - rollover
+	}
+	granted = plan.Quota
+	movement := QuotaMovement{Reason: QuotaReasonSubscription, Reference: fmt.Sprintf("subscription:%d", subscription.Id)}
+	var movements []pendingQuotaMovement
+	for _, delta := range []int{granted, -forfeited} {
+		if delta != 0 {
+			movements = append(movements, pendingQuotaMovement{delta: delta, movement: movement, createdAt: common.GetTimestamp()})
+		}
+	}
+	if len(movements) > 0 {
+		err = applyQuotaMovements(tx, quotaLedgerAccount{accountType: QuotaAccountUser, accountId: subscription.UserId}, movements)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	subscription.PeriodQuota = plan.Quota + rollover
+	subscription.PeriodStart = start
+	subscription.NextGrantAt = start + plan.period()
+	return granted, forfeited, nil
+}
+
+func recordSubscriptionGrant(subscription *Subscription, plan *SubscriptionPlan, granted int, forfeited int) {
+	RecordLog(subscription.UserId, LogTypeTopup, fmt.Sprintf("Subscription %s period started, granted quota: %v",
+		plan.Name, logger.FormatQuota(granted)))
+	if forfeited > 0 {
+		RecordLog(subscription.UserId, LogTypeManage, fmt.Sprintf("Subscription %s unused quota of the last period forfeited: %v",
+			plan.Name, logger.FormatQuota(forfeited)))
+	}
+}
+
+// CompleteSubscriptionOrder records the payment of a pending order. A user without a subscription of the plan is
+// subscribed and granted the first period, a payment for the plan they are subscribed to pays for one more period.
+func CompleteSubscriptionOrder(tradeNo string, stripeCustomerId string, stripeSubscriptionId string) error {
+	if tradeNo == "" {
+		return errors.New("Payment order number not provided.")
+	}
+	var (
+		subscription *Subscription
+		plan         *SubscriptionPlan
+		granted      int
+		forfeited    int
+		started      bool
+		oldGroup     string
+	)
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		order := &SubscriptionOrder{}
+		err := tx.Set("gorm:query_option", "FOR UPDATE").Where("trade_no = ?", tradeNo).First(order).Error
+		if err != nil {
+			return errors.New("The subscription order does not exist.")
+		}
+		if order.Status != SubscriptionOrderStatusPending {
+			return errors.New("Subscription order status error")
+		}
+		plan = &SubscriptionPlan{}
+		if err = tx.First(plan, order.PlanId).Error; err != nil {
+			return err
+		}
+		if plan.PeriodDays <= 0 {
+			return errors.New("The plan has no period.")
+		}
+		now := common.GetTimestamp()
+
+		subscription = &Subscription{}
+		err = tx.Where("user_id = ? AND status = ?", order.UserId, SubscriptionStatusActive).First(subscription).Error
+		switch {
+		case err == nil && subscription.PlanId == order.PlanId:
+			subscription.PaidUntil = max(subscription.PaidUntil, subscription.NextGrantAt) + plan.period()
+			subscription.CancelAtPeriodEnd = false
+		case err == nil:
+			return errors.New("The user is subscribed to another plan.")
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			var user User
+			if err = tx.Select("id", "group").Where("id = ?", order.UserId).First(&user).Error; err != nil {
+				return err
+			}
+			subscription = &Subscription{
+				UserId:        order.UserId,
+				PlanId:        plan.Id,
+				Status:        SubscriptionStatusActive,
+				PaymentMethod: order.PaymentMethod,
+				CreatedTime:   now,
+			}
+			if err = tx.Create(subscription).Error; err != nil {
+				return err
+			}
+			if granted, forfeited, err = grantSubscriptionPeriod(tx, subscription, plan, now); err != nil {
+				return err
+			}
+			subscription.PaidUntil = subscription.NextGrantAt
+			if plan.Group != "" && user.Group != plan.Group {
+				subscription.PreviousGroup = user.Group
+				oldGroup = user.Group
+				if err = setUserGroup(tx, order.UserId, plan.Group); err != nil {
+					return err
+				}
+			}
+			started = true
+		default:
+			return err
+		}
+		if stripeSubscriptionId != "" {
+			subscription.StripeSubscriptionId = stripeSubscriptionId
+		}
+		subscription.UpdatedTime = now
+		if err = tx.Save(subscription).Error; err != nil {
+			return err
+		}
+		if stripeCustomerId != "" {
+			if err = tx.Model(&User{}).Where("id = ?", order.UserId).Update("stripe_customer", stripeCustomerId).Error; err != nil {
+				return err
+			}
+		}
+		order.SubscriptionId = subscription.Id
+		order.Status = SubscriptionOrderStatusSuccess
+		order.CompleteTime = now
+		return tx.Save(order).Error
+	})
+	if err != nil {
+		return errors.New("Subscription failed, " + err.Error())
+	}
+	_ = invalidateUserCache(subscription.UserId)
+	if started {
+		recordSubscriptionGrant(subscription, plan, granted, forfeited)
+		if oldGroup != "" {
+			RecordLog(subscription.UserId, LogTypeManage, fmt.Sprintf("Subscription %s moved the user from group %s to %s",
+				plan.Name, oldGroup, plan.Group))
+		}
+	} else {
+		RecordLog(subscription.UserId, LogTypeTopup, fmt.Sprintf("Subscription %s renewed, paid until %s",
+			plan.Name, time.Unix(subscription.PaidUntil, 0).Format(time.DateTime)))
+	}
+	return nil
+}
+
+// RenewStripeSubscription records a paid renewal invoice of a Stripe subscription, the invoice id makes the
+// webhook idempotent. An error makes Stripe deliver the invoice again.
+func RenewStripeSubscription(stripeSubscriptionId string, invoiceId string, money float64) error {
+	if order := GetSubscriptionOrderByTradeNo(invoiceId); order != nil {
+		switch order.Status {
+		case SubscriptionOrderStatusSuccess:
+			return nil
+		case SubscriptionOrderStatusPending:
+			// an earlier delivery recorded the order but failed to complete it
+			return CompleteSubscriptionOrder(invoiceId, "", "")
+		default:
+			return fmt.Errorf("renewal order %s is %s", invoiceId, order.Status)
+		}
+	}
+	subscription, err := GetSubscriptionByStripeId(stripeSubscriptionId)
+	if err != nil {
+		return fmt.Errorf("subscription %s not found", stripeSubscriptionId)
+	}
+	if subscription.Status != SubscriptionStatusActive {
+		return fmt.Errorf("subscription %s is not active", stripeSubscriptionId)
+	}
+	order := &SubscriptionOrder{
+		UserId:         subscription.UserId,
+		PlanId:         subscription.PlanId,
+		SubscriptionId: subscription.Id,
+		TradeNo:        invoiceId,
+		PaymentMethod:  subscription.PaymentMethod,
+		Money:          money,
+		Status:         SubscriptionOrderStatusPending,
+		CreateTime:     common.GetTimestamp(),
+	}
+	if err = order.Insert(); err != nil {
+		return err
+	}
+	return CompleteSubscriptionOrder(invoiceId, "", "")
+}
+
+// CancelSubscriptionAtPeriodEnd stops the renewal, the subscription lapses when the periods paid for end.
+func CancelSubscriptionAtPeriodEnd(subscription *Subscription) error {
+	subscription.CancelAtPeriodEnd = true
+	subscription.UpdatedTime = common.GetTimestamp()
+	return DB.Model(subscription).Select("cancel_at_period_end", "updated_time").Updates(subscription).Error
+}
+
+// processSubscription starts the next period of a subscription that is due, or lets it lapse when the next
+// period is not paid for.
+func processSubscription(id int, now int64) error {
+	var (
+		subscription = &Subscription{}
+		plan         = &SubscriptionPlan{}
+		granted      int
+		forfeited    int
+		lapsed       bool
+		restored     bool
+		changed      bool
+	)
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Set("gorm:query_option", "FOR UPDATE").First(subscription, id).Error
+		if err != nil {
+			return err
+		}
+		if subscription.Status != SubscriptionStatusActive || subscription.NextGrantAt > now {
+			return nil
+		}
+		if err = tx.First(plan, subscription.PlanId).Error; err != nil {
+			return err
+		}
+		if subscription.PaidUntil > subscription.NextGrantAt {
+			granted, forfeited, err = grantSubscriptionPeriod(tx, subscription, plan, subscription.NextGrantAt)
+			if err != nil {
+				return err
+			}
+		} else {
+			if subscription.StripeSubscriptionId != "" && !subscription.CancelAtPeriodEnd &&
+				now < subscription.NextGrantAt+int64(subscriptionRenewalGrace.Seconds()) {
+				return nil
+			}
+			subscription.Status = SubscriptionStatusExpired
+			lapsed = true
+			if plan.Group != "" {
+				// the group is only restored when nobody changed it while the plan ran
+				result := tx.Model(&User{}).Where("id = ? AND "+commonGroupCol+" = ?", subscription.UserId, plan.Group).
+					Update("group", subscription.PreviousGroup)
+				if result.Error != nil {
+					return result.Error
+				}
+				restored = result.RowsAffected > 0 && subscription.PreviousGroup != ""
+			}
+		}
+		subscription.UpdatedTime = now
+		changed = true
+		return tx.Save(subscription).Error
+	})
+	if err != nil || !changed {
+		return err
+	}
+	_ = invalidateUserCache(subscription.UserId)
+	if lapsed {
+		RecordLog(subscription.UserId, LogTypeManage, fmt.Sprintf("Subscription %s lapsed", plan.Name))
+		if restored {
+			RecordLog(subscription.UserId, LogTypeManage, fmt.Sprintf("Subscription %s ended, the user is back in group %s",
+				plan.Name, subscription.PreviousGroup))
+		}
+		return nil
+	}
+	recordSubscriptionGrant(subscription, plan, granted, forfeited)
+	return nil
+}
+
+// RunSubscriptionScheduler grants the periods of the subscriptions and lets the unpaid ones lapse, it runs on
+// the master node.
+func RunSubscriptionScheduler() {
+	for {
+		now := common.GetTimestamp()
+		lastId := 0
+		for {
+			var ids []int
+			err := DB.Model(&Subscription{}).Where("status = ? AND next_grant_at <= ? AND id > ?", SubscriptionStatusActive, now, lastId).
+				Order("id asc").Limit(100).Pluck("id", &ids).Error
+			if err != nil {
+				common.SysError("failed to load due subscriptions: " + err.Error())
+				break
+			}
+			for _, id := range ids {
+				if err := processSubscription(id, now); err != nil {
+					common.SysError(fmt.Sprintf("failed to process subscription %d: %s", id, err.Error()))
+				}
+				lastId = id
+			}
+			if len(ids) < 100 {
+				break
+			}
+		}
+		time.Sleep(time.Minute)
+	}
+}
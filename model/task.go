@@ -46,6 +46,7 @@ type Task struct {
 	TaskID     string                `json:"task_id" gorm:"type:varchar(191);index"` 
 	Platform   constant.TaskPlatform `json:"platform" gorm:"type:varchar(30);index"` 
 	UserId     int                   `json:"user_id" gorm:"index"`
+	TokenId    int                   `json:"token_id" gorm:"default:0"`
 	Group      string                `json:"group" gorm:"type:varchar(50)"` 
 	ChannelId  int                   `json:"channel_id" gorm:"index"`
 	Quota      int                   `json:"quota"`
@@ -100,6 +101,7 @@ type SyncTaskQueryParams struct {
 func InitTask(platform constant.TaskPlatform, relayInfo *commonRelay.RelayInfo) *Task {
 	t := &Task{
 		UserId:     relayInfo.UserId,
+		TokenId:    relayInfo.TokenId,
 		Group:      relayInfo.UsingGroup,
 		SubmitTime: time.Now().Unix(),
 		Status:     TaskStatusNotStart,
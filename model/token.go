@@ -27,6 +27,8 @@ type Token struct {
 	AllowIps           *string        `json:"allow_ips" gorm:"default:''"`
 	UsedQuota          int            `json:"used_quota" gorm:"default:0"` 
 	Group              string         `json:"group" gorm:"default:''"`
+	HedgeEnabled       bool           `json:"hedge_enabled"`
+	McpServers         string         `json:"mcp_servers" gorm:"type:varchar(1024);default:''"`
 	DeletedAt          gorm.DeletedAt `gorm:"index"`
 }
 
@@ -185,10 +187,37 @@ func (token *Token) Update() (err error) {
 		}
 	}()
 	err = DB.Model(token).Select("name", "status", "expired_time", "remain_quota", "unlimited_quota",
-		"model_limits_enabled", "model_limits", "allow_ips", "group").Updates(token).Error
+		"model_limits_enabled", "model_limits", "allow_ips", "group", "hedge_enabled", "mcp_servers").Updates(token).Error
 	return err
 }
 
+// UpdateWithQuota saves the token like Update, but its remaining quota is changed by delta in the same transaction
+// and recorded in the ledger instead of being overwritten.
+func (token *Token) UpdateWithQuota(delta int, movement QuotaMovement) (err error) {
+	if delta == 0 {
+		return token.Update()
+	}
+	defer func() {
+		if shouldUpdateRedis(true, err) {
+			gopool.Go(func() {
+				err := cacheSetToken(*token)
+				if err != nil {
+					common.SysLog("failed to update token cache: " + err.Error())
+				}
+			})
+		}
+	}()
+	return DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(token).Select("name", "status", "expired_time", "unlimited_quota",
+			"model_limits_enabled", "model_limits", "allow_ips", "group", "hedge_enabled", "mcp_servers").Updates(token).Error
+		if err != nil {
+			return err
+		}
+		token.RemainQuota, err = adjustTokenRemainQuota(tx, token.Id, delta, movement)
+		return err
+	})
+}
+
 func (token *Token) SelectUpdate() (err error) {
 	defer func() {
 		if shouldUpdateRedis(true, err) {
@@ -259,26 +288,17 @@ func DeleteTokenById(id int, userId int) (err error) {
 	if err != nil {
 		return err
 	}
-	return token.Delete()
+	if err = token.Delete(); err != nil {
+		return err
+	}
+	return DeleteTokenBudgets([]int{token.Id})
 }
 
-func IncreaseTokenQuota(id int, key string, quota int) (err error) {
+func IncreaseTokenQuota(id int, key string, quota int, movement QuotaMovement) (err error) {
 	if quota < 0 {
 		return errors.New("quota cannot be negative!")
 	}
-	if common.RedisEnabled {
-		gopool.Go(func() {
-			err := cacheIncrTokenQuota(key, int64(quota))
-			if err != nil {
-				common.SysLog("failed to increase token quota: " + err.Error())
-			}
-		})
-	}
-	if common.BatchUpdateEnabled {
-		addNewRecord(BatchUpdateTypeTokenQuota, id, quota)
-		return nil
-	}
-	return increaseTokenQuota(id, quota)
+	return AdjustTokenQuota(id, key, quota, movement)
 }
 
 func increaseTokenQuota(id int, quota int) (err error) {
@@ -292,34 +312,11 @@ func increaseTokenQuota(id int, quota int) (err error) {
 	return err
 }
 
-func DecreaseTokenQuota(id int, key string, quota int) (err error) {
+func DecreaseTokenQuota(id int, key string, quota int, movement QuotaMovement) (err error) {
 	if quota < 0 {
 		return errors.New("quota cannot be negative!")
 	}
-	if common.RedisEnabled {
-		gopool.Go(func() {
-			err := cacheDecrTokenQuota(key, int64(quota))
-			if err != nil {
-				common.SysLog("failed to decrease token quota: " + err.Error())
-			}
-		})
-	}
-	if common.BatchUpdateEnabled {
-		addNewRecord(BatchUpdateTypeTokenQuota, id, -quota)
-		return nil
-	}
-	return decreaseTokenQuota(id, quota)
-}
-
-func decreaseTokenQuota(id int, quota int) (err error) {
-	err = DB.Model(&Token{}).Where("id = ?", id).Updates(
-		map[string]interface{}{
-			"remain_quota":  gorm.Expr("remain_quota - ?", quota),
-			"used_quota":    gorm.Expr("used_quota + ?", quota),
-			"accessed_time": common.GetTimestamp(),
-		},
-	).Error
-	return err
+	return AdjustTokenQuota(id, key, -quota, movement)
 }
 
 // CountUserTokens returns total number of tokens for the given user, used for pagination
@@ -352,6 +349,14 @@ func BatchDeleteTokens(ids []int, userId int) (int, error) {
 		return 0, err
 	}
 
+	tokenIds := make([]int, 0, len(tokens))
+	for _, t := range tokens {
+		tokenIds = append(tokenIds, t.Id)
+	}
+	if err := DeleteTokenBudgets(tokenIds); err != nil {
+		common.SysLog("failed to delete token budgets: " + err.Error())
+	}
+
 	if common.RedisEnabled {
 		gopool.Go(func() {
 			for _, t := range tokens {
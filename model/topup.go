@@ -86,7 +86,11 @@ func Recharge(referenceId string, customerId string) (err error) {
 		}
 
 		quota = topUp.Money * common.QuotaPerUnit
-		err = tx.Model(&User{}).Where("id = ?", topUp.UserId).Updates(map[string]interface{}{"stripe_customer": customerId, "quota": gorm.Expr("quota + ?", quota)}).Error
+		err = tx.Model(&User{}).Where("id = ?", topUp.UserId).Update("stripe_customer", customerId).Error
+		if err != nil {
+			return err
+		}
+		err = adjustUserQuota(tx, topUp.UserId, int(quota), QuotaMovement{Reason: QuotaReasonTopUp, Reference: topUp.TradeNo})
 		if err != nil {
 			return err
 		}
@@ -288,7 +292,7 @@ func ManualCompleteTopUp(tradeNo string) error {
 		}
 
 		
-		if err := tx.Model(&User{}).Where("id = ?", topUp.UserId).Update("quota", gorm.Expr("quota + ?", quotaToAdd)).Error; err != nil {
+		if err := adjustUserQuota(tx, topUp.UserId, quotaToAdd, QuotaMovement{Reason: QuotaReasonTopUp, Reference: topUp.TradeNo}); err != nil {
 			return err
 		}
 
@@ -51,7 +51,7 @@ func addNewRecord(type_ int, id int, value int) {
 
 func batchUpdate() {
 	
-	hasData := false
+	hasData := hasQuotaLedgerBatch()
 	for i := 0; i < BatchUpdateTypeCount; i++ {
 		batchUpdateLocks[i].Lock()
 		if len(batchUpdateStores[i]) > 0 {
@@ -67,6 +67,7 @@ func batchUpdate() {
 	}
 
 	common.SysLog("batch update started")
+	flushQuotaLedgerBatch()
 	for i := 0; i < BatchUpdateTypeCount; i++ {
 		batchUpdateLocks[i].Lock()
 		store := batchUpdateStores[i]
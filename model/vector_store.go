@@ -0,0 +1,350 @@
+package model
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	VectorStoreStatusInProgress = "in_progress"
+	VectorStoreStatusCompleted  = "completed"
+	VectorStoreStatusExpired    = "expired"
+)
+
+const (
+	VectorStoreFileStatusInProgress = "in_progress"
+	VectorStoreFileStatusCompleted  = "completed"
+	VectorStoreFileStatusFailed     = "failed"
+)
+
+// chunks written in one insert statement
+const vectorStoreChunkInsertBatch = 100
+
+// VectorStore is a vector store of the gateway, the chunks of its files are embedded with EmbeddingModel.
+type VectorStore struct {
+	Id             string `json:"id" gorm:"type:varchar(64);primaryKey"`
+	UserId         int    `json:"-" gorm:"index"`
+	TokenId        int    `json:"-" gorm:"index"`
+	Name           string `json:"name" gorm:"type:varchar(255)"`
+	Metadata       string `json:"metadata" gorm:"type:text"`
+	EmbeddingModel string `json:"embedding_model" gorm:"type:varchar(128)"`
+	UsageBytes     int64  `json:"usage_bytes"`
+	// days after the last activity the store expires, 0 keeps it
+	ExpiresAfterDays int   `json:"expires_after_days"`
+	ExpiresAt        int64 `json:"expires_at" gorm:"bigint"`
+	LastActiveAt     int64 `json:"last_active_at" gorm:"bigint"`
+	CreatedAt        int64 `json:"created_at" gorm:"bigint;index"`
+	// changes whenever chunks are added or removed, in-process indexes are rebuilt when it moves
+	IndexVersion int64 `json:"-" gorm:"bigint"`
+}
+
+// VectorStoreFile is a file of the Files API added to a vector store.
+type VectorStoreFile struct {
+	Id               int    `json:"id"`
+	VectorStoreId    string `json:"vector_store_id" gorm:"type:varchar(64);uniqueIndex:idx_vector_store_file"`
+	FileId           string `json:"file_id" gorm:"type:varchar(64);uniqueIndex:idx_vector_store_file;index"`
+	Status           string `json:"status" gorm:"type:varchar(32)"`
+	LastErrorCode    string `json:"last_error_code" gorm:"type:varchar(64)"`
+	LastErrorMessage string `json:"last_error_message" gorm:"type:text"`
+	UsageBytes       int64  `json:"usage_bytes"`
+	ChunkSize        int    `json:"chunk_size"`
+	ChunkOverlap     int    `json:"chunk_overlap"`
+	Attributes       string `json:"attributes" gorm:"type:text"`
+	CreatedAt        int64  `json:"created_at" gorm:"bigint;index"`
+}
+
+// VectorStoreChunk is a chunk of a file in a vector store. Embedding is the vector as a JSON list, on PostgreSQL
+// with pgvector it is copied to the embedding_vector column the search runs on.
+type VectorStoreChunk struct {
+	Id            int    `json:"id"`
+	VectorStoreId string `json:"vector_store_id" gorm:"type:varchar(64);index"`
+	FileId        string `json:"file_id" gorm:"type:varchar(64);index"`
+	ChunkIndex    int    `json:"chunk_index"`
+	Content       string `json:"content" gorm:"type:text"`
+	Embedding     string `json:"-" gorm:"type:text"`
+}
+
+// VectorStoreChunkHit is a chunk found by a search with its cosine similarity to the query.
+type VectorStoreChunkHit struct {
+	VectorStoreChunk
+	Score float64 `json:"score"`
+}
+
+func NewVectorStoreId() string {
+	return "vs_" + common.GetRandomString(24)
+}
+
+func (store *VectorStore) Insert() error {
+	now := common.GetTimestamp()
+	if store.CreatedAt == 0 {
+		store.CreatedAt = now
+	}
+	store.LastActiveAt = now
+	store.IndexVersion = time.Now().UnixNano()
+	store.updateExpiresAt()
+	return DB.Create(store).Error
+}
+
+func (store *VectorStore) updateExpiresAt() {
+	if store.ExpiresAfterDays > 0 {
+		store.ExpiresAt = store.LastActiveAt + int64(store.ExpiresAfterDays)*24*3600
+	} else {
+		store.ExpiresAt = 0
+	}
+}
+
+func (store *VectorStore) IsExpired() bool {
+	return store.ExpiresAt > 0 && store.ExpiresAt <= common.GetTimestamp()
+}
+
+// Touch records a use of the store, which moves its expiry when it expires after inactivity.
+func (store *VectorStore) Touch() error {
+	store.LastActiveAt = common.GetTimestamp()
+	store.updateExpiresAt()
+	return DB.Model(store).Select("last_active_at", "expires_at").Updates(store).Error
+}
+
+func (store *VectorStore) Update() error {
+	store.updateExpiresAt()
+	return DB.Model(store).Select("name", "metadata", "expires_after_days", "expires_at").Updates(store).Error
+}
+
+func (store *VectorStore) Delete() error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("vector_store_id = ?", store.Id).Delete(&VectorStoreChunk{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("vector_store_id = ?", store.Id).Delete(&VectorStoreFile{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(store).Error
+	})
+}
+
+func GetUserVectorStoreById(id string, userId int) (*VectorStore, error) {
+	if id == "" {
+		return nil, errors.New("vector store id is empty")
+	}
+	var store VectorStore
+	err := DB.Where("id = ? and user_id = ?", id, userId).First(&store).Error
+	if err != nil {
+		return nil, err
+	}
+	return &store, nil
+}
+
+// GetUserVectorStores lists the user's vector stores in the given order of creation, starting after the store with id after.
+func GetUserVectorStores(userId int, after string, limit int, ascending bool) ([]*VectorStore, error) {
+	var stores []*VectorStore
+	tx := DB.Where("user_id = ?", userId)
+	order := "created_at desc, id desc"
+	if ascending {
+		order = "created_at asc, id asc"
+	}
+	if after != "" {
+		cursor, err := GetUserVectorStoreById(after, userId)
+		if err != nil {
+			return nil, err
+		}
+		if ascending {
+			tx = tx.Where("created_at > ? or (created_at = ? and id > ?)", cursor.CreatedAt, cursor.CreatedAt, cursor.Id)
+		} else {
+			tx = tx.Where("created_at < ? or (created_at = ? and id < ?)", cursor.CreatedAt, cursor.CreatedAt, cursor.Id)
+		}
+	}
+	err := tx.Order(order).Limit(limit).Find(&stores).Error
+	return stores, err
+}
+
+// CountVectorStoreFiles returns the number of files of the store by their status.
+func CountVectorStoreFiles(vectorStoreId string) (map[string]int, error) {
+	var rows []struct {
+		Status string
+		Count  int
+	}
+	err := DB.Model(&VectorStoreFile{}).Select("status, count(*) as count").
+		Where("vector_store_id = ?", vectorStoreId).Group("status").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int, len(rows))
+	for _, row := range rows {
+		counts[row.Status] = row.Count
+	}
+	return counts, nil
+}
+
+func (file *VectorStoreFile) Insert() error {
+	if file.CreatedAt == 0 {
+		file.CreatedAt = common.GetTimestamp()
+	}
+	return DB.Create(file).Error
+}
+
+func GetVectorStoreFile(vectorStoreId string, fileId string) (*VectorStoreFile, error) {
+	var file VectorStoreFile
+	err := DB.Where("vector_store_id = ? and file_id = ?", vectorStoreId, fileId).First(&file).Error
+	if err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// GetVectorStoreFiles lists the files of the store in the given order of creation, starting after the file with id after.
+func GetVectorStoreFiles(vectorStoreId string, status string, after string, limit int, ascending bool) ([]*VectorStoreFile, error) {
+	var files []*VectorStoreFile
+	tx := DB.Where("vector_store_id = ?", vectorStoreId)
+	if status != "" {
+		tx = tx.Where("status = ?", status)
+	}
+	order := "created_at desc, id desc"
+	if ascending {
+		order = "created_at asc, id asc"
+	}
+	if after != "" {
+		cursor, err := GetVectorStoreFile(vectorStoreId, after)
+		if err != nil {
+			return nil, err
+		}
+		if ascending {
+			tx = tx.Where("created_at > ? or (created_at = ? and id > ?)", cursor.CreatedAt, cursor.CreatedAt, cursor.Id)
+		} else {
+			tx = tx.Where("created_at < ? or (created_at = ? and id < ?)", cursor.CreatedAt, cursor.CreatedAt, cursor.Id)
+		}
+	}
+	err := tx.Order(order).Limit(limit).Find(&files).Error
+	return files, err
+}
+
+// refreshVectorStore sums the usage of the store's files and moves its index version after its chunks changed.
+func refreshVectorStore(tx *gorm.DB, vectorStoreId string) error {
+	return tx.Model(&VectorStore{}).Where("id = ?", vectorStoreId).Updates(map[string]any{
+		"usage_bytes": tx.Model(&VectorStoreFile{}).Select("coalesce(sum(usage_bytes), 0)").
+			Where("vector_store_id = ?", vectorStoreId),
+		"index_version": time.Now().UnixNano(),
+	}).Error
+}
+
+// SaveVectorStoreFileChunks replaces the chunks of the file in its store and saves the file with its new status.
+func SaveVectorStoreFileChunks(file *VectorStoreFile, chunks []*VectorStoreChunk) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("vector_store_id = ? and file_id = ?", file.VectorStoreId, file.FileId).Delete(&VectorStoreChunk{}).Error; err != nil {
+			return err
+		}
+		if len(chunks) > 0 {
+			if err := tx.CreateInBatches(chunks, vectorStoreChunkInsertBatch).Error; err != nil {
+				return err
+			}
+			if PgvectorEnabled() {
+				err := tx.Exec("UPDATE vector_store_chunks SET embedding_vector = CAST(embedding AS vector) WHERE vector_store_id = ? AND file_id = ?",
+					file.VectorStoreId, file.FileId).Error
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if err := tx.Save(file).Error; err != nil {
+			return err
+		}
+		return refreshVectorStore(tx, file.VectorStoreId)
+	})
+}
+
+// SaveVectorStoreFileStatus saves the status and error of a file whose chunks did not change.
+func SaveVectorStoreFileStatus(file *VectorStoreFile) error {
+	return DB.Model(file).Select("status", "last_error_code", "last_error_message").Updates(file).Error
+}
+
+// RemoveVectorStoreFile takes the file and its chunks out of the store, the file itself is kept.
+func RemoveVectorStoreFile(file *VectorStoreFile) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("vector_store_id = ? and file_id = ?", file.VectorStoreId, file.FileId).Delete(&VectorStoreChunk{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(file).Error; err != nil {
+			return err
+		}
+		return refreshVectorStore(tx, file.VectorStoreId)
+	})
+}
+
+// removeFileFromVectorStores takes a deleted file out of every store it was added to.
+func removeFileFromVectorStores(tx *gorm.DB, fileId string) error {
+	var vectorStoreIds []string
+	if err := tx.Model(&VectorStoreFile{}).Where("file_id = ?", fileId).Pluck("vector_store_id", &vectorStoreIds).Error; err != nil {
+		return err
+	}
+	if len(vectorStoreIds) == 0 {
+		return nil
+	}
+	if err := tx.Where("file_id = ?", fileId).Delete(&VectorStoreChunk{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("file_id = ?", fileId).Delete(&VectorStoreFile{}).Error; err != nil {
+		return err
+	}
+	for _, vectorStoreId := range vectorStoreIds {
+		if err := refreshVectorStore(tx, vectorStoreId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetVectorStoreChunkEmbeddings loads the embeddings of all chunks of a store, without their content.
+func GetVectorStoreChunkEmbeddings(vectorStoreId string) ([]*VectorStoreChunk, error) {
+	var chunks []*VectorStoreChunk
+	err := DB.Select("id", "vector_store_id", "file_id", "embedding").
+		Where("vector_store_id = ?", vectorStoreId).Find(&chunks).Error
+	return chunks, err
+}
+
+func GetVectorStoreChunksByIds(ids []int) ([]*VectorStoreChunk, error) {
+	var chunks []*VectorStoreChunk
+	err := DB.Omit("embedding").Where("id in ?", ids).Find(&chunks).Error
+	return chunks, err
+}
+
+// SearchVectorStoreChunks finds the chunks of the stores nearest to the query embedding with pgvector.
+func SearchVectorStoreChunks(vectorStoreIds []string, embedding string, limit int) ([]*VectorStoreChunkHit, error) {
+	var hits []*VectorStoreChunkHit
+	err := DB.Model(&VectorStoreChunk{}).
+		Select("id, vector_store_id, file_id, chunk_index, content, 1 - (embedding_vector <=> CAST(? AS vector)) AS score", embedding).
+		Where("vector_store_id IN ? AND embedding_vector IS NOT NULL", vectorStoreIds).
+		Order(clause.Expr{SQL: "embedding_vector <=> CAST(? AS vector)", Vars: []any{embedding}}).
+		Limit(limit).Scan(&hits).Error
+	return hits, err
+}
+
+var (
+	pgvectorEnabled     bool
+	pgvectorEnabledOnce sync.Once
+)
+
+// PgvectorEnabled reports whether the chunks have the pgvector column, migrateVectorStoreIndex adds it on
+// PostgreSQL when the extension can be created. Without it the stores are searched in process.
+func PgvectorEnabled() bool {
+	pgvectorEnabledOnce.Do(func() {
+		pgvectorEnabled = common.UsingPostgreSQL && DB.Migrator().HasColumn(&VectorStoreChunk{}, "embedding_vector")
+	})
+	return pgvectorEnabled
+}
+
+func migrateVectorStoreIndex() {
+	if !common.UsingPostgreSQL {
+		return
+	}
+	if err := DB.Exec("CREATE EXTENSION IF NOT EXISTS vector").Error; err != nil {
+		common.SysLog("pgvector is not available, vector stores are searched in process: " + err.Error())
+		return
+	}
+	if err := DB.Exec("ALTER TABLE vector_store_chunks ADD COLUMN IF NOT EXISTS embedding_vector vector").Error; err != nil {
+		common.SysLog("failed to add the pgvector column of vector store chunks: " + err.Error())
+	}
+}
@@ -1,6 +1,7 @@
 package channel
 
 import (
+	"errors"
 	"io"
 	"net/http"
 
@@ -12,6 +13,9 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+// ErrNotImplemented is returned by an adaptor for a request format its channel does not support.
+var ErrNotImplemented = errors.New("not implemented")
+
 type Adaptor interface {
 	
 	Init(info *relaycommon.RelayInfo)
@@ -31,6 +35,15 @@ type Adaptor interface {
 	ConvertGeminiRequest(c *gin.Context, info *relaycommon.RelayInfo, request *dto.GeminiChatRequest) (any, error)
 }
 
+// TokenCountAdaptor is implemented by adaptors whose upstream can count the input tokens of a request.
+type TokenCountAdaptor interface {
+	// GetTokenCountRequestURL returns an error when the upstream cannot count tokens for the model.
+	GetTokenCountRequestURL(info *relaycommon.RelayInfo) (string, error)
+	// ConvertTokenCountRequest builds the count request from the request converted for the upstream.
+	ConvertTokenCountRequest(c *gin.Context, info *relaycommon.RelayInfo, convertedRequest any) (any, error)
+	ParseTokenCountResponse(body []byte) (int, error)
+}
+
 type TaskAdaptor interface {
 	Init(info *relaycommon.RelayInfo)
 
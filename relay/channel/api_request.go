@@ -2,6 +2,7 @@ package channel
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -89,6 +90,55 @@ func DoApiRequest(a Adaptor, c *gin.Context, info *common.RelayInfo, requestBody
 	return resp, nil
 }
 
+// DoTokenCountRequest sends the count request of a TokenCountAdaptor with the headers of the channel.
+func DoTokenCountRequest(a Adaptor, c *gin.Context, info *common.RelayInfo, fullRequestURL string, requestBody io.Reader) (*http.Response, error) {
+	if common2.DebugEnabled {
+		println("fullRequestURL:", fullRequestURL)
+	}
+	req, err := http.NewRequest(http.MethodPost, fullRequestURL, requestBody)
+	if err != nil {
+		return nil, fmt.Errorf("new request failed: %w", err)
+	}
+	headers := req.Header
+	headerOverride, err := processHeaderOverride(info)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range headerOverride {
+		headers.Set(key, value)
+	}
+	err = a.SetupRequestHeader(c, &headers, info)
+	if err != nil {
+		return nil, fmt.Errorf("setup request header failed: %w", err)
+	}
+	headers.Set("Content-Type", "application/json")
+	headers.Set("Accept", "application/json")
+	resp, err := doRequest(c, req, info)
+	if err != nil {
+		return nil, fmt.Errorf("do request failed: %w", err)
+	}
+	return resp, nil
+}
+
+// PickRequestFields keeps only the given top level fields of the request.
+func PickRequestFields(request any, fields ...string) (map[string]json.RawMessage, error) {
+	data, err := common2.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	if err = common2.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	picked := make(map[string]json.RawMessage, len(fields))
+	for _, field := range fields {
+		if value, ok := all[field]; ok {
+			picked[field] = value
+		}
+	}
+	return picked, nil
+}
+
 func DoFormRequest(a Adaptor, c *gin.Context, info *common.RelayInfo, requestBody io.Reader) (*http.Response, error) {
 	fullRequestURL, err := a.GetRequestURL(info)
 	if err != nil {
@@ -265,7 +315,8 @@ func doRequest(c *gin.Context, req *http.Request, info *common.RelayInfo) (*http
 	}
 
 	var stopPinger context.CancelFunc
-	if info.IsStream {
+	// a held stream must stay uncommitted, neither its headers nor pings are sent before the first token
+	if info.IsStream && !helper.StreamHoldEnabled() {
 		helper.SetEventStreamHeaders(c)
 		
 		generalSettings := operation_setting.GetGeneralSetting()
@@ -284,6 +335,10 @@ func doRequest(c *gin.Context, req *http.Request, info *common.RelayInfo) (*http
 		}
 	}
 
+	if info.Hedge != nil {
+		// the copy of a hedged request that loses is cancelled through the request context
+		req = req.WithContext(c.Request.Context())
+	}
 	resp, err := client.Do(req)
 	if err != nil {
 		logger.LogError(c, "do request failed: "+err.Error())
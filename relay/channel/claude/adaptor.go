@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/QuantumNous/new-api/common"
 	"github.com/QuantumNous/new-api/dto"
 	"github.com/QuantumNous/new-api/relay/channel"
 	relaycommon "github.com/QuantumNous/new-api/relay/common"
@@ -25,9 +26,11 @@ type Adaptor struct {
 	RequestMode int
 }
 
-func (a *Adaptor) ConvertGeminiRequest(*gin.Context, *relaycommon.RelayInfo, *dto.GeminiChatRequest) (any, error) {
-	
-	return nil, errors.New("not implemented")
+func (a *Adaptor) ConvertGeminiRequest(c *gin.Context, info *relaycommon.RelayInfo, request *dto.GeminiChatRequest) (any, error) {
+	if a.RequestMode != RequestModeMessage {
+		return nil, errors.New("gemini format is only supported for claude messages models")
+	}
+	return RequestGemini2ClaudeMessage(c, request, info)
 }
 
 func (a *Adaptor) ConvertClaudeRequest(c *gin.Context, info *relaycommon.RelayInfo, request *dto.ClaudeRequest) (any, error) {
@@ -65,6 +68,41 @@ func (a *Adaptor) GetRequestURL(info *relaycommon.RelayInfo) (string, error) {
 	return baseURL, nil
 }
 
+func (a *Adaptor) GetTokenCountRequestURL(info *relaycommon.RelayInfo) (string, error) {
+	if a.RequestMode != RequestModeMessage {
+		return "", errors.New("token counting is only supported for messages models")
+	}
+	requestURL := fmt.Sprintf("%s/v1/messages/count_tokens", info.ChannelBaseUrl)
+	if info.IsClaudeBetaQuery {
+		requestURL = requestURL + "?beta=true"
+	}
+	return requestURL, nil
+}
+
+func (a *Adaptor) ConvertTokenCountRequest(c *gin.Context, info *relaycommon.RelayInfo, convertedRequest any) (any, error) {
+	return channel.PickRequestFields(convertedRequest, ClaudeTokenCountFields...)
+}
+
+func (a *Adaptor) ParseTokenCountResponse(body []byte) (int, error) {
+	return ParseClaudeTokenCountResponse(body)
+}
+
+// ClaudeTokenCountFields are the fields of a messages request the count_tokens API accepts.
+var ClaudeTokenCountFields = []string{"model", "messages", "system", "tools", "tool_choice", "thinking", "mcp_servers"}
+
+func ParseClaudeTokenCountResponse(body []byte) (int, error) {
+	var response struct {
+		InputTokens *int `json:"input_tokens"`
+	}
+	if err := common.Unmarshal(body, &response); err != nil {
+		return 0, err
+	}
+	if response.InputTokens == nil {
+		return 0, errors.New("input_tokens is missing in the count tokens response")
+	}
+	return *response.InputTokens, nil
+}
+
 func CommonClaudeHeadersOperation(c *gin.Context, req *http.Header, info *relaycommon.RelayInfo) {
 	
 	anthropicBeta := c.Request.Header.Get("anthropic-beta")
@@ -108,7 +146,7 @@ func (a *Adaptor) ConvertEmbeddingRequest(c *gin.Context, info *relaycommon.Rela
 
 func (a *Adaptor) ConvertOpenAIResponsesRequest(c *gin.Context, info *relaycommon.RelayInfo, request dto.OpenAIResponsesRequest) (any, error) {
 	
-	return nil, errors.New("not implemented")
+	return nil, channel.ErrNotImplemented
 }
 
 func (a *Adaptor) DoRequest(c *gin.Context, info *relaycommon.RelayInfo, requestBody io.Reader) (any, error) {
@@ -0,0 +1,473 @@
+package claude
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+
+	"github.com/gin-gonic/gin"
+)
+
+// geminiToolUse collects the input of a tool_use block while a claude stream is converted to gemini,
+// gemini sends a function call in one piece.
+type geminiToolUse struct {
+	id    string
+	name  string
+	input strings.Builder
+}
+
+// RequestGemini2ClaudeMessage converts a Gemini generateContent request to a Claude messages request.
+func RequestGemini2ClaudeMessage(c *gin.Context, geminiRequest *dto.GeminiChatRequest, info *relaycommon.RelayInfo) (*dto.ClaudeRequest, error) {
+	generationConfig := geminiRequest.GenerationConfig
+	claudeRequest := &dto.ClaudeRequest{
+		Model:         info.UpstreamModelName,
+		MaxTokens:     generationConfig.MaxOutputTokens,
+		StopSequences: generationConfig.StopSequences,
+		Temperature:   generationConfig.Temperature,
+		TopP:          generationConfig.TopP,
+		TopK:          int(generationConfig.TopK),
+		Stream:        info.IsStream,
+	}
+	if claudeRequest.MaxTokens == 0 {
+		claudeRequest.MaxTokens = uint(model_setting.GetClaudeSettings().GetDefaultMaxTokens(claudeRequest.Model))
+	}
+
+	if thinkingConfig := generationConfig.ThinkingConfig; thinkingConfig != nil {
+		// -1 asks gemini for a dynamic budget
+		budget := -1
+		if thinkingConfig.ThinkingBudget != nil {
+			budget = *thinkingConfig.ThinkingBudget
+		}
+		if budget > 0 || (budget < 0 && thinkingConfig.IncludeThoughts) {
+			// claude takes at least 1024 budget tokens and the budget must be below max_tokens
+			if budget > 0 && budget < 1024 {
+				budget = 1024
+			}
+			if budget < 0 || budget >= int(claudeRequest.MaxTokens) {
+				if claudeRequest.MaxTokens < 1280 {
+					claudeRequest.MaxTokens = 1280
+				}
+				budget = int(float64(claudeRequest.MaxTokens) * model_setting.GetClaudeSettings().ThinkingAdapterBudgetTokensPercentage)
+			}
+			claudeRequest.Thinking = &dto.Thinking{
+				Type:         "enabled",
+				BudgetTokens: common.GetPointer[int](budget),
+			}
+			// https://docs.anthropic.com/en/docs/build-with-claude/extended-thinking#important-considerations-when-using-extended-thinking
+			claudeRequest.TopP = 0
+			claudeRequest.TopK = 0
+			claudeRequest.Temperature = common.GetPointer[float64](1.0)
+		}
+	}
+
+	if geminiRequest.SystemInstructions != nil {
+		var systemTexts []string
+		for _, part := range geminiRequest.SystemInstructions.Parts {
+			if part.Text != "" {
+				systemTexts = append(systemTexts, part.Text)
+			}
+		}
+		if len(systemTexts) > 0 {
+			claudeRequest.SetStringSystem(strings.Join(systemTexts, "\n"))
+		}
+	}
+
+	tools, err := geminiToolsToClaude(geminiRequest)
+	if err != nil {
+		return nil, err
+	}
+	if len(tools) > 0 {
+		claudeRequest.Tools = tools
+	}
+
+	if geminiRequest.ToolConfig != nil && geminiRequest.ToolConfig.FunctionCallingConfig != nil {
+		functionCallingConfig := geminiRequest.ToolConfig.FunctionCallingConfig
+		switch functionCallingConfig.Mode {
+		case "AUTO", "VALIDATED":
+			claudeRequest.ToolChoice = &dto.ClaudeToolChoice{Type: "auto"}
+		case "ANY":
+			if len(functionCallingConfig.AllowedFunctionNames) == 1 {
+				claudeRequest.ToolChoice = &dto.ClaudeToolChoice{Type: "tool", Name: functionCallingConfig.AllowedFunctionNames[0]}
+			} else {
+				claudeRequest.ToolChoice = &dto.ClaudeToolChoice{Type: "any"}
+			}
+		case "NONE":
+			claudeRequest.ToolChoice = &dto.ClaudeToolChoice{Type: "none"}
+		}
+	}
+
+	// gemini function responses may not carry the id of their call, they are matched by name in order
+	pendingToolUseIds := make(map[string][]string)
+	messages := make([]dto.ClaudeMessage, 0, len(geminiRequest.Contents))
+	for i, content := range geminiRequest.Contents {
+		role := "user"
+		if content.Role == "model" {
+			role = "assistant"
+		}
+		blocks := make([]dto.ClaudeMediaMessage, 0, len(content.Parts))
+		// a streamed thinking block arrives as several thought parts, the last one carries the signature
+		thinking := ""
+		for j, part := range content.Parts {
+			switch {
+			case part.Thought:
+				thinking += part.Text
+				// claude only takes back thinking blocks with their signature
+				if part.ThoughtSignature == "" {
+					continue
+				}
+				blocks = append(blocks, dto.ClaudeMediaMessage{
+					Type:      "thinking",
+					Thinking:  common.GetPointer(thinking),
+					Signature: part.ThoughtSignature,
+				})
+				thinking = ""
+			case part.FunctionCall != nil:
+				id := part.FunctionCall.Id
+				if id == "" {
+					id = fmt.Sprintf("toolu_%d_%d", i, j)
+				}
+				name := part.FunctionCall.FunctionName
+				pendingToolUseIds[name] = append(pendingToolUseIds[name], id)
+				input := part.FunctionCall.Arguments
+				if input == nil {
+					input = map[string]any{}
+				}
+				blocks = append(blocks, dto.ClaudeMediaMessage{
+					Type:  "tool_use",
+					Id:    id,
+					Name:  name,
+					Input: input,
+				})
+			case part.FunctionResponse != nil:
+				name := part.FunctionResponse.Name
+				id := part.FunctionResponse.Id
+				if ids := pendingToolUseIds[name]; len(ids) > 0 {
+					if id == "" {
+						id = ids[0]
+					}
+					pendingToolUseIds[name] = ids[1:]
+				}
+				if id == "" {
+					return nil, fmt.Errorf("no function call found for the response of function %s", name)
+				}
+				result, err := common.Marshal(part.FunctionResponse.Response)
+				if err != nil {
+					return nil, err
+				}
+				blocks = append(blocks, dto.ClaudeMediaMessage{
+					Type:      "tool_result",
+					ToolUseId: id,
+					Content:   string(result),
+				})
+			case part.InlineData != nil:
+				block, err := geminiMediaToClaudeBlock(part.InlineData.MimeType, part.InlineData.Data, "")
+				if err != nil {
+					return nil, err
+				}
+				blocks = append(blocks, *block)
+			case part.FileData != nil:
+				block, err := geminiMediaToClaudeBlock(part.FileData.MimeType, "", part.FileData.FileUri)
+				if err != nil {
+					return nil, err
+				}
+				blocks = append(blocks, *block)
+			case part.ExecutableCode != nil:
+				blocks = append(blocks, newClaudeTextBlock("```"+part.ExecutableCode.Language+"\n"+part.ExecutableCode.Code+"\n```"))
+			case part.CodeExecutionResult != nil:
+				blocks = append(blocks, newClaudeTextBlock("```output\n"+part.CodeExecutionResult.Output+"\n```"))
+			case part.Text != "":
+				blocks = append(blocks, newClaudeTextBlock(part.Text))
+			}
+		}
+		if len(blocks) == 0 {
+			continue
+		}
+		if last := len(messages) - 1; last >= 0 && messages[last].Role == role {
+			lastBlocks, _ := messages[last].Content.([]dto.ClaudeMediaMessage)
+			messages[last].SetContent(append(lastBlocks, blocks...))
+			continue
+		}
+		messages = append(messages, dto.ClaudeMessage{
+			Role:    role,
+			Content: blocks,
+		})
+	}
+	claudeRequest.Messages = messages
+
+	return claudeRequest, nil
+}
+
+func newClaudeTextBlock(text string) dto.ClaudeMediaMessage {
+	block := dto.ClaudeMediaMessage{Type: dto.ContentTypeText}
+	block.SetText(text)
+	return block
+}
+
+// geminiMediaToClaudeBlock converts inline data, or a file uri when data is empty, to an image or document block.
+func geminiMediaToClaudeBlock(mimeType string, data string, fileUri string) (*dto.ClaudeMediaMessage, error) {
+	blockType := ""
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		blockType = "image"
+	case mimeType == "application/pdf":
+		blockType = "document"
+	case mimeType == "text/plain" && fileUri == "":
+		text, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, fmt.Errorf("decode text/plain data failed: %w", err)
+		}
+		return &dto.ClaudeMediaMessage{
+			Type: "document",
+			Source: &dto.ClaudeMessageSource{
+				Type:      "text",
+				MediaType: mimeType,
+				Data:      string(text),
+			},
+		}, nil
+	default:
+		return nil, fmt.Errorf("mime type is not supported by Claude: '%s'", mimeType)
+	}
+	if fileUri != "" {
+		if !strings.HasPrefix(fileUri, "http://") && !strings.HasPrefix(fileUri, "https://") {
+			return nil, fmt.Errorf("file uri is not supported by Claude: '%s'", fileUri)
+		}
+		return &dto.ClaudeMediaMessage{
+			Type: blockType,
+			Source: &dto.ClaudeMessageSource{
+				Type: "url",
+				Url:  fileUri,
+			},
+		}, nil
+	}
+	return &dto.ClaudeMediaMessage{
+		Type: blockType,
+		Source: &dto.ClaudeMessageSource{
+			Type:      "base64",
+			MediaType: mimeType,
+			Data:      data,
+		},
+	}, nil
+}
+
+func geminiToolsToClaude(geminiRequest *dto.GeminiChatRequest) ([]any, error) {
+	var claudeTools []any
+	for _, tool := range geminiRequest.GetTools() {
+		if tool.GoogleSearch != nil || tool.GoogleSearchRetrieval != nil {
+			claudeTools = append(claudeTools, &dto.ClaudeWebSearchTool{
+				Type: "web_search_20250305",
+				Name: "web_search",
+			})
+		}
+		if tool.FunctionDeclarations == nil {
+			continue
+		}
+		declarations, err := common.Any2Type[[]map[string]any](tool.FunctionDeclarations)
+		if err != nil {
+			return nil, fmt.Errorf("invalid function declarations: %w", err)
+		}
+		for _, declaration := range declarations {
+			name, _ := declaration["name"].(string)
+			if name == "" {
+				return nil, errors.New("function declaration without name")
+			}
+			description, _ := declaration["description"].(string)
+			schema, ok := declaration["parametersJsonSchema"].(map[string]any)
+			if !ok {
+				schema, _ = geminiSchemaToJsonSchema(declaration["parameters"]).(map[string]any)
+			}
+			if schema == nil {
+				schema = map[string]any{
+					"type":       "object",
+					"properties": map[string]any{},
+				}
+			}
+			claudeTools = append(claudeTools, &dto.Tool{
+				Name:        name,
+				Description: description,
+				InputSchema: schema,
+			})
+		}
+	}
+	return claudeTools, nil
+}
+
+// geminiSchemaToJsonSchema lower cases the OpenAPI type names gemini schemas use, e.g. OBJECT.
+func geminiSchemaToJsonSchema(schema any) any {
+	switch v := schema.(type) {
+	case map[string]any:
+		converted := make(map[string]any, len(v))
+		for key, value := range v {
+			if typeName, ok := value.(string); ok && key == "type" {
+				converted[key] = strings.ToLower(typeName)
+				continue
+			}
+			converted[key] = geminiSchemaToJsonSchema(value)
+		}
+		return converted
+	case []any:
+		converted := make([]any, len(v))
+		for i, value := range v {
+			converted[i] = geminiSchemaToJsonSchema(value)
+		}
+		return converted
+	}
+	return schema
+}
+
+func stopReasonClaude2Gemini(reason string) string {
+	switch reason {
+	case "max_tokens":
+		return "MAX_TOKENS"
+	case "refusal":
+		return "SAFETY"
+	default:
+		return "STOP"
+	}
+}
+
+func claudeGeminiUsage(usage *dto.Usage) dto.GeminiUsageMetadata {
+	promptTokens := usage.PromptTokens + usage.PromptTokensDetails.CachedTokens + usage.PromptTokensDetails.CachedCreationTokens
+	return dto.GeminiUsageMetadata{
+		PromptTokenCount:        promptTokens,
+		CandidatesTokenCount:    usage.CompletionTokens,
+		TotalTokenCount:         promptTokens + usage.CompletionTokens,
+		CachedContentTokenCount: usage.PromptTokensDetails.CachedTokens,
+	}
+}
+
+// ResponseClaude2Gemini converts a Claude message to a Gemini generateContent response, thinking blocks
+// become thought parts that keep their signature.
+func ResponseClaude2Gemini(claudeResponse *dto.ClaudeResponse, usage *dto.Usage) *dto.GeminiChatResponse {
+	parts := make([]dto.GeminiPart, 0, len(claudeResponse.Content))
+	for _, block := range claudeResponse.Content {
+		switch block.Type {
+		case dto.ContentTypeText:
+			parts = append(parts, dto.GeminiPart{Text: block.GetText()})
+		case "thinking":
+			thinking := ""
+			if block.Thinking != nil {
+				thinking = *block.Thinking
+			}
+			parts = append(parts, dto.GeminiPart{
+				Text:             thinking,
+				Thought:          true,
+				ThoughtSignature: block.Signature,
+			})
+		case "tool_use":
+			parts = append(parts, dto.GeminiPart{
+				FunctionCall: &dto.FunctionCall{
+					Id:           block.Id,
+					FunctionName: block.Name,
+					Arguments:    block.Input,
+				},
+			})
+		}
+	}
+	return &dto.GeminiChatResponse{
+		Candidates: []dto.GeminiChatCandidate{
+			{
+				Content: dto.GeminiChatContent{
+					Role:  "model",
+					Parts: parts,
+				},
+				FinishReason: common.GetPointer(stopReasonClaude2Gemini(claudeResponse.StopReason)),
+			},
+		},
+		UsageMetadata: claudeGeminiUsage(usage),
+		ModelVersion:  claudeResponse.Model,
+		ResponseId:    claudeResponse.Id,
+	}
+}
+
+// StreamResponseClaude2Gemini converts a claude stream event to a gemini chunk, it returns nil for events
+// that have nothing to send yet.
+func StreamResponseClaude2Gemini(claudeResponse *dto.ClaudeResponse, claudeInfo *ClaudeResponseInfo) *dto.GeminiChatResponse {
+	var parts []dto.GeminiPart
+	var finishReason *string
+	switch claudeResponse.Type {
+	case "content_block_start":
+		if claudeResponse.ContentBlock != nil && claudeResponse.ContentBlock.Type == "tool_use" {
+			if claudeInfo.geminiToolUses == nil {
+				claudeInfo.geminiToolUses = make(map[int]*geminiToolUse)
+			}
+			claudeInfo.geminiToolUses[claudeResponse.GetIndex()] = &geminiToolUse{
+				id:   claudeResponse.ContentBlock.Id,
+				name: claudeResponse.ContentBlock.Name,
+			}
+		}
+		return nil
+	case "content_block_delta":
+		if claudeResponse.Delta == nil {
+			return nil
+		}
+		switch claudeResponse.Delta.Type {
+		case "text_delta":
+			parts = append(parts, dto.GeminiPart{Text: claudeResponse.Delta.GetText()})
+		case "thinking_delta":
+			if claudeResponse.Delta.Thinking == nil {
+				return nil
+			}
+			parts = append(parts, dto.GeminiPart{Text: *claudeResponse.Delta.Thinking, Thought: true})
+		case "signature_delta":
+			parts = append(parts, dto.GeminiPart{Thought: true, ThoughtSignature: claudeResponse.Delta.Signature})
+		case "input_json_delta":
+			if toolUse, ok := claudeInfo.geminiToolUses[claudeResponse.GetIndex()]; ok && claudeResponse.Delta.PartialJson != nil {
+				toolUse.input.WriteString(*claudeResponse.Delta.PartialJson)
+			}
+			return nil
+		default:
+			return nil
+		}
+	case "content_block_stop":
+		toolUse, ok := claudeInfo.geminiToolUses[claudeResponse.GetIndex()]
+		if !ok {
+			return nil
+		}
+		delete(claudeInfo.geminiToolUses, claudeResponse.GetIndex())
+		args := map[string]any{}
+		if toolUse.input.Len() > 0 {
+			if err := common.UnmarshalJsonStr(toolUse.input.String(), &args); err != nil {
+				common.SysLog("invalid tool use input in claude stream: " + err.Error())
+			}
+		}
+		parts = append(parts, dto.GeminiPart{
+			FunctionCall: &dto.FunctionCall{
+				Id:           toolUse.id,
+				FunctionName: toolUse.name,
+				Arguments:    args,
+			},
+		})
+	case "message_delta":
+		stopReason := ""
+		if claudeResponse.Delta != nil && claudeResponse.Delta.StopReason != nil {
+			stopReason = *claudeResponse.Delta.StopReason
+		}
+		finishReason = common.GetPointer(stopReasonClaude2Gemini(stopReason))
+		parts = make([]dto.GeminiPart, 0)
+	default:
+		return nil
+	}
+	response := &dto.GeminiChatResponse{
+		Candidates: []dto.GeminiChatCandidate{
+			{
+				Content: dto.GeminiChatContent{
+					Role:  "model",
+					Parts: parts,
+				},
+				FinishReason: finishReason,
+			},
+		},
+		ModelVersion: claudeInfo.Model,
+		ResponseId:   claudeInfo.ResponseId,
+	}
+	if finishReason != nil {
+		response.UsageMetadata = claudeGeminiUsage(claudeInfo.Usage)
+	}
+	return response
+}
@@ -7,9 +7,9 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/QuantumNous/new-api/common"
 	"github.com/QuantumNous/new-api/dto"
 	"github.com/QuantumNous/new-api/relay/channel"
-	"github.com/QuantumNous/new-api/relay/channel/openai"
 	relaycommon "github.com/QuantumNous/new-api/relay/common"
 	"github.com/QuantumNous/new-api/relay/constant"
 	"github.com/QuantumNous/new-api/setting/model_setting"
@@ -42,12 +42,7 @@ func (a *Adaptor) ConvertGeminiRequest(c *gin.Context, info *relaycommon.RelayIn
 }
 
 func (a *Adaptor) ConvertClaudeRequest(c *gin.Context, info *relaycommon.RelayInfo, req *dto.ClaudeRequest) (any, error) {
-	adaptor := openai.Adaptor{}
-	oaiReq, err := adaptor.ConvertClaudeRequest(c, info, req)
-	if err != nil {
-		return nil, err
-	}
-	return a.ConvertOpenAIRequest(c, info, oaiReq.(*dto.GeneralOpenAIRequest))
+	return RequestClaude2Gemini(c, req, info)
 }
 
 func (a *Adaptor) ConvertAudioRequest(c *gin.Context, info *relaycommon.RelayInfo, request dto.AudioRequest) (io.Reader, error) {
@@ -165,6 +160,47 @@ func (a *Adaptor) GetRequestURL(info *relaycommon.RelayInfo) (string, error) {
 	return fmt.Sprintf("%s/%s/models/%s:%s", info.ChannelBaseUrl, version, info.UpstreamModelName, action), nil
 }
 
+func (a *Adaptor) GetTokenCountRequestURL(info *relaycommon.RelayInfo) (string, error) {
+	info.IsStream = false
+	requestURL, err := a.GetRequestURL(info)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(requestURL, ":generateContent") {
+		return "", errors.New("token counting is only supported for generateContent models")
+	}
+	return strings.TrimSuffix(requestURL, ":generateContent") + ":countTokens", nil
+}
+
+func (a *Adaptor) ConvertTokenCountRequest(c *gin.Context, info *relaycommon.RelayInfo, convertedRequest any) (any, error) {
+	generateContentRequest, err := channel.PickRequestFields(convertedRequest, GeminiTokenCountFields...)
+	if err != nil {
+		return nil, err
+	}
+	generateContentRequest["model"], _ = common.Marshal("models/" + info.UpstreamModelName)
+	return map[string]any{"generateContentRequest": generateContentRequest}, nil
+}
+
+func (a *Adaptor) ParseTokenCountResponse(body []byte) (int, error) {
+	return ParseGeminiTokenCountResponse(body)
+}
+
+// GeminiTokenCountFields are the fields of a generateContent request that take part in token counting.
+var GeminiTokenCountFields = []string{"contents", "systemInstruction", "tools", "toolConfig"}
+
+func ParseGeminiTokenCountResponse(body []byte) (int, error) {
+	var response struct {
+		TotalTokens *int `json:"totalTokens"`
+	}
+	if err := common.Unmarshal(body, &response); err != nil {
+		return 0, err
+	}
+	if response.TotalTokens == nil {
+		return 0, errors.New("totalTokens is missing in the count tokens response")
+	}
+	return *response.TotalTokens, nil
+}
+
 func (a *Adaptor) SetupRequestHeader(c *gin.Context, req *http.Header, info *relaycommon.RelayInfo) error {
 	channel.SetupApiRequestHeader(info, c, req)
 	req.Set("x-goog-api-key", info.ApiKey)
@@ -233,7 +269,7 @@ func (a *Adaptor) ConvertEmbeddingRequest(c *gin.Context, info *relaycommon.Rela
 
 func (a *Adaptor) ConvertOpenAIResponsesRequest(c *gin.Context, info *relaycommon.RelayInfo, request dto.OpenAIResponsesRequest) (any, error) {
 	
-	return nil, errors.New("not implemented")
+	return nil, channel.ErrNotImplemented
 }
 
 func (a *Adaptor) DoRequest(c *gin.Context, info *relaycommon.RelayInfo, requestBody io.Reader) (any, error) {
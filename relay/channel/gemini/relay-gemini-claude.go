@@ -0,0 +1,753 @@
+package gemini
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/logger"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/relay/helper"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequestClaude2Gemini converts a Claude messages request to a Gemini generateContent request directly,
+// so thinking signatures, documents and tool result content are kept.
+func RequestClaude2Gemini(c *gin.Context, claudeRequest *dto.ClaudeRequest, info *relaycommon.RelayInfo) (*dto.GeminiChatRequest, error) {
+	geminiRequest := &dto.GeminiChatRequest{
+		Contents: make([]dto.GeminiChatContent, 0, len(claudeRequest.Messages)),
+		GenerationConfig: dto.GeminiChatGenerationConfig{
+			Temperature:     claudeRequest.Temperature,
+			TopP:            claudeRequest.TopP,
+			TopK:            float64(claudeRequest.TopK),
+			MaxOutputTokens: claudeRequest.MaxTokens,
+			StopSequences:   claudeRequest.StopSequences,
+		},
+	}
+
+	if model_setting.IsGeminiModelSupportImagine(info.UpstreamModelName) {
+		geminiRequest.GenerationConfig.ResponseModalities = []string{
+			"TEXT",
+			"IMAGE",
+		}
+	}
+
+	if claudeRequest.Thinking != nil {
+		switch claudeRequest.Thinking.Type {
+		case "enabled":
+			thinkingConfig := &dto.GeminiThinkingConfig{
+				IncludeThoughts: true,
+			}
+			if budget := claudeRequest.Thinking.GetBudgetTokens(); budget > 0 {
+				thinkingConfig.SetThinkingBudget(clampThinkingBudget(info.UpstreamModelName, budget))
+			}
+			geminiRequest.GenerationConfig.ThinkingConfig = thinkingConfig
+		case "disabled":
+			if !isNew25ProModel(info.UpstreamModelName) {
+				geminiRequest.GenerationConfig.ThinkingConfig = &dto.GeminiThinkingConfig{
+					ThinkingBudget: common.GetPointer(0),
+				}
+			}
+		}
+	} else {
+		ThinkingAdaptor(geminiRequest, info)
+	}
+
+	safetySettings := make([]dto.GeminiChatSafetySettings, 0, len(SafetySettingList))
+	for _, category := range SafetySettingList {
+		safetySettings = append(safetySettings, dto.GeminiChatSafetySettings{
+			Category:  category,
+			Threshold: model_setting.GetGeminiSafetySetting(category),
+		})
+	}
+	geminiRequest.SafetySettings = safetySettings
+
+	if claudeRequest.Tools != nil {
+		tools, err := common.Any2Type[[]map[string]any](claudeRequest.Tools)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tools: %w", err)
+		}
+		var geminiTools []dto.GeminiChatTool
+		functions := make([]dto.FunctionRequest, 0, len(tools))
+		for _, tool := range tools {
+			toolType, _ := tool["type"].(string)
+			switch {
+			case strings.HasPrefix(toolType, "web_search"):
+				geminiTools = append(geminiTools, dto.GeminiChatTool{
+					GoogleSearch: make(map[string]string),
+				})
+			case strings.HasPrefix(toolType, "code_execution"):
+				geminiTools = append(geminiTools, dto.GeminiChatTool{
+					CodeExecution: make(map[string]string),
+				})
+			case toolType == "" || toolType == "custom":
+				name, _ := tool["name"].(string)
+				description, _ := tool["description"].(string)
+				parameters := tool["input_schema"]
+				if params, ok := parameters.(map[string]any); ok {
+					if props, hasProps := params["properties"].(map[string]any); hasProps && len(props) == 0 {
+						parameters = nil
+					}
+				}
+				functions = append(functions, dto.FunctionRequest{
+					Name:        name,
+					Description: description,
+					Parameters:  cleanFunctionParameters(parameters),
+				})
+			}
+			// other anthropic defined tools have no gemini counterpart
+		}
+		if len(functions) > 0 {
+			geminiTools = append(geminiTools, dto.GeminiChatTool{
+				FunctionDeclarations: functions,
+			})
+		}
+		if len(geminiTools) > 0 {
+			geminiRequest.SetTools(geminiTools)
+		}
+	}
+
+	if claudeRequest.ToolChoice != nil {
+		toolChoice, err := common.Any2Type[dto.ClaudeToolChoice](claudeRequest.ToolChoice)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tool_choice: %w", err)
+		}
+		functionCallingConfig := &dto.FunctionCallingConfig{}
+		switch toolChoice.Type {
+		case "auto":
+			functionCallingConfig.Mode = "AUTO"
+		case "any":
+			functionCallingConfig.Mode = "ANY"
+		case "tool":
+			functionCallingConfig.Mode = "ANY"
+			functionCallingConfig.AllowedFunctionNames = []string{toolChoice.Name}
+		case "none":
+			functionCallingConfig.Mode = "NONE"
+		}
+		if functionCallingConfig.Mode != "" {
+			geminiRequest.ToolConfig = &dto.ToolConfig{
+				FunctionCallingConfig: functionCallingConfig,
+			}
+		}
+	}
+
+	var systemParts []dto.GeminiPart
+	if claudeRequest.IsStringSystem() {
+		if system := claudeRequest.GetStringSystem(); system != "" {
+			systemParts = append(systemParts, dto.GeminiPart{Text: system})
+		}
+	} else {
+		for _, block := range claudeRequest.ParseSystem() {
+			if block.Type == dto.ContentTypeText && block.GetText() != "" {
+				systemParts = append(systemParts, dto.GeminiPart{Text: block.GetText()})
+			}
+		}
+	}
+	if len(systemParts) > 0 {
+		geminiRequest.SystemInstructions = &dto.GeminiChatContent{
+			Parts: systemParts,
+		}
+	}
+
+	for _, message := range claudeRequest.Messages {
+		content := dto.GeminiChatContent{
+			Role: "user",
+		}
+		if message.Role == "assistant" {
+			content.Role = "model"
+		}
+		if message.IsStringContent() {
+			if message.GetStringContent() != "" {
+				content.Parts = append(content.Parts, dto.GeminiPart{Text: message.GetStringContent()})
+			}
+		} else {
+			blocks, err := message.ParseContent()
+			if err != nil {
+				return nil, fmt.Errorf("invalid message content: %w", err)
+			}
+			parts, err := claudeBlocksToGeminiParts(c, claudeRequest, blocks)
+			if err != nil {
+				return nil, err
+			}
+			content.Parts = parts
+		}
+		if len(content.Parts) == 0 {
+			continue
+		}
+		// gemini expects the turns to alternate, consecutive messages of the same role are merged
+		if last := len(geminiRequest.Contents) - 1; last >= 0 && geminiRequest.Contents[last].Role == content.Role {
+			geminiRequest.Contents[last].Parts = append(geminiRequest.Contents[last].Parts, content.Parts...)
+			continue
+		}
+		geminiRequest.Contents = append(geminiRequest.Contents, content)
+	}
+
+	return geminiRequest, nil
+}
+
+// claudeBlocksToGeminiParts converts the content blocks of one message. A thinking block without text
+// only carries the signature gemini attached to the next part, it is put back on that part.
+func claudeBlocksToGeminiParts(c *gin.Context, claudeRequest *dto.ClaudeRequest, blocks []dto.ClaudeMediaMessage) ([]dto.GeminiPart, error) {
+	var parts []dto.GeminiPart
+	pendingSignature := ""
+	appendPart := func(part dto.GeminiPart) {
+		if pendingSignature != "" && !part.Thought {
+			part.ThoughtSignature = pendingSignature
+			pendingSignature = ""
+		}
+		parts = append(parts, part)
+	}
+
+	imageNum := 0
+	for _, block := range blocks {
+		switch block.Type {
+		case dto.ContentTypeText:
+			if block.GetText() == "" {
+				continue
+			}
+			appendPart(dto.GeminiPart{Text: block.GetText()})
+		case "thinking":
+			if block.Thinking == nil || *block.Thinking == "" {
+				pendingSignature = block.Signature
+				continue
+			}
+			appendPart(dto.GeminiPart{
+				Text:             *block.Thinking,
+				Thought:          true,
+				ThoughtSignature: block.Signature,
+			})
+		case "image", "document":
+			if block.Type == "image" {
+				imageNum++
+				if constant.GeminiVisionMaxImageNum != -1 && imageNum > constant.GeminiVisionMaxImageNum {
+					return nil, fmt.Errorf("too many images in the message, max allowed is %d", constant.GeminiVisionMaxImageNum)
+				}
+			}
+			part, err := claudeSourceToGeminiPart(c, block)
+			if err != nil {
+				return nil, err
+			}
+			appendPart(*part)
+		case "tool_use":
+			args := block.Input
+			if args == nil {
+				args = map[string]any{}
+			}
+			appendPart(dto.GeminiPart{
+				FunctionCall: &dto.FunctionCall{
+					Id:           block.Id,
+					FunctionName: block.Name,
+					Arguments:    args,
+				},
+			})
+		case "tool_result":
+			response, mediaParts, err := claudeToolResultToGemini(c, block)
+			if err != nil {
+				return nil, err
+			}
+			appendPart(dto.GeminiPart{
+				FunctionResponse: &dto.GeminiFunctionResponse{
+					Id:       block.ToolUseId,
+					Name:     claudeRequest.SearchToolNameByToolCallId(block.ToolUseId),
+					Response: response,
+				},
+			})
+			for _, part := range mediaParts {
+				appendPart(part)
+			}
+		}
+		// redacted thinking and server tool blocks can not be replayed to gemini
+	}
+	if pendingSignature != "" {
+		parts = append(parts, dto.GeminiPart{ThoughtSignature: pendingSignature})
+	}
+	return parts, nil
+}
+
+func claudeSourceToGeminiPart(c *gin.Context, block dto.ClaudeMediaMessage) (*dto.GeminiPart, error) {
+	source := block.Source
+	if source == nil {
+		return nil, fmt.Errorf("%s block has no source", block.Type)
+	}
+	switch source.Type {
+	case "base64":
+		data, _ := source.Data.(string)
+		return &dto.GeminiPart{
+			InlineData: &dto.GeminiInlineData{
+				MimeType: source.MediaType,
+				Data:     data,
+			},
+		}, nil
+	case "url":
+		fileData, err := service.GetFileBase64FromUrl(c, source.Url, "formatting "+block.Type+" for Gemini")
+		if err != nil {
+			return nil, fmt.Errorf("get file base64 from url '%s' failed: %w", source.Url, err)
+		}
+		if _, ok := geminiSupportedMimeTypes[strings.ToLower(fileData.MimeType)]; !ok {
+			return nil, fmt.Errorf("mime type is not supported by Gemini: '%s', url: '%s', supported types are: %v", fileData.MimeType, source.Url, getSupportedMimeTypesList())
+		}
+		return &dto.GeminiPart{
+			InlineData: &dto.GeminiInlineData{
+				MimeType: fileData.MimeType,
+				Data:     fileData.Base64Data,
+			},
+		}, nil
+	case "text":
+		data, _ := source.Data.(string)
+		return &dto.GeminiPart{Text: data}, nil
+	}
+	return nil, fmt.Errorf("%s source type '%s' is not supported by Gemini", block.Type, source.Type)
+}
+
+// claudeToolResultToGemini returns the function response of a tool_result block and the images or
+// documents in its content, which gemini takes as separate parts.
+func claudeToolResultToGemini(c *gin.Context, block dto.ClaudeMediaMessage) (map[string]any, []dto.GeminiPart, error) {
+	var texts []string
+	var mediaParts []dto.GeminiPart
+	if block.IsStringContent() {
+		texts = append(texts, block.GetStringContent())
+	} else {
+		for _, item := range block.ParseMediaContent() {
+			switch item.Type {
+			case dto.ContentTypeText:
+				texts = append(texts, item.GetText())
+			case "image", "document":
+				part, err := claudeSourceToGeminiPart(c, item)
+				if err != nil {
+					return nil, nil, err
+				}
+				mediaParts = append(mediaParts, *part)
+			}
+		}
+	}
+	text := strings.Join(texts, "\n")
+	if block.IsError != nil && *block.IsError {
+		return map[string]any{"error": text}, mediaParts, nil
+	}
+	var response map[string]any
+	if err := common.UnmarshalJsonStr(text, &response); err != nil || response == nil {
+		response = map[string]any{"content": text}
+	}
+	return response, mediaParts, nil
+}
+
+func stopReasonGemini2Claude(finishReason string) string {
+	switch finishReason {
+	case "MAX_TOKENS":
+		return "max_tokens"
+	case "SAFETY", "RECITATION", "BLOCKLIST", "PROHIBITED_CONTENT", "SPII", "IMAGE_SAFETY":
+		return "refusal"
+	default:
+		return "end_turn"
+	}
+}
+
+// geminiPartText returns the text a non thought part shows to a claude client.
+func geminiPartText(part *dto.GeminiPart) string {
+	if part.InlineData != nil {
+		if strings.HasPrefix(part.InlineData.MimeType, "image") {
+			return "![image](data:" + part.InlineData.MimeType + ";base64," + part.InlineData.Data + ")"
+		}
+		return fmt.Sprintf("[media](data:%s;base64,%s)", part.InlineData.MimeType, part.InlineData.Data)
+	}
+	if part.ExecutableCode != nil {
+		return "```" + part.ExecutableCode.Language + "\n" + part.ExecutableCode.Code + "\n```\n"
+	}
+	if part.CodeExecutionResult != nil {
+		return "```output\n" + part.CodeExecutionResult.Output + "\n```\n"
+	}
+	return part.Text
+}
+
+func geminiFunctionCallInput(call *dto.FunctionCall) any {
+	if args, ok := call.Arguments.(map[string]any); ok {
+		return unescapeMapOrSlice(args)
+	}
+	if call.Arguments == nil {
+		return map[string]any{}
+	}
+	return call.Arguments
+}
+
+func geminiToolUseId(call *dto.FunctionCall) string {
+	if call.Id != "" {
+		return call.Id
+	}
+	return fmt.Sprintf("toolu_%s", common.GetUUID())
+}
+
+func geminiClaudeUsage(metadata *dto.GeminiUsageMetadata) *dto.ClaudeUsage {
+	return &dto.ClaudeUsage{
+		InputTokens:          metadata.PromptTokenCount - metadata.CachedContentTokenCount,
+		CacheReadInputTokens: metadata.CachedContentTokenCount,
+		OutputTokens:         metadata.CandidatesTokenCount + metadata.ThoughtsTokenCount,
+	}
+}
+
+// ResponseGemini2Claude converts a Gemini generateContent response to a Claude message. A signature gemini
+// attached to a part that is not a thought becomes a thinking block without text in front of it.
+func ResponseGemini2Claude(c *gin.Context, response *dto.GeminiChatResponse, info *relaycommon.RelayInfo) *dto.ClaudeResponse {
+	claudeResponse := &dto.ClaudeResponse{
+		Id:         helper.GetResponseID(c),
+		Type:       "message",
+		Role:       "assistant",
+		Model:      info.UpstreamModelName,
+		StopReason: "end_turn",
+		Usage:      geminiClaudeUsage(&response.UsageMetadata),
+	}
+	contents := make([]dto.ClaudeMediaMessage, 0)
+	hasToolUse := false
+	if len(response.Candidates) > 0 {
+		candidate := response.Candidates[0]
+		for i := range candidate.Content.Parts {
+			part := &candidate.Content.Parts[i]
+			if part.Thought {
+				last := len(contents) - 1
+				if last >= 0 && contents[last].Type == "thinking" && contents[last].Signature == "" {
+					contents[last].Thinking = common.GetPointer(*contents[last].Thinking + part.Text)
+					contents[last].Signature = part.ThoughtSignature
+					continue
+				}
+				contents = append(contents, dto.ClaudeMediaMessage{
+					Type:      "thinking",
+					Thinking:  common.GetPointer(part.Text),
+					Signature: part.ThoughtSignature,
+				})
+				continue
+			}
+			if part.ThoughtSignature != "" {
+				contents = append(contents, dto.ClaudeMediaMessage{
+					Type:      "thinking",
+					Thinking:  common.GetPointer(""),
+					Signature: part.ThoughtSignature,
+				})
+			}
+			if part.FunctionCall != nil {
+				hasToolUse = true
+				contents = append(contents, dto.ClaudeMediaMessage{
+					Type:  "tool_use",
+					Id:    geminiToolUseId(part.FunctionCall),
+					Name:  part.FunctionCall.FunctionName,
+					Input: geminiFunctionCallInput(part.FunctionCall),
+				})
+				continue
+			}
+			text := geminiPartText(part)
+			if text == "" {
+				continue
+			}
+			if last := len(contents) - 1; last >= 0 && contents[last].Type == dto.ContentTypeText {
+				contents[last].SetText(contents[last].GetText() + text)
+				continue
+			}
+			block := dto.ClaudeMediaMessage{Type: dto.ContentTypeText}
+			block.SetText(text)
+			contents = append(contents, block)
+		}
+		if candidate.FinishReason != nil {
+			claudeResponse.StopReason = stopReasonGemini2Claude(*candidate.FinishReason)
+		}
+	} else if response.PromptFeedback != nil && response.PromptFeedback.BlockReason != nil {
+		claudeResponse.StopReason = "refusal"
+	}
+	if hasToolUse {
+		claudeResponse.StopReason = "tool_use"
+	}
+	claudeResponse.Content = contents
+	return claudeResponse
+}
+
+// geminiClaudeStreamState turns the chunks of a gemini stream into claude message events.
+type geminiClaudeStreamState struct {
+	id         string
+	model      string
+	started    bool
+	blockType  string
+	blockIndex int
+	signed     bool
+	hasToolUse bool
+	stopReason string
+}
+
+func (s *geminiClaudeStreamState) start(promptTokens int) []*dto.ClaudeResponse {
+	if s.started {
+		return nil
+	}
+	s.started = true
+	msg := &dto.ClaudeMediaMessage{
+		Id:    s.id,
+		Model: s.model,
+		Type:  "message",
+		Role:  "assistant",
+		Usage: &dto.ClaudeUsage{
+			InputTokens: promptTokens,
+		},
+	}
+	msg.SetContent(make([]any, 0))
+	return []*dto.ClaudeResponse{{
+		Type:    "message_start",
+		Message: msg,
+	}}
+}
+
+func (s *geminiClaudeStreamState) closeBlock() []*dto.ClaudeResponse {
+	if s.blockType == "" {
+		return nil
+	}
+	resp := &dto.ClaudeResponse{
+		Type: "content_block_stop",
+	}
+	resp.SetIndex(s.blockIndex)
+	s.blockType = ""
+	s.blockIndex++
+	return []*dto.ClaudeResponse{resp}
+}
+
+func (s *geminiClaudeStreamState) openBlock(block *dto.ClaudeMediaMessage) []*dto.ClaudeResponse {
+	responses := s.closeBlock()
+	resp := &dto.ClaudeResponse{
+		Type:         "content_block_start",
+		ContentBlock: block,
+	}
+	resp.SetIndex(s.blockIndex)
+	s.blockType = block.Type
+	s.signed = false
+	return append(responses, resp)
+}
+
+func (s *geminiClaudeStreamState) delta(delta *dto.ClaudeMediaMessage) *dto.ClaudeResponse {
+	resp := &dto.ClaudeResponse{
+		Type:  "content_block_delta",
+		Delta: delta,
+	}
+	resp.SetIndex(s.blockIndex)
+	return resp
+}
+
+func (s *geminiClaudeStreamState) signatureBlock(signature string) []*dto.ClaudeResponse {
+	if signature == "" {
+		return nil
+	}
+	responses := s.openBlock(&dto.ClaudeMediaMessage{
+		Type:     "thinking",
+		Thinking: common.GetPointer(""),
+	})
+	responses = append(responses, s.delta(&dto.ClaudeMediaMessage{
+		Type:      "signature_delta",
+		Signature: signature,
+	}))
+	return append(responses, s.closeBlock()...)
+}
+
+func (s *geminiClaudeStreamState) chunk(response *dto.GeminiChatResponse) []*dto.ClaudeResponse {
+	var responses []*dto.ClaudeResponse
+	if response.PromptFeedback != nil && response.PromptFeedback.BlockReason != nil {
+		s.stopReason = "refusal"
+	}
+	if len(response.Candidates) == 0 {
+		return responses
+	}
+	candidate := response.Candidates[0]
+	for i := range candidate.Content.Parts {
+		part := &candidate.Content.Parts[i]
+		switch {
+		case part.Thought:
+			if s.blockType != "thinking" || s.signed {
+				responses = append(responses, s.openBlock(&dto.ClaudeMediaMessage{
+					Type:     "thinking",
+					Thinking: common.GetPointer(""),
+				})...)
+			}
+			if part.Text != "" {
+				responses = append(responses, s.delta(&dto.ClaudeMediaMessage{
+					Type:     "thinking_delta",
+					Thinking: common.GetPointer(part.Text),
+				}))
+			}
+			if part.ThoughtSignature != "" {
+				responses = append(responses, s.delta(&dto.ClaudeMediaMessage{
+					Type:      "signature_delta",
+					Signature: part.ThoughtSignature,
+				}))
+				s.signed = true
+			}
+		case part.FunctionCall != nil:
+			s.hasToolUse = true
+			responses = append(responses, s.signatureBlock(part.ThoughtSignature)...)
+			responses = append(responses, s.openBlock(&dto.ClaudeMediaMessage{
+				Type:  "tool_use",
+				Id:    geminiToolUseId(part.FunctionCall),
+				Name:  part.FunctionCall.FunctionName,
+				Input: map[string]any{},
+			})...)
+			if args, err := common.Marshal(geminiFunctionCallInput(part.FunctionCall)); err == nil {
+				responses = append(responses, s.delta(&dto.ClaudeMediaMessage{
+					Type:        "input_json_delta",
+					PartialJson: common.GetPointer(string(args)),
+				}))
+			}
+			responses = append(responses, s.closeBlock()...)
+		default:
+			responses = append(responses, s.signatureBlock(part.ThoughtSignature)...)
+			text := geminiPartText(part)
+			if text == "" {
+				continue
+			}
+			if s.blockType != dto.ContentTypeText {
+				responses = append(responses, s.openBlock(&dto.ClaudeMediaMessage{
+					Type: dto.ContentTypeText,
+					Text: common.GetPointer(""),
+				})...)
+			}
+			responses = append(responses, s.delta(&dto.ClaudeMediaMessage{
+				Type: "text_delta",
+				Text: common.GetPointer(text),
+			}))
+		}
+	}
+	if candidate.FinishReason != nil {
+		s.stopReason = stopReasonGemini2Claude(*candidate.FinishReason)
+	}
+	return responses
+}
+
+func (s *geminiClaudeStreamState) finish(usage *dto.Usage, cachedTokens int) []*dto.ClaudeResponse {
+	responses := s.closeBlock()
+	stopReason := s.stopReason
+	if stopReason == "" {
+		stopReason = "end_turn"
+	}
+	if s.hasToolUse {
+		stopReason = "tool_use"
+	}
+	responses = append(responses, &dto.ClaudeResponse{
+		Type: "message_delta",
+		Usage: &dto.ClaudeUsage{
+			InputTokens:          usage.PromptTokens - cachedTokens,
+			CacheReadInputTokens: cachedTokens,
+			OutputTokens:         usage.CompletionTokens,
+		},
+		Delta: &dto.ClaudeMediaMessage{
+			StopReason: common.GetPointer(stopReason),
+		},
+	})
+	return append(responses, &dto.ClaudeResponse{
+		Type: "message_stop",
+	})
+}
+
+// geminiClaudeStreamHandler streams a gemini response to a claude messages client.
+func geminiClaudeStreamHandler(c *gin.Context, info *relaycommon.RelayInfo, resp *http.Response) (*dto.Usage, *types.NewAPIError) {
+	state := &geminiClaudeStreamState{
+		id:    helper.GetResponseID(c),
+		model: info.UpstreamModelName,
+	}
+	responseText := strings.Builder{}
+	var usage = &dto.Usage{}
+	var cachedTokens int
+
+	sendEvents := func(responses []*dto.ClaudeResponse) {
+		for _, response := range responses {
+			if err := helper.ClaudeData(c, *response); err != nil {
+				logger.LogError(c, "send_stream_response_failed: "+err.Error())
+			}
+		}
+	}
+
+	streamErr := helper.StreamScannerHandler(c, resp, info, func(data string) bool {
+		var geminiResponse dto.GeminiChatResponse
+		err := common.UnmarshalJsonStr(data, &geminiResponse)
+		if err != nil {
+			logger.LogError(c, "error unmarshalling stream response: "+err.Error())
+			return false
+		}
+
+		for _, candidate := range geminiResponse.Candidates {
+			for _, part := range candidate.Content.Parts {
+				if part.Text != "" {
+					responseText.WriteString(part.Text)
+				}
+			}
+		}
+		if geminiResponse.UsageMetadata.TotalTokenCount != 0 {
+			usage.PromptTokens = geminiResponse.UsageMetadata.PromptTokenCount
+			usage.CompletionTokens = geminiResponse.UsageMetadata.CandidatesTokenCount
+			usage.CompletionTokenDetails.ReasoningTokens = geminiResponse.UsageMetadata.ThoughtsTokenCount
+			usage.TotalTokens = geminiResponse.UsageMetadata.TotalTokenCount
+			cachedTokens = geminiResponse.UsageMetadata.CachedContentTokenCount
+		}
+
+		sendEvents(state.start(info.PromptTokens))
+		sendEvents(state.chunk(&geminiResponse))
+		info.SendResponseCount++
+		return true
+	})
+	if streamErr != nil {
+		return nil, streamErr
+	}
+
+	if info.SendResponseCount == 0 {
+		return nil, types.NewOpenAIError(errors.New("no response received from Gemini API"), types.ErrorCodeEmptyResponse, http.StatusInternalServerError)
+	}
+
+	usage.PromptTokensDetails.TextTokens = usage.PromptTokens
+	usage.CompletionTokens = usage.TotalTokens - usage.PromptTokens
+	if usage.CompletionTokens == 0 {
+		str := responseText.String()
+		if len(str) > 0 {
+			usage = service.ResponseText2Usage(str, info.UpstreamModelName, info.PromptTokens)
+		} else {
+			usage = &dto.Usage{}
+		}
+	}
+
+	sendEvents(state.finish(usage, cachedTokens))
+	return usage, nil
+}
+
+// geminiClaudeHandler answers a claude messages client with a non stream gemini response.
+func geminiClaudeHandler(c *gin.Context, info *relaycommon.RelayInfo, resp *http.Response) (*dto.Usage, *types.NewAPIError) {
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, types.NewOpenAIError(err, types.ErrorCodeBadResponseBody, http.StatusInternalServerError)
+	}
+	service.CloseResponseBodyGracefully(resp)
+	if common.DebugEnabled {
+		println(string(responseBody))
+	}
+	var geminiResponse dto.GeminiChatResponse
+	if err = common.Unmarshal(responseBody, &geminiResponse); err != nil {
+		return nil, types.NewOpenAIError(err, types.ErrorCodeBadResponseBody, http.StatusInternalServerError)
+	}
+
+	usage := dto.Usage{
+		PromptTokens: geminiResponse.UsageMetadata.PromptTokenCount,
+		TotalTokens:  geminiResponse.UsageMetadata.TotalTokenCount,
+	}
+	usage.CompletionTokenDetails.ReasoningTokens = geminiResponse.UsageMetadata.ThoughtsTokenCount
+	usage.CompletionTokens = usage.TotalTokens - usage.PromptTokens
+	for _, detail := range geminiResponse.UsageMetadata.PromptTokensDetails {
+		if detail.Modality == "AUDIO" {
+			usage.PromptTokensDetails.AudioTokens = detail.TokenCount
+		} else if detail.Modality == "TEXT" {
+			usage.PromptTokensDetails.TextTokens = detail.TokenCount
+		}
+	}
+
+	claudeResponse := ResponseGemini2Claude(c, &geminiResponse, info)
+	responseBody, err = common.Marshal(claudeResponse)
+	if err != nil {
+		return nil, types.NewError(err, types.ErrorCodeBadResponseBody)
+	}
+	service.IOCopyBytesGracefully(c, resp, responseBody)
+	return &usage, nil
+}
@@ -49,11 +49,26 @@ type Adaptor struct {
 }
 
 func (a *Adaptor) ConvertGeminiRequest(c *gin.Context, info *relaycommon.RelayInfo, request *dto.GeminiChatRequest) (any, error) {
+	if a.RequestMode == RequestModeClaude {
+		claudeReq, err := claude.RequestGemini2ClaudeMessage(c, request, info)
+		if err != nil {
+			return nil, err
+		}
+		return a.ConvertClaudeRequest(c, info, claudeReq)
+	}
 	geminiAdaptor := gemini.Adaptor{}
 	return geminiAdaptor.ConvertGeminiRequest(c, info, request)
 }
 
 func (a *Adaptor) ConvertClaudeRequest(c *gin.Context, info *relaycommon.RelayInfo, request *dto.ClaudeRequest) (any, error) {
+	if a.RequestMode == RequestModeGemini {
+		geminiRequest, err := gemini.RequestClaude2Gemini(c, request, info)
+		if err != nil {
+			return nil, err
+		}
+		c.Set("request_model", request.Model)
+		return geminiRequest, nil
+	}
 	if v, ok := claudeModelMap[info.UpstreamModelName]; ok {
 		c.Set("request_model", v)
 	} else {
@@ -207,6 +222,50 @@ func (a *Adaptor) GetRequestURL(info *relaycommon.RelayInfo) (string, error) {
 	return "", errors.New("unsupported request mode")
 }
 
+func (a *Adaptor) GetTokenCountRequestURL(info *relaycommon.RelayInfo) (string, error) {
+	switch a.RequestMode {
+	case RequestModeGemini:
+		info.IsStream = false
+		requestURL, err := a.GetRequestURL(info)
+		if err != nil {
+			return "", err
+		}
+		if !strings.Contains(requestURL, ":generateContent") {
+			return "", errors.New("token counting is only supported for generateContent models")
+		}
+		return strings.Replace(requestURL, ":generateContent", ":countTokens", 1), nil
+	case RequestModeClaude:
+		if info.ChannelOtherSettings.VertexKeyType == dto.VertexKeyTypeAPIKey {
+			return "", errors.New("token counting of claude models requires service account credentials")
+		}
+		return a.getRequestUrl(info, "count-tokens", "rawPredict")
+	}
+	return "", errors.New("token counting is not supported for this model")
+}
+
+func (a *Adaptor) ConvertTokenCountRequest(c *gin.Context, info *relaycommon.RelayInfo, convertedRequest any) (any, error) {
+	if a.RequestMode == RequestModeClaude {
+		request, err := channel.PickRequestFields(convertedRequest, claude.ClaudeTokenCountFields...)
+		if err != nil {
+			return nil, err
+		}
+		model := info.UpstreamModelName
+		if v, ok := claudeModelMap[info.UpstreamModelName]; ok {
+			model = v
+		}
+		request["model"], _ = common.Marshal(model)
+		return request, nil
+	}
+	return channel.PickRequestFields(convertedRequest, "contents", "systemInstruction", "tools")
+}
+
+func (a *Adaptor) ParseTokenCountResponse(body []byte) (int, error) {
+	if a.RequestMode == RequestModeClaude {
+		return claude.ParseClaudeTokenCountResponse(body)
+	}
+	return gemini.ParseGeminiTokenCountResponse(body)
+}
+
 func (a *Adaptor) SetupRequestHeader(c *gin.Context, req *http.Header, info *relaycommon.RelayInfo) error {
 	channel.SetupApiRequestHeader(info, c, req)
 	if info.ChannelOtherSettings.VertexKeyType != dto.VertexKeyTypeAPIKey {
@@ -313,7 +372,7 @@ func (a *Adaptor) ConvertEmbeddingRequest(c *gin.Context, info *relaycommon.Rela
 
 func (a *Adaptor) ConvertOpenAIResponsesRequest(c *gin.Context, info *relaycommon.RelayInfo, request dto.OpenAIResponsesRequest) (any, error) {
 	
-	return nil, errors.New("not implemented")
+	return nil, channel.ErrNotImplemented
 }
 
 func (a *Adaptor) DoRequest(c *gin.Context, info *relaycommon.RelayInfo, requestBody io.Reader) (any, error) {
@@ -96,6 +96,13 @@ func ClaudeHelper(c *gin.Context, info *relaycommon.RelayInfo) (newAPIError *typ
 		}
 	}
 
+	if shouldEmulateClaudeToolCalls(info, request) {
+		writer := emulateClaudeToolCalls(c, request)
+		defer func() {
+			finishToolCallEmulation(c, writer, newAPIError == nil)
+		}()
+	}
+
 	var requestBody io.Reader
 	if model_setting.GetGlobalSettings().PassThroughRequestEnabled || info.ChannelSetting.PassThroughBodyEnabled {
 		body, err := common.GetRequestBody(c)
@@ -0,0 +1,75 @@
+package common
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+)
+
+// HedgeInfo is shared by the copies of a hedged request, so that only one of them is billed.
+type HedgeInfo struct {
+	// channels the request was sent to, set before Started
+	ChannelIds []int
+	started    atomic.Bool
+	settledBy  atomic.Pointer[RelayInfo]
+}
+
+func (h *HedgeInfo) MarkStarted(channelIds ...int) {
+	h.ChannelIds = channelIds
+	h.started.Store(true)
+}
+
+// Started reports whether a second copy of the request was sent.
+func (h *HedgeInfo) Started() bool {
+	return h != nil && h.started.Load()
+}
+
+// Claim makes info the copy that is billed and answers the client. It returns false when another copy already won.
+func (h *HedgeInfo) Claim(info *RelayInfo) bool {
+	return h.settledBy.CompareAndSwap(nil, info) || h.settledBy.Load() == info
+}
+
+// ClaimSettlement reports whether the request may be settled. It is always true for requests that are not hedged.
+func (info *RelayInfo) ClaimSettlement() bool {
+	if info.Hedge == nil {
+		return true
+	}
+	return info.Hedge.Claim(info)
+}
+
+// CloneForHedge returns a copy of the relay info that can run concurrently with the original.
+func (info *RelayInfo) CloneForHedge(hedge *HedgeInfo) (*RelayInfo, error) {
+	clone := *info
+	clone.Hedge = hedge
+	if info.ChannelMeta != nil {
+		channelMeta := *info.ChannelMeta
+		clone.ChannelMeta = &channelMeta
+	}
+	if info.ClaudeConvertInfo != nil {
+		claudeConvertInfo := *info.ClaudeConvertInfo
+		clone.ClaudeConvertInfo = &claudeConvertInfo
+	}
+	if info.ResponsesUsageInfo != nil {
+		responsesUsageInfo := *info.ResponsesUsageInfo
+		clone.ResponsesUsageInfo = &responsesUsageInfo
+	}
+	switch request := info.Request.(type) {
+	case *dto.GeneralOpenAIRequest:
+		copied, err := common.DeepCopy(request)
+		if err != nil {
+			return nil, err
+		}
+		clone.Request = copied
+	case *dto.EmbeddingRequest:
+		copied, err := common.DeepCopy(request)
+		if err != nil {
+			return nil, err
+		}
+		clone.Request = copied
+	default:
+		return nil, fmt.Errorf("request type %T cannot be hedged", info.Request)
+	}
+	return &clone, nil
+}
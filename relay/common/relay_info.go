@@ -78,6 +78,7 @@ type RelayInfo struct {
 	UserId            int
 	UsingGroup        string 
 	UserGroup         string 
+	RequestId         string
 	TokenUnlimited    bool
 	StartTime         time.Time
 	FirstResponseTime time.Time
@@ -108,6 +109,13 @@ type RelayInfo struct {
 	SendResponseCount      int
 	FinalPreConsumedQuota  int  
 	IsClaudeBetaQuery      bool 
+	// requested model when the request is served by a fallback model, OriginModelName is then the fallback
+	FallbackFromModel string
+	// set on the copies of a hedged request
+	Hedge *HedgeInfo
+	// set by PreConsumeQuota, the spending of a request checked against no budget is not counted
+	BudgetsChecked bool
+	HasBudgets     bool
 
 	PriceData types.PriceData
 
@@ -312,6 +320,19 @@ func GenRelayInfoEmbedding(c *gin.Context, request dto.Request) *RelayInfo {
 	return info
 }
 
+// GenRelayInfoOllama is for requests of the Ollama API, they have been converted to chat completions or
+// embeddings requests and are sent upstream on those endpoints.
+func GenRelayInfoOllama(c *gin.Context, request dto.Request) *RelayInfo {
+	info := genBaseRelayInfo(c, request)
+	info.RelayFormat = types.RelayFormatOllama
+	if info.RelayMode == relayconstant.RelayModeEmbeddings {
+		info.RequestURLPath = "/v1/embeddings"
+	} else {
+		info.RequestURLPath = "/v1/chat/completions"
+	}
+	return info
+}
+
 func GenRelayInfoResponses(c *gin.Context, request *dto.OpenAIResponsesRequest) *RelayInfo {
 	info := genBaseRelayInfo(c, request)
 	info.RelayMode = relayconstant.RelayModeResponses
@@ -394,6 +415,7 @@ func genBaseRelayInfo(c *gin.Context, request dto.Request) *RelayInfo {
 		TokenId:        common.GetContextKeyInt(c, constant.ContextKeyTokenId),
 		TokenKey:       common.GetContextKeyString(c, constant.ContextKeyTokenKey),
 		TokenUnlimited: common.GetContextKeyBool(c, constant.ContextKeyTokenUnlimited),
+		RequestId:      c.GetString(common.RequestIdKey),
 
 		isFirstResponse: true,
 		RelayMode:       relayconstant.Path2RelayMode(c.Request.URL.Path),
@@ -447,6 +469,8 @@ func GenRelayInfo(c *gin.Context, relayFormat types.RelayFormat, request dto.Req
 		return GenRelayInfoGemini(c, request), nil
 	case types.RelayFormatEmbedding:
 		return GenRelayInfoEmbedding(c, request), nil
+	case types.RelayFormatOllama:
+		return GenRelayInfoOllama(c, request), nil
 	case types.RelayFormatOpenAIResponses:
 		if request, ok := request.(*dto.OpenAIResponsesRequest); ok {
 			return GenRelayInfoResponses(c, request), nil
@@ -84,6 +84,10 @@ func Path2RelayMode(path string) int {
 		relayMode = RelayModeRealtime
 	} else if strings.HasPrefix(path, "/v1beta/models") || strings.HasPrefix(path, "/v1/models") {
 		relayMode = RelayModeGemini
+	} else if strings.HasPrefix(path, "/api/chat") || strings.HasPrefix(path, "/api/generate") {
+		relayMode = RelayModeChatCompletions
+	} else if strings.HasPrefix(path, "/api/embed") {
+		relayMode = RelayModeEmbeddings
 	} else if strings.HasPrefix(path, "/mj") {
 		relayMode = Path2RelayModeMidjourney(path)
 	}
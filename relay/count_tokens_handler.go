@@ -0,0 +1,104 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/relay/channel"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/relay/helper"
+	"github.com/QuantumNous/new-api/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+var ErrTokenCountNotSupported = errors.New("the channel does not support token counting")
+
+// CountTokensHelper asks the upstream of the selected channel for the input tokens of the request.
+func CountTokensHelper(c *gin.Context, info *relaycommon.RelayInfo) (int, error) {
+	info.InitChannelMeta(c)
+	info.IsStream = false
+
+	adaptor := GetAdaptor(info.ApiType)
+	if adaptor == nil {
+		return 0, fmt.Errorf("invalid api type: %d", info.ApiType)
+	}
+	counter, ok := adaptor.(channel.TokenCountAdaptor)
+	if !ok {
+		return 0, ErrTokenCountNotSupported
+	}
+
+	var request dto.Request
+	switch r := info.Request.(type) {
+	case *dto.ClaudeRequest:
+		claudeRequest, err := common.DeepCopy(r)
+		if err != nil {
+			return 0, err
+		}
+		request = claudeRequest
+	case *dto.OpenAIResponsesRequest:
+		responsesRequest, err := common.DeepCopy(r)
+		if err != nil {
+			return 0, err
+		}
+		request = responsesRequest
+	default:
+		return 0, fmt.Errorf("invalid request type %T", info.Request)
+	}
+	if err := helper.ModelMappedHelper(c, info, request); err != nil {
+		return 0, err
+	}
+	adaptor.Init(info)
+
+	requestURL, err := counter.GetTokenCountRequestURL(info)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrTokenCountNotSupported, err.Error())
+	}
+	var convertedRequest any
+	switch r := request.(type) {
+	case *dto.ClaudeRequest:
+		convertedRequest, err = adaptor.ConvertClaudeRequest(c, info, r)
+	case *dto.OpenAIResponsesRequest:
+		var chatRequest *dto.GeneralOpenAIRequest
+		chatRequest, err = service.ResponsesToChatCompletionsRequest(r)
+		if err != nil {
+			return 0, err
+		}
+		chatRequest.Stream = false
+		chatRequest.StreamOptions = nil
+		convertedRequest, err = adaptor.ConvertOpenAIRequest(c, info, chatRequest)
+	}
+	if err != nil {
+		return 0, err
+	}
+	countRequest, err := counter.ConvertTokenCountRequest(c, info, convertedRequest)
+	if err != nil {
+		return 0, err
+	}
+	jsonData, err := common.Marshal(countRequest)
+	if err != nil {
+		return 0, err
+	}
+	if common.DebugEnabled {
+		println("requestBody: ", string(jsonData))
+	}
+
+	resp, err := channel.DoTokenCountRequest(adaptor, c, info, requestURL, bytes.NewReader(jsonData))
+	if err != nil {
+		return 0, err
+	}
+	defer service.CloseResponseBodyGracefully(resp)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("count tokens request failed: status %d: %s", resp.StatusCode, common.MaskSensitiveInfo(string(body)))
+	}
+	return counter.ParseTokenCountResponse(body)
+}
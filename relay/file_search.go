@@ -0,0 +1,135 @@
+package relay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// results of a file search without max_num_results, as in the OpenAI API
+const defaultFileSearchResults = 10
+
+type responsesFileSearchTool struct {
+	Type           string                               `json:"type"`
+	VectorStoreIds []string                             `json:"vector_store_ids"`
+	MaxNumResults  int                                  `json:"max_num_results"`
+	RankingOptions *dto.OpenAIVectorStoreRankingOptions `json:"ranking_options"`
+}
+
+// prepareFileSearch takes the file_search tool out of a Responses request when its vector stores live in the gateway,
+// the request is then served through chat completions with the searches run by the relay. nil is returned when the
+// request has no such tool.
+func prepareFileSearch(info *relaycommon.RelayInfo, request *dto.OpenAIResponsesRequest) (*gatewayTools, *types.NewAPIError) {
+	if !operation_setting.GetVectorStoreSetting().Enabled || len(request.Tools) == 0 {
+		return nil, nil
+	}
+	if model_setting.GetGlobalSettings().PassThroughRequestEnabled || info.ChannelSetting.PassThroughBodyEnabled {
+		return nil, nil
+	}
+	var tools []json.RawMessage
+	if err := common.Unmarshal(request.Tools, &tools); err != nil {
+		return nil, nil
+	}
+	var fileSearch *gatewayFileSearch
+	remaining := make([]json.RawMessage, 0, len(tools))
+	for _, tool := range tools {
+		var searchTool responsesFileSearchTool
+		if err := common.Unmarshal(tool, &searchTool); err != nil || searchTool.Type != dto.BuildInToolFileSearch {
+			remaining = append(remaining, tool)
+			continue
+		}
+		if fileSearch != nil {
+			return nil, types.NewErrorWithStatusCode(errors.New("only one file_search tool is supported"),
+				types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+		}
+		stores := make([]*model.VectorStore, 0, len(searchTool.VectorStoreIds))
+		for _, vectorStoreId := range searchTool.VectorStoreIds {
+			store, err := model.GetUserVectorStoreById(vectorStoreId, info.UserId)
+			if err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					return nil, types.NewErrorWithStatusCode(fmt.Errorf("vector store %s not found", vectorStoreId),
+						types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+				}
+				return nil, types.NewError(err, types.ErrorCodeQueryDataError, types.ErrOptionWithSkipRetry())
+			}
+			if store.IsExpired() {
+				return nil, types.NewErrorWithStatusCode(fmt.Errorf("vector store %s is expired", vectorStoreId),
+					types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+			}
+			stores = append(stores, store)
+		}
+		if len(stores) == 0 {
+			return nil, types.NewErrorWithStatusCode(errors.New("file_search requires vector_store_ids"),
+				types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+		}
+		fileSearch = &gatewayFileSearch{
+			stores:     stores,
+			maxResults: defaultFileSearchResults,
+		}
+		if searchTool.MaxNumResults > 0 {
+			fileSearch.maxResults = min(searchTool.MaxNumResults, 50)
+		}
+		if searchTool.RankingOptions != nil {
+			fileSearch.scoreThreshold = searchTool.RankingOptions.ScoreThreshold
+		}
+	}
+	if fileSearch == nil {
+		return nil, nil
+	}
+
+	if len(remaining) > 0 {
+		data, err := common.Marshal(remaining)
+		if err != nil {
+			return nil, types.NewError(err, types.ErrorCodeInvalidRequest, types.ErrOptionWithSkipRetry())
+		}
+		request.Tools = data
+	} else {
+		request.Tools = nil
+	}
+	// a tool_choice forcing the search becomes a choice of the function the model searches with
+	if common.GetJsonType(request.ToolChoice) == "object" {
+		var toolChoice struct {
+			Type string `json:"type"`
+		}
+		if err := common.Unmarshal(request.ToolChoice, &toolChoice); err == nil && toolChoice.Type == dto.BuildInToolFileSearch {
+			request.ToolChoice, _ = common.Marshal(map[string]string{"type": "function", "name": service.FileSearchToolName})
+		}
+	}
+	return &gatewayTools{
+		mcpTools:   make(map[string]gatewayMcpTool),
+		fileSearch: fileSearch,
+	}, nil
+}
+
+// executeFileSearch runs a search the model asked for and returns the tool message content, ok is false when
+// no search was made.
+func executeFileSearch(c *gin.Context, info *relaycommon.RelayInfo, fileSearch *gatewayFileSearch, toolCall dto.ToolCallRequest) (content string, ok bool) {
+	var arguments struct {
+		Query string `json:"query"`
+	}
+	_ = common.UnmarshalJsonStr(toolCall.Function.Arguments, &arguments)
+	if arguments.Query == "" {
+		return "Search failed: the query is empty.", false
+	}
+	hits, err := service.SearchVectorStores(c.Request.Context(), info.TokenKey, fileSearch.stores,
+		[]string{arguments.Query}, fileSearch.maxResults, fileSearch.scoreThreshold)
+	if err != nil {
+		logger.LogWarn(c, "file search failed: "+err.Error())
+		return "Search failed: " + err.Error(), false
+	}
+	return service.FormatFileSearchResults(service.VectorStoreSearchResults(hits, info.UserId)), true
+}
@@ -0,0 +1,431 @@
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/relay/channel"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	relayconstant "github.com/QuantumNous/new-api/relay/constant"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// mcpToolType is the tool type of a chat request that names a registered MCP server by its server_label.
+const mcpToolType = "mcp"
+
+// gatewayMcpTool is a tool of a registered MCP server the relay offers the model as a function.
+type gatewayMcpTool struct {
+	server *model.McpServer
+	name   string
+}
+
+// gatewayFileSearch is the file_search tool of a Responses request, run on the vector stores of the gateway.
+type gatewayFileSearch struct {
+	stores         []*model.VectorStore
+	maxResults     int
+	scoreThreshold float64
+}
+
+// gatewayTools are the tools of a chat request the relay runs itself instead of handing their calls to the client.
+type gatewayTools struct {
+	webSearch bool
+	backend   service.WebSearchBackend
+	// function name to the MCP tool it calls
+	mcpTools     map[string]gatewayMcpTool
+	fileSearch   *gatewayFileSearch
+	searches     int
+	mcpCalls     int
+	fileSearches int
+}
+
+// shouldResolveMcpTools reports whether the relay resolves the MCP tools of a chat request for the upstream.
+func shouldResolveMcpTools(info *relaycommon.RelayInfo, request *dto.GeneralOpenAIRequest) bool {
+	if !operation_setting.GetMcpSetting().RelayResolveEnabled || info.RelayMode != relayconstant.RelayModeChatCompletions {
+		return false
+	}
+	if model_setting.GetGlobalSettings().PassThroughRequestEnabled || info.ChannelSetting.PassThroughBodyEnabled {
+		return false
+	}
+	for _, tool := range request.Tools {
+		if tool.Type == mcpToolType {
+			return true
+		}
+	}
+	return false
+}
+
+// prepareGatewayTools replaces the web_search and mcp tools of the request with the functions the model calls,
+// nil is returned when the request has none the gateway runs.
+func prepareGatewayTools(c *gin.Context, info *relaycommon.RelayInfo, request *dto.GeneralOpenAIRequest) (*gatewayTools, *types.NewAPIError) {
+	tools := &gatewayTools{
+		webSearch: shouldExecuteWebSearch(info, request),
+		mcpTools:  make(map[string]gatewayMcpTool),
+	}
+	resolveMcp := shouldResolveMcpTools(info, request)
+	if !tools.webSearch && !resolveMcp {
+		return nil, nil
+	}
+	if tools.webSearch {
+		backend, err := service.GetWebSearchBackend()
+		if err != nil {
+			return nil, types.NewError(err, types.ErrorCodeDoRequestFailed, types.ErrOptionWithSkipRetry())
+		}
+		tools.backend = backend
+	}
+	var servers []*model.McpServer
+	if resolveMcp {
+		var err error
+		servers, err = service.GetAccessibleMcpServers(c)
+		if err != nil {
+			return nil, types.NewError(err, types.ErrorCodeQueryDataError, types.ErrOptionWithSkipRetry())
+		}
+	}
+
+	requestTools := make([]dto.ToolCallRequest, 0, len(request.Tools))
+	for _, tool := range request.Tools {
+		switch {
+		case tool.Type == service.WebSearchToolName && tools.webSearch:
+		case tool.Type == mcpToolType && resolveMcp:
+			functions, newAPIError := tools.resolveMcpServer(c, servers, tool)
+			if newAPIError != nil {
+				return nil, newAPIError
+			}
+			requestTools = append(requestTools, functions...)
+		default:
+			requestTools = append(requestTools, tool)
+		}
+	}
+	if tools.webSearch {
+		requestTools = append(requestTools, service.WebSearchTool())
+	}
+	request.Tools = requestTools
+	return tools, nil
+}
+
+// resolveMcpServer turns an mcp tool of the request into one function per tool of the server it names.
+func (t *gatewayTools) resolveMcpServer(c *gin.Context, servers []*model.McpServer, tool dto.ToolCallRequest) ([]dto.ToolCallRequest, *types.NewAPIError) {
+	index := slices.IndexFunc(servers, func(server *model.McpServer) bool {
+		return server.Name == tool.ServerLabel
+	})
+	if index < 0 {
+		return nil, types.NewErrorWithStatusCode(fmt.Errorf("mcp server %q is not available", tool.ServerLabel),
+			types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+	}
+	server := servers[index]
+	serverTools, err := service.ListMcpServerTools(c.Request.Context(), server)
+	if err != nil {
+		return nil, types.NewError(fmt.Errorf("failed to list tools of mcp server %s: %w", server.Name, err),
+			types.ErrorCodeDoRequestFailed, types.ErrOptionWithSkipRetry())
+	}
+	functions := make([]dto.ToolCallRequest, 0, len(serverTools))
+	for _, serverTool := range serverTools {
+		if len(tool.AllowedTools) > 0 && !slices.Contains(tool.AllowedTools, serverTool.Name) {
+			continue
+		}
+		name := service.McpToolName(server.Name, serverTool.Name)
+		t.mcpTools[name] = gatewayMcpTool{server: server, name: serverTool.Name}
+		var parameters any = map[string]any{"type": "object", "properties": map[string]any{}}
+		if len(serverTool.InputSchema) > 0 {
+			parameters = serverTool.InputSchema
+		}
+		functions = append(functions, dto.ToolCallRequest{
+			Type: "function",
+			Function: dto.FunctionRequest{
+				Name:        name,
+				Description: serverTool.Description,
+				Parameters:  parameters,
+			},
+		})
+	}
+	return functions, nil
+}
+
+func (t *gatewayTools) handles(name string) bool {
+	if name == service.WebSearchToolName && t.webSearch {
+		return true
+	}
+	if name == service.FileSearchToolName && t.fileSearch != nil {
+		return true
+	}
+	_, ok := t.mcpTools[name]
+	return ok
+}
+
+// maxRounds is the largest round budget of the tools the request uses.
+func (t *gatewayTools) maxRounds() int {
+	rounds := 1
+	if t.webSearch {
+		rounds = max(rounds, operation_setting.GetWebSearchSetting().MaxRounds)
+	}
+	if len(t.mcpTools) > 0 {
+		rounds = max(rounds, operation_setting.GetMcpSetting().MaxRounds)
+	}
+	if t.fileSearch != nil {
+		rounds = max(rounds, operation_setting.GetVectorStoreSetting().MaxRounds)
+	}
+	return rounds
+}
+
+// removeFrom takes the gateway functions away for the last round, the model has to answer with what it has.
+func (t *gatewayTools) removeFrom(request *dto.GeneralOpenAIRequest) {
+	tools := make([]dto.ToolCallRequest, 0, len(request.Tools))
+	for _, tool := range request.Tools {
+		if !t.handles(tool.Function.Name) {
+			tools = append(tools, tool)
+		}
+	}
+	if len(tools) == 0 {
+		request.Tools = nil
+		request.ToolChoice = nil
+		return
+	}
+	request.Tools = tools
+	if _, ok := request.ToolChoice.(map[string]any); ok {
+		request.ToolChoice = nil
+	}
+}
+
+// split separates the calls the gateway runs from the calls that go to the client.
+func (t *gatewayTools) split(toolCalls []dto.ToolCallRequest) (gatewayCalls []dto.ToolCallRequest, others []dto.ToolCallRequest) {
+	for _, toolCall := range toolCalls {
+		if t.handles(toolCall.Function.Name) {
+			gatewayCalls = append(gatewayCalls, toolCall)
+		} else {
+			others = append(others, toolCall)
+		}
+	}
+	return gatewayCalls, others
+}
+
+// execute runs a call of a gateway tool and returns the content of the tool message for the model.
+func (t *gatewayTools) execute(c *gin.Context, info *relaycommon.RelayInfo, toolCall dto.ToolCallRequest) string {
+	if toolCall.Function.Name == service.WebSearchToolName && t.webSearch {
+		content, ok := executeWebSearch(c, t.backend, toolCall)
+		if ok {
+			t.searches++
+		}
+		return content
+	}
+	if toolCall.Function.Name == service.FileSearchToolName && t.fileSearch != nil {
+		content, ok := executeFileSearch(c, info, t.fileSearch, toolCall)
+		if ok {
+			t.fileSearches++
+		}
+		return content
+	}
+	t.mcpCalls++
+	return executeMcpToolCall(c, info, t.mcpTools[toolCall.Function.Name], toolCall)
+}
+
+// executeMcpToolCall calls the tool on its server, the call is metered like a call made through /mcp.
+func executeMcpToolCall(c *gin.Context, info *relaycommon.RelayInfo, tool gatewayMcpTool, toolCall dto.ToolCallRequest) string {
+	groupRatio := info.PriceData.GroupRatioInfo.GroupRatio
+	if apiErr := service.CheckMcpCallQuota(c, info, service.McpCallQuota(tool.server, groupRatio)); apiErr != nil {
+		logger.LogWarn(c, fmt.Sprintf("mcp tool %s of server %s refused: %s", tool.name, tool.server.Name, apiErr.Error()))
+		return "Tool call refused: insufficient quota."
+	}
+	startTime := time.Now()
+	result, err := service.CallMcpServerTool(c.Request.Context(), tool.server, tool.name, json.RawMessage(toolCall.Function.Arguments))
+	service.RecordMcpToolCall(c, info, tool.server, tool.name, groupRatio, err, time.Since(startTime))
+	if err != nil {
+		logger.LogWarn(c, fmt.Sprintf("mcp tool %s of server %s failed: %s", tool.name, tool.server.Name, err.Error()))
+		return "Tool call failed: " + err.Error()
+	}
+	text, isError := service.McpToolResultText(result)
+	if isError {
+		return "Tool error: " + text
+	}
+	return text
+}
+
+// gatewayToolsHelper serves a chat request with tools the gateway runs. All rounds are billed together with the
+// searches in one consume record, MCP calls are billed per call.
+func gatewayToolsHelper(c *gin.Context, info *relaycommon.RelayInfo, adaptor channel.Adaptor, request *dto.GeneralOpenAIRequest, tools *gatewayTools) *types.NewAPIError {
+	usage, newAPIError := runGatewayTools(c, info, adaptor, request, tools)
+	if newAPIError != nil {
+		return newAPIError
+	}
+	postConsumeQuota(c, info, usage, "")
+	return nil
+}
+
+// runGatewayTools calls the model without streaming, runs the web searches, file searches and MCP tool calls it
+// asks for and feeds their results back until it answers, within the round budget of the settings. A streaming
+// client gets the final answer as one stream. The usage of all rounds is returned for the caller to settle.
+// When a round fails after tools have run, the rounds before it are settled here and the error is not retried,
+// another attempt would run the tools again.
+func runGatewayTools(c *gin.Context, info *relaycommon.RelayInfo, adaptor channel.Adaptor, request *dto.GeneralOpenAIRequest, tools *gatewayTools) (_ *dto.Usage, newAPIError *types.NewAPIError) {
+	maxRounds := tools.maxRounds()
+
+	clientStream := request.Stream
+	request.Stream = false
+	request.StreamOptions = nil
+	info.IsStream = false
+
+	// on a channel with emulated tool calls the rounds are read and written in the text form of the emulation
+	_, emulated := c.Writer.(*toolCallEmulationWriter)
+	totalUsage := &dto.Usage{}
+	originalWriter := c.Writer
+	defer func() {
+		c.Writer = originalWriter
+	}()
+
+	var (
+		writer   *structuredOutputWriter
+		response *dto.OpenAITextResponse
+		rounds   int
+		ranTools bool
+	)
+	defer func() {
+		if newAPIError != nil && ranTools {
+			settleGatewayToolRounds(c, info, tools, totalUsage, rounds)
+			types.ErrOptionWithSkipRetry()(newAPIError)
+		}
+	}()
+	for round := 0; round < maxRounds; round++ {
+		if round == maxRounds-1 && !emulated {
+			tools.removeFrom(request)
+		}
+		// adaptors may change the request they convert, every round gets its own copy
+		roundRequest, err := common.DeepCopy(request)
+		if err != nil {
+			return nil, types.NewError(err, types.ErrorCodeInvalidRequest, types.ErrOptionWithSkipRetry())
+		}
+		requestBody, newAPIError := convertTextRequest(c, info, adaptor, roundRequest)
+		if newAPIError != nil {
+			return nil, newAPIError
+		}
+		writer = newStructuredOutputWriter(originalWriter)
+		c.Writer = writer
+		usage, newAPIError := doTextRequest(c, info, adaptor, requestBody)
+		c.Writer = originalWriter
+		if newAPIError != nil {
+			if round > 0 {
+				logger.LogWarn(c, fmt.Sprintf("gateway tool round %d failed after %d searches and %d mcp calls: %s",
+					round+1, tools.searches, tools.mcpCalls, newAPIError.Error()))
+			}
+			return nil, newAPIError
+		}
+		rounds++
+		addUsage(totalUsage, usage)
+
+		body := writer.body.Bytes()
+		if emulated && writer.status == http.StatusOK {
+			if body, err = rewriteOpenAIToolCallBody(body); err != nil {
+				return nil, types.NewError(err, types.ErrorCodeBadResponseBody)
+			}
+		}
+		response = &dto.OpenAITextResponse{}
+		if err := common.Unmarshal(body, response); err != nil || len(response.Choices) == 0 {
+			response = nil
+			break
+		}
+		message := &response.Choices[0].Message
+		gatewayCalls, otherCalls := tools.split(message.ParseToolCalls())
+		if len(gatewayCalls) == 0 {
+			break
+		}
+		if len(otherCalls) > 0 || round == maxRounds-1 {
+			// the client only gets the calls of its own tools
+			if len(otherCalls) > 0 {
+				message.SetToolCalls(otherCalls)
+			} else {
+				message.ToolCalls = nil
+				response.Choices[0].FinishReason = "stop"
+			}
+			break
+		}
+
+		assistantMessage := dto.Message{Role: "assistant"}
+		if content := message.StringContent(); content != "" {
+			assistantMessage.SetStringContent(content)
+		} else {
+			assistantMessage.SetNullContent()
+		}
+		assistantMessage.SetToolCalls(gatewayCalls)
+		roundMessages := []dto.Message{assistantMessage}
+		ranTools = true
+		for _, toolCall := range gatewayCalls {
+			toolMessage := dto.Message{Role: "tool", ToolCallId: toolCall.ID}
+			toolMessage.SetStringContent(tools.execute(c, info, toolCall))
+			roundMessages = append(roundMessages, toolMessage)
+		}
+		if emulated {
+			roundMessages = service.EmulateOpenAIToolMessages(roundMessages)
+		}
+		request.Messages = append(request.Messages, roundMessages...)
+	}
+
+	tools.recordSearches(info)
+
+	if response == nil {
+		// not a chat completion the calls can be read from, hand it over as it is
+		for key, values := range writer.header {
+			for _, value := range values {
+				c.Writer.Header().Add(key, value)
+			}
+		}
+		c.Writer.WriteHeader(writer.status)
+		_, _ = c.Writer.Write(writer.body.Bytes())
+	} else {
+		response.Usage = *totalUsage
+		if clientStream {
+			writeStructuredOutputStream(c, info, response)
+		} else {
+			c.JSON(http.StatusOK, response)
+		}
+	}
+	logger.LogInfo(c, fmt.Sprintf("gateway tools ran %d web searches, %d file searches and %d mcp calls in %d rounds",
+		tools.searches, tools.fileSearches, tools.mcpCalls, rounds))
+	return totalUsage, nil
+}
+
+// recordSearches adds the web and file searches that ran to the built-in tools the consume record bills.
+func (t *gatewayTools) recordSearches(info *relaycommon.RelayInfo) {
+	if t.searches > 0 {
+		recordBuiltInToolUsage(info, dto.BuildInToolWebSearchPreview, &relaycommon.BuildInToolInfo{
+			ToolName:          service.WebSearchToolName,
+			CallCount:         t.searches,
+			SearchContextSize: operation_setting.GetWebSearchSetting().SearchContextSize,
+		})
+	}
+	if t.fileSearches > 0 {
+		recordBuiltInToolUsage(info, dto.BuildInToolFileSearch, &relaycommon.BuildInToolInfo{
+			ToolName:  service.FileSearchToolName,
+			CallCount: t.fileSearches,
+		})
+	}
+}
+
+// settleGatewayToolRounds bills the rounds and searches that completed before a later round failed. The
+// pre-consumed quota is taken into the settlement, it is not returned when the request fails.
+func settleGatewayToolRounds(c *gin.Context, info *relaycommon.RelayInfo, tools *gatewayTools, usage *dto.Usage, rounds int) {
+	if !info.ClaimSettlement() {
+		return
+	}
+	tools.recordSearches(info)
+	postConsumeQuota(c, info, usage, fmt.Sprintf("gateway tool round %d failed", rounds+1))
+	info.FinalPreConsumedQuota = 0
+}
+
+// recordBuiltInToolUsage adds the calls of a tool the gateway ran to the built-in tools the consume record bills.
+func recordBuiltInToolUsage(info *relaycommon.RelayInfo, name string, tool *relaycommon.BuildInToolInfo) {
+	if info.ResponsesUsageInfo == nil {
+		info.ResponsesUsageInfo = &relaycommon.ResponsesUsageInfo{
+			BuiltInTools: make(map[string]*relaycommon.BuildInToolInfo),
+		}
+	}
+	info.ResponsesUsageInfo.BuiltInTools[name] = tool
+}
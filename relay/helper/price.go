@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
 	relaycommon "github.com/QuantumNous/new-api/relay/common"
 	"github.com/QuantumNous/new-api/setting/operation_setting"
 	"github.com/QuantumNous/new-api/setting/ratio_setting"
@@ -40,6 +41,17 @@ func HandleGroupRatio(ctx *gin.Context, relayInfo *relaycommon.RelayInfo) types.
 		groupRatioInfo.GroupRatio = ratio_setting.GetGroupRatio(relayInfo.UsingGroup)
 	}
 
+	if common.GetContextKeyString(ctx, constant.ContextKeyBatchId) != "" {
+		groupRatioInfo.GroupRatio *= ratio_setting.BatchRatio
+	}
+
+	// the window is resolved once at the start of the request, the settlement keeps its ratio
+	if window, ok := ratio_setting.GetPricingWindow(relayInfo.OriginModelName, relayInfo.UsingGroup, relayInfo.StartTime); ok {
+		groupRatioInfo.GroupRatio *= window.Ratio
+		groupRatioInfo.PricingWindow = window.Name
+		groupRatioInfo.PricingWindowRatio = window.Ratio
+	}
+
 	return groupRatioInfo
 }
 
@@ -81,6 +93,10 @@ func ModelPriceHelper(c *gin.Context, info *relaycommon.RelayInfo, promptTokens
 		audioRatio = ratio_setting.GetAudioRatio(info.OriginModelName)
 		audioCompletionRatio = ratio_setting.GetAudioCompletionRatio(info.OriginModelName)
 		ratio := modelRatio * groupRatioInfo.GroupRatio
+		// the tier is settled on the actual usage, the estimated prompt only sizes the pre-consumed quota
+		if tier, _, ok := ratio_setting.GetModelRatioTier(info.OriginModelName, promptTokens); ok {
+			ratio *= tier.Ratio
+		}
 		preConsumedQuota = int(float64(preConsumedTokens) * ratio)
 	} else {
 		if meta.ImagePriceRatio != 0 {
@@ -0,0 +1,153 @@
+package helper
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+	"github.com/QuantumNous/new-api/types"
+)
+
+type streamChunkKind int
+
+const (
+	streamChunkContent streamChunkKind = iota
+	streamChunkPreamble
+	streamChunkError
+)
+
+// streamChunkProbe holds the fields that tell content chunks from preamble and error chunks
+// across the OpenAI, Responses, Claude and Gemini stream formats.
+type streamChunkProbe struct {
+	Type    string          `json:"type"`
+	Error   json.RawMessage `json:"error"`
+	Choices []struct {
+		Text  string `json:"text"`
+		Delta struct {
+			Content          json.RawMessage `json:"content"`
+			ReasoningContent string          `json:"reasoning_content"`
+			Reasoning        string          `json:"reasoning"`
+			ToolCalls        json.RawMessage `json:"tool_calls"`
+		} `json:"delta"`
+	} `json:"choices"`
+	Candidates json.RawMessage `json:"candidates"`
+}
+
+func isEmptyJsonValue(value json.RawMessage) bool {
+	switch strings.TrimSpace(string(value)) {
+	case "", "null", `""`, "[]", "{}":
+		return true
+	}
+	return false
+}
+
+// classifyStreamChunk decides whether a chunk carries content. Chunks of unknown shape count as content,
+// so formats the probe does not understand are streamed without being held back.
+func classifyStreamChunk(data string) streamChunkKind {
+	var probe streamChunkProbe
+	if err := common.UnmarshalJsonStr(data, &probe); err != nil {
+		return streamChunkContent
+	}
+	if !isEmptyJsonValue(probe.Error) || probe.Type == "error" || probe.Type == "response.failed" {
+		return streamChunkError
+	}
+	if probe.Type != "" {
+		if probe.Type == "content_block_delta" || strings.HasSuffix(probe.Type, ".delta") {
+			return streamChunkContent
+		}
+		return streamChunkPreamble
+	}
+	if probe.Choices != nil {
+		for _, choice := range probe.Choices {
+			if choice.Text != "" || choice.Delta.ReasoningContent != "" || choice.Delta.Reasoning != "" ||
+				!isEmptyJsonValue(choice.Delta.Content) || !isEmptyJsonValue(choice.Delta.ToolCalls) {
+				return streamChunkContent
+			}
+		}
+		return streamChunkPreamble
+	}
+	return streamChunkContent
+}
+
+// streamHold keeps the response uncommitted until the first content chunk arrives.
+type streamHold struct {
+	holding     atomic.Bool
+	chunks      []string
+	size        int
+	bufferBytes int
+	deadline    time.Time
+}
+
+func newStreamHold() *streamHold {
+	setting := operation_setting.GetStreamFailoverSetting()
+	if !setting.Enabled {
+		return nil
+	}
+	bufferBytes := setting.BufferBytes
+	if bufferBytes <= 0 {
+		bufferBytes = 64 << 10
+	}
+	timeout := time.Duration(setting.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	hold := &streamHold{bufferBytes: bufferBytes, deadline: time.Now().Add(timeout)}
+	hold.holding.Store(true)
+	return hold
+}
+
+// StreamHoldEnabled reports whether streams are held back until their first token, the response headers are then
+// only set by StreamScannerHandler when the hold releases.
+func StreamHoldEnabled() bool {
+	return operation_setting.GetStreamFailoverSetting().Enabled
+}
+
+func (h *streamHold) active() bool {
+	return h != nil && h.holding.Load()
+}
+
+// add holds the chunk back and reports false when the buffer or the time limit is used up.
+func (h *streamHold) add(data string) bool {
+	if h.size+len(data) > h.bufferBytes || time.Now().After(h.deadline) {
+		return false
+	}
+	h.chunks = append(h.chunks, data)
+	h.size += len(data)
+	return true
+}
+
+// release ends the hold and returns the held chunks. It returns false when the hold was already
+// ended, e.g. aborted after a failure, in which case nothing may be written anymore.
+func (h *streamHold) release() ([]string, bool) {
+	if !h.holding.CompareAndSwap(true, false) {
+		return nil, false
+	}
+	chunks := h.chunks
+	h.chunks = nil
+	return chunks, true
+}
+
+// abort ends the hold without writing anything and reports whether the response is still uncommitted.
+func (h *streamHold) abort() bool {
+	if h == nil {
+		return false
+	}
+	return h.holding.CompareAndSwap(true, false)
+}
+
+// newStreamFailoverError returns a retryable error for a stream that failed before its first token.
+func newStreamFailoverError(err error) *types.NewAPIError {
+	return types.NewOpenAIError(err, types.ErrorCodeBadResponse, http.StatusBadGateway)
+}
+
+func streamErrorBeforeFirstToken(data string) error {
+	return fmt.Errorf("upstream stream failed before the first token: %s", data)
+}
+
+var errStreamTimeoutBeforeFirstToken = errors.New("upstream stream timed out before the first token")
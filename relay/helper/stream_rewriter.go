@@ -0,0 +1,161 @@
+package helper
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StreamRewriter sits in front of the client connection and hands the event stream written by an adaptor
+// to a transform, one line at a time. Features that change the output format embed it and supply only the
+// transform, a non-stream body is kept for them until they write it themselves.
+type StreamRewriter struct {
+	gin.ResponseWriter
+	transform func(line string) error
+	// observe passes the output to the client unchanged, the transform only reads the lines
+	observe bool
+	// streamContentType replaces the content type of a rewritten stream when set
+	streamContentType string
+	status            int
+	written           bool
+	stream            *bool
+	body              bytes.Buffer
+	pending           bytes.Buffer
+}
+
+// NewStreamRewriter returns a rewriter that writes nothing to the client on its own, the transform
+// writes what the client gets for each line of a stream.
+func NewStreamRewriter(writer gin.ResponseWriter, transform func(line string) error) *StreamRewriter {
+	return &StreamRewriter{ResponseWriter: writer, transform: transform, status: http.StatusOK}
+}
+
+// NewStreamObserver returns a rewriter that passes the output to the client unchanged and hands the
+// lines of a stream to observe.
+func NewStreamObserver(writer gin.ResponseWriter, observe func(line string)) *StreamRewriter {
+	return &StreamRewriter{
+		ResponseWriter: writer,
+		transform: func(line string) error {
+			observe(line)
+			return nil
+		},
+		observe: true,
+		status:  http.StatusOK,
+	}
+}
+
+// SetStreamContentType sets the content type the client gets for a rewritten stream.
+func (w *StreamRewriter) SetStreamContentType(contentType string) {
+	w.streamContentType = contentType
+}
+
+// IsStream reports whether the adaptor writes an event stream, it is decided on the first call from the
+// content type set by the adaptor.
+func (w *StreamRewriter) IsStream() bool {
+	if w.stream == nil {
+		stream := strings.Contains(w.ResponseWriter.Header().Get("Content-Type"), "text/event-stream")
+		w.stream = &stream
+		if stream && !w.observe {
+			if w.streamContentType != "" {
+				w.ResponseWriter.Header().Set("Content-Type", w.streamContentType)
+			}
+			w.ResponseWriter.Header().Del("Content-Length")
+			w.ResponseWriter.WriteHeader(w.status)
+		}
+	}
+	return *w.stream
+}
+
+// Streaming reports whether an event stream has already been started.
+func (w *StreamRewriter) Streaming() bool {
+	return w.stream != nil && *w.stream
+}
+
+// Body returns the non-stream body written so far.
+func (w *StreamRewriter) Body() []byte {
+	return w.body.Bytes()
+}
+
+// FlushPending hands a last line without line break to the transform.
+func (w *StreamRewriter) FlushPending() error {
+	if w.pending.Len() == 0 {
+		return nil
+	}
+	line := w.pending.String()
+	w.pending.Reset()
+	return w.transform(strings.TrimRight(line, "\r\n"))
+}
+
+func (w *StreamRewriter) WriteHeader(code int) {
+	if w.observe {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if w.Streaming() {
+		return
+	}
+	w.status = code
+	w.written = true
+}
+
+func (w *StreamRewriter) WriteHeaderNow() {
+	if w.observe {
+		w.ResponseWriter.WriteHeaderNow()
+		return
+	}
+	w.written = true
+}
+
+func (w *StreamRewriter) Status() int {
+	if w.observe {
+		return w.ResponseWriter.Status()
+	}
+	return w.status
+}
+
+func (w *StreamRewriter) Written() bool {
+	if w.observe {
+		return w.ResponseWriter.Written()
+	}
+	return w.written
+}
+
+func (w *StreamRewriter) Write(data []byte) (int, error) {
+	n := len(data)
+	var err error
+	if w.observe {
+		n, err = w.ResponseWriter.Write(data)
+		data = data[:n]
+	} else {
+		w.written = true
+	}
+	if !w.IsStream() {
+		w.body.Write(data)
+		return n, err
+	}
+	w.pending.Write(data)
+	for {
+		line, readErr := w.pending.ReadString('\n')
+		if readErr != nil {
+			// keep the incomplete line for the next write
+			w.pending.Reset()
+			w.pending.WriteString(line)
+			break
+		}
+		if transformErr := w.transform(strings.TrimRight(line, "\r\n")); transformErr != nil {
+			return 0, transformErr
+		}
+	}
+	return n, err
+}
+
+func (w *StreamRewriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *StreamRewriter) Flush() {
+	if w.observe || w.Streaming() {
+		w.ResponseWriter.Flush()
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/QuantumNous/new-api/common"
@@ -15,6 +16,7 @@ import (
 	"github.com/QuantumNous/new-api/logger"
 	relaycommon "github.com/QuantumNous/new-api/relay/common"
 	"github.com/QuantumNous/new-api/setting/operation_setting"
+	"github.com/QuantumNous/new-api/types"
 
 	"github.com/bytedance/gopkg/util/gopool"
 
@@ -27,10 +29,13 @@ const (
 	DefaultPingInterval      = 10 * time.Second
 )
 
-func StreamScannerHandler(c *gin.Context, resp *http.Response, info *relaycommon.RelayInfo, dataHandler func(data string) bool) {
+// StreamScannerHandler relays the upstream SSE stream through dataHandler. When stream failover is enabled
+// the response stays uncommitted until the first content chunk, and a failure before it is returned as a
+// retryable error instead of being streamed to the client.
+func StreamScannerHandler(c *gin.Context, resp *http.Response, info *relaycommon.RelayInfo, dataHandler func(data string) bool) *types.NewAPIError {
 
 	if resp == nil || dataHandler == nil {
-		return
+		return nil
 	}
 
 	
@@ -49,6 +54,8 @@ func StreamScannerHandler(c *gin.Context, resp *http.Response, info *relaycommon
 		pingTicker *time.Ticker
 		writeMutex sync.Mutex     
 		wg         sync.WaitGroup 
+		hold       = newStreamHold()
+		streamErr  atomic.Pointer[types.NewAPIError]
 	)
 
 	generalSettings := operation_setting.GetGeneralSetting()
@@ -97,7 +104,9 @@ func StreamScannerHandler(c *gin.Context, resp *http.Response, info *relaycommon
 
 	scanner.Buffer(make([]byte, InitialScannerBufferSize), MaxScannerBufferSize)
 	scanner.Split(bufio.ScanLines)
-	SetEventStreamHeaders(c)
+	if !hold.active() {
+		SetEventStreamHeaders(c)
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -127,6 +136,10 @@ func StreamScannerHandler(c *gin.Context, resp *http.Response, info *relaycommon
 			for {
 				select {
 				case <-pingTicker.C:
+					if hold.active() {
+						// a ping would commit the response before failover is ruled out
+						continue
+					}
 					
 					done := make(chan error, 1)
 					go func() {
@@ -167,7 +180,46 @@ func StreamScannerHandler(c *gin.Context, resp *http.Response, info *relaycommon
 		})
 	}
 
-	
+	// 使用超时机制防止写操作阻塞
+	handleData := func(data string) bool {
+		done := make(chan bool, 1)
+		go func() {
+			writeMutex.Lock()
+			defer writeMutex.Unlock()
+			done <- dataHandler(data)
+		}()
+
+		select {
+		case success := <-done:
+			return success
+		case <-time.After(10 * time.Second):
+			logger.LogError(c, "data handler timeout")
+			return false
+		case <-ctx.Done():
+			return false
+		case <-stopChan:
+			return false
+		}
+	}
+
+	// releaseHeld commits the response and replays the chunks held back before the first token
+	releaseHeld := func() bool {
+		if hold == nil {
+			return true
+		}
+		chunks, ok := hold.release()
+		if !ok {
+			return false
+		}
+		SetEventStreamHeaders(c)
+		for _, chunk := range chunks {
+			if !handleData(chunk) {
+				return false
+			}
+		}
+		return true
+	}
+
 	wg.Add(1)
 	common.RelayCtxGo(ctx, func() {
 		defer func() {
@@ -209,27 +261,25 @@ func StreamScannerHandler(c *gin.Context, resp *http.Response, info *relaycommon
 			data = strings.TrimLeft(data, " ")
 			data = strings.TrimSuffix(data, "\r")
 			if !strings.HasPrefix(data, "[DONE]") {
-				info.SetFirstResponseTime()
-
-				// 使用超时机制防止写操作阻塞
-				done := make(chan bool, 1)
-				go func() {
-					writeMutex.Lock()
-					defer writeMutex.Unlock()
-					done <- dataHandler(data)
-				}()
-
-				select {
-				case success := <-done:
-					if !success {
+				if hold.active() {
+					switch classifyStreamChunk(data) {
+					case streamChunkError:
+						// stored before the abort, so the main loop sees it whenever it loses the abort
+						streamErr.Store(newStreamFailoverError(streamErrorBeforeFirstToken(data)))
+						hold.abort()
 						return
+					case streamChunkPreamble:
+						if hold.add(data) {
+							continue
+						}
 					}
-				case <-time.After(10 * time.Second):
-					logger.LogError(c, "data handler timeout")
-					return
-				case <-ctx.Done():
-					return
-				case <-stopChan:
+					if !releaseHeld() {
+						return
+					}
+				}
+				info.SetFirstResponseTime()
+
+				if !handleData(data) {
 					return
 				}
 			} else {
@@ -237,6 +287,7 @@ func StreamScannerHandler(c *gin.Context, resp *http.Response, info *relaycommon
 				if common.DebugEnabled {
 					println("received [DONE], stopping scanner")
 				}
+				releaseHeld()
 				return
 			}
 		}
@@ -245,19 +296,49 @@ func StreamScannerHandler(c *gin.Context, resp *http.Response, info *relaycommon
 			if err != io.EOF {
 				logger.LogError(c, "scanner error: "+err.Error())
 			}
+			if hold.active() {
+				streamErr.Store(newStreamFailoverError(fmt.Errorf("upstream stream broke before the first token: %w", err)))
+				hold.abort()
+				return
+			}
 		}
+		releaseHeld()
 	})
 
+	// the hold has its own deadline, an upstream that stays silent would otherwise only hit the streaming timeout
+	var holdTimeout <-chan time.Time
+	if hold.active() {
+		holdTimer := time.NewTimer(time.Until(hold.deadline))
+		defer holdTimer.Stop()
+		holdTimeout = holdTimer.C
+	}
+
 	// 主循环等待完成或超时
-	select {
-	case <-ticker.C:
-		// 超时处理逻辑
-		logger.LogError(c, "streaming timeout")
-	case <-stopChan:
-		// 正常结束
-		logger.LogInfo(c, "streaming finished")
-	case <-c.Request.Context().Done():
-		// 客户端断开连接
-		logger.LogInfo(c, "client disconnected")
+	for {
+		select {
+		case <-holdTimeout:
+			holdTimeout = nil
+			if hold.abort() {
+				logger.LogError(c, "stream hold timeout")
+				// unblock the scanner so the retry does not wait for it
+				resp.Body.Close()
+				return newStreamFailoverError(errStreamTimeoutBeforeFirstToken)
+			}
+			continue
+		case <-ticker.C:
+			// 超时处理逻辑
+			logger.LogError(c, "streaming timeout")
+			if hold.abort() {
+				resp.Body.Close()
+				return newStreamFailoverError(errStreamTimeoutBeforeFirstToken)
+			}
+		case <-stopChan:
+			// 正常结束
+			logger.LogInfo(c, "streaming finished")
+		case <-c.Request.Context().Done():
+			// 客户端断开连接
+			logger.LogInfo(c, "client disconnected")
+		}
+		return streamErr.Load()
 	}
 }
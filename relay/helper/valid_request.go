@@ -10,6 +10,7 @@ import (
 	"github.com/QuantumNous/new-api/dto"
 	"github.com/QuantumNous/new-api/logger"
 	relayconstant "github.com/QuantumNous/new-api/relay/constant"
+	"github.com/QuantumNous/new-api/service"
 	"github.com/QuantumNous/new-api/types"
 
 	"github.com/gin-gonic/gin"
@@ -44,6 +45,8 @@ func GetAndValidateRequest(c *gin.Context, format types.RelayFormat) (request dt
 		request, err = GetAndValidAudioRequest(c, relayMode)
 	case types.RelayFormatOpenAIRealtime:
 		request = &dto.BaseRequest{}
+	case types.RelayFormatOllama:
+		request, err = GetAndValidateOllamaRequest(c, relayMode)
 	default:
 		return nil, fmt.Errorf("unsupported relay format: %s", format)
 	}
@@ -134,6 +137,33 @@ func GetAndValidateResponsesRequest(c *gin.Context) (*dto.OpenAIResponsesRequest
 	return request, nil
 }
 
+// GetAndValidateOllamaRequest reads a request of the Ollama API and converts it to the chat completions or
+// embeddings request it is relayed as.
+func GetAndValidateOllamaRequest(c *gin.Context, relayMode int) (dto.Request, error) {
+	if relayMode == relayconstant.RelayModeEmbeddings {
+		request := &dto.OllamaEmbedRequest{}
+		if err := common.UnmarshalBodyReusable(c, request); err != nil {
+			return nil, err
+		}
+		return service.OllamaEmbedToOpenAIRequest(request)
+	}
+	if strings.HasPrefix(c.Request.URL.Path, "/api/generate") {
+		request := &dto.OllamaGenerateRequest{}
+		if err := common.UnmarshalBodyReusable(c, request); err != nil {
+			return nil, err
+		}
+		return service.OllamaGenerateToOpenAIRequest(request)
+	}
+	request := &dto.OllamaChatRequest{}
+	if err := common.UnmarshalBodyReusable(c, request); err != nil {
+		return nil, err
+	}
+	if len(request.Messages) == 0 {
+		return nil, errors.New("messages is required")
+	}
+	return service.OllamaChatToOpenAIRequest(request)
+}
+
 func GetAndValidOpenAIImageRequest(c *gin.Context, relayMode int) (*dto.ImageRequest, error) {
 	imageRequest := &dto.ImageRequest{}
 
@@ -0,0 +1,306 @@
+package relay
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/logger"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	relayconstant "github.com/QuantumNous/new-api/relay/constant"
+	"github.com/QuantumNous/new-api/relay/helper"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OllamaHelper serves a request of the Ollama API. The request has been converted to chat completions or
+// embeddings, it is relayed as such and the output of the adaptor is written back in the Ollama format.
+func OllamaHelper(c *gin.Context, info *relaycommon.RelayInfo) (newAPIError *types.NewAPIError) {
+	writer := newOllamaWriter(c.Writer, info, c.Request.URL.Path)
+	c.Writer = writer
+	defer func() {
+		c.Writer = writer.ResponseWriter
+		info.RelayFormat = types.RelayFormatOllama
+	}()
+
+	if info.RelayMode == relayconstant.RelayModeEmbeddings {
+		info.RelayFormat = types.RelayFormatEmbedding
+		newAPIError = EmbeddingHelper(c, info)
+	} else {
+		info.RelayFormat = types.RelayFormatOpenAI
+		newAPIError = TextHelper(c, info)
+	}
+	if newAPIError != nil {
+		return newAPIError
+	}
+	if err := writer.finish(); err != nil {
+		logger.LogError(c, "failed to write ollama response: "+err.Error())
+	}
+	return nil
+}
+
+type ollamaToolCall struct {
+	name      string
+	arguments strings.Builder
+}
+
+// ollamaWriter sits in front of the client connection and rewrites chat completions and embeddings output
+// to the Ollama format, server-sent events become newline delimited JSON.
+type ollamaWriter struct {
+	*helper.StreamRewriter
+	info     *relaycommon.RelayInfo
+	generate bool
+	embed    bool
+
+	toolCalls  map[int]*ollamaToolCall
+	doneReason string
+	usage      *dto.Usage
+	done       bool
+}
+
+func newOllamaWriter(writer gin.ResponseWriter, info *relaycommon.RelayInfo, path string) *ollamaWriter {
+	w := &ollamaWriter{
+		info:      info,
+		generate:  strings.HasPrefix(path, "/api/generate"),
+		embed:     info.RelayMode == relayconstant.RelayModeEmbeddings,
+		toolCalls: make(map[int]*ollamaToolCall),
+	}
+	w.StreamRewriter = helper.NewStreamRewriter(writer, w.writeStreamLine)
+	w.SetStreamContentType("application/x-ndjson")
+	return w
+}
+
+func (w *ollamaWriter) writeStreamLine(line string) error {
+	if !strings.HasPrefix(line, "data:") {
+		return nil
+	}
+	data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+	if data == "" {
+		return nil
+	}
+	if data == "[DONE]" {
+		return w.writeDone()
+	}
+	var chunk dto.ChatCompletionsStreamResponse
+	if err := common.UnmarshalJsonStr(data, &chunk); err != nil {
+		return nil
+	}
+	if chunk.Usage != nil {
+		w.usage = chunk.Usage
+	}
+	if len(chunk.Choices) == 0 {
+		return nil
+	}
+	delta := chunk.Choices[0].Delta
+	for i, toolCall := range delta.ToolCalls {
+		index := i
+		if toolCall.Index != nil {
+			index = *toolCall.Index
+		}
+		call, ok := w.toolCalls[index]
+		if !ok {
+			call = &ollamaToolCall{}
+			w.toolCalls[index] = call
+		}
+		if toolCall.Function.Name != "" {
+			call.name = toolCall.Function.Name
+		}
+		call.arguments.WriteString(toolCall.Function.Arguments)
+	}
+	content := delta.GetContentString()
+	thinking := delta.GetReasoningContent()
+	if content != "" || thinking != "" {
+		if err := w.writeLine(w.message(content, thinking, nil)); err != nil {
+			return err
+		}
+	}
+	if finishReason := chunk.Choices[0].FinishReason; finishReason != nil {
+		w.doneReason = *finishReason
+		if len(w.toolCalls) > 0 && !w.generate {
+			if err := w.writeLine(w.message("", "", w.collectToolCalls())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (w *ollamaWriter) collectToolCalls() []dto.OllamaToolCall {
+	indexes := make([]int, 0, len(w.toolCalls))
+	for index := range w.toolCalls {
+		indexes = append(indexes, index)
+	}
+	slices.Sort(indexes)
+	toolCalls := make([]dto.OllamaToolCall, 0, len(indexes))
+	for i, index := range indexes {
+		call := w.toolCalls[index]
+		toolCalls = append(toolCalls, ollamaToolCallOf(i, call.name, call.arguments.String()))
+	}
+	w.toolCalls = make(map[int]*ollamaToolCall)
+	return toolCalls
+}
+
+func ollamaToolCallOf(index int, name string, arguments string) dto.OllamaToolCall {
+	// Ollama sends the arguments as an object
+	var argumentsValue any = map[string]any{}
+	if arguments != "" {
+		_ = common.UnmarshalJsonStr(arguments, &argumentsValue)
+	}
+	return dto.OllamaToolCall{Function: dto.OllamaToolCallFunction{
+		Index:     common.GetPointer(index),
+		Name:      name,
+		Arguments: argumentsValue,
+	}}
+}
+
+func (w *ollamaWriter) message(content string, thinking string, toolCalls []dto.OllamaToolCall) *dto.OllamaChatResponse {
+	response := &dto.OllamaChatResponse{
+		Model:     w.info.OriginModelName,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if w.generate {
+		response.Response = common.GetPointer(content)
+		response.Thinking = thinking
+	} else {
+		response.Message = &dto.OllamaMessage{
+			Role:      "assistant",
+			Content:   content,
+			Thinking:  thinking,
+			ToolCalls: toolCalls,
+		}
+	}
+	return response
+}
+
+// final completes a response with the done fields, the durations are measured by the relay.
+func (w *ollamaWriter) final(response *dto.OllamaChatResponse, finishReason string, usage *dto.Usage) {
+	response.Done = true
+	response.DoneReason = "stop"
+	if finishReason == "length" {
+		response.DoneReason = "length"
+	}
+	total := time.Since(w.info.StartTime)
+	response.TotalDuration = total.Nanoseconds()
+	if w.info.HasSendResponse() {
+		promptEval := w.info.FirstResponseTime.Sub(w.info.StartTime)
+		response.PromptEvalDuration = promptEval.Nanoseconds()
+		response.EvalDuration = (total - promptEval).Nanoseconds()
+	}
+	if usage != nil {
+		response.PromptEvalCount = usage.PromptTokens
+		response.EvalCount = usage.CompletionTokens
+	}
+}
+
+func (w *ollamaWriter) writeLine(response *dto.OllamaChatResponse) error {
+	data, err := common.Marshal(response)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if _, err = w.ResponseWriter.Write(data); err != nil {
+		return err
+	}
+	w.ResponseWriter.Flush()
+	return nil
+}
+
+func (w *ollamaWriter) writeDone() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	if len(w.toolCalls) > 0 && !w.generate {
+		if err := w.writeLine(w.message("", "", w.collectToolCalls())); err != nil {
+			return err
+		}
+	}
+	response := w.message("", "", nil)
+	w.final(response, w.doneReason, w.usage)
+	return w.writeLine(response)
+}
+
+// finish writes what the adaptor left in the buffer, a non-stream response is converted as a whole.
+func (w *ollamaWriter) finish() error {
+	if !w.Written() {
+		return nil
+	}
+	if w.IsStream() {
+		if err := w.FlushPending(); err != nil {
+			return err
+		}
+		return w.writeDone()
+	}
+	body := w.Body()
+	if w.Status() == http.StatusOK {
+		var (
+			converted any
+			err       error
+		)
+		if w.embed {
+			converted, err = w.convertEmbedding(body)
+		} else {
+			converted, err = w.convertChat(body)
+		}
+		if err != nil {
+			return err
+		}
+		if body, err = common.Marshal(converted); err != nil {
+			return err
+		}
+	}
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	w.ResponseWriter.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.ResponseWriter.WriteHeader(w.Status())
+	_, err := w.ResponseWriter.Write(body)
+	return err
+}
+
+func (w *ollamaWriter) convertChat(body []byte) (*dto.OllamaChatResponse, error) {
+	var chatResponse dto.OpenAITextResponse
+	if err := common.Unmarshal(body, &chatResponse); err != nil {
+		return nil, err
+	}
+	if len(chatResponse.Choices) == 0 {
+		response := w.message("", "", nil)
+		w.final(response, "", &chatResponse.Usage)
+		return response, nil
+	}
+	choice := chatResponse.Choices[0]
+	var toolCalls []dto.OllamaToolCall
+	for i, toolCall := range choice.Message.ParseToolCalls() {
+		toolCalls = append(toolCalls, ollamaToolCallOf(i, toolCall.Function.Name, toolCall.Function.Arguments))
+	}
+	thinking := choice.Message.ReasoningContent
+	if thinking == "" {
+		thinking = choice.Message.Reasoning
+	}
+	response := w.message(choice.Message.StringContent(), thinking, toolCalls)
+	w.final(response, choice.FinishReason, &chatResponse.Usage)
+	return response, nil
+}
+
+func (w *ollamaWriter) convertEmbedding(body []byte) (*dto.OllamaEmbedResponse, error) {
+	var embeddingResponse dto.OpenAIEmbeddingResponse
+	if err := common.Unmarshal(body, &embeddingResponse); err != nil {
+		return nil, err
+	}
+	slices.SortFunc(embeddingResponse.Data, func(a, b dto.OpenAIEmbeddingResponseItem) int {
+		return a.Index - b.Index
+	})
+	response := &dto.OllamaEmbedResponse{
+		Model:           w.info.OriginModelName,
+		Embeddings:      make([][]float64, 0, len(embeddingResponse.Data)),
+		TotalDuration:   time.Since(w.info.StartTime).Nanoseconds(),
+		PromptEvalCount: embeddingResponse.PromptTokens,
+	}
+	for _, item := range embeddingResponse.Data {
+		response.Embeddings = append(response.Embeddings, item.Embedding)
+	}
+	return response, nil
+}
@@ -0,0 +1,112 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/relay/helper"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+
+	"github.com/gin-gonic/gin"
+)
+
+// shouldStoreResponse follows the store field of the request, the Responses API stores by default.
+func shouldStoreResponse(request *dto.OpenAIResponsesRequest) bool {
+	if len(request.Store) > 0 {
+		var store bool
+		if err := common.Unmarshal(request.Store, &store); err == nil && !store {
+			return false
+		}
+	}
+	return true
+}
+
+// responseStoreWriter passes the output to the client unchanged and keeps the final response object,
+// from the body of a non-stream response or from the completed event of a stream.
+type responseStoreWriter struct {
+	*helper.StreamRewriter
+	response json.RawMessage
+}
+
+func newResponseStoreWriter(writer gin.ResponseWriter) *responseStoreWriter {
+	w := &responseStoreWriter{}
+	w.StreamRewriter = helper.NewStreamObserver(writer, w.readStreamLine)
+	return w
+}
+
+func (w *responseStoreWriter) readStreamLine(line string) {
+	if !strings.HasPrefix(line, "data:") {
+		return
+	}
+	// only the final events carry the whole response, the deltas are not decoded
+	if !strings.Contains(line, `"response.completed"`) && !strings.Contains(line, `"response.incomplete"`) {
+		return
+	}
+	var event struct {
+		Type     string          `json:"type"`
+		Response json.RawMessage `json:"response"`
+	}
+	if err := common.UnmarshalJsonStr(strings.TrimSpace(strings.TrimPrefix(line, "data:")), &event); err != nil {
+		return
+	}
+	if event.Type == "response.completed" || event.Type == "response.incomplete" {
+		w.response = event.Response
+	}
+}
+
+// finalResponse returns the response object the client received, nil when there is none to store.
+func (w *responseStoreWriter) finalResponse() json.RawMessage {
+	if w.Status() != http.StatusOK || !w.Written() {
+		return nil
+	}
+	if w.Streaming() {
+		_ = w.FlushPending()
+		return w.response
+	}
+	return w.Body()
+}
+
+// saveStoredResponse keeps the input of the call and the response it got, a later call names it with
+// previous_response_id.
+func saveStoredResponse(c *gin.Context, info *relaycommon.RelayInfo, request *dto.OpenAIResponsesRequest, writer *responseStoreWriter) {
+	response := writer.finalResponse()
+	if len(response) == 0 {
+		return
+	}
+	var meta struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	}
+	if err := common.Unmarshal(response, &meta); err != nil || meta.ID == "" || meta.Status == "failed" {
+		return
+	}
+	input, err := service.StoredResponseInput(request)
+	if err != nil {
+		logger.LogError(c, "failed to store response: "+err.Error())
+		return
+	}
+	stored := &model.StoredResponse{
+		Id:                 meta.ID,
+		UserId:             info.UserId,
+		TokenId:            info.TokenId,
+		Model:              info.OriginModelName,
+		PreviousResponseId: request.PreviousResponseID,
+		ConversationId:     service.StoredConversationId(meta.ID, request.PreviousResponseID, info.UserId),
+		Input:              input,
+		Response:           string(response),
+		CreatedAt:          common.GetTimestamp(),
+	}
+	if days := operation_setting.GetResponseStoreSetting().RetentionDays; days > 0 {
+		stored.ExpiresAt = stored.CreatedAt + int64(days)*24*60*60
+	}
+	if err := stored.Insert(); err != nil {
+		logger.LogError(c, "failed to store response: "+err.Error())
+	}
+}
@@ -2,6 +2,7 @@ package relay
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -9,10 +10,12 @@ import (
 
 	"github.com/QuantumNous/new-api/common"
 	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/relay/channel"
 	relaycommon "github.com/QuantumNous/new-api/relay/common"
 	"github.com/QuantumNous/new-api/relay/helper"
 	"github.com/QuantumNous/new-api/service"
 	"github.com/QuantumNous/new-api/setting/model_setting"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
 	"github.com/QuantumNous/new-api/types"
 
 	"github.com/gin-gonic/gin"
@@ -31,6 +34,23 @@ func ResponsesHelper(c *gin.Context, info *relaycommon.RelayInfo) (newAPIError *
 		return types.NewError(fmt.Errorf("failed to copy request to GeneralOpenAIRequest: %w", err), types.ErrorCodeInvalidRequest, types.ErrOptionWithSkipRetry())
 	}
 
+	if operation_setting.GetResponseStoreSetting().Enabled {
+		// the conversation is expanded on every attempt so that a retry on another channel sees it as well
+		if err := service.ExpandPreviousResponse(request, info.UserId); err != nil {
+			return types.NewError(err, types.ErrorCodeInvalidRequest, types.ErrOptionWithSkipRetry())
+		}
+		if shouldStoreResponse(responsesReq) {
+			writer := newResponseStoreWriter(c.Writer)
+			c.Writer = writer
+			defer func() {
+				c.Writer = writer.ResponseWriter
+				if newAPIError == nil {
+					saveStoredResponse(c, info, responsesReq, writer)
+				}
+			}()
+		}
+	}
+
 	err = helper.ModelMappedHelper(c, info, request)
 	if err != nil {
 		return types.NewError(err, types.ErrorCodeChannelModelMappedError, types.ErrOptionWithSkipRetry())
@@ -41,6 +61,19 @@ func ResponsesHelper(c *gin.Context, info *relaycommon.RelayInfo) (newAPIError *
 		return types.NewError(fmt.Errorf("invalid api type: %d", info.ApiType), types.ErrorCodeInvalidApiType, types.ErrOptionWithSkipRetry())
 	}
 	adaptor.Init(info)
+	fileSearch, newAPIError := prepareFileSearch(info, request)
+	if newAPIError != nil {
+		return newAPIError
+	}
+	if fileSearch != nil {
+		// the vector stores live in the gateway, the searches are run by the relay around chat completions
+		usage, newAPIError := relayResponsesViaChat(c, info, adaptor, request, fileSearch)
+		if newAPIError != nil {
+			return newAPIError
+		}
+		postConsumeQuota(c, info, usage, "")
+		return nil
+	}
 	var requestBody io.Reader
 	if model_setting.GetGlobalSettings().PassThroughRequestEnabled || info.ChannelSetting.PassThroughBodyEnabled {
 		body, err := common.GetRequestBody(c)
@@ -50,6 +83,15 @@ func ResponsesHelper(c *gin.Context, info *relaycommon.RelayInfo) (newAPIError *
 		requestBody = bytes.NewBuffer(body)
 	} else {
 		convertedRequest, err := adaptor.ConvertOpenAIResponsesRequest(c, info, *request)
+		if errors.Is(err, channel.ErrNotImplemented) {
+			// the channel has no native Responses API, serve the request through chat completions
+			usage, newAPIError := relayResponsesViaChat(c, info, adaptor, request, nil)
+			if newAPIError != nil {
+				return newAPIError
+			}
+			postConsumeQuota(c, info, usage, "")
+			return nil
+		}
 		if err != nil {
 			return types.NewError(err, types.ErrorCodeConvertRequestFailed, types.ErrOptionWithSkipRetry())
 		}
@@ -72,6 +114,11 @@ func ResponsesHelper(c *gin.Context, info *relaycommon.RelayInfo) (newAPIError *
 			}
 		}
 
+		jsonData, err = service.ResolveUpstreamFileIds(c, info, jsonData)
+		if err != nil {
+			return types.NewError(err, types.ErrorCodeConvertRequestFailed)
+		}
+
 		if common.DebugEnabled {
 			println("requestBody: ", string(jsonData))
 		}
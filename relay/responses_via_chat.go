@@ -0,0 +1,164 @@
+package relay
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/relay/channel"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	relayconstant "github.com/QuantumNous/new-api/relay/constant"
+	"github.com/QuantumNous/new-api/relay/helper"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// responsesChatWriter sits in front of the client connection while a Responses API request is served
+// through chat completions, it rewrites the chat completions output of the adaptor to the Responses format.
+type responsesChatWriter struct {
+	*helper.StreamRewriter
+	request   *dto.OpenAIResponsesRequest
+	converter *service.ResponsesStreamConverter
+}
+
+func newResponsesChatWriter(writer gin.ResponseWriter, request *dto.OpenAIResponsesRequest) *responsesChatWriter {
+	w := &responsesChatWriter{
+		request:   request,
+		converter: service.NewResponsesStreamConverter(request),
+	}
+	w.StreamRewriter = helper.NewStreamRewriter(writer, w.writeStreamLine)
+	return w
+}
+
+func (w *responsesChatWriter) writeStreamLine(line string) error {
+	if strings.HasPrefix(line, ":") {
+		// keep alive comments go to the client as they are
+		_, err := w.ResponseWriter.WriteString(line + "\n\n")
+		return err
+	}
+	if !strings.HasPrefix(line, "data:") {
+		return nil
+	}
+	data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+	if data == "" || data == "[DONE]" {
+		return nil
+	}
+	var chunk dto.ChatCompletionsStreamResponse
+	if err := common.UnmarshalJsonStr(data, &chunk); err != nil {
+		return nil
+	}
+	return w.writeEvents(w.converter.Chunk(&chunk))
+}
+
+func (w *responsesChatWriter) writeEvents(events []dto.ResponsesStreamResponse) error {
+	for _, event := range events {
+		data, err := common.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if _, err = w.ResponseWriter.WriteString(fmt.Sprintf("event: %s\ndata: %s\n\n", event.Type, data)); err != nil {
+			return err
+		}
+	}
+	w.ResponseWriter.Flush()
+	return nil
+}
+
+// finish writes what the adaptor left in the buffer, usage is the usage the relay settled on.
+func (w *responsesChatWriter) finish(usage *dto.Usage) error {
+	if !w.Written() {
+		return nil
+	}
+	if w.IsStream() {
+		if err := w.FlushPending(); err != nil {
+			return err
+		}
+		return w.writeEvents(w.converter.Finish(usage))
+	}
+	body := w.Body()
+	if w.Status() == http.StatusOK {
+		var chatResponse dto.OpenAITextResponse
+		if err := common.Unmarshal(body, &chatResponse); err != nil {
+			return err
+		}
+		if usage != nil {
+			chatResponse.Usage = *usage
+		}
+		var err error
+		body, err = common.Marshal(service.ChatCompletionsToResponsesResponse(&chatResponse, w.request))
+		if err != nil {
+			return err
+		}
+	}
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	w.ResponseWriter.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.ResponseWriter.WriteHeader(w.Status())
+	_, err := w.ResponseWriter.Write(body)
+	return err
+}
+
+// fail ends a stream that has already started with a failed response.
+func (w *responsesChatWriter) fail(newAPIError *types.NewAPIError) {
+	if !w.Streaming() {
+		return
+	}
+	_ = w.writeEvents(w.converter.Fail(string(newAPIError.GetErrorCode()), newAPIError.Error()))
+}
+
+// relayResponsesViaChat serves a Responses API request on a channel without native Responses support
+// by converting it to a chat completions request and converting the output back. Tools the gateway runs
+// are offered to the model as functions and their calls are run by the relay.
+func relayResponsesViaChat(c *gin.Context, info *relaycommon.RelayInfo, adaptor channel.Adaptor, request *dto.OpenAIResponsesRequest, tools *gatewayTools) (usage *dto.Usage, newAPIError *types.NewAPIError) {
+	chatRequest, err := service.ResponsesToChatCompletionsRequest(request)
+	if err != nil {
+		return nil, types.NewErrorWithStatusCode(err, types.ErrorCodeConvertRequestFailed, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+	}
+
+	// the relay info is reused when the request is retried on another channel
+	relayMode, relayFormat, requestURLPath := info.RelayMode, info.RelayFormat, info.RequestURLPath
+	isStream, shouldIncludeUsage := info.IsStream, info.ShouldIncludeUsage
+	defer func() {
+		info.RelayMode, info.RelayFormat, info.RequestURLPath = relayMode, relayFormat, requestURLPath
+		info.IsStream, info.ShouldIncludeUsage = isStream, shouldIncludeUsage
+	}()
+	info.RelayMode = relayconstant.RelayModeChatCompletions
+	info.RelayFormat = types.RelayFormatOpenAI
+	info.RequestURLPath = "/v1/chat/completions"
+	info.ShouldIncludeUsage = true
+	if !info.SupportStreamOptions {
+		chatRequest.StreamOptions = nil
+	}
+	adaptor.Init(info)
+
+	writer := newResponsesChatWriter(c.Writer, request)
+	c.Writer = writer
+	defer func() {
+		c.Writer = writer.ResponseWriter
+	}()
+	if tools != nil {
+		if tools.fileSearch != nil {
+			chatRequest.Tools = append(chatRequest.Tools, service.FileSearchTool())
+		}
+		usage, newAPIError = runGatewayTools(c, info, adaptor, chatRequest, tools)
+	} else {
+		var requestBody io.Reader
+		requestBody, newAPIError = convertTextRequest(c, info, adaptor, chatRequest)
+		if newAPIError == nil {
+			usage, newAPIError = doTextRequest(c, info, adaptor, requestBody)
+		}
+	}
+	if newAPIError != nil {
+		writer.fail(newAPIError)
+		return nil, newAPIError
+	}
+	if err = writer.finish(usage); err != nil {
+		return nil, types.NewError(err, types.ErrorCodeBadResponseBody)
+	}
+	return usage, nil
+}
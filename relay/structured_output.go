@@ -0,0 +1,340 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/relay/channel"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	relayconstant "github.com/QuantumNous/new-api/relay/constant"
+	"github.com/QuantumNous/new-api/relay/helper"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// validation errors quoted back to the model in one repair prompt
+const structuredOutputMaxProblems = 20
+
+// structuredOutputWriter keeps the response of one emulation attempt away from the client.
+type structuredOutputWriter struct {
+	gin.ResponseWriter
+	header  http.Header
+	status  int
+	written bool
+	body    bytes.Buffer
+}
+
+func newStructuredOutputWriter(writer gin.ResponseWriter) *structuredOutputWriter {
+	return &structuredOutputWriter{
+		ResponseWriter: writer,
+		header:         make(http.Header),
+		status:         http.StatusOK,
+	}
+}
+
+func (w *structuredOutputWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *structuredOutputWriter) WriteHeader(code int) {
+	if code > 0 && !w.written {
+		w.status = code
+	}
+}
+
+func (w *structuredOutputWriter) WriteHeaderNow() {
+	w.written = true
+}
+
+func (w *structuredOutputWriter) Status() int {
+	return w.status
+}
+
+func (w *structuredOutputWriter) Size() int {
+	if !w.written {
+		return -1
+	}
+	return w.body.Len()
+}
+
+func (w *structuredOutputWriter) Written() bool {
+	return w.written
+}
+
+func (w *structuredOutputWriter) Write(data []byte) (int, error) {
+	w.written = true
+	return w.body.Write(data)
+}
+
+func (w *structuredOutputWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *structuredOutputWriter) Flush() {}
+
+// shouldEmulateStructuredOutput reports whether the response format of a chat request is emulated by prompting on this channel.
+func shouldEmulateStructuredOutput(info *relaycommon.RelayInfo, request *dto.GeneralOpenAIRequest) bool {
+	if !info.ChannelSetting.StructuredOutputEmulation || info.RelayMode != relayconstant.RelayModeChatCompletions {
+		return false
+	}
+	if request.ResponseFormat == nil {
+		return false
+	}
+	return request.ResponseFormat.Type == "json_schema" || request.ResponseFormat.Type == "json_object"
+}
+
+// structuredOutputHelper serves a chat request whose response format the upstream ignores. The schema is put into the
+// prompt, the answer is validated against it and, within the repair budget of the channel, the model is asked again
+// with the validation errors. The upstream is called without streaming, a streaming client gets the final answer as
+// one stream, and all attempts are billed together in one consume record.
+func structuredOutputHelper(c *gin.Context, info *relaycommon.RelayInfo, adaptor channel.Adaptor, request *dto.GeneralOpenAIRequest) *types.NewAPIError {
+	var schema any
+	instruction := "Reply with only a valid JSON object. Do not wrap it in markdown or add any other text."
+	if request.ResponseFormat.Type == "json_schema" {
+		var format dto.FormatJsonSchema
+		if err := common.Unmarshal(request.ResponseFormat.JsonSchema, &format); err != nil {
+			return types.NewErrorWithStatusCode(fmt.Errorf("invalid response_format.json_schema: %w", err), types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+		}
+		schemaJson, err := common.Marshal(format.Schema)
+		if err != nil {
+			return types.NewErrorWithStatusCode(fmt.Errorf("invalid response_format.json_schema: %w", err), types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+		}
+		schema = format.Schema
+		instruction = "Reply with only a JSON value that conforms to the JSON schema below. Do not wrap it in markdown or add any other text."
+		if format.Description != "" {
+			instruction += "\nDescription: " + format.Description
+		}
+		instruction += "\nSchema:\n" + string(schemaJson)
+	}
+
+	clientStream := request.Stream
+	request.Stream = false
+	request.StreamOptions = nil
+	request.ResponseFormat = nil
+	info.IsStream = false
+	appendToLastUserMessage(request, instruction)
+
+	maxRepairs := info.ChannelSetting.StructuredOutputMaxRepairs
+	if maxRepairs < 0 {
+		maxRepairs = 0
+	}
+	totalUsage := &dto.Usage{}
+	originalWriter := c.Writer
+	defer func() {
+		c.Writer = originalWriter
+	}()
+
+	var (
+		writer   *structuredOutputWriter
+		response *dto.OpenAITextResponse
+		problems []string
+		attempts int
+	)
+	for attempt := 0; attempt <= maxRepairs; attempt++ {
+		// adaptors may change the request they convert, every attempt gets its own copy
+		attemptRequest, err := common.DeepCopy(request)
+		if err != nil {
+			return types.NewError(err, types.ErrorCodeInvalidRequest, types.ErrOptionWithSkipRetry())
+		}
+		requestBody, newAPIError := convertTextRequest(c, info, adaptor, attemptRequest)
+		if newAPIError != nil {
+			return newAPIError
+		}
+		attemptWriter := newStructuredOutputWriter(originalWriter)
+		c.Writer = attemptWriter
+		usage, newAPIError := doTextRequest(c, info, adaptor, requestBody)
+		c.Writer = originalWriter
+		if newAPIError != nil {
+			if attempt == 0 {
+				return newAPIError
+			}
+			// keep the previous answer, the attempts so far are still billed
+			logger.LogWarn(c, "structured output repair failed: "+newAPIError.Error())
+			break
+		}
+		attempts++
+		writer = attemptWriter
+		addUsage(totalUsage, usage)
+
+		response = &dto.OpenAITextResponse{}
+		if err := common.Unmarshal(writer.body.Bytes(), response); err != nil || len(response.Choices) == 0 {
+			response = nil
+			break
+		}
+		message := &response.Choices[0].Message
+		if len(message.ParseToolCalls()) > 0 {
+			problems = nil
+			break
+		}
+		content := message.StringContent()
+		var cleaned string
+		cleaned, problems = validateStructuredOutput(content, schema)
+		message.SetStringContent(cleaned)
+		if len(problems) == 0 {
+			break
+		}
+		if attempt == maxRepairs {
+			break
+		}
+
+		if len(problems) > structuredOutputMaxProblems {
+			problems = problems[:structuredOutputMaxProblems]
+		}
+		assistantMessage := dto.Message{Role: "assistant"}
+		assistantMessage.SetStringContent(content)
+		repairMessage := dto.Message{Role: "user"}
+		repairMessage.SetStringContent("Your previous reply is invalid:\n- " + strings.Join(problems, "\n- ") + "\n" + instruction)
+		request.Messages = append(request.Messages, assistantMessage, repairMessage)
+	}
+
+	extraContent := fmt.Sprintf("Structured output emulated in %d attempts", attempts)
+	if len(problems) > 0 {
+		extraContent += ", the answer still does not match the schema"
+		logger.LogWarn(c, fmt.Sprintf("structured output does not match the schema after %d attempts: %s", attempts, strings.Join(problems, "; ")))
+	}
+
+	if response == nil {
+		// not a chat completion the answer can be checked in, hand it over as it is
+		for key, values := range writer.header {
+			for _, value := range values {
+				c.Writer.Header().Add(key, value)
+			}
+		}
+		c.Writer.WriteHeader(writer.status)
+		_, _ = c.Writer.Write(writer.body.Bytes())
+	} else {
+		response.Usage = *totalUsage
+		if clientStream {
+			writeStructuredOutputStream(c, info, response)
+		} else {
+			c.JSON(http.StatusOK, response)
+		}
+	}
+	postConsumeQuota(c, info, totalUsage, extraContent)
+	return nil
+}
+
+// addUsage adds the usage of one upstream call to the usage billed for the request.
+func addUsage(total *dto.Usage, usage *dto.Usage) {
+	if usage == nil {
+		return
+	}
+	total.PromptTokens += usage.PromptTokens
+	total.CompletionTokens += usage.CompletionTokens
+	total.TotalTokens += usage.TotalTokens
+	total.PromptTokensDetails.CachedTokens += usage.PromptTokensDetails.CachedTokens
+	total.CompletionTokenDetails.ReasoningTokens += usage.CompletionTokenDetails.ReasoningTokens
+}
+
+// appendToLastUserMessage adds the instruction to the last user message, so that the system prompt handling
+// of the channel is not affected.
+func appendToLastUserMessage(request *dto.GeneralOpenAIRequest, instruction string) {
+	for i := len(request.Messages) - 1; i >= 0; i-- {
+		message := &request.Messages[i]
+		if message.Role != "user" {
+			continue
+		}
+		if message.IsStringContent() {
+			message.SetStringContent(message.StringContent() + "\n\n" + instruction)
+		} else {
+			message.SetMediaContent(append(message.ParseContent(), dto.MediaContent{
+				Type: dto.ContentTypeText,
+				Text: instruction,
+			}))
+		}
+		return
+	}
+	userMessage := dto.Message{Role: "user"}
+	userMessage.SetStringContent(instruction)
+	request.Messages = append(request.Messages, userMessage)
+}
+
+// validateStructuredOutput extracts the JSON of an answer and checks it, a nil schema only requires a JSON object.
+func validateStructuredOutput(content string, schema any) (string, []string) {
+	cleaned := extractStructuredOutput(content)
+	var value any
+	if err := common.UnmarshalJsonStr(cleaned, &value); err != nil {
+		return content, []string{"the reply is not valid JSON: " + err.Error()}
+	}
+	if schema == nil {
+		if _, ok := value.(map[string]any); !ok {
+			return cleaned, []string{"the reply must be a JSON object"}
+		}
+		return cleaned, nil
+	}
+	return cleaned, service.ValidateJsonSchema(schema, value)
+}
+
+// extractStructuredOutput strips markdown fences and text around the JSON of an answer.
+func extractStructuredOutput(content string) string {
+	content = strings.TrimSpace(content)
+	if strings.HasPrefix(content, "```") {
+		content = strings.TrimPrefix(content, "```")
+		if newline := strings.IndexByte(content, '\n'); newline >= 0 && !strings.ContainsAny(content[:newline], "{[") {
+			content = content[newline+1:]
+		}
+		content = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(content), "```"))
+	}
+	if json.Valid([]byte(content)) {
+		return content
+	}
+	start := strings.IndexAny(content, "{[")
+	end := strings.LastIndexAny(content, "}]")
+	if start >= 0 && end > start && json.Valid([]byte(content[start:end+1])) {
+		return content[start : end+1]
+	}
+	return content
+}
+
+// writeStructuredOutputStream sends the final answer to a streaming client as chat completion chunks.
+func writeStructuredOutputStream(c *gin.Context, info *relaycommon.RelayInfo, response *dto.OpenAITextResponse) {
+	created := common.GetTimestamp()
+	if timestamp, ok := response.Created.(float64); ok {
+		created = int64(timestamp)
+	}
+	id := response.Id
+	if id == "" {
+		id = helper.GetResponseID(c)
+	}
+	helper.SetEventStreamHeaders(c)
+
+	choice := response.Choices[0]
+	delta := dto.ChatCompletionsStreamResponseChoiceDelta{Role: "assistant"}
+	delta.SetContentString(choice.Message.StringContent())
+	for i, toolCall := range choice.Message.ParseToolCalls() {
+		delta.ToolCalls = append(delta.ToolCalls, dto.ToolCallResponse{
+			Index: common.GetPointer(i),
+			ID:    toolCall.ID,
+			Type:  toolCall.Type,
+			Function: dto.FunctionResponse{
+				Name:      toolCall.Function.Name,
+				Arguments: toolCall.Function.Arguments,
+			},
+		})
+	}
+	_ = helper.ObjectData(c, &dto.ChatCompletionsStreamResponse{
+		Id:      id,
+		Object:  "chat.completion.chunk",
+		Created: created,
+		Model:   response.Model,
+		Choices: []dto.ChatCompletionsStreamResponseChoice{{Delta: delta}},
+	})
+	finishReason := choice.FinishReason
+	if finishReason == "" {
+		finishReason = constant.FinishReasonStop
+	}
+	_ = helper.ObjectData(c, helper.GenerateStopResponse(id, created, response.Model, finishReason))
+	if info.ShouldIncludeUsage {
+		_ = helper.ObjectData(c, helper.GenerateFinalUsageResponse(id, created, response.Model, response.Usage))
+	}
+	helper.Done(c)
+}
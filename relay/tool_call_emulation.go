@@ -0,0 +1,532 @@
+package relay
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/logger"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	relayconstant "github.com/QuantumNous/new-api/relay/constant"
+	"github.com/QuantumNous/new-api/relay/helper"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+
+	"github.com/gin-gonic/gin"
+)
+
+// toolCallEmulationEnabled reports whether the channel gets tools in the prompt instead of the tools field.
+func toolCallEmulationEnabled(info *relaycommon.RelayInfo) bool {
+	if model_setting.GetGlobalSettings().PassThroughRequestEnabled || info.ChannelSetting.PassThroughBodyEnabled {
+		return false
+	}
+	switch info.ChannelSetting.ToolCallEmulation {
+	case "force":
+		return true
+	case "disable":
+		return false
+	}
+	return operation_setting.IsToolCallEmulatedForChannelType(info.ChannelType)
+}
+
+func shouldEmulateOpenAIToolCalls(info *relaycommon.RelayInfo, request *dto.GeneralOpenAIRequest) bool {
+	if info.RelayMode != relayconstant.RelayModeChatCompletions || !toolCallEmulationEnabled(info) {
+		return false
+	}
+	if len(request.Tools) > 0 || len(request.Functions) > 0 {
+		return true
+	}
+	for _, message := range request.Messages {
+		if message.Role == "tool" || message.Role == "function" || len(message.ToolCalls) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func shouldEmulateClaudeToolCalls(info *relaycommon.RelayInfo, request *dto.ClaudeRequest) bool {
+	if !toolCallEmulationEnabled(info) {
+		return false
+	}
+	if len(request.GetTools()) > 0 {
+		return true
+	}
+	for _, message := range request.Messages {
+		if message.IsStringContent() {
+			continue
+		}
+		blocks, _ := message.ParseContent()
+		for _, block := range blocks {
+			if block.Type == "tool_use" || block.Type == "tool_result" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// emulateOpenAIToolCalls puts the tools of the request into the prompt and wraps the client writer, so that the
+// tool calls the model writes as text reach the client as tool_calls.
+func emulateOpenAIToolCalls(c *gin.Context, info *relaycommon.RelayInfo, request *dto.GeneralOpenAIRequest) *toolCallEmulationWriter {
+	systemPrompt := ""
+	if !info.ChannelSetting.SystemPromptOverride {
+		systemPrompt = info.ChannelSetting.SystemPrompt
+	}
+	// coze only forwards user messages
+	inUserMessage := info.ChannelType == constant.ChannelTypeCoze
+	service.EmulateOpenAITools(request, operation_setting.GetToolCallEmulationSetting().Template, systemPrompt, inUserMessage)
+	writer := newToolCallEmulationWriter(c.Writer, false)
+	c.Writer = writer
+	return writer
+}
+
+// emulateClaudeToolCalls is emulateOpenAIToolCalls for the Claude messages format, calls become tool_use blocks.
+func emulateClaudeToolCalls(c *gin.Context, request *dto.ClaudeRequest) *toolCallEmulationWriter {
+	service.EmulateClaudeTools(request, operation_setting.GetToolCallEmulationSetting().Template)
+	writer := newToolCallEmulationWriter(c.Writer, true)
+	c.Writer = writer
+	return writer
+}
+
+// finishToolCallEmulation writes what the emulation writer still holds and gives the client writer back.
+func finishToolCallEmulation(c *gin.Context, writer *toolCallEmulationWriter, succeeded bool) {
+	c.Writer = writer.ResponseWriter
+	if !succeeded {
+		return
+	}
+	if err := writer.finish(); err != nil {
+		logger.LogError(c, "failed to write emulated tool calls: "+err.Error())
+	}
+}
+
+// toolCallEmulationWriter sits in front of the client connection and turns the <tool_call> blocks in the
+// output of the adaptor into OpenAI tool_calls or Claude tool_use blocks, streaming or not.
+type toolCallEmulationWriter struct {
+	*helper.StreamRewriter
+	claude bool
+
+	// openai streams, per choice index
+	parsers   map[int]*service.ToolCallTextParser
+	lastChunk *dto.ChatCompletionsStreamResponse
+	done      bool
+
+	// claude streams, upstream text blocks are mapped to -1 and go through the parser
+	parser         *service.ToolCallTextParser
+	upstreamBlocks map[int]int
+	nextBlock      int
+	textBlock      int
+	flushed        bool
+}
+
+func newToolCallEmulationWriter(writer gin.ResponseWriter, claude bool) *toolCallEmulationWriter {
+	w := &toolCallEmulationWriter{
+		claude:         claude,
+		parsers:        make(map[int]*service.ToolCallTextParser),
+		parser:         service.NewToolCallTextParser(),
+		upstreamBlocks: make(map[int]int),
+		textBlock:      -1,
+	}
+	w.StreamRewriter = helper.NewStreamRewriter(writer, w.writeStreamLine)
+	return w
+}
+
+func (w *toolCallEmulationWriter) writeStreamLine(line string) error {
+	if strings.HasPrefix(line, ":") {
+		_, err := w.ResponseWriter.WriteString(line + "\n\n")
+		return err
+	}
+	// claude event lines are written again from the type of the data
+	if !strings.HasPrefix(line, "data:") {
+		return nil
+	}
+	data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+	if data == "" {
+		return nil
+	}
+	if w.claude {
+		return w.writeClaudeStreamData(data)
+	}
+	return w.writeOpenAIStreamData(data)
+}
+
+func (w *toolCallEmulationWriter) writeData(data string) error {
+	_, err := w.ResponseWriter.WriteString("data: " + data + "\n\n")
+	w.ResponseWriter.Flush()
+	return err
+}
+
+func (w *toolCallEmulationWriter) writeObject(object any) error {
+	data, err := common.Marshal(object)
+	if err != nil {
+		return err
+	}
+	return w.writeData(string(data))
+}
+
+func (w *toolCallEmulationWriter) choiceParser(index int) *service.ToolCallTextParser {
+	parser, ok := w.parsers[index]
+	if !ok {
+		parser = service.NewToolCallTextParser()
+		w.parsers[index] = parser
+	}
+	return parser
+}
+
+func (w *toolCallEmulationWriter) writeOpenAIStreamData(data string) error {
+	if data == "[DONE]" {
+		if err := w.flushOpenAIStream(); err != nil {
+			return err
+		}
+		return w.writeData(data)
+	}
+	var chunk dto.ChatCompletionsStreamResponse
+	if err := common.UnmarshalJsonStr(data, &chunk); err != nil || len(chunk.Choices) == 0 {
+		// usage chunks and anything unknown go to the client as they are
+		return w.writeData(data)
+	}
+	w.lastChunk = &chunk
+	for _, choice := range chunk.Choices {
+		parser := w.choiceParser(choice.Index)
+		events := parser.Feed(choice.Delta.GetContentString())
+		finishReason := choice.FinishReason
+		if finishReason != nil {
+			events = append(events, parser.Flush()...)
+			if parser.Calls() > 0 {
+				finishReason = common.GetPointer("tool_calls")
+			}
+		}
+		deltas := w.openAIDeltas(choice.Index, events)
+		base := choice.Delta
+		if len(deltas) == 0 {
+			if base.Role == "" && base.ReasoningContent == nil && base.Reasoning == nil && len(base.ToolCalls) == 0 && finishReason == nil && chunk.Usage == nil {
+				continue
+			}
+			deltas = append(deltas, dto.ChatCompletionsStreamResponseChoiceDelta{})
+		}
+		deltas[0].Role = base.Role
+		deltas[0].ReasoningContent = base.ReasoningContent
+		deltas[0].Reasoning = base.Reasoning
+		deltas[0].ToolCalls = append(base.ToolCalls, deltas[0].ToolCalls...)
+		for i, delta := range deltas {
+			out := chunk
+			out.Choices = []dto.ChatCompletionsStreamResponseChoice{{Index: choice.Index, Delta: delta}}
+			if i == len(deltas)-1 {
+				out.Choices[0].FinishReason = finishReason
+			} else {
+				out.Usage = nil
+			}
+			if err := w.writeObject(&out); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (w *toolCallEmulationWriter) openAIDeltas(index int, events []service.ToolCallTextEvent) []dto.ChatCompletionsStreamResponseChoiceDelta {
+	deltas := make([]dto.ChatCompletionsStreamResponseChoiceDelta, 0, len(events))
+	// call indexes continue from the calls written in earlier chunks
+	callIndex := w.choiceParser(index).Calls() - countToolCallEvents(events)
+	for _, event := range events {
+		delta := dto.ChatCompletionsStreamResponseChoiceDelta{}
+		if event.Call == nil {
+			delta.SetContentString(event.Text)
+		} else {
+			delta.ToolCalls = []dto.ToolCallResponse{{
+				Index: common.GetPointer(callIndex),
+				ID:    "call_" + common.GetRandomString(24),
+				Type:  "function",
+				Function: dto.FunctionResponse{
+					Name:      event.Call.Name,
+					Arguments: event.Call.Arguments,
+				},
+			}}
+			callIndex++
+		}
+		deltas = append(deltas, delta)
+	}
+	return deltas
+}
+
+func countToolCallEvents(events []service.ToolCallTextEvent) int {
+	count := 0
+	for _, event := range events {
+		if event.Call != nil {
+			count++
+		}
+	}
+	return count
+}
+
+// flushOpenAIStream writes what the parsers hold when the stream ends without a finish reason.
+func (w *toolCallEmulationWriter) flushOpenAIStream() error {
+	if w.done || w.lastChunk == nil {
+		return nil
+	}
+	w.done = true
+	for index, parser := range w.parsers {
+		for _, delta := range w.openAIDeltas(index, parser.Flush()) {
+			out := *w.lastChunk
+			out.Usage = nil
+			out.Choices = []dto.ChatCompletionsStreamResponseChoice{{Index: index, Delta: delta}}
+			if err := w.writeObject(&out); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (w *toolCallEmulationWriter) writeClaudeEvent(event *dto.ClaudeResponse) error {
+	data, err := common.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = w.ResponseWriter.WriteString(fmt.Sprintf("event: %s\ndata: %s\n\n", event.Type, data))
+	w.ResponseWriter.Flush()
+	return err
+}
+
+func (w *toolCallEmulationWriter) writeClaudeStreamData(data string) error {
+	var event dto.ClaudeResponse
+	if err := common.UnmarshalJsonStr(data, &event); err != nil {
+		return nil
+	}
+	upstreamIndex := event.GetIndex()
+	switch event.Type {
+	case "content_block_start":
+		if event.ContentBlock != nil && event.ContentBlock.Type == dto.ContentTypeText {
+			w.upstreamBlocks[upstreamIndex] = -1
+			return w.writeClaudeTextEvents(w.parser.Feed(event.ContentBlock.GetText()))
+		}
+		if err := w.closeClaudeTextBlock(); err != nil {
+			return err
+		}
+		w.upstreamBlocks[upstreamIndex] = w.nextBlock
+		event.SetIndex(w.nextBlock)
+		w.nextBlock++
+	case "content_block_delta", "content_block_stop":
+		index, ok := w.upstreamBlocks[upstreamIndex]
+		if ok && index < 0 {
+			if event.Type == "content_block_delta" && event.Delta != nil && event.Delta.Type == "text_delta" {
+				return w.writeClaudeTextEvents(w.parser.Feed(event.Delta.GetText()))
+			}
+			return nil
+		}
+		event.SetIndex(index)
+	case "message_delta":
+		if err := w.flushClaudeStream(); err != nil {
+			return err
+		}
+		if event.Delta != nil && w.parser.Calls() > 0 {
+			event.Delta.StopReason = common.GetPointer("tool_use")
+		}
+	default:
+		if event.Type == "message_stop" {
+			if err := w.flushClaudeStream(); err != nil {
+				return err
+			}
+		}
+		// message_start, ping and error events are not changed
+		_, err := w.ResponseWriter.WriteString(fmt.Sprintf("event: %s\ndata: %s\n\n", event.Type, data))
+		w.ResponseWriter.Flush()
+		return err
+	}
+	return w.writeClaudeEvent(&event)
+}
+
+func (w *toolCallEmulationWriter) flushClaudeStream() error {
+	if w.flushed {
+		return nil
+	}
+	w.flushed = true
+	if err := w.writeClaudeTextEvents(w.parser.Flush()); err != nil {
+		return err
+	}
+	return w.closeClaudeTextBlock()
+}
+
+func (w *toolCallEmulationWriter) closeClaudeTextBlock() error {
+	if w.textBlock < 0 {
+		return nil
+	}
+	stop := &dto.ClaudeResponse{Type: "content_block_stop"}
+	stop.SetIndex(w.textBlock)
+	w.textBlock = -1
+	return w.writeClaudeEvent(stop)
+}
+
+func (w *toolCallEmulationWriter) writeClaudeTextEvents(events []service.ToolCallTextEvent) error {
+	for _, event := range events {
+		if event.Call == nil {
+			if w.textBlock < 0 {
+				w.textBlock = w.nextBlock
+				w.nextBlock++
+				block := dto.ClaudeMediaMessage{Type: dto.ContentTypeText}
+				block.SetText("")
+				start := &dto.ClaudeResponse{Type: "content_block_start", ContentBlock: &block}
+				start.SetIndex(w.textBlock)
+				if err := w.writeClaudeEvent(start); err != nil {
+					return err
+				}
+			}
+			delta := &dto.ClaudeMediaMessage{Type: "text_delta"}
+			delta.SetText(event.Text)
+			textDelta := &dto.ClaudeResponse{Type: "content_block_delta", Delta: delta}
+			textDelta.SetIndex(w.textBlock)
+			if err := w.writeClaudeEvent(textDelta); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := w.closeClaudeTextBlock(); err != nil {
+			return err
+		}
+		index := w.nextBlock
+		w.nextBlock++
+		block := claudeToolUseBlock(event.Call)
+		block.Input = map[string]any{}
+		start := &dto.ClaudeResponse{Type: "content_block_start", ContentBlock: &block}
+		start.SetIndex(index)
+		inputDelta := &dto.ClaudeResponse{Type: "content_block_delta", Delta: &dto.ClaudeMediaMessage{
+			Type:        "input_json_delta",
+			PartialJson: common.GetPointer(event.Call.Arguments),
+		}}
+		inputDelta.SetIndex(index)
+		stop := &dto.ClaudeResponse{Type: "content_block_stop"}
+		stop.SetIndex(index)
+		for _, out := range []*dto.ClaudeResponse{start, inputDelta, stop} {
+			if err := w.writeClaudeEvent(out); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func claudeToolUseBlock(call *service.EmulatedToolCall) dto.ClaudeMediaMessage {
+	var input any = map[string]any{}
+	_ = common.UnmarshalJsonStr(call.Arguments, &input)
+	return dto.ClaudeMediaMessage{
+		Type:  "tool_use",
+		Id:    "toolu_" + common.GetRandomString(24),
+		Name:  call.Name,
+		Input: input,
+	}
+}
+
+// finish writes what the adaptor left in the buffer, a non-stream response is rewritten as a whole.
+func (w *toolCallEmulationWriter) finish() error {
+	if !w.Written() {
+		return nil
+	}
+	if w.IsStream() {
+		if err := w.FlushPending(); err != nil {
+			return err
+		}
+		if w.claude {
+			return w.flushClaudeStream()
+		}
+		return w.flushOpenAIStream()
+	}
+	body := w.Body()
+	if w.Status() == http.StatusOK {
+		var err error
+		if w.claude {
+			body, err = rewriteClaudeToolCallBody(body)
+		} else {
+			body, err = rewriteOpenAIToolCallBody(body)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	w.ResponseWriter.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.ResponseWriter.WriteHeader(w.Status())
+	_, err := w.ResponseWriter.Write(body)
+	return err
+}
+
+func rewriteOpenAIToolCallBody(body []byte) ([]byte, error) {
+	var response dto.OpenAITextResponse
+	if err := common.Unmarshal(body, &response); err != nil || len(response.Choices) == 0 {
+		// not a chat completion, the client gets it as it is
+		return body, nil
+	}
+	for i := range response.Choices {
+		choice := &response.Choices[i]
+		parser := service.NewToolCallTextParser()
+		events := append(parser.Feed(choice.Message.StringContent()), parser.Flush()...)
+		if parser.Calls() == 0 {
+			continue
+		}
+		var text strings.Builder
+		toolCalls := choice.Message.ParseToolCalls()
+		for _, event := range events {
+			if event.Call == nil {
+				text.WriteString(event.Text)
+				continue
+			}
+			toolCalls = append(toolCalls, dto.ToolCallRequest{
+				ID:   "call_" + common.GetRandomString(24),
+				Type: "function",
+				Function: dto.FunctionRequest{
+					Name:      event.Call.Name,
+					Arguments: event.Call.Arguments,
+				},
+			})
+		}
+		if content := strings.TrimSpace(text.String()); content != "" {
+			choice.Message.SetStringContent(content)
+		} else {
+			choice.Message.SetNullContent()
+		}
+		choice.Message.SetToolCalls(toolCalls)
+		choice.FinishReason = "tool_calls"
+	}
+	return common.Marshal(&response)
+}
+
+func rewriteClaudeToolCallBody(body []byte) ([]byte, error) {
+	var response dto.ClaudeResponse
+	if err := common.Unmarshal(body, &response); err != nil || response.Type != "message" {
+		return body, nil
+	}
+	parser := service.NewToolCallTextParser()
+	content := make([]dto.ClaudeMediaMessage, 0, len(response.Content))
+	appendEvents := func(events []service.ToolCallTextEvent) {
+		for _, event := range events {
+			if event.Call != nil {
+				content = append(content, claudeToolUseBlock(event.Call))
+				continue
+			}
+			if last := len(content) - 1; last >= 0 && content[last].Type == dto.ContentTypeText {
+				content[last].SetText(content[last].GetText() + event.Text)
+				continue
+			}
+			block := dto.ClaudeMediaMessage{Type: dto.ContentTypeText}
+			block.SetText(event.Text)
+			content = append(content, block)
+		}
+	}
+	for _, block := range response.Content {
+		if block.Type == dto.ContentTypeText {
+			appendEvents(parser.Feed(block.GetText()))
+			continue
+		}
+		appendEvents(parser.Flush())
+		content = append(content, block)
+	}
+	appendEvents(parser.Flush())
+	if parser.Calls() == 0 {
+		return body, nil
+	}
+	response.Content = content
+	response.StopReason = "tool_use"
+	return common.Marshal(&response)
+}
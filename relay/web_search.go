@@ -0,0 +1,48 @@
+package relay
+
+import (
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/logger"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	relayconstant "github.com/QuantumNous/new-api/relay/constant"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+
+	"github.com/gin-gonic/gin"
+)
+
+// shouldExecuteWebSearch reports whether the gateway runs the web_search tool of a chat request itself.
+func shouldExecuteWebSearch(info *relaycommon.RelayInfo, request *dto.GeneralOpenAIRequest) bool {
+	if !operation_setting.GetWebSearchSetting().Enabled || info.RelayMode != relayconstant.RelayModeChatCompletions {
+		return false
+	}
+	if model_setting.GetGlobalSettings().PassThroughRequestEnabled || info.ChannelSetting.PassThroughBodyEnabled {
+		return false
+	}
+	for _, tool := range request.Tools {
+		if tool.Type == service.WebSearchToolName {
+			return true
+		}
+	}
+	return false
+}
+
+// executeWebSearch runs a search the model asked for and returns the tool message content, ok is false when
+// no search was made.
+func executeWebSearch(c *gin.Context, backend service.WebSearchBackend, toolCall dto.ToolCallRequest) (content string, ok bool) {
+	var arguments struct {
+		Query string `json:"query"`
+	}
+	_ = common.UnmarshalJsonStr(toolCall.Function.Arguments, &arguments)
+	if arguments.Query == "" {
+		return "Search failed: the query is empty.", false
+	}
+	results, err := backend.Search(c.Request.Context(), arguments.Query, operation_setting.GetWebSearchSetting().MaxResults)
+	if err != nil {
+		logger.LogWarn(c, "web search failed: "+err.Error())
+		return "Search failed: " + err.Error(), false
+	}
+	return service.FormatWebSearchResults(results), true
+}
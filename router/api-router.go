@@ -83,6 +83,7 @@ func SetApiRouter(router *gin.Engine) {
 				selfRoute.POST("/stripe/amount", controller.RequestStripeAmount)
 				selfRoute.POST("/aff_transfer", controller.TransferAffQuota)
 				selfRoute.PUT("/setting", controller.UpdateUserSetting)
+				selfRoute.GET("/self/budgets", controller.GetSelfBudgets)
 
 				
 				selfRoute.GET("/2fa/status", controller.Get2FAStatus)
@@ -105,6 +106,8 @@ func SetApiRouter(router *gin.Engine) {
 				adminRoute.PUT("/", controller.UpdateUser)
 				adminRoute.DELETE("/:id", controller.DeleteUser)
 				adminRoute.DELETE("/:id/reset_passkey", controller.AdminResetPasskey)
+				adminRoute.GET("/:id/budgets", controller.GetUserBudgets)
+				adminRoute.PUT("/:id/budgets", controller.UpdateUserBudgets)
 
 				
 				adminRoute.GET("/2fa/stats", controller.Admin2FAStats)
@@ -132,6 +135,9 @@ func SetApiRouter(router *gin.Engine) {
 			channelRoute.GET("/search", controller.SearchChannels)
 			channelRoute.GET("/models", controller.ChannelListModels)
 			channelRoute.GET("/models_enabled", controller.EnabledListModels)
+			channelRoute.GET("/stats", controller.GetChannelStats)
+			channelRoute.GET("/breakers", controller.GetChannelBreakers)
+			channelRoute.POST("/breakers/:id/reset", controller.ResetChannelBreakers)
 			channelRoute.GET("/:id", controller.GetChannel)
 			channelRoute.POST("/:id/key", middleware.CriticalRateLimit(), middleware.DisableCache(), middleware.SecureVerificationRequired(), controller.GetChannelKey)
 			channelRoute.GET("/test", controller.TestAllChannels)
@@ -163,6 +169,8 @@ func SetApiRouter(router *gin.Engine) {
 			tokenRoute.POST("/", controller.AddToken)
 			tokenRoute.PUT("/", controller.UpdateToken)
 			tokenRoute.DELETE("/:id", controller.DeleteToken)
+			tokenRoute.GET("/:id/budgets", controller.GetTokenBudgets)
+			tokenRoute.PUT("/:id/budgets", controller.UpdateTokenBudgets)
 			tokenRoute.POST("/batch", controller.DeleteTokenBatch)
 		}
 
@@ -219,6 +227,39 @@ func SetApiRouter(router *gin.Engine) {
 			prefillGroupRoute.DELETE("/:id", controller.DeletePrefillGroup)
 		}
 
+		mcpServerRoute := apiRouter.Group("/mcp_server")
+		mcpServerRoute.Use(middleware.AdminAuth())
+		{
+			mcpServerRoute.GET("/", controller.GetMcpServers)
+			mcpServerRoute.POST("/", controller.CreateMcpServer)
+			mcpServerRoute.PUT("/", controller.UpdateMcpServer)
+			mcpServerRoute.DELETE("/:id", controller.DeleteMcpServer)
+			mcpServerRoute.GET("/:id/tools", controller.GetMcpServerTools)
+		}
+
+		ledgerRoute := apiRouter.Group("/ledger")
+		{
+			ledgerRoute.GET("/", middleware.AdminAuth(), controller.GetQuotaLedger)
+			ledgerRoute.GET("/reconcile", middleware.RootAuth(), controller.ReconcileQuotaLedger)
+			ledgerRoute.POST("/reconcile", middleware.RootAuth(), controller.RepairQuotaLedger)
+		}
+
+		subscriptionRoute := apiRouter.Group("/subscription")
+		{
+			subscriptionRoute.GET("/epay/notify", controller.SubscriptionEpayNotify)
+			subscriptionRoute.GET("/plans", middleware.UserAuth(), controller.GetEnabledSubscriptionPlans)
+			subscriptionRoute.GET("/self", middleware.UserAuth(), controller.GetSelfSubscription)
+			subscriptionRoute.GET("/self/history", middleware.UserAuth(), controller.GetSelfSubscriptions)
+			subscriptionRoute.POST("/self/cancel", middleware.UserAuth(), middleware.CriticalRateLimit(), controller.CancelSelfSubscription)
+			subscriptionRoute.POST("/epay/pay", middleware.UserAuth(), middleware.CriticalRateLimit(), controller.RequestSubscriptionEpay)
+			subscriptionRoute.POST("/stripe/pay", middleware.UserAuth(), middleware.CriticalRateLimit(), controller.RequestSubscriptionStripe)
+			subscriptionRoute.GET("/", middleware.AdminAuth(), controller.GetAllSubscriptions)
+			subscriptionRoute.GET("/plan", middleware.AdminAuth(), controller.GetSubscriptionPlans)
+			subscriptionRoute.POST("/plan", middleware.AdminAuth(), controller.CreateSubscriptionPlan)
+			subscriptionRoute.PUT("/plan", middleware.AdminAuth(), controller.UpdateSubscriptionPlan)
+			subscriptionRoute.DELETE("/plan/:id", middleware.AdminAuth(), controller.DeleteSubscriptionPlan)
+		}
+
 		mjRoute := apiRouter.Group("/mj")
 		mjRoute.GET("/self", middleware.UserAuth(), controller.GetUserMidjourney)
 		mjRoute.GET("/", middleware.AdminAuth(), controller.GetAllMidjourney)
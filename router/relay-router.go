@@ -55,6 +55,14 @@ func SetRelayRouter(router *gin.Engine) {
 		})
 	}
 
+	mcpRouter := router.Group("/mcp")
+	mcpRouter.Use(middleware.TokenAuth())
+	{
+		mcpRouter.POST("", controller.Mcp)
+		mcpRouter.GET("", controller.McpMethodNotAllowed)
+		mcpRouter.DELETE("", controller.McpMethodNotAllowed)
+	}
+
 	playgroundRouter := router.Group("/pg")
 	playgroundRouter.Use(middleware.UserAuth(), middleware.Distribute())
 	{
@@ -71,6 +79,53 @@ func SetRelayRouter(router *gin.Engine) {
 			controller.Relay(c, types.RelayFormatOpenAIRealtime)
 		})
 	}
+	{
+		filesRouter := relayV1Router.Group("/files")
+		filesRouter.GET("", controller.ListFiles)
+		filesRouter.POST("", controller.UploadFile)
+		filesRouter.GET("/:id", controller.RetrieveFile)
+		filesRouter.DELETE("/:id", controller.DeleteFile)
+		filesRouter.GET("/:id/content", controller.RetrieveFileContent)
+	}
+	{
+		batchesRouter := relayV1Router.Group("/batches")
+		batchesRouter.POST("", controller.CreateBatch)
+		batchesRouter.GET("", controller.ListBatches)
+		batchesRouter.GET("/:id", controller.RetrieveBatch)
+		batchesRouter.POST("/:id/cancel", controller.CancelBatch)
+	}
+	{
+		responsesRouter := relayV1Router.Group("/responses")
+		responsesRouter.GET("/:id", controller.RetrieveResponse)
+		responsesRouter.DELETE("/:id", controller.DeleteResponse)
+		responsesRouter.GET("/:id/input_items", controller.ListResponseInputItems)
+	}
+	{
+		vectorStoresRouter := relayV1Router.Group("/vector_stores")
+		vectorStoresRouter.POST("", controller.CreateVectorStore)
+		vectorStoresRouter.GET("", controller.ListVectorStores)
+		vectorStoresRouter.GET("/:id", controller.RetrieveVectorStore)
+		vectorStoresRouter.POST("/:id", controller.ModifyVectorStore)
+		vectorStoresRouter.DELETE("/:id", controller.DeleteVectorStore)
+		vectorStoresRouter.POST("/:id/files", controller.CreateVectorStoreFile)
+		vectorStoresRouter.GET("/:id/files", controller.ListVectorStoreFiles)
+		vectorStoresRouter.GET("/:id/files/:file_id", controller.RetrieveVectorStoreFile)
+		vectorStoresRouter.DELETE("/:id/files/:file_id", controller.DeleteVectorStoreFile)
+		vectorStoresRouter.POST("/:id/search", controller.SearchVectorStore)
+	}
+	
+	countTokensRouter := router.Group("/v1")
+	countTokensRouter.Use(middleware.TokenAuth())
+	countTokensRouter.Use(middleware.CountTokensRateLimit())
+	countTokensRouter.Use(middleware.DistributeWithoutReservation())
+	{
+		countTokensRouter.POST("/messages/count_tokens", func(c *gin.Context) {
+			controller.CountTokens(c, types.RelayFormatClaude)
+		})
+		countTokensRouter.POST("/responses/input_tokens", func(c *gin.Context) {
+			controller.CountTokens(c, types.RelayFormatOpenAIResponses)
+		})
+	}
 	{
 		
 		httpRouter := relayV1Router.Group("")
@@ -141,11 +196,6 @@ func SetRelayRouter(router *gin.Engine) {
 
 		
 		httpRouter.POST("/images/variations", controller.RelayNotImplemented)
-		httpRouter.GET("/files", controller.RelayNotImplemented)
-		httpRouter.POST("/files", controller.RelayNotImplemented)
-		httpRouter.DELETE("/files/:id", controller.RelayNotImplemented)
-		httpRouter.GET("/files/:id", controller.RelayNotImplemented)
-		httpRouter.GET("/files/:id/content", controller.RelayNotImplemented)
 		httpRouter.POST("/fine-tunes", controller.RelayNotImplemented)
 		httpRouter.GET("/fine-tunes", controller.RelayNotImplemented)
 		httpRouter.GET("/fine-tunes/:id", controller.RelayNotImplemented)
@@ -169,6 +219,22 @@ func SetRelayRouter(router *gin.Engine) {
 		relaySunoRouter.GET("/fetch/:id", controller.RelayTask)
 	}
 
+	ollamaRouter := router.Group("/api")
+	ollamaRouter.Use(middleware.TokenAuth())
+	{
+		ollamaRouter.GET("/tags", func(c *gin.Context) {
+			controller.ListModels(c, constant.ChannelTypeOllama)
+		})
+		ollamaRelayRouter := ollamaRouter.Group("")
+		ollamaRelayRouter.Use(middleware.ModelRequestRateLimit())
+		ollamaRelayRouter.Use(middleware.Distribute())
+		for _, path := range []string{"/chat", "/generate", "/embed"} {
+			ollamaRelayRouter.POST(path, func(c *gin.Context) {
+				controller.Relay(c, types.RelayFormatOllama)
+			})
+		}
+	}
+
 	relayGeminiRouter := router.Group("/v1beta")
 	relayGeminiRouter.Use(middleware.TokenAuth())
 	relayGeminiRouter.Use(middleware.ModelRequestRateLimit())
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/types"
+)
+
+// CheckBudgets refuses a request when a budget of its token or user has no room left for the quota it is
+// expected to cost.
+func CheckBudgets(relayInfo *relaycommon.RelayInfo, quota int) *types.NewAPIError {
+	budgets, err := model.GetBudgetsCache(relayInfo.UserId, relayInfo.TokenId)
+	if err != nil {
+		return types.NewError(err, types.ErrorCodeQueryDataError, types.ErrOptionWithSkipRetry())
+	}
+	relayInfo.BudgetsChecked = true
+	relayInfo.HasBudgets = len(budgets) > 0
+	for _, budget := range budgets {
+		remaining := budget.Remaining()
+		if remaining > 0 && remaining >= quota {
+			continue
+		}
+		return types.NewErrorWithStatusCode(fmt.Errorf("The %s budget of the %s is exhausted, remaining: %s, required: %s, it resets at %s",
+			budget.Period, budget.Subject(), logger.FormatQuota(remaining), logger.FormatQuota(quota),
+			time.Unix(budget.ResetAt(), 0).Format(time.DateTime)),
+			types.ErrorCodeBudgetExceeded, http.StatusTooManyRequests, types.ErrOptionWithSkipRetry(), types.ErrOptionWithNoRecordErrorLog())
+	}
+	return nil
+}
+
+// SettleTaskQuota charges a task delta more quota, or refunds it when negative, after the request that submitted
+// it has ended. The budgets the task was counted against are adjusted with the user quota.
+func SettleTaskQuota(task *model.Task, delta int) error {
+	movement := model.QuotaMovement{Reason: model.QuotaReasonConsume, Reference: task.TaskID}
+	if delta < 0 {
+		movement.Reason = model.QuotaReasonTaskRefund
+	}
+	if err := model.AdjustUserQuota(task.UserId, -delta, movement, false); err != nil {
+		return err
+	}
+	if err := model.AddBudgetUsage(task.UserId, task.TokenId, delta); err != nil {
+		common.SysError(fmt.Sprintf("failed to update budgets of user %d: %s", task.UserId, err.Error()))
+	}
+	return nil
+}
+
+// addBudgetUsage counts the quota against the budgets, it is skipped for requests known to have none.
+func addBudgetUsage(relayInfo *relaycommon.RelayInfo, quota int) {
+	if relayInfo.BudgetsChecked && !relayInfo.HasBudgets {
+		return
+	}
+	if err := model.AddBudgetUsage(relayInfo.UserId, relayInfo.TokenId, quota); err != nil {
+		common.SysError(fmt.Sprintf("failed to update budgets of user %d: %s", relayInfo.UserId, err.Error()))
+	}
+}
@@ -38,6 +38,7 @@ func DisableChannel(channelError types.ChannelError, reason string) {
 func EnableChannel(channelId int, usingKey string, channelName string) {
 	success := model.UpdateChannelStatus(channelId, usingKey, common.ChannelStatusEnabled, "")
 	if success {
+		model.ResetChannelBreakers(channelId)
 		subject := fmt.Sprintf("Channel \"%s\" (#%d) has been enabled.", channelName, channelId)
 		content := fmt.Sprintf("Channel \"%s\" (#%d) has been enabled.", channelName, channelId)
 		NotifyRootUser(formatNotifyType(channelId, common.ChannelStatusEnabled), subject, content)
@@ -0,0 +1,230 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/setting/system_setting"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+var ErrStoredFileNotFound = errors.New("stored file not found")
+
+// FileStorage keeps the content of files uploaded through the Files API.
+type FileStorage interface {
+	Put(ctx context.Context, key string, content io.Reader, size int64) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// GetFileStorage returns the storage configured in the file storage settings.
+func GetFileStorage() (FileStorage, error) {
+	settings := system_setting.GetFileStorageSettings()
+	switch settings.Type {
+	case "", system_setting.FileStorageTypeLocal:
+		root := settings.LocalPath
+		if root == "" {
+			root = "data/files"
+		}
+		return &localFileStorage{root: root}, nil
+	case system_setting.FileStorageTypeS3:
+		if settings.S3Endpoint == "" || settings.S3Bucket == "" {
+			return nil, errors.New("s3 file storage requires an endpoint and a bucket")
+		}
+		return &s3FileStorage{
+			endpoint:  strings.TrimSuffix(settings.S3Endpoint, "/"),
+			region:    settings.S3Region,
+			bucket:    settings.S3Bucket,
+			prefix:    strings.Trim(settings.S3Prefix, "/"),
+			pathStyle: settings.S3PathStyle,
+			credentials: aws.Credentials{
+				AccessKeyID:     settings.S3AccessKeyId,
+				SecretAccessKey: settings.S3SecretAccessKey,
+			},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown file storage type: %s", settings.Type)
+	}
+}
+
+// SaveUserFile stores the content and records it as a file of the user.
+func SaveUserFile(ctx context.Context, file *model.File, content io.Reader) error {
+	storage, err := GetFileStorage()
+	if err != nil {
+		return err
+	}
+	if file.Id == "" {
+		file.Id = model.NewFileId()
+	}
+	if file.Status == "" {
+		file.Status = model.FileStatusProcessed
+	}
+	file.StorageKey = fmt.Sprintf("%d/%s", file.UserId, file.Id)
+	if err = storage.Put(ctx, file.StorageKey, content, file.Bytes); err != nil {
+		return err
+	}
+	if err = file.Insert(); err != nil {
+		_ = storage.Delete(ctx, file.StorageKey)
+		return err
+	}
+	return nil
+}
+
+type localFileStorage struct {
+	root string
+}
+
+func (s *localFileStorage) path(key string) (string, error) {
+	path := filepath.Join(s.root, filepath.FromSlash(key))
+	if !strings.HasPrefix(path, filepath.Clean(s.root)+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid file key: %s", key)
+	}
+	return path, nil
+}
+
+func (s *localFileStorage) Put(ctx context.Context, key string, content io.Reader, size int64) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(file, content); err != nil {
+		_ = file.Close()
+		_ = os.Remove(path)
+		return err
+	}
+	return file.Close()
+}
+
+func (s *localFileStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrStoredFileNotFound
+	}
+	return file, err
+}
+
+func (s *localFileStorage) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// s3FileStorage talks to S3 compatible object storage with plain signed requests.
+type s3FileStorage struct {
+	endpoint    string
+	region      string
+	bucket      string
+	prefix      string
+	pathStyle   bool
+	credentials aws.Credentials
+}
+
+func (s *s3FileStorage) objectURL(key string) (string, error) {
+	endpoint, err := url.Parse(s.endpoint)
+	if err != nil {
+		return "", err
+	}
+	if s.prefix != "" {
+		key = s.prefix + "/" + key
+	}
+	if s.pathStyle {
+		endpoint.Path = strings.TrimSuffix(endpoint.Path, "/") + "/" + s.bucket + "/" + key
+	} else {
+		endpoint.Host = s.bucket + "." + endpoint.Host
+		endpoint.Path = strings.TrimSuffix(endpoint.Path, "/") + "/" + key
+	}
+	return endpoint.String(), nil
+}
+
+func (s *s3FileStorage) do(ctx context.Context, method string, key string, body io.Reader, size int64) (*http.Response, error) {
+	objectURL, err := s.objectURL(key)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, objectURL, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	const unsignedPayload = "UNSIGNED-PAYLOAD"
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	region := s.region
+	if region == "" {
+		region = "us-east-1"
+	}
+	if err = v4.NewSigner().SignHTTP(ctx, s.credentials, req, unsignedPayload, "s3", region, time.Now()); err != nil {
+		return nil, err
+	}
+	return GetHttpClient().Do(req)
+}
+
+func (s *s3FileStorage) Put(ctx context.Context, key string, content io.Reader, size int64) error {
+	resp, err := s.do(ctx, http.MethodPut, key, content, size)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("s3 put object failed: status %d: %s", resp.StatusCode, string(message))
+	}
+	return nil
+}
+
+func (s *s3FileStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrStoredFileNotFound
+	}
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 get object failed: status %d: %s", resp.StatusCode, string(message))
+	}
+	return resp.Body, nil
+}
+
+func (s *s3FileStorage) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("s3 delete object failed: status %d", resp.StatusCode)
+	}
+	return nil
+}
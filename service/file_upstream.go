@@ -0,0 +1,174 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/model"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fileIdFields are the request fields that reference uploaded files.
+var fileIdFields = map[string]bool{
+	"file_id":       true,
+	"input_file_id": true,
+}
+
+// ResolveUpstreamFileIds replaces the ids of files uploaded to the gateway with the ids the files have
+// on the selected channel, uploading them there the first time they are used. Ids the gateway does not
+// know are left alone, they may already be upstream ids.
+func ResolveUpstreamFileIds(c *gin.Context, info *relaycommon.RelayInfo, jsonData []byte) ([]byte, error) {
+	if info.ApiType != constant.APITypeOpenAI || !bytes.Contains(jsonData, []byte(`file_id"`)) {
+		return jsonData, nil
+	}
+	var request any
+	if err := common.Unmarshal(jsonData, &request); err != nil {
+		return jsonData, nil
+	}
+	resolved := make(map[string]string)
+	changed := false
+	var walk func(node any) error
+	walk = func(node any) error {
+		switch value := node.(type) {
+		case map[string]any:
+			for key, child := range value {
+				if fileId, ok := child.(string); ok && fileIdFields[key] && strings.HasPrefix(fileId, "file-") {
+					upstreamId, err := resolveUpstreamFileId(c, info, fileId, resolved)
+					if err != nil {
+						return err
+					}
+					if upstreamId != fileId {
+						value[key] = upstreamId
+						changed = true
+					}
+					continue
+				}
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+		case []any:
+			for _, child := range value {
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk(request); err != nil {
+		return nil, err
+	}
+	if !changed {
+		return jsonData, nil
+	}
+	return common.Marshal(request)
+}
+
+func resolveUpstreamFileId(c *gin.Context, info *relaycommon.RelayInfo, fileId string, resolved map[string]string) (string, error) {
+	if upstreamId, ok := resolved[fileId]; ok {
+		return upstreamId, nil
+	}
+	file, err := model.GetUserFileById(fileId, info.UserId)
+	if err != nil {
+		resolved[fileId] = fileId
+		return fileId, nil
+	}
+	upstreamId, ok := model.GetFileUpstreamId(file.Id, info.ChannelId)
+	if !ok {
+		upstreamId, err = uploadFileToChannel(c, info, file)
+		if err != nil {
+			return "", fmt.Errorf("upload file %s to channel #%d failed: %w", file.Id, info.ChannelId, err)
+		}
+		if err = model.SaveFileUpstreamId(file.Id, info.ChannelId, upstreamId); err != nil {
+			common.SysError("failed to save upstream file id: " + err.Error())
+		}
+	}
+	resolved[fileId] = upstreamId
+	return upstreamId, nil
+}
+
+// uploadFileToChannel sends the stored file to the channel's Files API and returns the id it was given there.
+func uploadFileToChannel(c *gin.Context, info *relaycommon.RelayInfo, file *model.File) (string, error) {
+	storage, err := GetFileStorage()
+	if err != nil {
+		return "", err
+	}
+	content, err := storage.Get(c.Request.Context(), file.StorageKey)
+	if err != nil {
+		return "", err
+	}
+	defer content.Close()
+
+	bodyReader, bodyWriter := io.Pipe()
+	writer := multipart.NewWriter(bodyWriter)
+	go func() {
+		err := writer.WriteField("purpose", file.Purpose)
+		if err == nil {
+			var part io.Writer
+			part, err = writer.CreateFormFile("file", file.Filename)
+			if err == nil {
+				_, err = io.Copy(part, content)
+			}
+		}
+		if err == nil {
+			err = writer.Close()
+		}
+		_ = bodyWriter.CloseWithError(err)
+	}()
+
+	uploadURL := relaycommon.GetFullRequestURL(info.ChannelBaseUrl, "/v1/files", info.ChannelType)
+	if info.ChannelType == constant.ChannelTypeAzure {
+		uploadURL = fmt.Sprintf("%s/openai/files?api-version=%s", info.ChannelBaseUrl, info.ApiVersion)
+	}
+	req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodPost, uploadURL, bodyReader)
+	if err != nil {
+		_ = bodyReader.Close()
+		return "", err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	if info.ChannelType == constant.ChannelTypeAzure {
+		req.Header.Set("api-key", info.ApiKey)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+info.ApiKey)
+	}
+
+	client := GetHttpClient()
+	if info.ChannelSetting.Proxy != "" {
+		client, err = NewProxyHttpClient(info.ChannelSetting.Proxy)
+		if err != nil {
+			_ = bodyReader.Close()
+			return "", err
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status code %d: %s", resp.StatusCode, string(responseBody))
+	}
+	var uploaded struct {
+		Id string `json:"id"`
+	}
+	if err = common.Unmarshal(responseBody, &uploaded); err != nil {
+		return "", err
+	}
+	if uploaded.Id == "" {
+		return "", fmt.Errorf("upstream returned no file id: %s", string(responseBody))
+	}
+	return uploaded.Id, nil
+}
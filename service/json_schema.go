@@ -0,0 +1,308 @@
+package service
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/QuantumNous/new-api/common"
+)
+
+// ValidateJsonSchema checks a decoded JSON value against a JSON Schema and returns the violations it finds.
+// It covers the keywords used by structured outputs: type, enum, const, properties, required, additionalProperties,
+// items, prefixItems, anyOf, oneOf, allOf, not, local $ref and the number, string and array bounds. format is not checked.
+func ValidateJsonSchema(schema any, value any) []string {
+	validator := &jsonSchemaValidator{root: schema}
+	validator.validate(schema, value, "$")
+	return validator.problems
+}
+
+type jsonSchemaValidator struct {
+	root     any
+	problems []string
+	depth    int
+}
+
+func (v *jsonSchemaValidator) fail(path string, format string, args ...any) {
+	v.problems = append(v.problems, path+": "+fmt.Sprintf(format, args...))
+}
+
+// check validates value without recording problems, for the anyOf, oneOf and not branches.
+func (v *jsonSchemaValidator) check(schema any, value any, path string) []string {
+	branch := &jsonSchemaValidator{root: v.root, depth: v.depth}
+	branch.validate(schema, value, path)
+	return branch.problems
+}
+
+func (v *jsonSchemaValidator) resolve(ref string) (any, bool) {
+	if ref == "#" {
+		return v.root, true
+	}
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, false
+	}
+	current := v.root
+	for _, token := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		object, ok := current.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if current, ok = object[token]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+func (v *jsonSchemaValidator) validate(schemaValue any, value any, path string) {
+	if allowed, ok := schemaValue.(bool); ok {
+		if !allowed {
+			v.fail(path, "no value is allowed here")
+		}
+		return
+	}
+	schema, ok := schemaValue.(map[string]any)
+	if !ok {
+		return
+	}
+	v.depth++
+	defer func() {
+		v.depth--
+	}()
+	if v.depth > 64 {
+		return
+	}
+
+	if ref, ok := schema["$ref"].(string); ok {
+		resolved, found := v.resolve(ref)
+		if !found {
+			v.fail(path, "cannot resolve $ref %s", ref)
+			return
+		}
+		v.validate(resolved, value, path)
+	}
+
+	if types := jsonSchemaTypes(schema["type"]); len(types) > 0 {
+		matched := false
+		for _, t := range types {
+			if jsonValueHasType(value, t) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			v.fail(path, "expected %s, got %s", strings.Join(types, " or "), jsonValueType(value))
+			return
+		}
+	}
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, option := range enum {
+			if jsonValuesEqual(option, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			allowed, _ := common.Marshal(enum)
+			v.fail(path, "must be one of %s", string(allowed))
+		}
+	}
+	if constant, ok := schema["const"]; ok && !jsonValuesEqual(constant, value) {
+		expected, _ := common.Marshal(constant)
+		v.fail(path, "must be %s", string(expected))
+	}
+
+	if allOf, ok := schema["allOf"].([]any); ok {
+		for _, sub := range allOf {
+			v.validate(sub, value, path)
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]any); ok {
+		var branchProblems []string
+		matched := false
+		for _, sub := range anyOf {
+			problems := v.check(sub, value, path)
+			if len(problems) == 0 {
+				matched = true
+				break
+			}
+			branchProblems = append(branchProblems, problems...)
+		}
+		if !matched {
+			v.fail(path, "does not match any of the allowed schemas (%s)", strings.Join(branchProblems, "; "))
+		}
+	}
+	if oneOf, ok := schema["oneOf"].([]any); ok {
+		matches := 0
+		for _, sub := range oneOf {
+			if len(v.check(sub, value, path)) == 0 {
+				matches++
+			}
+		}
+		if matches != 1 {
+			v.fail(path, "must match exactly one of the allowed schemas, matched %d", matches)
+		}
+	}
+	if not, ok := schema["not"]; ok && len(v.check(not, value, path)) == 0 {
+		v.fail(path, "must not match the excluded schema")
+	}
+
+	switch typed := value.(type) {
+	case map[string]any:
+		v.validateObject(schema, typed, path)
+	case []any:
+		v.validateArray(schema, typed, path)
+	case string:
+		length := utf8.RuneCountInString(typed)
+		if minLength, ok := jsonSchemaNumber(schema["minLength"]); ok && float64(length) < minLength {
+			v.fail(path, "must be at least %v characters long", minLength)
+		}
+		if maxLength, ok := jsonSchemaNumber(schema["maxLength"]); ok && float64(length) > maxLength {
+			v.fail(path, "must be at most %v characters long", maxLength)
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			if re, err := regexp.Compile(pattern); err == nil && !re.MatchString(typed) {
+				v.fail(path, "must match the pattern %s", pattern)
+			}
+		}
+	case float64:
+		if minimum, ok := jsonSchemaNumber(schema["minimum"]); ok && typed < minimum {
+			v.fail(path, "must be >= %v", minimum)
+		}
+		if maximum, ok := jsonSchemaNumber(schema["maximum"]); ok && typed > maximum {
+			v.fail(path, "must be <= %v", maximum)
+		}
+		if minimum, ok := jsonSchemaNumber(schema["exclusiveMinimum"]); ok && typed <= minimum {
+			v.fail(path, "must be > %v", minimum)
+		}
+		if maximum, ok := jsonSchemaNumber(schema["exclusiveMaximum"]); ok && typed >= maximum {
+			v.fail(path, "must be < %v", maximum)
+		}
+		if multipleOf, ok := jsonSchemaNumber(schema["multipleOf"]); ok && multipleOf > 0 {
+			quotient := typed / multipleOf
+			if math.Abs(quotient-math.Round(quotient)) > 1e-9 {
+				v.fail(path, "must be a multiple of %v", multipleOf)
+			}
+		}
+	}
+}
+
+func (v *jsonSchemaValidator) validateObject(schema map[string]any, object map[string]any, path string) {
+	properties, _ := schema["properties"].(map[string]any)
+	if required, ok := schema["required"].([]any); ok {
+		for _, name := range required {
+			if key, ok := name.(string); ok {
+				if _, exists := object[key]; !exists {
+					v.fail(path, "missing required property %q", key)
+				}
+			}
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(object)) {
+		propertyValue := object[key]
+		propertyPath := path + "." + key
+		if propertySchema, ok := properties[key]; ok {
+			v.validate(propertySchema, propertyValue, propertyPath)
+			continue
+		}
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				v.fail(path, "property %q is not allowed", key)
+			}
+		case map[string]any:
+			v.validate(additional, propertyValue, propertyPath)
+		}
+	}
+	if minProperties, ok := jsonSchemaNumber(schema["minProperties"]); ok && float64(len(object)) < minProperties {
+		v.fail(path, "must have at least %v properties", minProperties)
+	}
+	if maxProperties, ok := jsonSchemaNumber(schema["maxProperties"]); ok && float64(len(object)) > maxProperties {
+		v.fail(path, "must have at most %v properties", maxProperties)
+	}
+}
+
+func (v *jsonSchemaValidator) validateArray(schema map[string]any, array []any, path string) {
+	prefixItems, _ := schema["prefixItems"].([]any)
+	for i, item := range array {
+		itemPath := fmt.Sprintf("%s[%d]", path, i)
+		if i < len(prefixItems) {
+			v.validate(prefixItems[i], item, itemPath)
+		} else if items, ok := schema["items"]; ok {
+			v.validate(items, item, itemPath)
+		}
+	}
+	if minItems, ok := jsonSchemaNumber(schema["minItems"]); ok && float64(len(array)) < minItems {
+		v.fail(path, "must have at least %v items", minItems)
+	}
+	if maxItems, ok := jsonSchemaNumber(schema["maxItems"]); ok && float64(len(array)) > maxItems {
+		v.fail(path, "must have at most %v items", maxItems)
+	}
+	if unique, ok := schema["uniqueItems"].(bool); ok && unique {
+		for i := range array {
+			for j := i + 1; j < len(array); j++ {
+				if jsonValuesEqual(array[i], array[j]) {
+					v.fail(path, "items %d and %d are equal", i, j)
+				}
+			}
+		}
+	}
+}
+
+func jsonSchemaTypes(typeValue any) []string {
+	switch typed := typeValue.(type) {
+	case string:
+		return []string{typed}
+	case []any:
+		types := make([]string, 0, len(typed))
+		for _, t := range typed {
+			if name, ok := t.(string); ok {
+				types = append(types, name)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+func jsonSchemaNumber(value any) (float64, bool) {
+	number, ok := value.(float64)
+	return number, ok
+}
+
+func jsonValueType(value any) string {
+	switch typed := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if typed == math.Trunc(typed) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return "unknown"
+}
+
+func jsonValueHasType(value any, schemaType string) bool {
+	actual := jsonValueType(value)
+	return actual == schemaType || (schemaType == "number" && actual == "integer")
+}
+
+func jsonValuesEqual(a any, b any) bool {
+	return reflect.DeepEqual(a, b)
+}
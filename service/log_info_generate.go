@@ -7,6 +7,7 @@ import (
 	"github.com/QuantumNous/new-api/constant"
 	"github.com/QuantumNous/new-api/dto"
 	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/setting/ratio_setting"
 	"github.com/QuantumNous/new-api/types"
 
 	"github.com/gin-gonic/gin"
@@ -49,6 +50,22 @@ func GenerateTextOtherInfo(ctx *gin.Context, relayInfo *relaycommon.RelayInfo, m
 		other["is_model_mapped"] = true
 		other["upstream_model_name"] = relayInfo.UpstreamModelName
 	}
+	if relayInfo.FallbackFromModel != "" {
+		other["is_model_fallback"] = true
+		other["fallback_origin_model"] = relayInfo.FallbackFromModel
+		other["fallback_model"] = relayInfo.OriginModelName
+	}
+	if relayInfo.Hedge.Started() {
+		other["is_hedged"] = true
+		other["hedge_channels"] = relayInfo.Hedge.ChannelIds
+	}
+	if batchId := common.GetContextKeyString(ctx, constant.ContextKeyBatchId); batchId != "" {
+		other["batch_id"] = batchId
+	}
+	if groupRatioInfo := relayInfo.PriceData.GroupRatioInfo; groupRatioInfo.PricingWindow != "" {
+		other["pricing_window"] = groupRatioInfo.PricingWindow
+		other["pricing_window_ratio"] = groupRatioInfo.PricingWindowRatio
+	}
 
 	isSystemPromptOverwritten := common.GetContextKeyBool(ctx, constant.ContextKeySystemPromptOverride)
 	if isSystemPromptOverwritten {
@@ -100,6 +117,14 @@ func GenerateClaudeOtherInfo(ctx *gin.Context, relayInfo *relaycommon.RelayInfo,
 	return info
 }
 
+// AppendModelRatioTierInfo records the tier a context-tiered model was billed at, the ratios of the log are
+// already those of the tier.
+func AppendModelRatioTierInfo(other map[string]interface{}, tier ratio_setting.ModelRatioTier, index int, promptTokens int) {
+	other["model_ratio_tier"] = index
+	other["model_ratio_tier_max_prompt_tokens"] = tier.MaxPromptTokens
+	other["model_ratio_tier_prompt_tokens"] = promptTokens
+}
+
 func GenerateMjOtherInfo(relayInfo *relaycommon.RelayInfo, priceData types.PerCallPriceData) map[string]interface{} {
 	other := make(map[string]interface{})
 	other["model_price"] = priceData.ModelPrice
@@ -107,6 +132,10 @@ func GenerateMjOtherInfo(relayInfo *relaycommon.RelayInfo, priceData types.PerCa
 	if priceData.GroupRatioInfo.HasSpecialRatio {
 		other["user_group_ratio"] = priceData.GroupRatioInfo.GroupSpecialRatio
 	}
+	if priceData.GroupRatioInfo.PricingWindow != "" {
+		other["pricing_window"] = priceData.GroupRatioInfo.PricingWindow
+		other["pricing_window_ratio"] = priceData.GroupRatioInfo.PricingWindowRatio
+	}
 	appendRequestPath(nil, relayInfo, other)
 	return other
 }
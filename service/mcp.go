@@ -0,0 +1,169 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+)
+
+// McpToolNameSeparator joins the server name and the tool name in the tools the gateway exposes.
+const McpToolNameSeparator = "__"
+
+func McpToolName(serverName string, toolName string) string {
+	return serverName + McpToolNameSeparator + toolName
+}
+
+// SplitMcpToolName splits a gateway tool name into the server name and the tool name of that server.
+func SplitMcpToolName(name string) (string, string, bool) {
+	serverName, toolName, ok := strings.Cut(name, McpToolNameSeparator)
+	if !ok || serverName == "" || toolName == "" {
+		return "", "", false
+	}
+	return serverName, toolName, true
+}
+
+// McpServerAccessible reports whether a request of the group with the token's server list may use the server,
+// an empty token list allows every server of the group.
+func McpServerAccessible(server *model.McpServer, group string, tokenServers string) bool {
+	if server.Status != model.McpServerStatusEnabled || !server.AllowsGroup(group) {
+		return false
+	}
+	if strings.TrimSpace(tokenServers) == "" {
+		return true
+	}
+	for _, name := range strings.Split(tokenServers, ",") {
+		if strings.TrimSpace(name) == server.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// GetAccessibleMcpServers returns the enabled servers the user and token of the request may use.
+func GetAccessibleMcpServers(c *gin.Context) ([]*model.McpServer, error) {
+	servers, err := model.GetEnabledMcpServers()
+	if err != nil {
+		return nil, err
+	}
+	group := common.GetContextKeyString(c, constant.ContextKeyUsingGroup)
+	tokenServers := common.GetContextKeyString(c, constant.ContextKeyTokenMcpServers)
+	accessible := make([]*model.McpServer, 0, len(servers))
+	for _, server := range servers {
+		if McpServerAccessible(server, group, tokenServers) {
+			accessible = append(accessible, server)
+		}
+	}
+	return accessible, nil
+}
+
+// McpCallQuota is the quota one successful call to a tool of the server costs.
+func McpCallQuota(server *model.McpServer, groupRatio float64) int {
+	if server.CallPrice <= 0 {
+		return 0
+	}
+	return int(decimal.NewFromFloat(server.CallPrice).
+		Mul(decimal.NewFromFloat(common.QuotaPerUnit)).
+		Mul(decimal.NewFromFloat(groupRatio)).Round(0).IntPart())
+}
+
+// CheckMcpCallQuota checks before a priced tool call that the user, the token and the budgets can pay for it,
+// the same check applies to calls made through /mcp and to calls the relay runs for a model.
+func CheckMcpCallQuota(c *gin.Context, info *relaycommon.RelayInfo, quota int) *types.NewAPIError {
+	if quota <= 0 {
+		return nil
+	}
+	userQuota, err := model.GetUserQuota(info.UserId, false)
+	if err != nil {
+		return types.NewError(err, types.ErrorCodeQueryDataError, types.ErrOptionWithSkipRetry())
+	}
+	if userQuota < quota || (!info.TokenUnlimited && c.GetInt("token_quota") < quota) {
+		return types.NewErrorWithStatusCode(errors.New("insufficient quota for the tool call"),
+			types.ErrorCodeInsufficientUserQuota, http.StatusForbidden, types.ErrOptionWithSkipRetry())
+	}
+	return CheckBudgets(info, quota)
+}
+
+// McpToolResultText renders a CallToolResult as text for a model, isError is set by the server for failed calls.
+func McpToolResultText(result json.RawMessage) (string, bool) {
+	var callResult struct {
+		Content           []map[string]any `json:"content"`
+		StructuredContent json.RawMessage  `json:"structuredContent"`
+		IsError           bool             `json:"isError"`
+	}
+	if err := common.Unmarshal(result, &callResult); err != nil {
+		return string(result), false
+	}
+	parts := make([]string, 0, len(callResult.Content))
+	for _, content := range callResult.Content {
+		if text, ok := content["text"].(string); ok && content["type"] == "text" {
+			parts = append(parts, text)
+			continue
+		}
+		// images, audio and resources are handed over as they are
+		data, err := common.Marshal(content)
+		if err == nil {
+			parts = append(parts, string(data))
+		}
+	}
+	if len(parts) == 0 && len(callResult.StructuredContent) > 0 {
+		parts = append(parts, string(callResult.StructuredContent))
+	}
+	return strings.Join(parts, "\n"), callResult.IsError
+}
+
+// RecordMcpToolCall meters a tool call: a successful call of a priced server is billed to the user and the token,
+// every call is counted as a request and written to the consume log with the quota actually charged.
+func RecordMcpToolCall(c *gin.Context, info *relaycommon.RelayInfo, server *model.McpServer, toolName string, groupRatio float64, callErr error, duration time.Duration) {
+	quota := 0
+	if callErr == nil {
+		quota = McpCallQuota(server, groupRatio)
+	}
+	chargeFailed := false
+	if quota > 0 {
+		if err := PostConsumeQuota(info, quota, 0, true); err != nil {
+			logger.LogError(c, "failed to consume mcp call quota: "+err.Error())
+			// nothing was charged, the log and the used quota must agree with the balance
+			quota = 0
+			chargeFailed = true
+		}
+	}
+	model.UpdateUserUsedQuotaAndRequestCount(info.UserId, quota)
+
+	content := fmt.Sprintf("MCP tool %s of server %s", toolName, server.Name)
+	other := map[string]interface{}{
+		"mcp_server":     server.Name,
+		"mcp_tool":       toolName,
+		"mcp_call_price": server.CallPrice,
+		"group_ratio":    groupRatio,
+	}
+	if chargeFailed {
+		other["mcp_charge_failed"] = true
+	}
+	if callErr != nil {
+		content += " failed: " + callErr.Error()
+		other["mcp_error"] = true
+	}
+	model.RecordConsumeLog(c, info.UserId, model.RecordConsumeLogParams{
+		ModelName:      "mcp/" + server.Name,
+		TokenName:      c.GetString("token_name"),
+		TokenId:        info.TokenId,
+		Quota:          quota,
+		Content:        content,
+		UseTimeSeconds: int(duration.Seconds()),
+		Group:          info.UsingGroup,
+		Other:          other,
+	})
+}
@@ -0,0 +1,496 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+)
+
+// McpProtocolVersion is the MCP revision the gateway speaks, as a client and as a server.
+const McpProtocolVersion = "2025-06-18"
+
+// upper bound on the pages of a tools/list walk
+const maxMcpToolPages = 100
+
+type McpTool struct {
+	Name         string          `json:"name"`
+	Title        string          `json:"title,omitempty"`
+	Description  string          `json:"description,omitempty"`
+	InputSchema  json.RawMessage `json:"inputSchema,omitempty"`
+	OutputSchema json.RawMessage `json:"outputSchema,omitempty"`
+	Annotations  json.RawMessage `json:"annotations,omitempty"`
+}
+
+// McpRpcMessage is a JSON-RPC request, notification or response of MCP.
+type McpRpcMessage struct {
+	JsonRpc string          `json:"jsonrpc"`
+	Id      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *McpRpcError    `json:"error,omitempty"`
+}
+
+type McpRpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    any    `json:"data,omitempty"`
+}
+
+func (e *McpRpcError) Error() string {
+	return fmt.Sprintf("mcp error %d: %s", e.Code, e.Message)
+}
+
+// mcpSession is one connection to an MCP server, for the duration of one operation of the gateway.
+type mcpSession interface {
+	request(ctx context.Context, method string, params any) (json.RawMessage, error)
+	notify(ctx context.Context, method string, params any) error
+	setProtocolVersion(version string)
+	close()
+}
+
+func newMcpRpcMessage(id int, method string, params any) (*McpRpcMessage, error) {
+	message := &McpRpcMessage{JsonRpc: "2.0", Method: method}
+	if id > 0 {
+		message.Id = json.RawMessage(strconv.Itoa(id))
+	}
+	if params != nil {
+		data, err := common.Marshal(params)
+		if err != nil {
+			return nil, err
+		}
+		message.Params = data
+	}
+	return message, nil
+}
+
+// mcpResponseResult returns the result of the response to request id, ok is false for other messages.
+func mcpResponseResult(data []byte, id int) (json.RawMessage, bool, error) {
+	var message McpRpcMessage
+	if err := common.Unmarshal(data, &message); err != nil {
+		return nil, false, nil
+	}
+	if message.Method != "" || strings.TrimSpace(string(message.Id)) != strconv.Itoa(id) {
+		// requests and notifications of the server are not answered
+		return nil, false, nil
+	}
+	if message.Error != nil {
+		return nil, true, message.Error
+	}
+	return message.Result, true, nil
+}
+
+type mcpSseEvent struct {
+	event string
+	data  string
+}
+
+func readMcpSseEvent(reader *bufio.Reader) (*mcpSseEvent, error) {
+	event := &mcpSseEvent{}
+	var data []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) && len(data) > 0 {
+				event.data = strings.Join(data, "\n")
+				return event, nil
+			}
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if len(data) == 0 && event.event == "" {
+				continue
+			}
+			event.data = strings.Join(data, "\n")
+			return event, nil
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			event.event = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+}
+
+func setMcpHeaders(req *http.Request, headers map[string]string) {
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+}
+
+func readMcpErrorBody(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("mcp server returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+}
+
+// mcpHttpSession speaks the streamable HTTP transport, every message is a POST that is answered
+// with JSON or with a stream of events.
+type mcpHttpSession struct {
+	url             string
+	headers         map[string]string
+	sessionId       string
+	protocolVersion string
+	nextId          int
+}
+
+func (s *mcpHttpSession) post(ctx context.Context, message *McpRpcMessage) (*http.Response, error) {
+	data, err := common.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	setMcpHeaders(req, s.headers)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json, text/event-stream")
+	if s.sessionId != "" {
+		req.Header.Set("Mcp-Session-Id", s.sessionId)
+	}
+	if s.protocolVersion != "" {
+		req.Header.Set("MCP-Protocol-Version", s.protocolVersion)
+	}
+	return GetHttpClient().Do(req)
+}
+
+func (s *mcpHttpSession) request(ctx context.Context, method string, params any) (json.RawMessage, error) {
+	s.nextId++
+	id := s.nextId
+	message, err := newMcpRpcMessage(id, method, params)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.post(ctx, message)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, readMcpErrorBody(resp)
+	}
+	if sessionId := resp.Header.Get("Mcp-Session-Id"); sessionId != "" {
+		s.sessionId = sessionId
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		result, ok, err := mcpResponseResult(body, id)
+		if !ok && err == nil {
+			err = fmt.Errorf("mcp server did not answer %s", method)
+		}
+		return result, err
+	}
+	reader := bufio.NewReader(resp.Body)
+	for {
+		event, err := readMcpSseEvent(reader)
+		if err != nil {
+			return nil, fmt.Errorf("mcp server did not answer %s: %w", method, err)
+		}
+		if event.event != "" && event.event != "message" {
+			continue
+		}
+		if result, ok, err := mcpResponseResult([]byte(event.data), id); ok {
+			return result, err
+		}
+	}
+}
+
+func (s *mcpHttpSession) notify(ctx context.Context, method string, params any) error {
+	message, err := newMcpRpcMessage(0, method, params)
+	if err != nil {
+		return err
+	}
+	resp, err := s.post(ctx, message)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		return readMcpErrorBody(resp)
+	}
+	return nil
+}
+
+func (s *mcpHttpSession) setProtocolVersion(version string) {
+	s.protocolVersion = version
+}
+
+func (s *mcpHttpSession) close() {
+	if s.sessionId == "" {
+		return
+	}
+	// the session is ended on a best effort basis, servers may not allow it
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.url, nil)
+	if err != nil {
+		return
+	}
+	setMcpHeaders(req, s.headers)
+	req.Header.Set("Mcp-Session-Id", s.sessionId)
+	if resp, err := GetHttpClient().Do(req); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// mcpSseSession speaks the older HTTP with SSE transport, messages are posted to the endpoint the server
+// announces on the event stream and the responses arrive on that stream.
+type mcpSseSession struct {
+	headers  map[string]string
+	endpoint string
+	stream   io.ReadCloser
+	reader   *bufio.Reader
+	nextId   int
+}
+
+func openMcpSseSession(ctx context.Context, serverUrl string, headers map[string]string) (*mcpSseSession, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, serverUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	setMcpHeaders(req, headers)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := GetHttpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, readMcpErrorBody(resp)
+	}
+	session := &mcpSseSession{
+		headers: headers,
+		stream:  resp.Body,
+		reader:  bufio.NewReader(resp.Body),
+	}
+	for session.endpoint == "" {
+		event, err := readMcpSseEvent(session.reader)
+		if err != nil {
+			session.close()
+			return nil, fmt.Errorf("mcp server did not announce its endpoint: %w", err)
+		}
+		if event.event != "endpoint" {
+			continue
+		}
+		base, err := url.Parse(serverUrl)
+		if err != nil {
+			session.close()
+			return nil, err
+		}
+		endpoint, err := base.Parse(strings.TrimSpace(event.data))
+		if err != nil {
+			session.close()
+			return nil, fmt.Errorf("invalid mcp endpoint: %w", err)
+		}
+		session.endpoint = endpoint.String()
+	}
+	return session, nil
+}
+
+func (s *mcpSseSession) post(ctx context.Context, message *McpRpcMessage) error {
+	data, err := common.Marshal(message)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	setMcpHeaders(req, s.headers)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := GetHttpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return readMcpErrorBody(resp)
+	}
+	return nil
+}
+
+func (s *mcpSseSession) request(ctx context.Context, method string, params any) (json.RawMessage, error) {
+	s.nextId++
+	id := s.nextId
+	message, err := newMcpRpcMessage(id, method, params)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.post(ctx, message); err != nil {
+		return nil, err
+	}
+	for {
+		event, err := readMcpSseEvent(s.reader)
+		if err != nil {
+			return nil, fmt.Errorf("mcp server did not answer %s: %w", method, err)
+		}
+		if event.event != "" && event.event != "message" {
+			continue
+		}
+		if result, ok, err := mcpResponseResult([]byte(event.data), id); ok {
+			return result, err
+		}
+	}
+}
+
+func (s *mcpSseSession) notify(ctx context.Context, method string, params any) error {
+	message, err := newMcpRpcMessage(0, method, params)
+	if err != nil {
+		return err
+	}
+	return s.post(ctx, message)
+}
+
+func (s *mcpSseSession) setProtocolVersion(version string) {}
+
+func (s *mcpSseSession) close() {
+	_ = s.stream.Close()
+}
+
+// withMcpSession connects to the server, runs the MCP handshake and hands the session to fn.
+func withMcpSession(ctx context.Context, server *model.McpServer, fn func(ctx context.Context, session mcpSession) error) error {
+	if timeout := operation_setting.GetMcpSetting().TimeoutSeconds; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+		defer cancel()
+	}
+	var session mcpSession
+	switch server.Transport {
+	case model.McpTransportSse:
+		sseSession, err := openMcpSseSession(ctx, server.Url, server.GetHeaders())
+		if err != nil {
+			return err
+		}
+		session = sseSession
+	case "", model.McpTransportStreamableHttp:
+		session = &mcpHttpSession{url: server.Url, headers: server.GetHeaders()}
+	default:
+		return fmt.Errorf("unknown mcp transport: %s", server.Transport)
+	}
+	defer session.close()
+
+	result, err := session.request(ctx, "initialize", map[string]any{
+		"protocolVersion": McpProtocolVersion,
+		"capabilities":    map[string]any{},
+		"clientInfo": map[string]any{
+			"name":    "new-api",
+			"version": common.Version,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("mcp initialize failed: %w", err)
+	}
+	var initialized struct {
+		ProtocolVersion string `json:"protocolVersion"`
+	}
+	_ = common.Unmarshal(result, &initialized)
+	session.setProtocolVersion(initialized.ProtocolVersion)
+	if err := session.notify(ctx, "notifications/initialized", nil); err != nil {
+		return err
+	}
+	return fn(ctx, session)
+}
+
+type mcpToolCacheEntry struct {
+	tools       []McpTool
+	updatedTime int64
+	expiresAt   time.Time
+}
+
+var (
+	mcpToolCache     = make(map[int]mcpToolCacheEntry)
+	mcpToolCacheLock sync.Mutex
+)
+
+// ListMcpServerTools returns the tools of the server, the list is cached for the configured time
+// and dropped when the server is edited.
+func ListMcpServerTools(ctx context.Context, server *model.McpServer) ([]McpTool, error) {
+	mcpToolCacheLock.Lock()
+	entry, ok := mcpToolCache[server.Id]
+	mcpToolCacheLock.Unlock()
+	if ok && entry.updatedTime == server.UpdatedTime && time.Now().Before(entry.expiresAt) {
+		return entry.tools, nil
+	}
+
+	var tools []McpTool
+	err := withMcpSession(ctx, server, func(ctx context.Context, session mcpSession) error {
+		cursor := ""
+		for page := 0; page < maxMcpToolPages; page++ {
+			var params any
+			if cursor != "" {
+				params = map[string]any{"cursor": cursor}
+			}
+			result, err := session.request(ctx, "tools/list", params)
+			if err != nil {
+				return err
+			}
+			var list struct {
+				Tools      []McpTool `json:"tools"`
+				NextCursor string    `json:"nextCursor"`
+			}
+			if err := common.Unmarshal(result, &list); err != nil {
+				return fmt.Errorf("invalid tools/list result: %w", err)
+			}
+			tools = append(tools, list.Tools...)
+			if list.NextCursor == "" {
+				return nil
+			}
+			cursor = list.NextCursor
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if seconds := operation_setting.GetMcpSetting().ToolCacheSeconds; seconds > 0 {
+		mcpToolCacheLock.Lock()
+		mcpToolCache[server.Id] = mcpToolCacheEntry{
+			tools:       tools,
+			updatedTime: server.UpdatedTime,
+			expiresAt:   time.Now().Add(time.Duration(seconds) * time.Second),
+		}
+		mcpToolCacheLock.Unlock()
+	}
+	return tools, nil
+}
+
+// CallMcpServerTool calls a tool of the server and returns the CallToolResult as the server sent it.
+func CallMcpServerTool(ctx context.Context, server *model.McpServer, name string, arguments json.RawMessage) (json.RawMessage, error) {
+	if len(arguments) == 0 || string(arguments) == "null" {
+		arguments = json.RawMessage("{}")
+	}
+	var result json.RawMessage
+	err := withMcpSession(ctx, server, func(ctx context.Context, session mcpSession) error {
+		var err error
+		result, err = session.request(ctx, "tools/call", map[string]any{
+			"name":      name,
+			"arguments": arguments,
+		})
+		return err
+	})
+	return result, err
+}
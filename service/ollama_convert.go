@@ -0,0 +1,206 @@
+package service
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+)
+
+// OllamaChatToOpenAIRequest converts an Ollama /api/chat request to a chat completions request.
+func OllamaChatToOpenAIRequest(request *dto.OllamaChatRequest) (*dto.GeneralOpenAIRequest, error) {
+	if request.Model == "" {
+		return nil, fmt.Errorf("model is required")
+	}
+	chatRequest := &dto.GeneralOpenAIRequest{
+		Model:  request.Model,
+		Stream: request.Stream == nil || *request.Stream,
+		Tools:  request.Tools,
+	}
+	if err := applyOllamaOptions(chatRequest, request.Options, request.Format, request.Think); err != nil {
+		return nil, err
+	}
+
+	// Ollama tool messages name the tool instead of the call, they are matched to the open calls in order
+	var pendingCalls []dto.ToolCallRequest
+	for i, message := range request.Messages {
+		converted := dto.Message{Role: message.Role}
+		switch message.Role {
+		case "assistant":
+			converted.ReasoningContent = message.Thinking
+			if len(message.ToolCalls) > 0 {
+				pendingCalls = nil
+				for j, toolCall := range message.ToolCalls {
+					arguments, err := common.Marshal(toolCall.Function.Arguments)
+					if err != nil || toolCall.Function.Arguments == nil {
+						arguments = []byte("{}")
+					}
+					pendingCalls = append(pendingCalls, dto.ToolCallRequest{
+						ID:   fmt.Sprintf("call_%d_%d", i, j),
+						Type: "function",
+						Function: dto.FunctionRequest{
+							Name:      toolCall.Function.Name,
+							Arguments: string(arguments),
+						},
+					})
+				}
+				converted.SetToolCalls(pendingCalls)
+			}
+		case "tool":
+			for j, toolCall := range pendingCalls {
+				if message.ToolName == "" || toolCall.Function.Name == message.ToolName {
+					converted.ToolCallId = toolCall.ID
+					pendingCalls = append(pendingCalls[:j], pendingCalls[j+1:]...)
+					break
+				}
+			}
+			if message.ToolName != "" {
+				converted.Name = common.GetPointer(message.ToolName)
+			}
+		}
+		if len(message.Images) == 0 {
+			converted.SetStringContent(message.Content)
+		} else {
+			converted.SetMediaContent(ollamaMediaContent(message.Content, message.Images))
+		}
+		chatRequest.Messages = append(chatRequest.Messages, converted)
+	}
+	if chatRequest.Stream {
+		chatRequest.StreamOptions = &dto.StreamOptions{IncludeUsage: true}
+	}
+	return chatRequest, nil
+}
+
+// OllamaGenerateToOpenAIRequest converts an Ollama /api/generate request to a chat completions request,
+// the system and prompt become the messages of a one turn conversation.
+func OllamaGenerateToOpenAIRequest(request *dto.OllamaGenerateRequest) (*dto.GeneralOpenAIRequest, error) {
+	if request.Model == "" {
+		return nil, fmt.Errorf("model is required")
+	}
+	chatRequest := &dto.GeneralOpenAIRequest{
+		Model:  request.Model,
+		Stream: request.Stream == nil || *request.Stream,
+	}
+	if err := applyOllamaOptions(chatRequest, request.Options, request.Format, request.Think); err != nil {
+		return nil, err
+	}
+	if request.System != "" {
+		systemMessage := dto.Message{Role: "system"}
+		systemMessage.SetStringContent(request.System)
+		chatRequest.Messages = append(chatRequest.Messages, systemMessage)
+	}
+	userMessage := dto.Message{Role: "user"}
+	if len(request.Images) == 0 {
+		userMessage.SetStringContent(request.Prompt)
+	} else {
+		userMessage.SetMediaContent(ollamaMediaContent(request.Prompt, request.Images))
+	}
+	chatRequest.Messages = append(chatRequest.Messages, userMessage)
+	if chatRequest.Stream {
+		chatRequest.StreamOptions = &dto.StreamOptions{IncludeUsage: true}
+	}
+	return chatRequest, nil
+}
+
+// OllamaEmbedToOpenAIRequest converts an Ollama /api/embed request to an embeddings request.
+func OllamaEmbedToOpenAIRequest(request *dto.OllamaEmbedRequest) (*dto.EmbeddingRequest, error) {
+	if request.Model == "" {
+		return nil, fmt.Errorf("model is required")
+	}
+	if request.Input == nil {
+		return nil, fmt.Errorf("input is required")
+	}
+	return &dto.EmbeddingRequest{
+		Model:      request.Model,
+		Input:      request.Input,
+		Dimensions: request.Dimensions,
+	}, nil
+}
+
+func applyOllamaOptions(request *dto.GeneralOpenAIRequest, options map[string]any, format []byte, think []byte) error {
+	if value, ok := options["temperature"].(float64); ok {
+		request.Temperature = common.GetPointer(value)
+	}
+	if value, ok := options["top_p"].(float64); ok {
+		request.TopP = value
+	}
+	if value, ok := options["top_k"].(float64); ok {
+		request.TopK = int(value)
+	}
+	if value, ok := options["frequency_penalty"].(float64); ok {
+		request.FrequencyPenalty = value
+	}
+	if value, ok := options["presence_penalty"].(float64); ok {
+		request.PresencePenalty = value
+	}
+	if value, ok := options["seed"].(float64); ok {
+		request.Seed = value
+	}
+	// -1 and -2 ask Ollama to generate until the context is full
+	if value, ok := options["num_predict"].(float64); ok && value > 0 {
+		request.MaxTokens = uint(value)
+	}
+	if stop, ok := options["stop"]; ok {
+		request.Stop = stop
+	}
+
+	if len(format) > 0 && string(format) != "null" && string(format) != `""` {
+		var formatValue any
+		if err := common.Unmarshal(format, &formatValue); err != nil {
+			return fmt.Errorf("invalid format: %w", err)
+		}
+		switch typed := formatValue.(type) {
+		case string:
+			if typed != "json" {
+				return fmt.Errorf("invalid format: %s", typed)
+			}
+			request.ResponseFormat = &dto.ResponseFormat{Type: "json_object"}
+		case map[string]any:
+			jsonSchema, err := common.Marshal(dto.FormatJsonSchema{Name: "response", Schema: typed})
+			if err != nil {
+				return err
+			}
+			request.ResponseFormat = &dto.ResponseFormat{Type: "json_schema", JsonSchema: jsonSchema}
+		}
+	}
+
+	if len(think) > 0 {
+		// Ollama upstreams take think as it is, the levels also map to the reasoning effort of other upstreams
+		request.Think = think
+		var level string
+		if common.Unmarshal(think, &level) == nil {
+			request.ReasoningEffort = level
+		}
+	}
+	return nil
+}
+
+// ollamaMediaContent turns the bare base64 images of an Ollama message into data URLs.
+func ollamaMediaContent(text string, images []string) []dto.MediaContent {
+	contents := make([]dto.MediaContent, 0, len(images)+1)
+	if text != "" {
+		contents = append(contents, dto.MediaContent{Type: dto.ContentTypeText, Text: text})
+	}
+	for _, image := range images {
+		url := image
+		if !strings.HasPrefix(image, "data:") && !strings.HasPrefix(image, "http") {
+			mimeType := "image/png"
+			// 512 bytes are enough for the content sniffing
+			head := image[:min(len(image), 684)]
+			if data, err := base64.StdEncoding.DecodeString(head[:len(head)/4*4]); err == nil {
+				if detected := http.DetectContentType(data); strings.HasPrefix(detected, "image/") {
+					mimeType = detected
+				}
+			}
+			url = "data:" + mimeType + ";base64," + image
+		}
+		contents = append(contents, dto.MediaContent{
+			Type:     dto.ContentTypeImageURL,
+			ImageUrl: &dto.MessageImageUrl{Url: url},
+		})
+	}
+	return contents
+}
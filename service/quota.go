@@ -47,6 +47,31 @@ func hasCustomModelRatio(modelName string, currentRatio float64) bool {
 	return currentRatio != defaultRatio
 }
 
+// GetModelRatioTier picks the tier of a context-tiered model from the prompt tokens the request is settled with,
+// ok is false for models with one flat ratio and models priced per call.
+func GetModelRatioTier(relayInfo *relaycommon.RelayInfo, promptTokens int) (tier ratio_setting.ModelRatioTier, index int, ok bool) {
+	if relayInfo.PriceData.UsePrice {
+		return tier, 0, false
+	}
+	return ratio_setting.GetModelRatioTier(relayInfo.OriginModelName, promptTokens)
+}
+
+// ModelRatioTierPromptTokens returns the size of the prompt a tier is picked by. Claude upstreams leave the
+// cache reads and writes out of the prompt tokens even when the response is converted to another format.
+func ModelRatioTierPromptTokens(relayInfo *relaycommon.RelayInfo, usage *dto.Usage) int {
+	promptTokens := usage.PromptTokens
+	switch relayInfo.ChannelType {
+	case constant.ChannelTypeAnthropic, constant.ChannelTypeAws:
+	case constant.ChannelTypeVertexAi:
+		if !strings.HasPrefix(relayInfo.UpstreamModelName, "claude") {
+			return promptTokens
+		}
+	default:
+		return promptTokens
+	}
+	return promptTokens + usage.PromptTokensDetails.CachedTokens + usage.PromptTokensDetails.CachedCreationTokens
+}
+
 func calculateAudioQuota(info QuotaInfo) int {
 	if info.UsePrice {
 		modelPrice := decimal.NewFromFloat(info.ModelPrice)
@@ -265,6 +290,12 @@ func PostClaudeConsumeQuota(ctx *gin.Context, relayInfo *relaycommon.RelayInfo,
 		promptTokens -= cacheCreationTokens
 	}
 
+	// the whole prompt counts towards the tier, the cache reads and writes too
+	modelRatioTier, modelRatioTierIndex, tiered := GetModelRatioTier(relayInfo, promptTokens+cacheTokens+cacheCreationTokens)
+	if tiered {
+		modelRatio, completionRatio, cacheRatio = modelRatioTier.Apply(modelRatio, completionRatio, cacheRatio)
+	}
+
 	calculateQuota := 0.0
 	if !relayInfo.PriceData.UsePrice {
 		calculateQuota = float64(promptTokens)
@@ -323,6 +354,9 @@ func PostClaudeConsumeQuota(ctx *gin.Context, relayInfo *relaycommon.RelayInfo,
 
 	other := GenerateClaudeOtherInfo(ctx, relayInfo, modelRatio, groupRatio, completionRatio,
 		cacheTokens, cacheRatio, cacheCreationTokens, cacheCreationRatio, modelPrice, relayInfo.PriceData.GroupRatioInfo.GroupSpecialRatio)
+	if tiered {
+		AppendModelRatioTierInfo(other, modelRatioTier, modelRatioTierIndex, promptTokens+cacheTokens+cacheCreationTokens)
+	}
 	model.RecordConsumeLog(ctx, relayInfo.UserId, model.RecordConsumeLogParams{
 		ChannelId:        relayInfo.ChannelId,
 		PromptTokens:     promptTokens,
@@ -362,6 +396,10 @@ func CalcOpenRouterCacheCreateTokens(usage dto.Usage, priceData types.PriceData)
 }
 
 func PostAudioConsumeQuota(ctx *gin.Context, relayInfo *relaycommon.RelayInfo, usage *dto.Usage, extraContent string) {
+	if !relayInfo.ClaimSettlement() {
+		// another copy of the hedged request won and is billed instead
+		return
+	}
 
 	useTimeSeconds := time.Now().Unix() - relayInfo.StartTime.Unix()
 	textInputTokens := usage.PromptTokensDetails.TextTokens
@@ -481,7 +519,10 @@ func PreConsumeTokenQuota(relayInfo *relaycommon.RelayInfo, quota int) error {
 	if !relayInfo.TokenUnlimited && token.RemainQuota < quota {
 		return fmt.Errorf("token quota is not enough, token remain quota: %s, need quota: %s", logger.FormatQuota(token.RemainQuota), logger.FormatQuota(quota))
 	}
-	err = model.DecreaseTokenQuota(relayInfo.TokenId, relayInfo.TokenKey, quota)
+	err = model.DecreaseTokenQuota(relayInfo.TokenId, relayInfo.TokenKey, quota, model.QuotaMovement{
+		Reason:    model.QuotaReasonPreConsume,
+		Reference: relayInfo.RequestId,
+	})
 	if err != nil {
 		return err
 	}
@@ -490,25 +531,22 @@ func PreConsumeTokenQuota(relayInfo *relaycommon.RelayInfo, quota int) error {
 
 func PostConsumeQuota(relayInfo *relaycommon.RelayInfo, quota int, preConsumedQuota int, sendEmail bool) (err error) {
 
-	if quota > 0 {
-		err = model.DecreaseUserQuota(relayInfo.UserId, quota)
-	} else {
-		err = model.IncreaseUserQuota(relayInfo.UserId, -quota, false)
+	movement := model.QuotaMovement{Reason: model.QuotaReasonConsume, Reference: relayInfo.RequestId}
+	if quota < 0 {
+		movement.Reason = model.QuotaReasonRefund
 	}
+	err = model.AdjustUserQuota(relayInfo.UserId, -quota, movement, false)
 	if err != nil {
 		return err
 	}
 
 	if !relayInfo.IsPlayground {
-		if quota > 0 {
-			err = model.DecreaseTokenQuota(relayInfo.TokenId, relayInfo.TokenKey, quota)
-		} else {
-			err = model.IncreaseTokenQuota(relayInfo.TokenId, relayInfo.TokenKey, -quota)
-		}
+		err = model.AdjustTokenQuota(relayInfo.TokenId, relayInfo.TokenKey, -quota, movement)
 		if err != nil {
 			return err
 		}
 	}
+	addBudgetUsage(relayInfo, quota)
 
 	if sendEmail {
 		if (quota + preConsumedQuota) != 0 {
@@ -0,0 +1,161 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/model"
+
+	"gorm.io/gorm"
+)
+
+// guards the walk along the previous response ids
+const maxStoredResponseTurns = 1000
+
+// ResponsesInputItems returns the input of a Responses request as a list of items, a string input is one user message.
+func ResponsesInputItems(input json.RawMessage) ([]map[string]any, error) {
+	if len(input) == 0 || string(input) == "null" {
+		return nil, nil
+	}
+	if common.GetJsonType(input) == "string" {
+		var text string
+		if err := common.Unmarshal(input, &text); err != nil {
+			return nil, err
+		}
+		return []map[string]any{{"type": "message", "role": "user", "content": text}}, nil
+	}
+	var items []map[string]any
+	if err := common.Unmarshal(input, &items); err != nil {
+		return nil, fmt.Errorf("invalid input: %w", err)
+	}
+	return items, nil
+}
+
+// StoredResponseInput returns the input items of a call as they are stored, items get an id when they have none
+// so that the input items list can be paged.
+func StoredResponseInput(request *dto.OpenAIResponsesRequest) (string, error) {
+	items, err := ResponsesInputItems(request.Input)
+	if err != nil {
+		return "", err
+	}
+	for _, item := range items {
+		if id, _ := item["id"].(string); id == "" {
+			item["id"] = "msg_" + common.GetRandomString(32)
+		}
+	}
+	data, err := common.Marshal(items)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// StoredConversationItems returns the items of the stored conversation that ends with the response: the input
+// and output of each earlier turn and the input of the response, withOutput adds the output of the response.
+func StoredConversationItems(id string, userId int, withOutput bool) ([]map[string]any, error) {
+	last, err := model.GetUserStoredResponseById(id, userId)
+	if err != nil {
+		return nil, err
+	}
+	conversation := map[string]*model.StoredResponse{last.Id: last}
+	if last.PreviousResponseId != "" && last.ConversationId != "" {
+		responses, err := model.GetUserStoredConversation(last.ConversationId, userId)
+		if err != nil {
+			return nil, err
+		}
+		for _, stored := range responses {
+			conversation[stored.Id] = stored
+		}
+	}
+
+	turns := []*model.StoredResponse{last}
+	for next := last.PreviousResponseId; next != "" && len(turns) < maxStoredResponseTurns; {
+		stored, ok := conversation[next]
+		if !ok {
+			// the earlier turns have expired or were deleted, the conversation starts here
+			break
+		}
+		turns = append(turns, stored)
+		next = stored.PreviousResponseId
+	}
+
+	var items []map[string]any
+	for i := len(turns) - 1; i >= 0; i-- {
+		var input []map[string]any
+		if turns[i].Input != "" {
+			if err := common.UnmarshalJsonStr(turns[i].Input, &input); err != nil {
+				return nil, err
+			}
+		}
+		items = append(items, input...)
+		if i == 0 && !withOutput {
+			break
+		}
+		var response struct {
+			Output []map[string]any `json:"output"`
+		}
+		if err := common.UnmarshalJsonStr(turns[i].Response, &response); err != nil {
+			return nil, err
+		}
+		items = append(items, response.Output...)
+	}
+	return items, nil
+}
+
+// StoredConversationId returns the conversation a response continuing the previous response belongs to.
+func StoredConversationId(id string, previousResponseId string, userId int) string {
+	if previousResponseId == "" {
+		return id
+	}
+	previous, err := model.GetUserStoredResponseById(previousResponseId, userId)
+	if err != nil || previous.ConversationId == "" {
+		// the previous response is not in the store, the conversation starts here
+		return id
+	}
+	return previous.ConversationId
+}
+
+// ExpandPreviousResponse replaces previous_response_id with the stored conversation, the request can then go to
+// any channel. A response that is not in the store is left to an upstream that stores the conversation itself.
+func ExpandPreviousResponse(request *dto.OpenAIResponsesRequest, userId int) error {
+	if request.PreviousResponseID == "" {
+		return nil
+	}
+	items, err := StoredConversationItems(request.PreviousResponseID, userId, true)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	history := make([]map[string]any, 0, len(items))
+	for _, item := range items {
+		itemType, _ := item["type"].(string)
+		switch itemType {
+		case "item_reference":
+			history = append(history, item)
+			continue
+		case "reasoning":
+			// reasoning without its encrypted content cannot be sent back once the upstream has not stored it
+			if content, _ := item["encrypted_content"].(string); content == "" {
+				continue
+			}
+		}
+		// the ids belong to the upstream that produced the items, another channel does not know them
+		delete(item, "id")
+		history = append(history, item)
+	}
+	input, err := ResponsesInputItems(request.Input)
+	if err != nil {
+		return err
+	}
+	request.Input, err = common.Marshal(append(history, input...))
+	if err != nil {
+		return err
+	}
+	request.PreviousResponseID = ""
+	return nil
+}
@@ -0,0 +1,722 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+)
+
+type responsesInputItem struct {
+	Type      string                 `json:"type"`
+	Id        string                 `json:"id"`
+	Role      string                 `json:"role"`
+	Content   json.RawMessage        `json:"content"`
+	CallId    string                 `json:"call_id"`
+	Name      string                 `json:"name"`
+	Arguments string                 `json:"arguments"`
+	Output    json.RawMessage        `json:"output"`
+	Summary   []responsesSummaryPart `json:"summary"`
+}
+
+type responsesSummaryPart struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type responsesContentPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text"`
+	Refusal  string `json:"refusal"`
+	ImageUrl any    `json:"image_url"`
+	Detail   string `json:"detail"`
+	FileId   string `json:"file_id"`
+	FileData string `json:"file_data"`
+	FileUrl  string `json:"file_url"`
+	Filename string `json:"filename"`
+}
+
+type responsesFunctionTool struct {
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Parameters  any    `json:"parameters"`
+}
+
+type responsesTextFormat struct {
+	Format *struct {
+		Type        string `json:"type,omitempty"`
+		Name        string `json:"name,omitempty"`
+		Description string `json:"description,omitempty"`
+		Schema      any    `json:"schema,omitempty"`
+		Strict      *bool  `json:"strict,omitempty"`
+	} `json:"format"`
+}
+
+// ResponsesToChatCompletionsRequest converts a Responses API request to a chat completions request,
+// it is used for channels that have no native Responses API support.
+func ResponsesToChatCompletionsRequest(request *dto.OpenAIResponsesRequest) (*dto.GeneralOpenAIRequest, error) {
+	if request.PreviousResponseID != "" {
+		return nil, errors.New("previous_response_id is not supported by this channel")
+	}
+	chatRequest := &dto.GeneralOpenAIRequest{
+		Model:     request.Model,
+		Stream:    request.Stream,
+		MaxTokens: request.MaxOutputTokens,
+		TopP:      request.TopP,
+		User:      request.User,
+	}
+	if request.Stream {
+		chatRequest.StreamOptions = &dto.StreamOptions{IncludeUsage: true}
+	}
+	if request.Temperature != 0 {
+		chatRequest.Temperature = common.GetPointer(request.Temperature)
+	}
+	if request.Reasoning != nil {
+		chatRequest.ReasoningEffort = request.Reasoning.Effort
+	}
+	if len(request.ParallelToolCalls) > 0 {
+		var parallelToolCalls bool
+		if err := common.Unmarshal(request.ParallelToolCalls, &parallelToolCalls); err == nil {
+			chatRequest.ParallelTooCalls = &parallelToolCalls
+		}
+	}
+
+	if len(request.Instructions) > 0 {
+		var instructions string
+		if err := common.Unmarshal(request.Instructions, &instructions); err != nil {
+			return nil, fmt.Errorf("invalid instructions: %w", err)
+		}
+		if instructions != "" {
+			chatRequest.Messages = append(chatRequest.Messages, dto.Message{Role: "system", Content: instructions})
+		}
+	}
+	messages, err := responsesInputToMessages(request.Input)
+	if err != nil {
+		return nil, err
+	}
+	chatRequest.Messages = append(chatRequest.Messages, messages...)
+
+	if len(request.Tools) > 0 {
+		var tools []responsesFunctionTool
+		if err := common.Unmarshal(request.Tools, &tools); err != nil {
+			return nil, fmt.Errorf("invalid tools: %w", err)
+		}
+		for _, tool := range tools {
+			if tool.Type != "function" {
+				return nil, fmt.Errorf("tool type %s is not supported by this channel", tool.Type)
+			}
+			chatRequest.Tools = append(chatRequest.Tools, dto.ToolCallRequest{
+				Type: "function",
+				Function: dto.FunctionRequest{
+					Name:        tool.Name,
+					Description: tool.Description,
+					Parameters:  tool.Parameters,
+				},
+			})
+		}
+	}
+	if len(request.ToolChoice) > 0 {
+		switch common.GetJsonType(request.ToolChoice) {
+		case "string":
+			var toolChoice string
+			_ = common.Unmarshal(request.ToolChoice, &toolChoice)
+			chatRequest.ToolChoice = toolChoice
+		case "object":
+			var toolChoice responsesFunctionTool
+			if err := common.Unmarshal(request.ToolChoice, &toolChoice); err != nil {
+				return nil, fmt.Errorf("invalid tool_choice: %w", err)
+			}
+			if toolChoice.Type != "function" {
+				return nil, fmt.Errorf("tool_choice type %s is not supported by this channel", toolChoice.Type)
+			}
+			chatRequest.ToolChoice = map[string]any{
+				"type":     "function",
+				"function": map[string]any{"name": toolChoice.Name},
+			}
+		}
+	}
+
+	if len(request.Text) > 0 {
+		var text responsesTextFormat
+		if err := common.Unmarshal(request.Text, &text); err != nil {
+			return nil, fmt.Errorf("invalid text: %w", err)
+		}
+		if text.Format != nil {
+			switch text.Format.Type {
+			case "json_object":
+				chatRequest.ResponseFormat = &dto.ResponseFormat{Type: "json_object"}
+			case "json_schema":
+				jsonSchema := *text.Format
+				jsonSchema.Type = ""
+				jsonSchemaData, err := common.Marshal(jsonSchema)
+				if err != nil {
+					return nil, err
+				}
+				chatRequest.ResponseFormat = &dto.ResponseFormat{Type: "json_schema", JsonSchema: jsonSchemaData}
+			}
+		}
+	}
+	return chatRequest, nil
+}
+
+func responsesInputToMessages(input json.RawMessage) ([]dto.Message, error) {
+	if len(input) == 0 {
+		return nil, nil
+	}
+	if common.GetJsonType(input) == "string" {
+		var text string
+		if err := common.Unmarshal(input, &text); err != nil {
+			return nil, err
+		}
+		return []dto.Message{{Role: "user", Content: text}}, nil
+	}
+	var items []responsesInputItem
+	if err := common.Unmarshal(input, &items); err != nil {
+		return nil, fmt.Errorf("invalid input: %w", err)
+	}
+
+	var messages []dto.Message
+	var reasoning strings.Builder
+	// consecutive function calls become the tool calls of one assistant message
+	var toolCalls []dto.ToolCallRequest
+	flushToolCalls := func() {
+		if len(toolCalls) == 0 {
+			return
+		}
+		message := dto.Message{Role: "assistant", ReasoningContent: reasoning.String()}
+		message.SetNullContent()
+		message.SetToolCalls(toolCalls)
+		messages = append(messages, message)
+		toolCalls = nil
+		reasoning.Reset()
+	}
+	for _, item := range items {
+		switch item.Type {
+		case "", "message":
+			flushToolCalls()
+			message, err := responsesMessageToChat(item)
+			if err != nil {
+				return nil, err
+			}
+			if message.Role == "assistant" && reasoning.Len() > 0 {
+				message.ReasoningContent = reasoning.String()
+				reasoning.Reset()
+			}
+			messages = append(messages, message)
+		case "function_call":
+			toolCalls = append(toolCalls, dto.ToolCallRequest{
+				ID:   item.CallId,
+				Type: "function",
+				Function: dto.FunctionRequest{
+					Name:      item.Name,
+					Arguments: item.Arguments,
+				},
+			})
+		case "function_call_output":
+			flushToolCalls()
+			output := string(item.Output)
+			if common.GetJsonType(item.Output) == "string" {
+				_ = common.Unmarshal(item.Output, &output)
+			}
+			messages = append(messages, dto.Message{Role: "tool", ToolCallId: item.CallId, Content: output})
+		case "reasoning":
+			// upstream chat models cannot take the encrypted reasoning back, only the summary is kept
+			for _, summary := range item.Summary {
+				reasoning.WriteString(summary.Text)
+			}
+		default:
+			return nil, fmt.Errorf("input item type %s is not supported by this channel", item.Type)
+		}
+	}
+	flushToolCalls()
+	return messages, nil
+}
+
+func responsesMessageToChat(item responsesInputItem) (dto.Message, error) {
+	role := item.Role
+	if role == "developer" {
+		role = "system"
+	}
+	message := dto.Message{Role: role}
+	if common.GetJsonType(item.Content) == "string" {
+		var text string
+		_ = common.Unmarshal(item.Content, &text)
+		message.SetStringContent(text)
+		return message, nil
+	}
+	var parts []responsesContentPart
+	if err := common.Unmarshal(item.Content, &parts); err != nil {
+		return message, fmt.Errorf("invalid message content: %w", err)
+	}
+	var contents []dto.MediaContent
+	textOnly := true
+	for _, part := range parts {
+		switch part.Type {
+		case "input_text", "output_text":
+			contents = append(contents, dto.MediaContent{Type: dto.ContentTypeText, Text: part.Text})
+		case "refusal":
+			contents = append(contents, dto.MediaContent{Type: dto.ContentTypeText, Text: part.Refusal})
+		case "input_image":
+			textOnly = false
+			imageUrl := &dto.MessageImageUrl{Detail: part.Detail}
+			switch v := part.ImageUrl.(type) {
+			case string:
+				imageUrl.Url = v
+			case map[string]any:
+				imageUrl.Url = common.Interface2String(v["url"])
+			}
+			if imageUrl.Url == "" && part.FileId != "" {
+				return message, errors.New("input_image with file_id is not supported by this channel")
+			}
+			if imageUrl.Detail == "" {
+				imageUrl.Detail = "auto"
+			}
+			contents = append(contents, dto.MediaContent{Type: dto.ContentTypeImageURL, ImageUrl: imageUrl})
+		case "input_file":
+			textOnly = false
+			if part.FileUrl != "" && part.FileData == "" && part.FileId == "" {
+				return message, errors.New("input_file with file_url is not supported by this channel")
+			}
+			contents = append(contents, dto.MediaContent{
+				Type: dto.ContentTypeFile,
+				File: &dto.MessageFile{
+					FileName: part.Filename,
+					FileData: part.FileData,
+					FileId:   part.FileId,
+				},
+			})
+		default:
+			return message, fmt.Errorf("content type %s is not supported by this channel", part.Type)
+		}
+	}
+	if textOnly {
+		var text strings.Builder
+		for _, content := range contents {
+			text.WriteString(content.Text)
+		}
+		message.SetStringContent(text.String())
+	} else {
+		message.SetMediaContent(contents)
+	}
+	return message, nil
+}
+
+func newResponsesResponse(request *dto.OpenAIResponsesRequest, id string, createdAt int) *dto.OpenAIResponsesResponse {
+	response := &dto.OpenAIResponsesResponse{
+		ID:                 id,
+		Object:             "response",
+		CreatedAt:          createdAt,
+		Status:             "in_progress",
+		MaxOutputTokens:    int(request.MaxOutputTokens),
+		Model:              request.Model,
+		Output:             []dto.ResponsesOutput{},
+		ParallelToolCalls:  true,
+		PreviousResponseID: request.PreviousResponseID,
+		Reasoning:          request.Reasoning,
+		Temperature:        request.Temperature,
+		ToolChoice:         "auto",
+		Tools:              request.GetToolsMap(),
+		TopP:               request.TopP,
+		Truncation:         "disabled",
+		Metadata:           request.Metadata,
+	}
+	if len(request.Instructions) > 0 {
+		_ = common.Unmarshal(request.Instructions, &response.Instructions)
+	}
+	if len(request.ParallelToolCalls) > 0 {
+		_ = common.Unmarshal(request.ParallelToolCalls, &response.ParallelToolCalls)
+	}
+	if common.GetJsonType(request.ToolChoice) == "string" {
+		_ = common.Unmarshal(request.ToolChoice, &response.ToolChoice)
+	}
+	if request.User != "" {
+		response.User, _ = common.Marshal(request.User)
+	}
+	if response.Tools == nil {
+		response.Tools = []map[string]any{}
+	}
+	return response
+}
+
+func responsesUsage(usage *dto.Usage) *dto.Usage {
+	if usage == nil {
+		return nil
+	}
+	return &dto.Usage{
+		InputTokens:  usage.PromptTokens,
+		OutputTokens: usage.CompletionTokens,
+		TotalTokens:  usage.PromptTokens + usage.CompletionTokens,
+		InputTokensDetails: &dto.InputTokenDetails{
+			CachedTokens: usage.PromptTokensDetails.CachedTokens,
+		},
+		CompletionTokenDetails: dto.OutputTokenDetails{
+			ReasoningTokens: usage.CompletionTokenDetails.ReasoningTokens,
+		},
+	}
+}
+
+func completeResponsesResponse(response *dto.OpenAIResponsesResponse, finishReason string, usage *dto.Usage) {
+	response.Status = "completed"
+	if finishReason == "length" {
+		response.Status = "incomplete"
+		response.IncompleteDetails = &dto.IncompleteDetails{Reasoning: "max_output_tokens"}
+	}
+	response.Usage = responsesUsage(usage)
+}
+
+func newResponsesItemId(prefix string) string {
+	return prefix + "_" + strings.ReplaceAll(common.GetUUID(), "-", "")
+}
+
+// ChatCompletionsToResponsesResponse converts a chat completion to a Responses API response.
+func ChatCompletionsToResponsesResponse(chatResponse *dto.OpenAITextResponse, request *dto.OpenAIResponsesRequest) *dto.OpenAIResponsesResponse {
+	response := newResponsesResponse(request, newResponsesItemId("resp"), int(common.GetTimestamp()))
+	if chatResponse.Model != "" {
+		response.Model = chatResponse.Model
+	}
+	var finishReason string
+	if len(chatResponse.Choices) > 0 {
+		choice := chatResponse.Choices[0]
+		finishReason = choice.FinishReason
+		reasoning := choice.Message.ReasoningContent
+		if reasoning == "" {
+			reasoning = choice.Message.Reasoning
+		}
+		if reasoning != "" {
+			response.Output = append(response.Output, dto.ResponsesOutput{
+				Type:    "reasoning",
+				ID:      newResponsesItemId("rs"),
+				Status:  "completed",
+				Content: []dto.ResponsesOutputContent{},
+				Summary: []dto.ResponsesOutputContent{{Type: "summary_text", Text: reasoning}},
+			})
+		}
+		if text := choice.Message.StringContent(); text != "" {
+			response.Output = append(response.Output, dto.ResponsesOutput{
+				Type:   "message",
+				ID:     newResponsesItemId("msg"),
+				Status: "completed",
+				Role:   "assistant",
+				Content: []dto.ResponsesOutputContent{
+					{Type: "output_text", Text: text, Annotations: []interface{}{}},
+				},
+			})
+		}
+		for _, toolCall := range choice.Message.ParseToolCalls() {
+			response.Output = append(response.Output, dto.ResponsesOutput{
+				Type:      "function_call",
+				ID:        newResponsesItemId("fc"),
+				Status:    "completed",
+				CallId:    toolCall.ID,
+				Name:      toolCall.Function.Name,
+				Arguments: toolCall.Function.Arguments,
+			})
+		}
+	}
+	completeResponsesResponse(response, finishReason, &chatResponse.Usage)
+	return response
+}
+
+// ResponsesStreamConverter turns chat completion chunks into Responses API stream events,
+// one converter is used per stream because it keeps the state of the open output items.
+type ResponsesStreamConverter struct {
+	response     *dto.OpenAIResponsesResponse
+	sequence     int
+	finishReason string
+	usage        *dto.Usage
+	// output index of the open reasoning and message items, -1 when none is open
+	reasoningIndex int
+	messageIndex   int
+	// output index of the function calls by their chat tool call index
+	toolCallIndexes map[int]int
+	openToolCalls   []int
+	started         bool
+	finished        bool
+}
+
+func NewResponsesStreamConverter(request *dto.OpenAIResponsesRequest) *ResponsesStreamConverter {
+	return &ResponsesStreamConverter{
+		response:        newResponsesResponse(request, newResponsesItemId("resp"), int(common.GetTimestamp())),
+		reasoningIndex:  -1,
+		messageIndex:    -1,
+		toolCallIndexes: make(map[int]int),
+	}
+}
+
+func (s *ResponsesStreamConverter) event(event dto.ResponsesStreamResponse) dto.ResponsesStreamResponse {
+	event.SequenceNumber = s.sequence
+	s.sequence++
+	return event
+}
+
+func (s *ResponsesStreamConverter) snapshot() *dto.OpenAIResponsesResponse {
+	response := *s.response
+	response.Output = make([]dto.ResponsesOutput, 0, len(s.response.Output))
+	for _, item := range s.response.Output {
+		response.Output = append(response.Output, *cloneOutputItem(item))
+	}
+	return &response
+}
+
+// Start returns the events that open the response, it is safe to call more than once.
+func (s *ResponsesStreamConverter) Start() []dto.ResponsesStreamResponse {
+	if s.started {
+		return nil
+	}
+	s.started = true
+	return []dto.ResponsesStreamResponse{
+		s.event(dto.ResponsesStreamResponse{Type: "response.created", Response: s.snapshot()}),
+		s.event(dto.ResponsesStreamResponse{Type: "response.in_progress", Response: s.snapshot()}),
+	}
+}
+
+// cloneOutputItem copies the item for an event, the content of the open items keeps growing.
+func cloneOutputItem(item dto.ResponsesOutput) *dto.ResponsesOutput {
+	if item.Content != nil {
+		item.Content = append([]dto.ResponsesOutputContent{}, item.Content...)
+	}
+	if item.Summary != nil {
+		item.Summary = append([]dto.ResponsesOutputContent{}, item.Summary...)
+	}
+	return &item
+}
+
+func (s *ResponsesStreamConverter) addItem(item dto.ResponsesOutput) (int, dto.ResponsesStreamResponse) {
+	index := len(s.response.Output)
+	s.response.Output = append(s.response.Output, item)
+	return index, s.event(dto.ResponsesStreamResponse{
+		Type:        dto.ResponsesOutputTypeItemAdded,
+		OutputIndex: common.GetPointer(index),
+		Item:        cloneOutputItem(item),
+	})
+}
+
+func (s *ResponsesStreamConverter) doneItem(index int) dto.ResponsesStreamResponse {
+	s.response.Output[index].Status = "completed"
+	item := cloneOutputItem(s.response.Output[index])
+	return s.event(dto.ResponsesStreamResponse{
+		Type:        dto.ResponsesOutputTypeItemDone,
+		OutputIndex: common.GetPointer(index),
+		Item:        item,
+	})
+}
+
+func (s *ResponsesStreamConverter) closeReasoning() []dto.ResponsesStreamResponse {
+	if s.reasoningIndex < 0 {
+		return nil
+	}
+	index := s.reasoningIndex
+	s.reasoningIndex = -1
+	item := &s.response.Output[index]
+	part := item.Summary[0]
+	return []dto.ResponsesStreamResponse{
+		s.event(dto.ResponsesStreamResponse{
+			Type:         "response.reasoning_summary_text.done",
+			ItemId:       item.ID,
+			OutputIndex:  common.GetPointer(index),
+			SummaryIndex: common.GetPointer(0),
+			Text:         part.Text,
+		}),
+		s.event(dto.ResponsesStreamResponse{
+			Type:         "response.reasoning_summary_part.done",
+			ItemId:       item.ID,
+			OutputIndex:  common.GetPointer(index),
+			SummaryIndex: common.GetPointer(0),
+			Part:         &part,
+		}),
+		s.doneItem(index),
+	}
+}
+
+func (s *ResponsesStreamConverter) closeMessage() []dto.ResponsesStreamResponse {
+	if s.messageIndex < 0 {
+		return nil
+	}
+	index := s.messageIndex
+	s.messageIndex = -1
+	item := &s.response.Output[index]
+	part := item.Content[0]
+	return []dto.ResponsesStreamResponse{
+		s.event(dto.ResponsesStreamResponse{
+			Type:         "response.output_text.done",
+			ItemId:       item.ID,
+			OutputIndex:  common.GetPointer(index),
+			ContentIndex: common.GetPointer(0),
+			Text:         part.Text,
+		}),
+		s.event(dto.ResponsesStreamResponse{
+			Type:         "response.content_part.done",
+			ItemId:       item.ID,
+			OutputIndex:  common.GetPointer(index),
+			ContentIndex: common.GetPointer(0),
+			Part:         &part,
+		}),
+		s.doneItem(index),
+	}
+}
+
+func (s *ResponsesStreamConverter) closeToolCalls() []dto.ResponsesStreamResponse {
+	var events []dto.ResponsesStreamResponse
+	for _, index := range s.openToolCalls {
+		item := s.response.Output[index]
+		events = append(events,
+			s.event(dto.ResponsesStreamResponse{
+				Type:        "response.function_call_arguments.done",
+				ItemId:      item.ID,
+				OutputIndex: common.GetPointer(index),
+				Arguments:   item.Arguments,
+			}),
+			s.doneItem(index),
+		)
+	}
+	s.openToolCalls = nil
+	return events
+}
+
+// Chunk returns the events for one chat completion chunk.
+func (s *ResponsesStreamConverter) Chunk(chunk *dto.ChatCompletionsStreamResponse) []dto.ResponsesStreamResponse {
+	events := s.Start()
+	if chunk.Model != "" {
+		s.response.Model = chunk.Model
+	}
+	if chunk.Usage != nil {
+		s.usage = chunk.Usage
+	}
+	if len(chunk.Choices) == 0 {
+		return events
+	}
+	choice := chunk.Choices[0]
+	if reasoning := choice.Delta.GetReasoningContent(); reasoning != "" {
+		events = append(events, s.closeMessage()...)
+		if s.reasoningIndex < 0 {
+			index, added := s.addItem(dto.ResponsesOutput{
+				Type:    "reasoning",
+				ID:      newResponsesItemId("rs"),
+				Status:  "in_progress",
+				Content: []dto.ResponsesOutputContent{},
+				Summary: []dto.ResponsesOutputContent{{Type: "summary_text"}},
+			})
+			s.reasoningIndex = index
+			events = append(events, added, s.event(dto.ResponsesStreamResponse{
+				Type:         "response.reasoning_summary_part.added",
+				ItemId:       s.response.Output[index].ID,
+				OutputIndex:  common.GetPointer(index),
+				SummaryIndex: common.GetPointer(0),
+				Part:         &dto.ResponsesOutputContent{Type: "summary_text"},
+			}))
+		}
+		item := &s.response.Output[s.reasoningIndex]
+		item.Summary[0].Text += reasoning
+		events = append(events, s.event(dto.ResponsesStreamResponse{
+			Type:         "response.reasoning_summary_text.delta",
+			ItemId:       item.ID,
+			OutputIndex:  common.GetPointer(s.reasoningIndex),
+			SummaryIndex: common.GetPointer(0),
+			Delta:        reasoning,
+		}))
+	}
+	if content := choice.Delta.GetContentString(); content != "" {
+		events = append(events, s.closeReasoning()...)
+		if s.messageIndex < 0 {
+			index, added := s.addItem(dto.ResponsesOutput{
+				Type:    "message",
+				ID:      newResponsesItemId("msg"),
+				Status:  "in_progress",
+				Role:    "assistant",
+				Content: []dto.ResponsesOutputContent{{Type: "output_text", Annotations: []interface{}{}}},
+			})
+			s.messageIndex = index
+			events = append(events, added, s.event(dto.ResponsesStreamResponse{
+				Type:         "response.content_part.added",
+				ItemId:       s.response.Output[index].ID,
+				OutputIndex:  common.GetPointer(index),
+				ContentIndex: common.GetPointer(0),
+				Part:         &dto.ResponsesOutputContent{Type: "output_text", Annotations: []interface{}{}},
+			}))
+		}
+		item := &s.response.Output[s.messageIndex]
+		item.Content[0].Text += content
+		events = append(events, s.event(dto.ResponsesStreamResponse{
+			Type:         "response.output_text.delta",
+			ItemId:       item.ID,
+			OutputIndex:  common.GetPointer(s.messageIndex),
+			ContentIndex: common.GetPointer(0),
+			Delta:        content,
+		}))
+	}
+	for i, toolCall := range choice.Delta.ToolCalls {
+		toolCallIndex := i
+		if toolCall.Index != nil {
+			toolCallIndex = *toolCall.Index
+		}
+		index, ok := s.toolCallIndexes[toolCallIndex]
+		if !ok {
+			events = append(events, s.closeReasoning()...)
+			events = append(events, s.closeMessage()...)
+			var added dto.ResponsesStreamResponse
+			index, added = s.addItem(dto.ResponsesOutput{
+				Type:   "function_call",
+				ID:     newResponsesItemId("fc"),
+				Status: "in_progress",
+				CallId: toolCall.ID,
+				Name:   toolCall.Function.Name,
+			})
+			s.toolCallIndexes[toolCallIndex] = index
+			s.openToolCalls = append(s.openToolCalls, index)
+			events = append(events, added)
+		}
+		if toolCall.Function.Arguments == "" {
+			continue
+		}
+		item := &s.response.Output[index]
+		item.Arguments += toolCall.Function.Arguments
+		events = append(events, s.event(dto.ResponsesStreamResponse{
+			Type:        "response.function_call_arguments.delta",
+			ItemId:      item.ID,
+			OutputIndex: common.GetPointer(index),
+			Delta:       toolCall.Function.Arguments,
+		}))
+	}
+	if choice.FinishReason != nil && *choice.FinishReason != "" {
+		s.finishReason = *choice.FinishReason
+	}
+	return events
+}
+
+// Finish closes the open output items and returns the final response event, usage is the
+// usage settled by the relay and takes precedence over the usage seen in the chunks.
+func (s *ResponsesStreamConverter) Finish(usage *dto.Usage) []dto.ResponsesStreamResponse {
+	if s.finished {
+		return nil
+	}
+	s.finished = true
+	events := s.Start()
+	events = append(events, s.closeReasoning()...)
+	events = append(events, s.closeMessage()...)
+	events = append(events, s.closeToolCalls()...)
+	if usage == nil {
+		usage = s.usage
+	}
+	completeResponsesResponse(s.response, s.finishReason, usage)
+	eventType := "response.completed"
+	if s.response.Status == "incomplete" {
+		eventType = "response.incomplete"
+	}
+	return append(events, s.event(dto.ResponsesStreamResponse{Type: eventType, Response: s.snapshot()}))
+}
+
+// Fail returns the event that ends the response with an error.
+func (s *ResponsesStreamConverter) Fail(code string, message string) []dto.ResponsesStreamResponse {
+	if s.finished {
+		return nil
+	}
+	s.finished = true
+	events := s.Start()
+	s.response.Status = "failed"
+	s.response.Error = map[string]any{"code": code, "message": message}
+	return append(events, s.event(dto.ResponsesStreamResponse{Type: "response.failed", Response: s.snapshot()}))
+}
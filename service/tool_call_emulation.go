@@ -0,0 +1,464 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+)
+
+const (
+	toolCallOpenTag      = "<tool_call>"
+	toolCallCloseTag     = "</tool_call>"
+	toolCallsPlaceholder = "{{tools}}"
+)
+
+type EmulatedTool struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Parameters  any    `json:"parameters,omitempty"`
+}
+
+type EmulatedToolCall struct {
+	Name string
+	// Arguments is the JSON object of the call, encoded
+	Arguments string
+}
+
+// ToolCallTextEvent is a piece of model output, either text for the client or a parsed tool call.
+type ToolCallTextEvent struct {
+	Text string
+	Call *EmulatedToolCall
+}
+
+// RenderToolCallPrompt renders the system prompt describing the tools. A required choice asks the model to call
+// at least one tool, a tool name asks for that tool.
+func RenderToolCallPrompt(template string, tools []EmulatedTool, required bool, toolName string) string {
+	lines := make([]string, 0, len(tools))
+	for _, tool := range tools {
+		line, err := common.Marshal(tool)
+		if err != nil {
+			continue
+		}
+		lines = append(lines, string(line))
+	}
+	toolsText := strings.Join(lines, "\n")
+	var prompt string
+	if strings.Contains(template, toolCallsPlaceholder) {
+		prompt = strings.ReplaceAll(template, toolCallsPlaceholder, toolsText)
+	} else {
+		prompt = template + "\n" + toolsText
+	}
+	if toolName != "" {
+		prompt += fmt.Sprintf("\nYou must call the tool %s in this reply.", toolName)
+	} else if required {
+		prompt += "\nYou must call at least one tool in this reply."
+	}
+	return prompt
+}
+
+// ToolCallHistoryText renders earlier tool calls of the assistant the way the model is asked to write them.
+func ToolCallHistoryText(calls []EmulatedToolCall) string {
+	blocks := make([]string, 0, len(calls))
+	for _, call := range calls {
+		arguments := call.Arguments
+		if !json.Valid([]byte(arguments)) {
+			arguments = "{}"
+		}
+		blocks = append(blocks, fmt.Sprintf("%s\n{\"name\": %q, \"arguments\": %s}\n%s", toolCallOpenTag, call.Name, arguments, toolCallCloseTag))
+	}
+	return strings.Join(blocks, "\n")
+}
+
+// ToolResultHistoryText renders the result of a tool call as plain text for the upstream.
+func ToolResultHistoryText(name string, content string) string {
+	if name == "" {
+		return fmt.Sprintf("<tool_result>\n%s\n</tool_result>", content)
+	}
+	return fmt.Sprintf("<tool_result name=%q>\n%s\n</tool_result>", name, content)
+}
+
+// ToolCallTextParser splits model output into text and tool calls. Output can be fed in pieces as it streams,
+// text that could be the start of a tool call is held back until it is decided.
+type ToolCallTextParser struct {
+	buffer    string
+	inCall    bool
+	afterCall bool
+	calls     int
+}
+
+func NewToolCallTextParser() *ToolCallTextParser {
+	return &ToolCallTextParser{}
+}
+
+// Calls returns the number of tool calls parsed so far.
+func (p *ToolCallTextParser) Calls() int {
+	return p.calls
+}
+
+func (p *ToolCallTextParser) Feed(text string) []ToolCallTextEvent {
+	p.buffer += text
+	var events []ToolCallTextEvent
+	for {
+		if p.inCall {
+			end := strings.Index(p.buffer, toolCallCloseTag)
+			if end < 0 {
+				return events
+			}
+			events = append(events, p.callEvent(p.buffer[:end], true))
+			p.buffer = p.buffer[end+len(toolCallCloseTag):]
+			p.inCall = false
+			continue
+		}
+		if p.afterCall {
+			// whitespace between and after calls is not sent as text
+			p.buffer = strings.TrimLeft(p.buffer, " \t\r\n")
+			if p.buffer == "" {
+				return events
+			}
+			p.afterCall = false
+		}
+		start := strings.Index(p.buffer, toolCallOpenTag)
+		if start >= 0 {
+			events = appendToolCallText(events, p.buffer[:start])
+			p.buffer = p.buffer[start+len(toolCallOpenTag):]
+			p.inCall = true
+			continue
+		}
+		hold := partialTagSuffix(p.buffer, toolCallOpenTag)
+		events = appendToolCallText(events, p.buffer[:len(p.buffer)-hold])
+		p.buffer = p.buffer[len(p.buffer)-hold:]
+		return events
+	}
+}
+
+// Flush returns what is still held back at the end of the output, an unterminated call is parsed if it can be.
+func (p *ToolCallTextParser) Flush() []ToolCallTextEvent {
+	var events []ToolCallTextEvent
+	if p.inCall {
+		events = append(events, p.callEvent(p.buffer, false))
+	} else if !p.afterCall {
+		events = appendToolCallText(events, p.buffer)
+	}
+	p.buffer = ""
+	p.inCall = false
+	return events
+}
+
+func (p *ToolCallTextParser) callEvent(body string, closed bool) ToolCallTextEvent {
+	call, ok := parseEmulatedToolCall(body)
+	if !ok {
+		text := toolCallOpenTag + body
+		if closed {
+			text += toolCallCloseTag
+		}
+		return ToolCallTextEvent{Text: text}
+	}
+	p.calls++
+	p.afterCall = true
+	return ToolCallTextEvent{Call: call}
+}
+
+func appendToolCallText(events []ToolCallTextEvent, text string) []ToolCallTextEvent {
+	if text == "" {
+		return events
+	}
+	return append(events, ToolCallTextEvent{Text: text})
+}
+
+// partialTagSuffix returns the length of the longest suffix of s that is a prefix of tag.
+func partialTagSuffix(s string, tag string) int {
+	for n := min(len(s), len(tag)-1); n > 0; n-- {
+		if strings.HasSuffix(s, tag[:n]) {
+			return n
+		}
+	}
+	return 0
+}
+
+func parseEmulatedToolCall(body string) (*EmulatedToolCall, bool) {
+	body = strings.TrimSpace(body)
+	if strings.HasPrefix(body, "```") {
+		if newline := strings.IndexByte(body, '\n'); newline >= 0 {
+			body = body[newline+1:]
+		}
+		body = strings.TrimSpace(strings.TrimSuffix(body, "```"))
+	}
+	var raw struct {
+		Name       string `json:"name"`
+		Arguments  any    `json:"arguments"`
+		Parameters any    `json:"parameters"`
+	}
+	if err := common.UnmarshalJsonStr(body, &raw); err != nil || raw.Name == "" {
+		return nil, false
+	}
+	arguments := raw.Arguments
+	if arguments == nil {
+		arguments = raw.Parameters
+	}
+	call := &EmulatedToolCall{Name: raw.Name, Arguments: "{}"}
+	switch typed := arguments.(type) {
+	case nil:
+	case string:
+		// some models encode the arguments twice, like the OpenAI API does
+		if json.Valid([]byte(typed)) {
+			call.Arguments = typed
+		} else {
+			return nil, false
+		}
+	default:
+		encoded, err := common.Marshal(typed)
+		if err != nil {
+			return nil, false
+		}
+		call.Arguments = string(encoded)
+	}
+	return call, true
+}
+
+// EmulateOpenAITools moves the tools of a chat request into the prompt and rewrites the tool messages of the
+// conversation as text, the request no longer has tools afterwards. The prompt goes into the system message, when
+// the request has none it is created with systemPrompt first. Upstreams that drop system messages get the prompt
+// at the start of the first user message instead.
+func EmulateOpenAITools(request *dto.GeneralOpenAIRequest, template string, systemPrompt string, inUserMessage bool) {
+	tools := make([]EmulatedTool, 0, len(request.Tools))
+	for _, tool := range request.Tools {
+		if tool.Type != "" && tool.Type != "function" {
+			continue
+		}
+		tools = append(tools, EmulatedTool{
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+			Parameters:  tool.Function.Parameters,
+		})
+	}
+	var (
+		choiceNone bool
+		required   bool
+		toolName   string
+	)
+	switch choice := request.ToolChoice.(type) {
+	case string:
+		choiceNone = choice == "none"
+		required = choice == "required"
+	case map[string]any:
+		if function, ok := choice["function"].(map[string]any); ok {
+			toolName, _ = function["name"].(string)
+		}
+	}
+	request.Tools = nil
+	request.ToolChoice = nil
+	request.Functions = nil
+	request.ParallelTooCalls = nil
+
+	request.Messages = EmulateOpenAIToolMessages(request.Messages)
+	if choiceNone || len(tools) == 0 {
+		return
+	}
+	prompt := RenderToolCallPrompt(template, tools, required, toolName)
+
+	if inUserMessage {
+		for i := range request.Messages {
+			if request.Messages[i].Role == "user" {
+				prependMessageText(&request.Messages[i], prompt+"\n\n")
+				return
+			}
+		}
+	} else {
+		for i := range request.Messages {
+			if request.Messages[i].Role == request.GetSystemRoleName() {
+				appendMessageText(&request.Messages[i], "\n\n"+prompt)
+				return
+			}
+		}
+	}
+	if systemPrompt != "" {
+		prompt = systemPrompt + "\n\n" + prompt
+	}
+	role := request.GetSystemRoleName()
+	if inUserMessage {
+		role = "user"
+	}
+	message := dto.Message{Role: role}
+	message.SetStringContent(prompt)
+	request.Messages = append([]dto.Message{message}, request.Messages...)
+}
+
+// EmulateOpenAIToolMessages renders the tool calls and tool results of a conversation as text.
+func EmulateOpenAIToolMessages(messages []dto.Message) []dto.Message {
+	toolNames := make(map[string]string)
+	converted := make([]dto.Message, 0, len(messages))
+	for _, message := range messages {
+		switch message.Role {
+		case "assistant":
+			toolCalls := message.ParseToolCalls()
+			if len(toolCalls) == 0 {
+				converted = append(converted, message)
+				continue
+			}
+			calls := make([]EmulatedToolCall, 0, len(toolCalls))
+			for _, toolCall := range toolCalls {
+				toolNames[toolCall.ID] = toolCall.Function.Name
+				calls = append(calls, EmulatedToolCall{Name: toolCall.Function.Name, Arguments: toolCall.Function.Arguments})
+			}
+			text := strings.TrimSpace(message.StringContent())
+			if text != "" {
+				text += "\n"
+			}
+			message.ToolCalls = nil
+			message.SetStringContent(text + ToolCallHistoryText(calls))
+			converted = append(converted, message)
+		case "tool", "function":
+			name := toolNames[message.ToolCallId]
+			if name == "" && message.Name != nil {
+				name = *message.Name
+			}
+			result := ToolResultHistoryText(name, message.StringContent())
+			// results of one turn are sent together as a single user message
+			if last := len(converted) - 1; last >= 0 && converted[last].Role == "user" && converted[last].IsStringContent() &&
+				strings.HasSuffix(converted[last].StringContent(), "</tool_result>") {
+				converted[last].SetStringContent(converted[last].StringContent() + "\n" + result)
+				continue
+			}
+			userMessage := dto.Message{Role: "user"}
+			userMessage.SetStringContent(result)
+			converted = append(converted, userMessage)
+		default:
+			converted = append(converted, message)
+		}
+	}
+	return converted
+}
+
+func appendMessageText(message *dto.Message, text string) {
+	if message.IsStringContent() {
+		message.SetStringContent(message.StringContent() + text)
+		return
+	}
+	message.SetMediaContent(append(message.ParseContent(), dto.MediaContent{
+		Type: dto.ContentTypeText,
+		Text: strings.TrimLeft(text, "\n"),
+	}))
+}
+
+func prependMessageText(message *dto.Message, text string) {
+	if message.IsStringContent() {
+		message.SetStringContent(text + message.StringContent())
+		return
+	}
+	message.SetMediaContent(append([]dto.MediaContent{{
+		Type: dto.ContentTypeText,
+		Text: strings.TrimRight(text, "\n"),
+	}}, message.ParseContent()...))
+}
+
+// EmulateClaudeTools moves the tools of a Claude request into the system prompt and rewrites the tool_use and
+// tool_result blocks of the conversation as text, the request no longer has tools afterwards.
+func EmulateClaudeTools(request *dto.ClaudeRequest, template string) {
+	var tools []EmulatedTool
+	for _, tool := range request.GetTools() {
+		toolMap, ok := tool.(map[string]any)
+		if !ok {
+			continue
+		}
+		// server tools such as web_search have a versioned type and run upstream, they cannot be emulated
+		if toolType, _ := toolMap["type"].(string); toolType != "" && toolType != "custom" {
+			continue
+		}
+		name, _ := toolMap["name"].(string)
+		description, _ := toolMap["description"].(string)
+		tools = append(tools, EmulatedTool{Name: name, Description: description, Parameters: toolMap["input_schema"]})
+	}
+	var (
+		choiceNone bool
+		required   bool
+		toolName   string
+	)
+	if choice, ok := request.ToolChoice.(map[string]any); ok {
+		switch choice["type"] {
+		case "none":
+			choiceNone = true
+		case "any":
+			required = true
+		case "tool":
+			toolName, _ = choice["name"].(string)
+		}
+	}
+	request.Tools = nil
+	request.ToolChoice = nil
+
+	toolNames := make(map[string]string)
+	for i := range request.Messages {
+		message := &request.Messages[i]
+		if message.IsStringContent() {
+			continue
+		}
+		blocks, err := message.ParseContent()
+		if err != nil {
+			continue
+		}
+		changed := false
+		for j := range blocks {
+			block := &blocks[j]
+			switch block.Type {
+			case "tool_use":
+				toolNames[block.Id] = block.Name
+				arguments, err := common.Marshal(block.Input)
+				if err != nil || block.Input == nil {
+					arguments = []byte("{}")
+				}
+				text := ToolCallHistoryText([]EmulatedToolCall{{Name: block.Name, Arguments: string(arguments)}})
+				*block = dto.ClaudeMediaMessage{Type: dto.ContentTypeText}
+				block.SetText(text)
+				changed = true
+			case "tool_result":
+				text := ToolResultHistoryText(toolNames[block.ToolUseId], claudeToolResultText(block.Content))
+				*block = dto.ClaudeMediaMessage{Type: dto.ContentTypeText}
+				block.SetText(text)
+				changed = true
+			}
+		}
+		if changed {
+			message.SetContent(blocks)
+		}
+	}
+
+	if choiceNone || len(tools) == 0 {
+		return
+	}
+	prompt := RenderToolCallPrompt(template, tools, required, toolName)
+	if request.System == nil || request.IsStringSystem() {
+		existing := strings.TrimSpace(request.GetStringSystem())
+		if existing != "" {
+			prompt = existing + "\n\n" + prompt
+		}
+		request.SetStringSystem(prompt)
+		return
+	}
+	system := dto.ClaudeMediaMessage{Type: dto.ContentTypeText}
+	system.SetText(prompt)
+	request.System = append(request.ParseSystem(), system)
+}
+
+func claudeToolResultText(content any) string {
+	switch typed := content.(type) {
+	case string:
+		return typed
+	case []any:
+		texts := make([]string, 0, len(typed))
+		for _, item := range typed {
+			if block, ok := item.(map[string]any); ok && block["type"] == dto.ContentTypeText {
+				if text, ok := block["text"].(string); ok {
+					texts = append(texts, text)
+				}
+			}
+		}
+		return strings.Join(texts, "\n")
+	case nil:
+		return ""
+	}
+	encoded, _ := common.Marshal(content)
+	return string(encoded)
+}
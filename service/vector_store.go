@@ -0,0 +1,459 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+)
+
+// chunking of files added without a chunking strategy, the defaults of the OpenAI API
+const (
+	DefaultVectorStoreChunkSize    = 800
+	DefaultVectorStoreChunkOverlap = 400
+)
+
+// VectorStoreEmbedder embeds the inputs with the model on behalf of the token. The controller provides it, it sends
+// the requests through the relay so that the embeddings are billed and logged like any other request.
+type VectorStoreEmbedder func(ctx context.Context, tokenKey string, model string, inputs []string) ([][]float64, error)
+
+var vectorStoreEmbedder VectorStoreEmbedder
+
+func SetVectorStoreEmbedder(embedder VectorStoreEmbedder) {
+	vectorStoreEmbedder = embedder
+}
+
+func embedVectorStoreInputs(ctx context.Context, tokenKey string, model string, inputs []string) ([][]float64, error) {
+	if vectorStoreEmbedder == nil {
+		return nil, errors.New("no embedder is registered for vector stores")
+	}
+	batchSize := max(operation_setting.GetVectorStoreSetting().EmbeddingBatchSize, 1)
+	vectors := make([][]float64, 0, len(inputs))
+	for start := 0; start < len(inputs); start += batchSize {
+		batch := inputs[start:min(start+batchSize, len(inputs))]
+		embeddings, err := vectorStoreEmbedder(ctx, tokenKey, model, batch)
+		if err != nil {
+			return nil, err
+		}
+		if len(embeddings) != len(batch) {
+			return nil, fmt.Errorf("expected %d embeddings, got %d", len(batch), len(embeddings))
+		}
+		vectors = append(vectors, embeddings...)
+	}
+	return vectors, nil
+}
+
+// ChunkVectorStoreText splits the text in chunks of at most chunkSize tokens, consecutive chunks share overlap tokens.
+func ChunkVectorStoreText(text string, chunkSize int, overlap int) []string {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil
+	}
+	encoder := getTokenEncoder("")
+	ids, _, err := encoder.Encode(text)
+	if err != nil || len(ids) <= chunkSize {
+		return []string{text}
+	}
+	step := max(chunkSize-overlap, 1)
+	var chunks []string
+	for start := 0; start < len(ids); start += step {
+		end := min(start+chunkSize, len(ids))
+		chunk, err := encoder.Decode(ids[start:end])
+		if err != nil {
+			continue
+		}
+		// a window can cut a character in two at either end
+		chunk = strings.TrimSpace(strings.ToValidUTF8(chunk, ""))
+		if chunk != "" {
+			chunks = append(chunks, chunk)
+		}
+		if end == len(ids) {
+			break
+		}
+	}
+	return chunks
+}
+
+// encodeVectorStoreEmbedding writes the vector as a JSON list with float32 precision, which is also the text form
+// of a pgvector vector.
+func encodeVectorStoreEmbedding(vector []float64) string {
+	var builder strings.Builder
+	builder.WriteByte('[')
+	for i, value := range vector {
+		if i > 0 {
+			builder.WriteByte(',')
+		}
+		builder.WriteString(strconv.FormatFloat(value, 'g', -1, 32))
+	}
+	builder.WriteByte(']')
+	return builder.String()
+}
+
+func decodeVectorStoreEmbedding(embedding string) ([]float32, error) {
+	var vector []float32
+	if err := common.UnmarshalJsonStr(embedding, &vector); err != nil {
+		return nil, err
+	}
+	return vector, nil
+}
+
+// normalizeVector scales the vector to unit length, the cosine similarity of unit vectors is their dot product.
+func normalizeVector(vector []float32) {
+	var norm float64
+	for _, value := range vector {
+		norm += float64(value) * float64(value)
+	}
+	if norm == 0 {
+		return
+	}
+	scale := float32(1 / math.Sqrt(norm))
+	for i := range vector {
+		vector[i] *= scale
+	}
+}
+
+// vectorStoreFileError is a failure of indexing a file, with the code the vector store file reports.
+type vectorStoreFileError struct {
+	code string
+	err  error
+}
+
+func (e *vectorStoreFileError) Error() string {
+	return e.err.Error()
+}
+
+func readVectorStoreFileText(ctx context.Context, file *model.File) (string, error) {
+	storage, err := GetFileStorage()
+	if err != nil {
+		return "", &vectorStoreFileError{code: "server_error", err: err}
+	}
+	content, err := storage.Get(ctx, file.StorageKey)
+	if err != nil {
+		return "", &vectorStoreFileError{code: "server_error", err: err}
+	}
+	defer content.Close()
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return "", &vectorStoreFileError{code: "server_error", err: err}
+	}
+	// only text files can be chunked, documents have to be converted to text before they are uploaded
+	if !utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0 {
+		return "", &vectorStoreFileError{code: "unsupported_file", err: fmt.Errorf("file %s is not a text file", file.Id)}
+	}
+	return string(data), nil
+}
+
+// IndexVectorStoreFile chunks and embeds the file and saves its chunks in the store, the store file ends up
+// completed or failed with the error.
+func IndexVectorStoreFile(ctx context.Context, tokenKey string, store *model.VectorStore, storeFile *model.VectorStoreFile, file *model.File) error {
+	err := indexVectorStoreFile(ctx, tokenKey, store, storeFile, file)
+	if err == nil {
+		return nil
+	}
+	code := "server_error"
+	var fileErr *vectorStoreFileError
+	if errors.As(err, &fileErr) {
+		code = fileErr.code
+	}
+	storeFile.Status = model.VectorStoreFileStatusFailed
+	storeFile.LastErrorCode = code
+	storeFile.LastErrorMessage = err.Error()
+	if saveErr := model.SaveVectorStoreFileStatus(storeFile); saveErr != nil {
+		return saveErr
+	}
+	return err
+}
+
+func indexVectorStoreFile(ctx context.Context, tokenKey string, store *model.VectorStore, storeFile *model.VectorStoreFile, file *model.File) error {
+	text, err := readVectorStoreFileText(ctx, file)
+	if err != nil {
+		return err
+	}
+	texts := ChunkVectorStoreText(text, storeFile.ChunkSize, storeFile.ChunkOverlap)
+	if len(texts) == 0 {
+		return &vectorStoreFileError{code: "invalid_file", err: fmt.Errorf("file %s has no text", file.Id)}
+	}
+	vectors, err := embedVectorStoreInputs(ctx, tokenKey, store.EmbeddingModel, texts)
+	if err != nil {
+		return err
+	}
+	chunks := make([]*model.VectorStoreChunk, 0, len(texts))
+	var usageBytes int64
+	for i, text := range texts {
+		chunks = append(chunks, &model.VectorStoreChunk{
+			VectorStoreId: store.Id,
+			FileId:        file.Id,
+			ChunkIndex:    i,
+			Content:       text,
+			Embedding:     encodeVectorStoreEmbedding(vectors[i]),
+		})
+		// the text and the vector as float32
+		usageBytes += int64(len(text) + 4*len(vectors[i]))
+	}
+	storeFile.Status = model.VectorStoreFileStatusCompleted
+	storeFile.LastErrorCode = ""
+	storeFile.LastErrorMessage = ""
+	storeFile.UsageBytes = usageBytes
+	return model.SaveVectorStoreFileChunks(storeFile, chunks)
+}
+
+// vectorStoreIndex holds the unit vectors of a store's chunks for the in-process search.
+type vectorStoreIndex struct {
+	version  int64
+	chunkIds []int
+	vectors  [][]float32
+}
+
+var (
+	vectorStoreIndexes    = make(map[string]*vectorStoreIndex)
+	vectorStoreIndexesMux sync.Mutex
+)
+
+func getVectorStoreIndex(store *model.VectorStore) (*vectorStoreIndex, error) {
+	vectorStoreIndexesMux.Lock()
+	index, ok := vectorStoreIndexes[store.Id]
+	vectorStoreIndexesMux.Unlock()
+	if ok && index.version == store.IndexVersion {
+		return index, nil
+	}
+	chunks, err := model.GetVectorStoreChunkEmbeddings(store.Id)
+	if err != nil {
+		return nil, err
+	}
+	index = &vectorStoreIndex{
+		version:  store.IndexVersion,
+		chunkIds: make([]int, 0, len(chunks)),
+		vectors:  make([][]float32, 0, len(chunks)),
+	}
+	for _, chunk := range chunks {
+		vector, err := decodeVectorStoreEmbedding(chunk.Embedding)
+		if err != nil {
+			continue
+		}
+		normalizeVector(vector)
+		index.chunkIds = append(index.chunkIds, chunk.Id)
+		index.vectors = append(index.vectors, vector)
+	}
+	vectorStoreIndexesMux.Lock()
+	vectorStoreIndexes[store.Id] = index
+	vectorStoreIndexesMux.Unlock()
+	return index, nil
+}
+
+// search scores every chunk against the query, which has to be a unit vector.
+func (index *vectorStoreIndex) search(query []float32, scores map[int]float64) {
+	for i, vector := range index.vectors {
+		if len(vector) != len(query) {
+			continue
+		}
+		var score float32
+		for j, value := range vector {
+			score += value * query[j]
+		}
+		if previous, ok := scores[index.chunkIds[i]]; !ok || float64(score) > previous {
+			scores[index.chunkIds[i]] = float64(score)
+		}
+	}
+}
+
+// SearchVectorStores embeds the queries with the model of each store and returns the chunks nearest to any of
+// them, best first. Stores are searched with pgvector when the database has it and in process otherwise.
+func SearchVectorStores(ctx context.Context, tokenKey string, stores []*model.VectorStore, queries []string, maxResults int, scoreThreshold float64) ([]*model.VectorStoreChunkHit, error) {
+	storesByModel := make(map[string][]*model.VectorStore)
+	for _, store := range stores {
+		storesByModel[store.EmbeddingModel] = append(storesByModel[store.EmbeddingModel], store)
+	}
+	scores := make(map[int]float64)
+	hitsById := make(map[int]*model.VectorStoreChunkHit)
+	for embeddingModel, modelStores := range storesByModel {
+		vectors, err := embedVectorStoreInputs(ctx, tokenKey, embeddingModel, queries)
+		if err != nil {
+			return nil, err
+		}
+		for _, vector := range vectors {
+			if model.PgvectorEnabled() {
+				storeIds := make([]string, 0, len(modelStores))
+				for _, store := range modelStores {
+					storeIds = append(storeIds, store.Id)
+				}
+				hits, err := model.SearchVectorStoreChunks(storeIds, encodeVectorStoreEmbedding(vector), maxResults)
+				if err != nil {
+					return nil, err
+				}
+				for _, hit := range hits {
+					if previous, ok := hitsById[hit.Id]; !ok || hit.Score > previous.Score {
+						hitsById[hit.Id] = hit
+						scores[hit.Id] = hit.Score
+					}
+				}
+				continue
+			}
+			query := make([]float32, len(vector))
+			for i, value := range vector {
+				query[i] = float32(value)
+			}
+			normalizeVector(query)
+			for _, store := range modelStores {
+				index, err := getVectorStoreIndex(store)
+				if err != nil {
+					return nil, err
+				}
+				index.search(query, scores)
+			}
+		}
+	}
+
+	chunkIds := make([]int, 0, len(scores))
+	for chunkId, score := range scores {
+		if score >= scoreThreshold {
+			chunkIds = append(chunkIds, chunkId)
+		}
+	}
+	sort.Slice(chunkIds, func(i, j int) bool {
+		return scores[chunkIds[i]] > scores[chunkIds[j]]
+	})
+	if len(chunkIds) > maxResults {
+		chunkIds = chunkIds[:maxResults]
+	}
+	// the in-process index has no content, it is loaded for the chunks that made it
+	var missing []int
+	for _, chunkId := range chunkIds {
+		if _, ok := hitsById[chunkId]; !ok {
+			missing = append(missing, chunkId)
+		}
+	}
+	if len(missing) > 0 {
+		chunks, err := model.GetVectorStoreChunksByIds(missing)
+		if err != nil {
+			return nil, err
+		}
+		for _, chunk := range chunks {
+			hitsById[chunk.Id] = &model.VectorStoreChunkHit{VectorStoreChunk: *chunk, Score: scores[chunk.Id]}
+		}
+	}
+	hits := make([]*model.VectorStoreChunkHit, 0, len(chunkIds))
+	for _, chunkId := range chunkIds {
+		if hit, ok := hitsById[chunkId]; ok {
+			hits = append(hits, hit)
+		}
+	}
+	for _, store := range stores {
+		_ = store.Touch()
+	}
+	return hits, nil
+}
+
+// VectorStoreSearchResults turns the hits of a search into search results with the name and attributes of their files.
+func VectorStoreSearchResults(hits []*model.VectorStoreChunkHit, userId int) []dto.OpenAIVectorStoreSearchResult {
+	files := make(map[string]*model.File)
+	storeFiles := make(map[string]*model.VectorStoreFile)
+	results := make([]dto.OpenAIVectorStoreSearchResult, 0, len(hits))
+	for _, hit := range hits {
+		file, ok := files[hit.FileId]
+		if !ok {
+			file, _ = model.GetUserFileById(hit.FileId, userId)
+			files[hit.FileId] = file
+		}
+		key := hit.VectorStoreId + "/" + hit.FileId
+		storeFile, ok := storeFiles[key]
+		if !ok {
+			storeFile, _ = model.GetVectorStoreFile(hit.VectorStoreId, hit.FileId)
+			storeFiles[key] = storeFile
+		}
+		result := dto.OpenAIVectorStoreSearchResult{
+			FileID:     hit.FileId,
+			Score:      hit.Score,
+			Attributes: map[string]any{},
+			Content:    []dto.OpenAIVectorStoreSearchContent{{Type: "text", Text: hit.Content}},
+		}
+		if file != nil {
+			result.Filename = file.Filename
+		}
+		if storeFile != nil && storeFile.Attributes != "" {
+			_ = common.UnmarshalJsonStr(storeFile.Attributes, &result.Attributes)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// FileSearchToolName is the function a model calls to search the vector stores of a file_search tool.
+const FileSearchToolName = "file_search"
+
+func FileSearchTool() dto.ToolCallRequest {
+	return dto.ToolCallRequest{
+		Type: "function",
+		Function: dto.FunctionRequest{
+			Name:        FileSearchToolName,
+			Description: "Search the files the user provided for passages relevant to the query. Returns the best matching passages with their file names.",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"query": map[string]any{
+						"type":        "string",
+						"description": "The search query",
+					},
+				},
+				"required": []string{"query"},
+			},
+		},
+	}
+}
+
+// FormatFileSearchResults renders the results of a file_search call as the tool message for a model.
+func FormatFileSearchResults(results []dto.OpenAIVectorStoreSearchResult) string {
+	if len(results) == 0 {
+		return "No results found."
+	}
+	var builder strings.Builder
+	for i, result := range results {
+		if i > 0 {
+			builder.WriteString("\n\n")
+		}
+		texts := make([]string, 0, len(result.Content))
+		for _, content := range result.Content {
+			texts = append(texts, content.Text)
+		}
+		builder.WriteString(fmt.Sprintf("[%d] %s (file %s, score %.3f)\n%s", i+1, result.Filename, result.FileID, result.Score, strings.Join(texts, "\n")))
+	}
+	return builder.String()
+}
+
+// VectorStoreSearchQueries reads the query of a search request, a string or a list of strings.
+func VectorStoreSearchQueries(query []byte) ([]string, error) {
+	var queries []string
+	switch common.GetJsonType(query) {
+	case "string":
+		var single string
+		if err := common.Unmarshal(query, &single); err != nil {
+			return nil, err
+		}
+		queries = []string{single}
+	case "array":
+		if err := common.Unmarshal(query, &queries); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("query must be a string or a list of strings")
+	}
+	queries = slices.DeleteFunc(queries, func(query string) bool {
+		return strings.TrimSpace(query) == ""
+	})
+	if len(queries) == 0 {
+		return nil, errors.New("query is empty")
+	}
+	return queries, nil
+}
@@ -0,0 +1,155 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+)
+
+// WebSearchToolName is the function the model calls when the gateway executes web searches.
+const WebSearchToolName = "web_search"
+
+type WebSearchResult struct {
+	Title   string `json:"title"`
+	Url     string `json:"url"`
+	Content string `json:"content"`
+}
+
+// WebSearchBackend runs the searches of the gateway web_search tool.
+type WebSearchBackend interface {
+	Search(ctx context.Context, query string, maxResults int) ([]WebSearchResult, error)
+}
+
+// GetWebSearchBackend returns the backend configured in the web search setting.
+func GetWebSearchBackend() (WebSearchBackend, error) {
+	setting := operation_setting.GetWebSearchSetting()
+	switch setting.Backend {
+	case "", "http":
+		if setting.Endpoint == "" {
+			return nil, fmt.Errorf("web search endpoint is not configured")
+		}
+		return &httpWebSearchBackend{
+			endpoint: setting.Endpoint,
+			apiKey:   setting.ApiKey,
+			timeout:  time.Duration(setting.TimeoutSeconds) * time.Second,
+		}, nil
+	case "stub":
+		return stubWebSearchBackend{}, nil
+	}
+	return nil, fmt.Errorf("unknown web search backend: %s", setting.Backend)
+}
+
+// httpWebSearchBackend posts {"query", "max_results"} to the endpoint and reads {"results": [{"title", "url", "content"}]}.
+type httpWebSearchBackend struct {
+	endpoint string
+	apiKey   string
+	timeout  time.Duration
+}
+
+func (b *httpWebSearchBackend) Search(ctx context.Context, query string, maxResults int) ([]WebSearchResult, error) {
+	if b.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.timeout)
+		defer cancel()
+	}
+	payload, err := common.Marshal(map[string]any{
+		"query":       query,
+		"max_results": maxResults,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if b.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+b.apiKey)
+	}
+	resp, err := GetHttpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("web search backend returned status %d: %s", resp.StatusCode, string(body))
+	}
+	var result struct {
+		Results []WebSearchResult `json:"results"`
+	}
+	if err := common.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("invalid web search response: %w", err)
+	}
+	if maxResults > 0 && len(result.Results) > maxResults {
+		result.Results = result.Results[:maxResults]
+	}
+	return result.Results, nil
+}
+
+// stubWebSearchBackend answers every query with made up results, it does not go to the network.
+type stubWebSearchBackend struct{}
+
+func (stubWebSearchBackend) Search(ctx context.Context, query string, maxResults int) ([]WebSearchResult, error) {
+	if maxResults <= 0 {
+		maxResults = 1
+	}
+	results := make([]WebSearchResult, 0, maxResults)
+	for i := 1; i <= maxResults; i++ {
+		results = append(results, WebSearchResult{
+			Title:   fmt.Sprintf("Result %d for %s", i, query),
+			Url:     fmt.Sprintf("https://example.com/search?q=%s&n=%d", url.QueryEscape(query), i),
+			Content: fmt.Sprintf("Stub content %d about %s.", i, query),
+		})
+	}
+	return results, nil
+}
+
+// WebSearchTool is the function definition that replaces the web_search tool of a request.
+func WebSearchTool() dto.ToolCallRequest {
+	return dto.ToolCallRequest{
+		Type: "function",
+		Function: dto.FunctionRequest{
+			Name:        WebSearchToolName,
+			Description: "Search the web for current information. Returns the title, url and an excerpt of the top results.",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"query": map[string]any{
+						"type":        "string",
+						"description": "The search query",
+					},
+				},
+				"required": []string{"query"},
+			},
+		},
+	}
+}
+
+// FormatWebSearchResults renders the results as the content of the tool message the model reads.
+func FormatWebSearchResults(results []WebSearchResult) string {
+	if len(results) == 0 {
+		return "No results found."
+	}
+	var builder strings.Builder
+	for i, result := range results {
+		if i > 0 {
+			builder.WriteString("\n\n")
+		}
+		builder.WriteString(fmt.Sprintf("[%d] %s\nURL: %s\n%s", i+1, result.Title, result.Url, result.Content))
+	}
+	return builder.String()
+}
@@ -0,0 +1,25 @@
+package operation_setting
+
+import "github.com/QuantumNous/new-api/setting/config"
+
+type BatchSetting struct {
+	// requests of one batch that run at the same time
+	Concurrency int `json:"concurrency"`
+	// upper bound on the lines of one input file
+	MaxRequests         int `json:"max_requests"`
+	PollIntervalSeconds int `json:"poll_interval_seconds"`
+}
+
+var batchSetting = BatchSetting{
+	Concurrency:         8,
+	MaxRequests:         1000000,
+	PollIntervalSeconds: 5,
+}
+
+func init() {
+	config.GlobalConfig.Register("batch_setting", &batchSetting)
+}
+
+func GetBatchSetting() *BatchSetting {
+	return &batchSetting
+}
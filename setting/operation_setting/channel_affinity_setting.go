@@ -0,0 +1,66 @@
+package operation_setting
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/setting/config"
+)
+
+const (
+	ChannelAffinitySourceHeader = "header"
+	ChannelAffinitySourceUser   = "user"
+	ChannelAffinitySourcePrompt = "prompt"
+)
+
+type ChannelAffinitySetting struct {
+	Enabled bool `json:"enabled"`
+	// groups that use affinity routing, empty means every group
+	Groups []string `json:"groups"`
+	// stable key sources tried in order: header, user, prompt
+	KeySources []string `json:"key_sources"`
+	HeaderName string   `json:"header_name"`
+	// leading messages hashed together with the system prompt for the prompt source
+	PromptMessages int `json:"prompt_messages"`
+	TTLSeconds     int `json:"ttl_seconds"`
+}
+
+var channelAffinitySetting = ChannelAffinitySetting{
+	Enabled:        false,
+	Groups:         []string{},
+	KeySources:     []string{ChannelAffinitySourceHeader, ChannelAffinitySourceUser, ChannelAffinitySourcePrompt},
+	HeaderName:     "X-Session-Id",
+	PromptMessages: 2,
+	TTLSeconds:     3600,
+}
+
+func init() {
+	config.GlobalConfig.Register("channel_affinity_setting", &channelAffinitySetting)
+}
+
+func GetChannelAffinitySetting() *ChannelAffinitySetting {
+	return &channelAffinitySetting
+}
+
+func IsChannelAffinityEnabled(group string) bool {
+	if !channelAffinitySetting.Enabled {
+		return false
+	}
+	return len(channelAffinitySetting.Groups) == 0 || slices.Contains(channelAffinitySetting.Groups, group)
+}
+
+func ValidateChannelAffinityKeySources(jsonStr string) error {
+	var sources []string
+	if err := common.UnmarshalJsonStr(jsonStr, &sources); err != nil {
+		return err
+	}
+	for _, source := range sources {
+		switch source {
+		case ChannelAffinitySourceHeader, ChannelAffinitySourceUser, ChannelAffinitySourcePrompt:
+		default:
+			return fmt.Errorf("unknown channel affinity key source: %s", source)
+		}
+	}
+	return nil
+}
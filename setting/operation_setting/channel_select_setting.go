@@ -0,0 +1,71 @@
+package operation_setting
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/setting/config"
+)
+
+const (
+	ChannelSelectModeWeighted = "weighted"
+	ChannelSelectModeAdaptive = "adaptive"
+)
+
+type ChannelSelectSetting struct {
+	// group -> select mode, groups not listed use the static weighted mode
+	GroupModes map[string]string `json:"group_modes"`
+	// added to every channel weight so that zero-weight channels still receive traffic
+	SmoothingFactor int `json:"smoothing_factor"`
+	// EWMA decay factor for latency, first token time and success ratio, in (0, 1]
+	EwmaAlpha float64 `json:"ewma_alpha"`
+	// channels with fewer samples than this keep their static weight
+	MinSamples int `json:"min_samples"`
+	// lower bound of the adaptive multiplier, keeps slow channels probed
+	MinWeightFactor float64 `json:"min_weight_factor"`
+	// stats older than this are ignored, in seconds
+	StatsTTLSeconds int `json:"stats_ttl_seconds"`
+}
+
+var channelSelectSetting = ChannelSelectSetting{
+	GroupModes:      map[string]string{},
+	SmoothingFactor: 10,
+	EwmaAlpha:       0.2,
+	MinSamples:      5,
+	MinWeightFactor: 0.05,
+	StatsTTLSeconds: 600,
+}
+
+func init() {
+	config.GlobalConfig.Register("channel_select_setting", &channelSelectSetting)
+}
+
+func GetChannelSelectSetting() *ChannelSelectSetting {
+	return &channelSelectSetting
+}
+
+func IsAdaptiveChannelSelectEnabled(group string) bool {
+	return channelSelectSetting.GroupModes[group] == ChannelSelectModeAdaptive
+}
+
+func ChannelSelectModes() []string {
+	return []string{ChannelSelectModeWeighted, ChannelSelectModeAdaptive}
+}
+
+func IsValidChannelSelectMode(mode string) bool {
+	return slices.Contains(ChannelSelectModes(), mode)
+}
+
+func ValidateChannelSelectGroupModes(jsonStr string) error {
+	groupModes := make(map[string]string)
+	if err := common.UnmarshalJsonStr(jsonStr, &groupModes); err != nil {
+		return err
+	}
+	for group, mode := range groupModes {
+		if !IsValidChannelSelectMode(mode) {
+			return fmt.Errorf("invalid channel select mode %q for group %s", mode, group)
+		}
+	}
+	return nil
+}
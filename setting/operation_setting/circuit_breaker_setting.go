@@ -0,0 +1,36 @@
+package operation_setting
+
+import "github.com/QuantumNous/new-api/setting/config"
+
+type CircuitBreakerSetting struct {
+	Enabled bool `json:"enabled"`
+	// consecutive failures that open the breaker
+	ConsecutiveFailures int `json:"consecutive_failures"`
+	// failure ratio within the window that opens the breaker, 0 disables the check
+	ErrorRateThreshold float64 `json:"error_rate_threshold"`
+	// minimum requests in the window before the error rate is evaluated
+	MinRequests   int `json:"min_requests"`
+	WindowSeconds int `json:"window_seconds"`
+	// how long the breaker stays open before probes are let through
+	CooldownSeconds int `json:"cooldown_seconds"`
+	// concurrent probe requests allowed while half-open, also the successes needed to close
+	HalfOpenProbes int `json:"half_open_probes"`
+}
+
+var circuitBreakerSetting = CircuitBreakerSetting{
+	Enabled:             false,
+	ConsecutiveFailures: 5,
+	ErrorRateThreshold:  0.5,
+	MinRequests:         20,
+	WindowSeconds:       60,
+	CooldownSeconds:     30,
+	HalfOpenProbes:      1,
+}
+
+func init() {
+	config.GlobalConfig.Register("circuit_breaker_setting", &circuitBreakerSetting)
+}
+
+func GetCircuitBreakerSetting() *CircuitBreakerSetting {
+	return &circuitBreakerSetting
+}
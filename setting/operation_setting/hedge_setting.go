@@ -0,0 +1,38 @@
+package operation_setting
+
+import (
+	"slices"
+
+	"github.com/QuantumNous/new-api/setting/config"
+)
+
+type HedgeSetting struct {
+	Enabled bool `json:"enabled"`
+	// groups whose non-streaming chat and embedding requests are hedged, tokens can also opt in on their own
+	Groups []string `json:"groups"`
+	// latency quantile of the first channel after which the hedge request starts
+	Quantile float64 `json:"quantile"`
+	// delay used while the channel has too few latency samples
+	DelayMs    int `json:"delay_ms"`
+	MinDelayMs int `json:"min_delay_ms"`
+}
+
+var hedgeSetting = HedgeSetting{
+	Enabled:    false,
+	Groups:     []string{},
+	Quantile:   0.9,
+	DelayMs:    3000,
+	MinDelayMs: 200,
+}
+
+func init() {
+	config.GlobalConfig.Register("hedge_setting", &hedgeSetting)
+}
+
+func GetHedgeSetting() *HedgeSetting {
+	return &hedgeSetting
+}
+
+func IsHedgeEnabledForGroup(group string) bool {
+	return hedgeSetting.Enabled && slices.Contains(hedgeSetting.Groups, group)
+}
@@ -0,0 +1,31 @@
+package operation_setting
+
+import "github.com/QuantumNous/new-api/setting/config"
+
+type McpSetting struct {
+	// serves the registered MCP servers on /mcp
+	Enabled bool `json:"enabled"`
+	// lets chat requests name registered servers with tools of type mcp, the relay then runs their tool calls
+	RelayResolveEnabled bool `json:"relay_resolve_enabled"`
+	TimeoutSeconds      int  `json:"timeout_seconds"`
+	// how long the tool list of a server is reused
+	ToolCacheSeconds int `json:"tool_cache_seconds"`
+	// model calls the relay makes for one request while it runs tool calls
+	MaxRounds int `json:"max_rounds"`
+}
+
+var mcpSetting = McpSetting{
+	Enabled:             false,
+	RelayResolveEnabled: false,
+	TimeoutSeconds:      30,
+	ToolCacheSeconds:    60,
+	MaxRounds:           5,
+}
+
+func init() {
+	config.GlobalConfig.Register("mcp_setting", &mcpSetting)
+}
+
+func GetMcpSetting() *McpSetting {
+	return &mcpSetting
+}
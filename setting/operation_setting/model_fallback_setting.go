@@ -0,0 +1,72 @@
+package operation_setting
+
+import (
+	"fmt"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/setting/config"
+)
+
+// ModelFallbackAllGroups holds chains that apply to every group without its own entry for the model.
+const ModelFallbackAllGroups = "*"
+
+type ModelFallbackSetting struct {
+	Enabled bool `json:"enabled"`
+	// group -> requested model -> ordered fallback models
+	GroupChains map[string]map[string][]string `json:"group_chains"`
+}
+
+var modelFallbackSetting = ModelFallbackSetting{
+	Enabled:     false,
+	GroupChains: map[string]map[string][]string{},
+}
+
+func init() {
+	config.GlobalConfig.Register("model_fallback_setting", &modelFallbackSetting)
+}
+
+func GetModelFallbackSetting() *ModelFallbackSetting {
+	return &modelFallbackSetting
+}
+
+// GetModelFallbackChain returns the fallback models configured for the model in the group,
+// without the model itself and without duplicates.
+func GetModelFallbackChain(group string, modelName string) []string {
+	if !modelFallbackSetting.Enabled {
+		return nil
+	}
+	chain, ok := modelFallbackSetting.GroupChains[group][modelName]
+	if !ok {
+		chain = modelFallbackSetting.GroupChains[ModelFallbackAllGroups][modelName]
+	}
+	seen := map[string]bool{modelName: true}
+	result := make([]string, 0, len(chain))
+	for _, fallbackModel := range chain {
+		if fallbackModel == "" || seen[fallbackModel] {
+			continue
+		}
+		seen[fallbackModel] = true
+		result = append(result, fallbackModel)
+	}
+	return result
+}
+
+func ValidateModelFallbackGroupChains(jsonStr string) error {
+	groupChains := make(map[string]map[string][]string)
+	if err := common.UnmarshalJsonStr(jsonStr, &groupChains); err != nil {
+		return err
+	}
+	for group, chains := range groupChains {
+		for modelName, chain := range chains {
+			if len(chain) == 0 {
+				return fmt.Errorf("fallback chain of model %s in group %s is empty", modelName, group)
+			}
+			for _, fallbackModel := range chain {
+				if fallbackModel == modelName {
+					return fmt.Errorf("model %s in group %s cannot fall back to itself", modelName, group)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package operation_setting
+
+import "github.com/QuantumNous/new-api/setting/config"
+
+type RealtimeBridgeSetting struct {
+	// serve realtime sessions on channels that cannot open an upstream realtime websocket
+	Enabled bool `json:"enabled"`
+	// used when the session does not name an input_audio_transcription model
+	TranscriptionModel string `json:"transcription_model"`
+	// answers the conversation, empty uses the model of the realtime session
+	ChatModel   string `json:"chat_model"`
+	SpeechModel string `json:"speech_model"`
+	// used when the session does not set a voice
+	Voice string `json:"voice"`
+}
+
+var realtimeBridgeSetting = RealtimeBridgeSetting{
+	Enabled:            false,
+	TranscriptionModel: "whisper-1",
+	ChatModel:          "",
+	SpeechModel:        "tts-1",
+	Voice:              "alloy",
+}
+
+func init() {
+	config.GlobalConfig.Register("realtime_bridge_setting", &realtimeBridgeSetting)
+}
+
+func GetRealtimeBridgeSetting() *RealtimeBridgeSetting {
+	return &realtimeBridgeSetting
+}
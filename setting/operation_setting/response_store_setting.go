@@ -0,0 +1,24 @@
+package operation_setting
+
+import "github.com/QuantumNous/new-api/setting/config"
+
+// ResponseStoreSetting controls the gateway side store of Responses API calls, it lets previous_response_id
+// work on any channel because the conversation is expanded before the request is dispatched.
+type ResponseStoreSetting struct {
+	Enabled bool `json:"enabled"`
+	// stored responses are deleted after this many days, 0 keeps them until they are deleted
+	RetentionDays int `json:"retention_days"`
+}
+
+var responseStoreSetting = ResponseStoreSetting{
+	Enabled:       false,
+	RetentionDays: 30,
+}
+
+func init() {
+	config.GlobalConfig.Register("response_store_setting", &responseStoreSetting)
+}
+
+func GetResponseStoreSetting() *ResponseStoreSetting {
+	return &responseStoreSetting
+}
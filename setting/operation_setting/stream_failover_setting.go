@@ -0,0 +1,27 @@
+package operation_setting
+
+import "github.com/QuantumNous/new-api/setting/config"
+
+// StreamFailoverSetting controls how long a stream is held back before the first token,
+// so that failures in that window can still be retried on another channel.
+type StreamFailoverSetting struct {
+	Enabled bool `json:"enabled"`
+	// upper bound of upstream data held back before the first token, in bytes
+	BufferBytes int `json:"buffer_bytes"`
+	// how long to hold back before giving up on failover and streaming as usual
+	TimeoutSeconds int `json:"timeout_seconds"`
+}
+
+var streamFailoverSetting = StreamFailoverSetting{
+	Enabled:        false,
+	BufferBytes:    64 << 10,
+	TimeoutSeconds: 30,
+}
+
+func init() {
+	config.GlobalConfig.Register("stream_failover_setting", &streamFailoverSetting)
+}
+
+func GetStreamFailoverSetting() *StreamFailoverSetting {
+	return &streamFailoverSetting
+}
@@ -0,0 +1,41 @@
+package operation_setting
+
+import (
+	"slices"
+
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/setting/config"
+)
+
+const DefaultToolCallEmulationTemplate = `You can call the following tools. To call a tool, reply with one block per call in exactly this format, with the arguments as a JSON object, and write nothing after the last block:
+<tool_call>
+{"name": "tool name", "arguments": {}}
+</tool_call>
+The results will be sent back to you in <tool_result> blocks.
+
+Tools:
+{{tools}}`
+
+type ToolCallEmulationSetting struct {
+	// channel types whose channels emulate tool calls unless their channel setting disables it
+	ChannelTypes []int `json:"channel_types"`
+	// system prompt describing the tools, {{tools}} is replaced by one JSON line per tool
+	Template string `json:"template"`
+}
+
+var toolCallEmulationSetting = ToolCallEmulationSetting{
+	ChannelTypes: []int{constant.ChannelTypePaLM, constant.ChannelTypeDify, constant.ChannelTypeCoze},
+	Template:     DefaultToolCallEmulationTemplate,
+}
+
+func init() {
+	config.GlobalConfig.Register("tool_call_emulation_setting", &toolCallEmulationSetting)
+}
+
+func GetToolCallEmulationSetting() *ToolCallEmulationSetting {
+	return &toolCallEmulationSetting
+}
+
+func IsToolCallEmulatedForChannelType(channelType int) bool {
+	return slices.Contains(toolCallEmulationSetting.ChannelTypes, channelType)
+}
@@ -0,0 +1,30 @@
+package operation_setting
+
+import "github.com/QuantumNous/new-api/setting/config"
+
+// VectorStoreSetting controls the vector stores the gateway keeps itself, their files are embedded through
+// the relay and searched by /v1/vector_stores/{id}/search and the file_search tool of the Responses API.
+type VectorStoreSetting struct {
+	Enabled bool `json:"enabled"`
+	// embedding model new stores use, a store keeps the model it was created with
+	EmbeddingModel string `json:"embedding_model"`
+	// chunks sent in one embedding request
+	EmbeddingBatchSize int `json:"embedding_batch_size"`
+	// model calls the relay makes for one request while it runs file searches
+	MaxRounds int `json:"max_rounds"`
+}
+
+var vectorStoreSetting = VectorStoreSetting{
+	Enabled:            false,
+	EmbeddingModel:     "text-embedding-3-small",
+	EmbeddingBatchSize: 64,
+	MaxRounds:          5,
+}
+
+func init() {
+	config.GlobalConfig.Register("vector_store_setting", &vectorStoreSetting)
+}
+
+func GetVectorStoreSetting() *VectorStoreSetting {
+	return &vectorStoreSetting
+}
@@ -0,0 +1,36 @@
+package operation_setting
+
+import "github.com/QuantumNous/new-api/setting/config"
+
+// WebSearchSetting configures the web_search tool the gateway executes itself, a chat request enables it
+// with a tool of type web_search.
+type WebSearchSetting struct {
+	Enabled bool `json:"enabled"`
+	// http posts the query to Endpoint, stub answers with fixed results and is meant for tests
+	Backend        string `json:"backend"`
+	Endpoint       string `json:"endpoint"`
+	ApiKey         string `json:"api_key"`
+	TimeoutSeconds int    `json:"timeout_seconds"`
+	MaxResults     int    `json:"max_results"`
+	// model calls with searches in between, the last one has to answer without searching
+	MaxRounds int `json:"max_rounds"`
+	// the context size the calls are billed with, see GetWebSearchPricePerThousand
+	SearchContextSize string `json:"search_context_size"`
+}
+
+var webSearchSetting = WebSearchSetting{
+	Enabled:           false,
+	Backend:           "http",
+	TimeoutSeconds:    15,
+	MaxResults:        5,
+	MaxRounds:         5,
+	SearchContextSize: "medium",
+}
+
+func init() {
+	config.GlobalConfig.Register("web_search_setting", &webSearchSetting)
+}
+
+func GetWebSearchSetting() *WebSearchSetting {
+	return &webSearchSetting
+}
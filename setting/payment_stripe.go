@@ -6,3 +6,6 @@ var StripePriceId = ""
 var StripeUnitPrice = 8.0
 var StripeMinTopUp = 1
 var StripePromotionCodesEnabled = false
+
+// StripeApiBase points the Stripe client at another API, such as a local stripe-mock, empty for the Stripe API
+var StripeApiBase = ""
@@ -0,0 +1,20 @@
+package ratio_setting
+
+import (
+	"errors"
+	"strconv"
+)
+
+// BatchRatio is applied on top of the group ratio to requests run through the Batch API.
+var BatchRatio = 1.0
+
+func CheckBatchRatio(value string) error {
+	ratio, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return err
+	}
+	if ratio < 0 {
+		return errors.New("batch ratio must be not less than 0")
+	}
+	return nil
+}
@@ -364,6 +364,10 @@ func InitRatioSettings() {
 	audioCompletionRatioMapMutex.Lock()
 	audioCompletionRatioMap = defaultAudioCompletionRatio
 	audioCompletionRatioMapMutex.Unlock()
+
+	modelRatioTiersMapMutex.Lock()
+	modelRatioTiersMap = make(map[string][]ModelRatioTier)
+	modelRatioTiersMapMutex.Unlock()
 }
 
 func GetModelPriceMap() map[string]float64 {
@@ -0,0 +1,129 @@
+package ratio_setting
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/QuantumNous/new-api/common"
+)
+
+// ModelRatioTier is the price of a model for prompts of at most MaxPromptTokens tokens, 0 leaves the tier
+// unbounded. Ratio multiplies the model ratio, a completion or cache ratio of 0 keeps the model's own ratio.
+type ModelRatioTier struct {
+	MaxPromptTokens int     `json:"max_prompt_tokens"`
+	Ratio           float64 `json:"ratio"`
+	CompletionRatio float64 `json:"completion_ratio,omitempty"`
+	CacheRatio      float64 `json:"cache_ratio,omitempty"`
+}
+
+// Apply returns the ratios of the model in the tier, falling back to the given ratios of the model.
+func (tier ModelRatioTier) Apply(modelRatio, completionRatio, cacheRatio float64) (float64, float64, float64) {
+	modelRatio *= tier.Ratio
+	if tier.CompletionRatio > 0 {
+		completionRatio = tier.CompletionRatio
+	}
+	if tier.CacheRatio > 0 {
+		cacheRatio = tier.CacheRatio
+	}
+	return modelRatio, completionRatio, cacheRatio
+}
+
+var (
+	modelRatioTiersMap      map[string][]ModelRatioTier = nil
+	modelRatioTiersMapMutex                             = sync.RWMutex{}
+)
+
+// sortModelRatioTiers orders the tiers by their bound, the unbounded tier last, and checks them.
+func sortModelRatioTiers(name string, tiers []ModelRatioTier) error {
+	if len(tiers) == 0 {
+		return fmt.Errorf("model %s has no ratio tiers", name)
+	}
+	sort.SliceStable(tiers, func(i, j int) bool {
+		if tiers[i].MaxPromptTokens == 0 || tiers[j].MaxPromptTokens == 0 {
+			return tiers[j].MaxPromptTokens == 0 && tiers[i].MaxPromptTokens != 0
+		}
+		return tiers[i].MaxPromptTokens < tiers[j].MaxPromptTokens
+	})
+	for i, tier := range tiers {
+		if tier.MaxPromptTokens < 0 {
+			return fmt.Errorf("max_prompt_tokens of model %s must be not less than 0", name)
+		}
+		if tier.Ratio <= 0 {
+			return fmt.Errorf("ratio of model %s must be greater than 0", name)
+		}
+		if tier.CompletionRatio < 0 || tier.CacheRatio < 0 {
+			return fmt.Errorf("ratios of model %s must be not less than 0", name)
+		}
+		if i > 0 && tier.MaxPromptTokens == tiers[i-1].MaxPromptTokens {
+			return fmt.Errorf("model %s has two tiers with the same max_prompt_tokens", name)
+		}
+	}
+	return nil
+}
+
+func parseModelRatioTiers(jsonStr string) (map[string][]ModelRatioTier, error) {
+	tiersMap := make(map[string][]ModelRatioTier)
+	if err := common.Unmarshal([]byte(jsonStr), &tiersMap); err != nil {
+		return nil, err
+	}
+	for name, tiers := range tiersMap {
+		if err := sortModelRatioTiers(name, tiers); err != nil {
+			return nil, err
+		}
+	}
+	return tiersMap, nil
+}
+
+func CheckModelRatioTiers(jsonStr string) error {
+	_, err := parseModelRatioTiers(jsonStr)
+	if err != nil {
+		return errors.New("invalid model ratio tiers: " + err.Error())
+	}
+	return nil
+}
+
+func ModelRatioTiers2JSONString() string {
+	modelRatioTiersMapMutex.RLock()
+	defer modelRatioTiersMapMutex.RUnlock()
+	jsonBytes, err := common.Marshal(modelRatioTiersMap)
+	if err != nil {
+		common.SysError("error marshalling model ratio tiers: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+func UpdateModelRatioTiersByJSONString(jsonStr string) error {
+	tiersMap, err := parseModelRatioTiers(jsonStr)
+	if err != nil {
+		return err
+	}
+	modelRatioTiersMapMutex.Lock()
+	modelRatioTiersMap = tiersMap
+	modelRatioTiersMapMutex.Unlock()
+	InvalidateExposedDataCache()
+	return nil
+}
+
+// GetModelRatioTiers returns the tiers of a context-tiered model, nil when the model has one flat ratio.
+func GetModelRatioTiers(name string) []ModelRatioTier {
+	modelRatioTiersMapMutex.RLock()
+	defer modelRatioTiersMapMutex.RUnlock()
+	return modelRatioTiersMap[FormatMatchingModelName(name)]
+}
+
+// GetModelRatioTier returns the tier a prompt of promptTokens tokens falls in and its index, a prompt above
+// every bound is billed at the last tier.
+func GetModelRatioTier(name string, promptTokens int) (ModelRatioTier, int, bool) {
+	tiers := GetModelRatioTiers(name)
+	if len(tiers) == 0 {
+		return ModelRatioTier{}, 0, false
+	}
+	for i, tier := range tiers {
+		if tier.MaxPromptTokens == 0 || promptTokens <= tier.MaxPromptTokens {
+			return tier, i, true
+		}
+	}
+	return tiers[len(tiers)-1], len(tiers) - 1, true
+}
@@ -0,0 +1,234 @@
+package ratio_setting
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+)
+
+// PricingWindow multiplies the group ratio of the requests started between Start and End on its weekdays,
+// End before Start runs the window past midnight.
+type PricingWindow struct {
+	Name string `json:"name"`
+	// model names, a trailing * matches a prefix, empty for all models
+	Models []string `json:"models,omitempty"`
+	// groups the window applies to, empty for all groups
+	Groups []string `json:"groups,omitempty"`
+	// days the window starts on, 0 is Sunday, empty for every day
+	Weekdays []int `json:"weekdays,omitempty"`
+	// HH:MM in the timezone of the schedule
+	Start string  `json:"start"`
+	End   string  `json:"end"`
+	Ratio float64 `json:"ratio"`
+
+	startMinute int
+	endMinute   int
+}
+
+// PricingSchedule holds the time-of-day pricing windows, the first window matching a request applies.
+type PricingSchedule struct {
+	Timezone string          `json:"timezone"`
+	Windows  []PricingWindow `json:"windows"`
+
+	location *time.Location
+}
+
+// PricingWindowOccurrence is one run of a window, as listed on the pricing page.
+type PricingWindowOccurrence struct {
+	Name    string   `json:"name"`
+	Models  []string `json:"models,omitempty"`
+	Groups  []string `json:"groups,omitempty"`
+	Ratio   float64  `json:"ratio"`
+	StartAt int64    `json:"start_at"`
+	EndAt   int64    `json:"end_at"`
+	Active  bool     `json:"active"`
+}
+
+var (
+	pricingSchedule      = &PricingSchedule{Windows: []PricingWindow{}, location: time.Local}
+	pricingScheduleMutex sync.RWMutex
+)
+
+func parsePricingMinute(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func parsePricingSchedule(jsonStr string) (*PricingSchedule, error) {
+	schedule := &PricingSchedule{}
+	if strings.TrimSpace(jsonStr) != "" {
+		if err := common.Unmarshal([]byte(jsonStr), schedule); err != nil {
+			return nil, err
+		}
+	}
+	schedule.location = time.Local
+	if schedule.Timezone != "" {
+		location, err := time.LoadLocation(schedule.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone %s", schedule.Timezone)
+		}
+		schedule.location = location
+	}
+	for i := range schedule.Windows {
+		window := &schedule.Windows[i]
+		var err error
+		if window.startMinute, err = parsePricingMinute(window.Start); err != nil {
+			return nil, fmt.Errorf("window %s: %w", window.Name, err)
+		}
+		if window.endMinute, err = parsePricingMinute(window.End); err != nil {
+			return nil, fmt.Errorf("window %s: %w", window.Name, err)
+		}
+		if window.startMinute == window.endMinute {
+			return nil, fmt.Errorf("window %s starts and ends at the same time", window.Name)
+		}
+		if window.Ratio < 0 {
+			return nil, fmt.Errorf("ratio of window %s must be not less than 0", window.Name)
+		}
+		for _, weekday := range window.Weekdays {
+			if weekday < 0 || weekday > 6 {
+				return nil, fmt.Errorf("window %s has an invalid weekday %d", window.Name, weekday)
+			}
+		}
+	}
+	return schedule, nil
+}
+
+func CheckPricingSchedule(jsonStr string) error {
+	_, err := parsePricingSchedule(jsonStr)
+	if err != nil {
+		return errors.New("invalid pricing schedule: " + err.Error())
+	}
+	return nil
+}
+
+func PricingSchedule2JSONString() string {
+	pricingScheduleMutex.RLock()
+	defer pricingScheduleMutex.RUnlock()
+	jsonBytes, err := common.Marshal(pricingSchedule)
+	if err != nil {
+		common.SysError("error marshalling pricing schedule: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+func UpdatePricingScheduleByJSONString(jsonStr string) error {
+	schedule, err := parsePricingSchedule(jsonStr)
+	if err != nil {
+		return err
+	}
+	pricingScheduleMutex.Lock()
+	pricingSchedule = schedule
+	pricingScheduleMutex.Unlock()
+	return nil
+}
+
+func (window *PricingWindow) matches(model string, group string) bool {
+	if len(window.Groups) > 0 && !common.StringsContains(window.Groups, group) {
+		return false
+	}
+	if len(window.Models) == 0 {
+		return true
+	}
+	for _, pattern := range window.Models {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(model, prefix) {
+				return true
+			}
+		} else if pattern == model {
+			return true
+		}
+	}
+	return false
+}
+
+func (window *PricingWindow) onWeekday(weekday time.Weekday) bool {
+	if len(window.Weekdays) == 0 {
+		return true
+	}
+	for _, day := range window.Weekdays {
+		if time.Weekday(day) == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+// occurrence returns the run of the window that starts on the day of the given midnight. The bounds are wall
+// clock times, a day with a daylight saving change is not 24 hours long.
+func (window *PricingWindow) occurrence(midnight time.Time) (time.Time, time.Time) {
+	year, month, day := midnight.Date()
+	start := time.Date(year, month, day, window.startMinute/60, window.startMinute%60, 0, 0, midnight.Location())
+	if window.endMinute < window.startMinute {
+		day++
+	}
+	end := time.Date(year, month, day, window.endMinute/60, window.endMinute%60, 0, 0, midnight.Location())
+	return start, end
+}
+
+func pricingMidnight(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// GetPricingWindow returns the window a request for the model in the group started at t is priced by.
+func GetPricingWindow(model string, group string, t time.Time) (PricingWindow, bool) {
+	pricingScheduleMutex.RLock()
+	defer pricingScheduleMutex.RUnlock()
+	t = t.In(pricingSchedule.location)
+	today := pricingMidnight(t)
+	for _, window := range pricingSchedule.Windows {
+		if !window.matches(model, group) {
+			continue
+		}
+		// a window running past midnight may have started the day before
+		for _, midnight := range []time.Time{today, today.AddDate(0, 0, -1)} {
+			if !window.onWeekday(midnight.Weekday()) {
+				continue
+			}
+			start, end := window.occurrence(midnight)
+			if !t.Before(start) && t.Before(end) {
+				return window, true
+			}
+		}
+	}
+	return PricingWindow{}, false
+}
+
+// GetPricingWindowOccurrences lists the runs of the windows that are active at now or start before until.
+func GetPricingWindowOccurrences(now time.Time, until time.Time) []PricingWindowOccurrence {
+	pricingScheduleMutex.RLock()
+	defer pricingScheduleMutex.RUnlock()
+	occurrences := make([]PricingWindowOccurrence, 0)
+	now = now.In(pricingSchedule.location)
+	for _, window := range pricingSchedule.Windows {
+		for midnight := pricingMidnight(now).AddDate(0, 0, -1); midnight.Before(until); midnight = midnight.AddDate(0, 0, 1) {
+			if !window.onWeekday(midnight.Weekday()) {
+				continue
+			}
+			start, end := window.occurrence(midnight)
+			if !end.After(now) || !start.Before(until) {
+				continue
+			}
+			occurrences = append(occurrences, PricingWindowOccurrence{
+				Name:    window.Name,
+				Models:  window.Models,
+				Groups:  window.Groups,
+				Ratio:   window.Ratio,
+				StartAt: start.Unix(),
+				EndAt:   end.Unix(),
+				Active:  !now.Before(start),
+			})
+		}
+	}
+	sort.SliceStable(occurrences, func(i, j int) bool {
+		return occurrences[i].StartAt < occurrences[j].StartAt
+	})
+	return occurrences
+}
@@ -0,0 +1,39 @@
+package system_setting
+
+import "github.com/QuantumNous/new-api/setting/config"
+
+const (
+	FileStorageTypeLocal = "local"
+	FileStorageTypeS3    = "s3"
+)
+
+type FileStorageSettings struct {
+	// local or s3
+	Type      string `json:"type"`
+	LocalPath string `json:"local_path"`
+	// any S3 compatible endpoint, e.g. https://s3.us-east-1.amazonaws.com or a MinIO server
+	S3Endpoint        string `json:"s3_endpoint"`
+	S3Region          string `json:"s3_region"`
+	S3Bucket          string `json:"s3_bucket"`
+	S3AccessKeyId     string `json:"s3_access_key_id"`
+	S3SecretAccessKey string `json:"s3_secret_access_key"`
+	S3PathStyle       bool   `json:"s3_path_style"`
+	S3Prefix          string `json:"s3_prefix"`
+	MaxFileSizeMB     int    `json:"max_file_size_mb"`
+}
+
+var defaultFileStorageSettings = FileStorageSettings{
+	Type:          FileStorageTypeLocal,
+	LocalPath:     "data/files",
+	S3Region:      "us-east-1",
+	S3PathStyle:   true,
+	MaxFileSizeMB: 512,
+}
+
+func init() {
+	config.GlobalConfig.Register("file_storage", &defaultFileStorageSettings)
+}
+
+func GetFileStorageSettings() *FileStorageSettings {
+	return &defaultFileStorageSettings
+}
@@ -82,6 +82,7 @@ const (
 	
 	ErrorCodeInsufficientUserQuota      ErrorCode = "insufficient_user_quota"
 	ErrorCodePreConsumeTokenQuotaFailed ErrorCode = "pre_consume_token_quota_failed"
+	ErrorCodeBudgetExceeded             ErrorCode = "budget_exceeded"
 )
 
 type NewAPIError struct {
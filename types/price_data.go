@@ -6,6 +6,9 @@ type GroupRatioInfo struct {
 	GroupRatio        float64
 	GroupSpecialRatio float64
 	HasSpecialRatio   bool
+	// time-of-day window the group ratio was multiplied by
+	PricingWindow      string
+	PricingWindowRatio float64
 }
 
 type PriceData struct {
@@ -12,6 +12,7 @@ const (
 	RelayFormatOpenAIRealtime              = "openai_realtime"
 	RelayFormatRerank                      = "rerank"
 	RelayFormatEmbedding                   = "embedding"
+	RelayFormatOllama                      = "ollama"
 
 	RelayFormatTask    = "task"
 	RelayFormatMjProxy = "mj_proxy"